@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// baselineWindow is how far back hourly baselines look.
+	baselineWindow = 7 * 24 * time.Hour
+
+	thresholdKeyPrefix = "threshold_"
+	statusKey          = "iowait_status"
+)
+
+// A thresholdLevel is how severe a threshold breach is.
+type thresholdLevel int
+
+const (
+	levelOK thresholdLevel = iota
+	levelWarning
+	levelCritical
+)
+
+func (l thresholdLevel) String() string {
+	switch l {
+	case levelWarning:
+		return "warning"
+	case levelCritical:
+		return "critical"
+	}
+	return "ok"
+}
+
+// hourBucket accumulates the samples of one metric during one hour.
+type hourBucket struct {
+	Hour  time.Time
+	Sum   float64
+	Count int
+}
+
+func (b hourBucket) mean() float64 { return b.Sum / float64(b.Count) }
+
+// baselines learn what is typical for every metric at each hour of the day,
+// from the hourly means over the trailing week. They are part of the
+// plugin state, so restarts don't forget them.
+type baselines map[string][]hourBucket
+
+// record adds a sample to the bucket of its hour and drops the buckets
+// older than the trailing week.
+func (b baselines) record(key string, t time.Time, v float64) {
+	hour := t.Truncate(time.Hour)
+	buckets := b[key]
+	if n := len(buckets); n > 0 && buckets[n-1].Hour.Equal(hour) {
+		buckets[n-1].Sum += v
+		buckets[n-1].Count++
+	} else {
+		buckets = append(buckets, hourBucket{Hour: hour, Sum: v, Count: 1})
+	}
+	start := hour.Add(-baselineWindow)
+	i := 0
+	for i < len(buckets) && !buckets[i].Hour.After(start) {
+		i++
+	}
+	b[key] = buckets[i:]
+}
+
+// typical returns the mean, over the previous days of the trailing week,
+// of a metric at the hour of day of t; false until a previous day is known.
+func (b baselines) typical(key string, t time.Time) (float64, bool) {
+	hour := t.Truncate(time.Hour)
+	sum, days := 0.0, 0
+	for _, bucket := range b[key] {
+		if bucket.Hour.Hour() != hour.Hour() || !bucket.Hour.Before(hour) {
+			continue
+		}
+		sum += bucket.mean()
+		days++
+	}
+	if days == 0 {
+		return 0, false
+	}
+	return sum / float64(days), true
+}
+
+func (b baselines) copy() baselines {
+	c := baselines{}
+	for key, buckets := range b {
+		c[key] = append([]hourBucket{}, buckets...)
+	}
+	return c
+}
+
+// A threshold is either an absolute limit or, if relative, a factor of the
+// metric's baseline for the current hour, e.g. "3x typical for this hour".
+type threshold struct {
+	limit    float64
+	relative bool
+}
+
+func (th threshold) String() string {
+	if th.relative {
+		return formatNumber(th.limit) + "x"
+	}
+	return formatNumber(th.limit)
+}
+
+// parseThresholds parses a comma separated list of metric=limit pairs,
+// where limit is a number or, relative to the baseline, a number followed
+// by x.
+func parseThresholds(s string) (map[string]threshold, error) {
+	thresholds := map[string]threshold{}
+	for _, pair := range splitList(s) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid threshold %q, expected metric=limit or metric=factorx", pair)
+		}
+		th := threshold{}
+		value := parts[1]
+		if strings.HasSuffix(value, "x") {
+			th.relative = true
+			value = strings.TrimSuffix(value, "x")
+		}
+		limit, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid threshold %q: %v", pair, err)
+		}
+		th.limit = limit
+		thresholds[parts[0]] = th
+	}
+	return thresholds, nil
+}
+
+// addDefaultThresholds flags the metrics of defaults with a zero limit,
+// as critical or not, unless they have a threshold of either level.
+func addDefaultThresholds(thresholds, critical map[string]threshold, defaults map[string]bool) {
+	for id, isCritical := range defaults {
+		_, warns := thresholds[id]
+		_, crits := critical[id]
+		switch {
+		case warns || crits:
+		case isCritical:
+			critical[id] = threshold{limit: 0}
+		default:
+			thresholds[id] = threshold{limit: 0}
+		}
+	}
+}
+
+// thresholdKey returns the key of the threshold of a metric: its ID or,
+// failing that, the longest ID prefix followed by an underscore, so that
+// e.g. write_iops applies to the write_iops_<pv> of every volume.
+func thresholdKey(thresholds map[string]threshold, id string) (string, bool) {
+	for _, key := range metricKeys(id) {
+		if _, ok := thresholds[key]; ok {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// thresholdFor returns the threshold of a metric, scaled as adjusted by
+// controls. The caller holds p.lock.
+func (p *Plugin) thresholdFor(thresholds map[string]threshold, id string) (threshold, bool) {
+	key, ok := thresholdKey(thresholds, id)
+	if !ok {
+		return threshold{}, false
+	}
+	th := thresholds[key]
+	if scale, ok := p.thresholdScales[key]; ok {
+		th.limit *= scale
+	}
+	return th, true
+}
+
+// checkThreshold learns the baseline of a metric with a threshold, unless
+// the sample was already recorded, and annotates its node when the sample
+// exceeds the warning or critical threshold. It returns the level exceeded
+// and whether the metric has a threshold at all. The caller holds p.lock.
+func (p *Plugin) checkThreshold(t *topology, nodeID string, m Metric, record bool) (thresholdLevel, bool) {
+	warning, hasWarning := p.thresholdFor(p.thresholds, m.ID)
+	critical, hasCritical := p.thresholdFor(p.criticalThresholds, m.ID)
+	if !hasWarning && !hasCritical {
+		return levelOK, false
+	}
+	key := nodeID + "/" + m.ID
+	typical, known := p.baselines.typical(key, m.Time)
+	if record {
+		p.baselines.record(key, m.Time, m.Value)
+	}
+
+	level, desc := levelOK, ""
+	if hasCritical {
+		if exceeded, d := critical.exceeded(m.Value, typical, known); exceeded {
+			level, desc = levelCritical, d
+		}
+	}
+	if level == levelOK && hasWarning {
+		if exceeded, d := warning.exceeded(m.Value, typical, known); exceeded {
+			level, desc = levelWarning, d
+		}
+	}
+	if level == levelOK {
+		return levelOK, true
+	}
+	n := t.Nodes[nodeID]
+	if n.Latest == nil {
+		n.Latest = map[string]stringEntry{}
+	}
+	n.Latest[thresholdKeyPrefix+m.ID] = stringEntry{
+		Timestamp: m.Time,
+		Value:     fmt.Sprintf("%s above %s (%s)", formatNumber(m.Value), desc, level),
+	}
+	t.Nodes[nodeID] = n
+	if t.MetadataTemplates == nil {
+		t.MetadataTemplates = map[string]metadataTemplate{}
+	}
+	label := m.Label
+	if label == "" {
+		label = m.ID
+	}
+	t.MetadataTemplates[thresholdKeyPrefix+m.ID] = metadataTemplate{
+		ID:       thresholdKeyPrefix + m.ID,
+		Label:    label + " threshold exceeded",
+		Priority: 3 + m.Priority/100,
+		From:     "latest",
+	}
+	return level, true
+}
+
+// exceeded tells whether a value is above the threshold, given the typical
+// value of the metric for relative thresholds, and describes the limit.
+func (th threshold) exceeded(value, typical float64, known bool) (bool, string) {
+	if !th.relative {
+		return value > th.limit, th.String()
+	}
+	if !known {
+		return false, ""
+	}
+	return value > th.limit*typical, fmt.Sprintf("%s typical for this hour (%s)", th, formatNumber(typical))
+}
+
+// statusNode identifies a node whose status is shown.
+type statusNode struct {
+	topology *topology
+	nodeID   string
+}
+
+// setStatus shows on a node the most severe threshold level its metrics
+// exceed, so that troubled hosts and volumes stand out. Nodes with
+// thresholds but within them show ok.
+func setStatus(t *topology, nodeID string, level thresholdLevel, ts time.Time) {
+	n := t.Nodes[nodeID]
+	if n.Latest == nil {
+		n.Latest = map[string]stringEntry{}
+	}
+	n.Latest[statusKey] = stringEntry{Timestamp: ts, Value: level.String()}
+	t.Nodes[nodeID] = n
+	if t.MetadataTemplates == nil {
+		t.MetadataTemplates = map[string]metadataTemplate{}
+	}
+	t.MetadataTemplates[statusKey] = metadataTemplate{
+		ID:       statusKey,
+		Label:    "IO status",
+		Priority: 2.5,
+		From:     "latest",
+	}
+}
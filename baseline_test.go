@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fixedCollector returns one write_iops sample, counting collections.
+type fixedCollector struct {
+	now   time.Time
+	calls int32
+}
+
+func (c *fixedCollector) Name() string { return "fixed" }
+
+func (c *fixedCollector) Collect(ctx context.Context) ([]Metric, error) {
+	atomic.AddInt32(&c.calls, 1)
+	return []Metric{{ID: "write_iops", Value: 42, Time: c.now}}, nil
+}
+
+func newBaselineTestPlugin() *Plugin {
+	p := &Plugin{
+		HostID:     "host",
+		collectors: []Collector{&fixedCollector{now: time.Now()}},
+		thresholds: map[string]threshold{"write_iops": {limit: 100}},
+		maxima:     newRollingMaxima(time.Minute),
+		baselines:  baselines{},
+		cpuHistory: map[string][]sample{},
+		cpuField:   cpuFieldIndex("iowait"),
+		reports:    newReportCache(0),
+	}
+	p.stream = newSampleStream(p.getTopologyHost())
+	return p
+}
+
+// recordedCount returns how many samples the baselines recorded.
+func recordedCount(p *Plugin) int {
+	count := 0
+	for _, buckets := range p.baselines {
+		for _, b := range buckets {
+			count += b.Count
+		}
+	}
+	return count
+}
+
+// TestCollectionRecordedOnce checks the samples of a collection are
+// recorded in the baselines once, however many reports show them.
+func TestCollectionRecordedOnce(t *testing.T) {
+	p := newBaselineTestPlugin()
+	if _, err := p.makeReport(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	p.lock.Lock()
+	_, err := p.latestReport()
+	p.lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := recordedCount(p); got != 1 {
+		t.Errorf("got %d samples recorded, want 1", got)
+	}
+}
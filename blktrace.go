@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	blktraceControlPrefix = "blktrace_"
+	blktraceTablePrefix   = "blktrace-"
+
+	// blkparseFormat puts the command last, since it may contain spaces.
+	blkparseFormat = "%a %d %S %n %p %T.%9t %C\n"
+	traceTopN      = 5
+)
+
+// blktracer runs short, bounded blktrace captures of a block device on
+// demand and keeps a summary of the latest capture of each device.
+type blktracer struct {
+	devices  []string
+	duration time.Duration
+
+	lock      sync.Mutex
+	running   map[string]bool
+	summaries map[string]traceSummary
+}
+
+// traceSummary summarises one blktrace capture.
+type traceSummary struct {
+	Started   time.Time
+	Duration  time.Duration
+	Requests  int
+	Err       error
+	Latencies []time.Duration
+	Processes map[string]int
+	Sectors   map[string]int
+}
+
+func newBlktracer(devices []string, duration time.Duration) *blktracer {
+	return &blktracer{
+		devices:   devices,
+		duration:  duration,
+		running:   map[string]bool{},
+		summaries: map[string]traceSummary{},
+	}
+}
+
+// shedMemory drops the summaries of finished captures.
+func (b *blktracer) shedMemory() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.summaries = map[string]traceSummary{}
+}
+
+func (b *blktracer) deviceForControl(controlID string) (string, bool) {
+	for _, device := range b.devices {
+		if blktraceControlPrefix+device == controlID {
+			return device, true
+		}
+	}
+	return "", false
+}
+
+func (b *blktracer) controlDetails() []controlDetails {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	details := []controlDetails{}
+	for _, device := range b.devices {
+		details = append(details, controlDetails{
+			id:    blktraceControlPrefix + device,
+			human: fmt.Sprintf("Trace IO on %s for %s", device, b.duration),
+			icon:  "fa-search",
+			dead:  b.running[device],
+		})
+	}
+	return details
+}
+
+// start captures IO on device in the background.
+func (b *blktracer) start(device string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.running[device] {
+		return fmt.Errorf("blktrace: a capture of %s is already running", device)
+	}
+	b.running[device] = true
+	go func() {
+		summary := b.capture(device)
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		b.running[device] = false
+		b.summaries[device] = summary
+	}()
+	return nil
+}
+
+func (b *blktracer) capture(device string) traceSummary {
+	started := time.Now()
+	summary, err := b.run(device)
+	if err != nil {
+		summary.Err = fmt.Errorf("blktrace: %v", err)
+	}
+	summary.Started = started
+	summary.Duration = time.Since(started)
+	return summary
+}
+
+func (b *blktracer) run(device string) (traceSummary, error) {
+	// blktrace stops on its own after -w seconds; the context is only a
+	// safety net against a wedged tool.
+	ctx, cancel := context.WithTimeout(context.Background(), b.duration+10*time.Second)
+	defer cancel()
+	seconds := strconv.Itoa(int((b.duration + time.Second - 1) / time.Second))
+	trace := exec.CommandContext(ctx, "blktrace", "-d", "/dev/"+device, "-w", seconds, "-o", "-")
+	parse := exec.CommandContext(ctx, "blkparse", "-q", "-i", "-", "-f", blkparseFormat)
+
+	out, err := trace.StdoutPipe()
+	if err != nil {
+		return traceSummary{}, err
+	}
+	parse.Stdin = out
+	parsed, err := parse.StdoutPipe()
+	if err != nil {
+		return traceSummary{}, err
+	}
+	if err := trace.Start(); err != nil {
+		return traceSummary{}, err
+	}
+	if err := parse.Start(); err != nil {
+		trace.Process.Kill()
+		trace.Wait()
+		return traceSummary{}, err
+	}
+	summary := summarizeTrace(parsed)
+	if err := trace.Wait(); err != nil {
+		return summary, err
+	}
+	return summary, parse.Wait()
+}
+
+// summarizeTrace reads blkparse output in blkparseFormat and computes the
+// queue-to-completion latency distribution and the busiest processes and
+// sectors.
+func summarizeTrace(r io.Reader) traceSummary {
+	summary := traceSummary{
+		Processes: map[string]int{},
+		Sectors:   map[string]int{},
+	}
+	queued := map[string]float64{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// Q W 223490 8 697 0.000000000 kjournald
+		fields := strings.SplitN(scanner.Text(), " ", 7)
+		if len(fields) < 7 {
+			continue
+		}
+		action, sector, process := fields[0], fields[2], fields[6]
+		ts, err := strconv.ParseFloat(fields[5], 64)
+		if err != nil {
+			continue
+		}
+		switch action {
+		case "Q":
+			summary.Requests++
+			summary.Processes[process]++
+			summary.Sectors[sector]++
+			queued[sector] = ts
+		case "C":
+			if start, ok := queued[sector]; ok {
+				summary.Latencies = append(summary.Latencies, time.Duration((ts-start)*float64(time.Second)))
+				delete(queued, sector)
+			}
+		}
+	}
+	sort.Slice(summary.Latencies, func(i, j int) bool { return summary.Latencies[i] < summary.Latencies[j] })
+	return summary
+}
+
+func (s traceSummary) percentile(p float64) time.Duration {
+	if len(s.Latencies) == 0 {
+		return 0
+	}
+	return s.Latencies[int(p*float64(len(s.Latencies)-1))]
+}
+
+func (s traceSummary) histogram() string {
+	bounds := []time.Duration{time.Millisecond, 10 * time.Millisecond, 100 * time.Millisecond}
+	counts := make([]int, len(bounds)+1)
+	for _, l := range s.Latencies {
+		i := sort.Search(len(bounds), func(i int) bool { return l < bounds[i] })
+		counts[i]++
+	}
+	return fmt.Sprintf("<1ms: %d, 1-10ms: %d, 10-100ms: %d, >100ms: %d", counts[0], counts[1], counts[2], counts[3])
+}
+
+// topCounts renders the n keys with the highest counts.
+func topCounts(counts map[string]int, n int) string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	top := []string{}
+	for _, key := range keys {
+		top = append(top, fmt.Sprintf("%s (%d)", key, counts[key]))
+	}
+	return strings.Join(top, ", ")
+}
+
+func (b *blktracer) Name() string { return "blktrace" }
+
+// Collect has nothing to do: captures are started by controls and their
+// summaries are shown as tables.
+func (b *blktracer) Collect(ctx context.Context) ([]Metric, error) {
+	return nil, nil
+}
+
+// Tables returns a property list per traced device.
+func (b *blktracer) Tables() []table {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	tables := []table{}
+	for device, s := range b.summaries {
+		id := blktraceTablePrefix + device
+		rows := map[string]string{
+			"Captured": fmt.Sprintf("%s for %s", s.Started.Format(time.RFC3339), s.Duration.Round(time.Second)),
+		}
+		if s.Err != nil {
+			rows["Error"] = s.Err.Error()
+		} else {
+			rows["Requests"] = strconv.Itoa(s.Requests)
+			rows["Latency p50/p90/p99"] = fmt.Sprintf("%s / %s / %s", s.percentile(0.5), s.percentile(0.9), s.percentile(0.99))
+			rows["Latency distribution"] = s.histogram()
+			rows["Top processes"] = topCounts(s.Processes, traceTopN)
+			rows["Top sectors"] = topCounts(s.Sectors, traceTopN)
+		}
+		tables = append(tables, table{
+			Template: tableTemplate{
+				ID:     id,
+				Label:  "IO trace of " + device,
+				Prefix: id + "-",
+				Type:   "property-list",
+			},
+			Properties: rows,
+		})
+	}
+	return tables
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	collectorFactories["cadvisor"] = func(opts collectorOptions) (Collector, error) {
+		if opts.CadvisorURL != "" {
+			client := opts.HTTPClient
+			if client == nil {
+				client = http.DefaultClient
+			}
+			u := strings.TrimSuffix(opts.CadvisorURL, "/")
+			return newCadvisorStats(&kubeClient{host: u, client: client}, "/metrics"), nil
+		}
+		kubelet, err := newKubeletClient(opts.KubeletURL, opts.KubeletInsecureTLS)
+		if err != nil {
+			return nil, err
+		}
+		return newCadvisorStats(kubelet, "/metrics/cadvisor"), nil
+	}
+}
+
+// cadvisorMetrics are the cAdvisor counters container IO is read from:
+// the per-device filesystem counters and, where those lack bytes, the blkio
+// usage by operation.
+var cadvisorMetrics = map[string]bool{
+	"container_fs_reads_total":           true,
+	"container_fs_writes_total":          true,
+	"container_fs_reads_bytes_total":     true,
+	"container_fs_writes_bytes_total":    true,
+	"container_blkio_device_usage_total": true,
+}
+
+// cadvisorStats attributes IO to containers from the metrics of cAdvisor,
+// either the kubelet's embedded one or a standalone cAdvisor, for older
+// kernels without the cgroup v2 io.stat of the cgroup-io collector. Like
+// it, rates are only known from the second scrape of a container onwards.
+type cadvisorStats struct {
+	client *kubeClient
+	path   string
+
+	lock     sync.Mutex
+	prev     map[string]cgroupIO
+	prevTime time.Time
+}
+
+func newCadvisorStats(client *kubeClient, path string) *cadvisorStats {
+	return &cadvisorStats{client: client, path: path}
+}
+
+func (c *cadvisorStats) Name() string { return "cadvisor" }
+
+func (c *cadvisorStats) resetCounters() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.prev = nil
+}
+
+// Collect attaches the per-container IO rates to Scope's container nodes.
+func (c *cadvisorStats) Collect(ctx context.Context) ([]Metric, error) {
+	raw, err := c.client.getText(ctx, c.path)
+	if err != nil {
+		return nil, fmt.Errorf("cadvisor: %w", err)
+	}
+	now := time.Now()
+	samples, err := parseExposition(raw, cadvisorMetrics)
+	if err != nil {
+		return nil, fmt.Errorf("cadvisor: %v", err)
+	}
+	cur := map[string]cgroupIO{}
+	blkio := map[string]cgroupIO{}
+	for _, s := range samples {
+		match := containerIDRegexp.FindStringSubmatch(path.Base(s.Labels["id"]))
+		if match == nil {
+			continue
+		}
+		id := match[1]
+		io := cur[id]
+		switch s.Name {
+		case "container_fs_reads_total":
+			io.rios += s.Value
+		case "container_fs_writes_total":
+			io.wios += s.Value
+		case "container_fs_reads_bytes_total":
+			io.rbytes += s.Value
+		case "container_fs_writes_bytes_total":
+			io.wbytes += s.Value
+		case "container_blkio_device_usage_total":
+			b := blkio[id]
+			switch s.Labels["operation"] {
+			case "Read":
+				b.rbytes += s.Value
+			case "Write":
+				b.wbytes += s.Value
+			}
+			blkio[id] = b
+		}
+		cur[id] = io
+	}
+	for id, b := range blkio {
+		if io := cur[id]; io.rbytes == 0 && io.wbytes == 0 {
+			io.rbytes, io.wbytes = b.rbytes, b.wbytes
+			cur[id] = io
+		}
+	}
+
+	c.lock.Lock()
+	prev, elapsed := c.prev, now.Sub(c.prevTime).Seconds()
+	c.prev, c.prevTime = cur, now
+	c.lock.Unlock()
+	return containerMetrics(containerRates(prev, cur, elapsed), now), nil
+}
+
+// expositionSample is one sample of the Prometheus text exposition format.
+type expositionSample struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+}
+
+// parseExposition parses the samples of the named metrics in the Prometheus
+// text exposition format, ignoring the others.
+func parseExposition(raw []byte, names map[string]bool) ([]expositionSample, error) {
+	samples := []expositionSample{}
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		end := strings.IndexAny(line, "{ ")
+		if end < 0 || !names[line[:end]] {
+			continue
+		}
+		s := expositionSample{Name: line[:end], Labels: map[string]string{}}
+		rest := line[end:]
+		if strings.HasPrefix(rest, "{") {
+			var err error
+			if s.Labels, rest, err = parseLabels(rest[1:]); err != nil {
+				return nil, fmt.Errorf("invalid sample %q: %v", line, err)
+			}
+		}
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("invalid sample %q: no value", line)
+		}
+		value, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sample %q: %v", line, err)
+		}
+		s.Value = value
+		samples = append(samples, s)
+	}
+	return samples, scanner.Err()
+}
+
+// parseLabels parses name="value" pairs up to the closing brace, returning
+// the rest of the line.
+func parseLabels(s string) (map[string]string, string, error) {
+	labels := map[string]string{}
+	for {
+		s = strings.TrimLeft(s, " ,")
+		if strings.HasPrefix(s, "}") {
+			return labels, s[1:], nil
+		}
+		eq := strings.Index(s, "=")
+		if eq < 0 || len(s) < eq+2 || s[eq+1] != '"' {
+			return nil, "", fmt.Errorf("expected name=\"value\"")
+		}
+		name := strings.TrimSpace(s[:eq])
+		value := strings.Builder{}
+		i := eq + 2
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+				switch s[i] {
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					value.WriteByte(s[i])
+				}
+				continue
+			}
+			value.WriteByte(s[i])
+		}
+		if i >= len(s) {
+			return nil, "", fmt.Errorf("unterminated value of label %s", name)
+		}
+		labels[name] = value.String()
+		s = s[i+1:]
+	}
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var captureLog = componentLog("capture")
+
+// Synchronised captures record high-frequency samples of every collector
+// on all plugin instances at the same time, to diagnose cluster-wide IO
+// storms. Every instance serves the capture API on -capture-listen; the
+// leader (-capture-leader) additionally gets a Scope control that
+// schedules a capture on all -capture-peers, gathers their samples and
+// stores them as one downloadable JSON artifact.
+const (
+	clusterCaptureControlID = "clusterCapture"
+	captureTableID          = "capture-table"
+	captureTablePrefix      = "capture-table-"
+
+	// captureLead is how far ahead a capture is scheduled, so that every
+	// peer learns about it before it starts.
+	captureLead = 5 * time.Second
+
+	// The capture API is unauthenticated, so the captures it schedules
+	// are bounded: they sample at most every captureMinInterval, for at
+	// most captureMaxDuration, starting within captureMaxLead.
+	captureMinInterval = 100 * time.Millisecond
+	captureMaxDuration = 5 * time.Minute
+	captureMaxLead     = time.Minute
+)
+
+var captureIDRegexp = regexp.MustCompile(`^[0-9]+$`)
+
+// captureRequest schedules a capture on one instance.
+type captureRequest struct {
+	ID       string        `json:"id"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+	Interval time.Duration `json:"interval"`
+}
+
+type captureSample struct {
+	Time    time.Time `json:"time"`
+	Metrics []Metric  `json:"metrics"`
+}
+
+// nodeCapture is the capture of one instance.
+type nodeCapture struct {
+	Host    string          `json:"host"`
+	Done    bool            `json:"done"`
+	Error   string          `json:"error,omitempty"`
+	Samples []captureSample `json:"samples,omitempty"`
+}
+
+// clusterCapture is the downloadable artifact aggregating all instances.
+type clusterCapture struct {
+	captureRequest
+	Nodes []nodeCapture `json:"nodes"`
+}
+
+// captureServer runs the captures scheduled on this instance, and, on the
+// leader, coordinates cluster-wide captures.
+type captureServer struct {
+	plugin    *Plugin
+	dir       string
+	advertise string
+	peers     []string
+	leader    bool
+	duration  time.Duration
+	interval  time.Duration
+	client    *http.Client
+
+	lock   sync.Mutex
+	local  map[string]*nodeCapture
+	status map[string]string
+}
+
+func newCaptureServer(plugin *Plugin, dir, advertise string, peers []string, leader bool, duration, interval time.Duration) *captureServer {
+	return &captureServer{
+		plugin:    plugin,
+		dir:       dir,
+		advertise: advertise,
+		peers:     peers,
+		leader:    leader,
+		duration:  duration,
+		interval:  interval,
+		client:    &http.Client{Timeout: 5 * time.Second},
+		local:     map[string]*nodeCapture{},
+		status:    map[string]string{},
+	}
+}
+
+func (s *captureServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/capture", s.serveCapture)
+	mux.HandleFunc("/captures/", s.serveArtifact)
+	return mux
+}
+
+// serveCapture schedules a capture (POST) or returns its samples (GET).
+func (s *captureServer) serveCapture(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		req := captureRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !captureIDRegexp.MatchString(req.ID) {
+			http.Error(w, "invalid capture request", http.StatusBadRequest)
+			return
+		}
+		if err := validCapture(req.Duration, req.Interval); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if time.Until(req.Start) > captureMaxLead {
+			http.Error(w, fmt.Sprintf("capture starts more than %s ahead", captureMaxLead), http.StatusBadRequest)
+			return
+		}
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if _, ok := s.local[req.ID]; !ok {
+			if s.running() {
+				http.Error(w, "a capture is already running", http.StatusConflict)
+				return
+			}
+			s.local[req.ID] = &nodeCapture{Host: s.plugin.HostID}
+			go s.run(req)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	case "GET":
+		s.lock.Lock()
+		c, ok := s.local[r.URL.Query().Get("id")]
+		var raw []byte
+		var err error
+		if ok {
+			raw, err = json.Marshal(c)
+		}
+		s.lock.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(raw)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// validCapture checks a capture's duration and interval are within the
+// bounds of the capture API.
+func validCapture(duration, interval time.Duration) error {
+	if duration <= 0 || duration > captureMaxDuration {
+		return fmt.Errorf("capture duration %s not within 0s and %s", duration, captureMaxDuration)
+	}
+	if interval < captureMinInterval || interval > duration {
+		return fmt.Errorf("capture interval %s not within %s and the duration", interval, captureMinInterval)
+	}
+	return nil
+}
+
+// running tells whether a capture is scheduled or running. The caller
+// holds s.lock.
+func (s *captureServer) running() bool {
+	for _, c := range s.local {
+		if !c.Done {
+			return true
+		}
+	}
+	return false
+}
+
+// serveArtifact lets users download the artifacts stored by the leader.
+func (s *captureServer) serveArtifact(w http.ResponseWriter, r *http.Request) {
+	name := filepath.Base(r.URL.Path)
+	if filepath.Ext(name) != ".json" || !captureIDRegexp.MatchString(name[:len(name)-len(".json")]) {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	http.ServeFile(w, r, filepath.Join(s.dir, "capture-"+name))
+}
+
+// run samples every collector each interval for the capture's duration.
+func (s *captureServer) run(req captureRequest) {
+	time.Sleep(time.Until(req.Start))
+	samples := []captureSample{}
+	ticker := time.NewTicker(req.Interval)
+	defer ticker.Stop()
+	for end := req.Start.Add(req.Duration); time.Now().Before(end); <-ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), req.Interval)
+		c := s.plugin.collect(ctx)
+		cancel()
+		samples = append(samples, captureSample{Time: time.Now(), Metrics: c.metrics})
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c := s.local[req.ID]
+	c.Samples = samples
+	c.Done = true
+}
+
+// startCluster schedules a capture on every peer and collects the results
+// in the background. It is run by a control, with the plugin lock held,
+// so peers are resolved and contacted after it returns.
+func (s *captureServer) startCluster() error {
+	id := strconv.FormatInt(time.Now().Unix(), 10)
+	s.setStatus(id, "scheduling")
+	go s.schedule(id)
+	return nil
+}
+
+// schedule resolves the peers and schedules the capture on all of them at
+// once, so that it starts captureLead after they are known, however slow
+// some are to answer, and then gathers the results.
+func (s *captureServer) schedule(id string) {
+	peers, err := s.resolvePeers()
+	if err != nil {
+		s.setStatus(id, "failed: "+err.Error())
+		return
+	}
+	req := captureRequest{
+		ID:       id,
+		Start:    time.Now().Add(captureLead),
+		Duration: s.duration,
+		Interval: s.interval,
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		s.setStatus(id, "failed: "+err.Error())
+		return
+	}
+	accepted := make([]bool, len(peers))
+	var wg sync.WaitGroup
+	for i, peer := range peers {
+		wg.Add(1)
+		go func(i int, peer string) {
+			defer wg.Done()
+			if err := s.schedulePeer(peer, body); err != nil {
+				captureLog.Errorf("scheduling on %s: %v", peer, err)
+				return
+			}
+			accepted[i] = true
+		}(i, peer)
+	}
+	wg.Wait()
+	scheduled := []string{}
+	for i, peer := range peers {
+		if accepted[i] {
+			scheduled = append(scheduled, peer)
+		}
+	}
+	s.setStatus(id, fmt.Sprintf("running on %d of %d instances", len(scheduled), len(peers)))
+	s.gather(req, scheduled)
+}
+
+// schedulePeer posts a capture request to a peer, which must accept it.
+func (s *captureServer) schedulePeer(peer string, body []byte) error {
+	res, err := s.client.Post("http://"+peer+"/capture", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("%s: %s", res.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// resolvePeers expands the peer list, resolving every name at once; a DNS
+// name such as a headless Kubernetes service resolves to every instance.
+func (s *captureServer) resolvePeers() ([]string, error) {
+	type hostPort struct{ host, port string }
+	names := []hostPort{}
+	for _, peer := range s.peers {
+		host, port, err := net.SplitHostPort(peer)
+		if err != nil {
+			return nil, fmt.Errorf("capture: invalid peer %q: %v", peer, err)
+		}
+		names = append(names, hostPort{host, port})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.client.Timeout)
+	defer cancel()
+	resolved := make([][]string, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name hostPort) {
+			defer wg.Done()
+			addrs, err := net.DefaultResolver.LookupHost(ctx, name.host)
+			if err != nil {
+				captureLog.Errorf("resolving %s: %v", name.host, err)
+				return
+			}
+			for _, addr := range addrs {
+				resolved[i] = append(resolved[i], net.JoinHostPort(addr, name.port))
+			}
+		}(i, name)
+	}
+	wg.Wait()
+	peers := []string{}
+	for _, addrs := range resolved {
+		peers = append(peers, addrs...)
+	}
+	sort.Strings(peers)
+	return peers, nil
+}
+
+func (s *captureServer) gather(req captureRequest, peers []string) {
+	time.Sleep(time.Until(req.Start.Add(req.Duration + 2*req.Interval)))
+	artifact := clusterCapture{captureRequest: req, Nodes: []nodeCapture{}}
+	for _, peer := range peers {
+		artifact.Nodes = append(artifact.Nodes, s.fetch(peer, req.ID))
+	}
+	raw, err := json.Marshal(artifact)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(s.dir, "capture-"+req.ID+".json"), raw, 0644)
+	}
+	if err != nil {
+		s.setStatus(req.ID, "failed: "+err.Error())
+		return
+	}
+	s.setStatus(req.ID, fmt.Sprintf("done (%d instances), download from http://%s/captures/%s.json", len(peers), s.advertise, req.ID))
+}
+
+// fetch gets the capture of one peer, waiting for it to finish.
+func (s *captureServer) fetch(peer, id string) nodeCapture {
+	for attempt := 0; ; attempt++ {
+		c, err := s.fetchOnce(peer, id)
+		if err == nil && c.Done {
+			return c
+		}
+		if attempt == 10 {
+			if err == nil {
+				err = fmt.Errorf("capture did not finish")
+			}
+			return nodeCapture{Host: peer, Error: err.Error()}
+		}
+		time.Sleep(s.interval)
+	}
+}
+
+func (s *captureServer) fetchOnce(peer, id string) (nodeCapture, error) {
+	c := nodeCapture{}
+	res, err := s.client.Get("http://" + peer + "/capture?id=" + id)
+	if err != nil {
+		return c, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return c, fmt.Errorf("%s", res.Status)
+	}
+	err = json.NewDecoder(res.Body).Decode(&c)
+	return c, err
+}
+
+// shedMemory drops the samples of finished captures. Peers that did not
+// fetch them yet get an error instead.
+func (s *captureServer) shedMemory() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for id, c := range s.local {
+		if c.Done {
+			delete(s.local, id)
+		}
+	}
+}
+
+func (s *captureServer) setStatus(id, status string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.status[id] = status
+}
+
+func (s *captureServer) controlDetails() []controlDetails {
+	if !s.leader {
+		return nil
+	}
+	return []controlDetails{{
+		id:    clusterCaptureControlID,
+		human: fmt.Sprintf("Capture IO on all nodes for %s", s.duration),
+		icon:  "fa-camera",
+	}}
+}
+
+func (s *captureServer) Name() string { return "capture" }
+
+func (s *captureServer) String() string {
+	if s.leader {
+		return "capture=leader"
+	}
+	return "capture"
+}
+
+// Collect has nothing to do: captures are started by a control.
+func (s *captureServer) Collect(ctx context.Context) ([]Metric, error) {
+	return nil, nil
+}
+
+// Tables shows the status of the leader's captures.
+func (s *captureServer) Tables() []table {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.status) == 0 {
+		return nil
+	}
+	properties := map[string]string{}
+	for id, status := range s.status {
+		sec, _ := strconv.ParseInt(id, 10, 64)
+		properties[time.Unix(sec, 0).UTC().Format(time.RFC3339)] = status
+	}
+	return []table{{
+		Template: tableTemplate{
+			ID:     captureTableID,
+			Label:  "Cluster IO captures",
+			Prefix: captureTablePrefix,
+			Type:   "property-list",
+		},
+		Properties: properties,
+	}}
+}
+
+func defaultCaptureDir() string {
+	return filepath.Join(os.TempDir(), "iowait-captures")
+}
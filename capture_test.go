@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSchedulePeer(t *testing.T) {
+	s := newCaptureServer(&Plugin{}, t.TempDir(), "", nil, true, captureLead, captureLead)
+	for _, tc := range []struct {
+		status  int
+		wantErr bool
+	}{
+		{status: http.StatusAccepted},
+		{status: http.StatusBadRequest, wantErr: true},
+		{status: http.StatusConflict, wantErr: true},
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tc.status)
+		}))
+		err := s.schedulePeer(strings.TrimPrefix(srv.URL, "http://"), []byte("{}"))
+		srv.Close()
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%d: got error %v, want error %v", tc.status, err, tc.wantErr)
+		}
+	}
+}
+
+func TestServeCaptureBounds(t *testing.T) {
+	s := newCaptureServer(&Plugin{}, t.TempDir(), "", nil, false, time.Minute, time.Second)
+	post := func(req captureRequest) int {
+		body, _ := json.Marshal(req)
+		res := httptest.NewRecorder()
+		s.serveCapture(res, httptest.NewRequest("POST", "/capture", bytes.NewReader(body)))
+		return res.Code
+	}
+	start := time.Now().Add(captureMaxLead / 2)
+	for _, tc := range []struct {
+		name string
+		req  captureRequest
+		want int
+	}{
+		{"tight loop", captureRequest{ID: "1", Start: start, Duration: time.Minute, Interval: time.Nanosecond}, http.StatusBadRequest},
+		{"too long", captureRequest{ID: "1", Start: start, Duration: time.Hour, Interval: time.Second}, http.StatusBadRequest},
+		{"no duration", captureRequest{ID: "1", Start: start, Interval: time.Second}, http.StatusBadRequest},
+		{"far ahead", captureRequest{ID: "1", Start: time.Now().Add(time.Hour), Duration: time.Minute, Interval: time.Second}, http.StatusBadRequest},
+	} {
+		if got := post(tc.req); got != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.name, got, tc.want)
+		}
+	}
+
+	// The capture starts well after the test, so it stays scheduled.
+	start = time.Now().Add(captureMaxLead - time.Second)
+	if got := post(captureRequest{ID: "1", Start: start, Duration: time.Minute, Interval: time.Second}); got != http.StatusAccepted {
+		t.Fatalf("got %d, want %d", got, http.StatusAccepted)
+	}
+	if got := post(captureRequest{ID: "1", Start: start, Duration: time.Minute, Interval: time.Second}); got != http.StatusAccepted {
+		t.Errorf("same capture again: got %d, want %d", got, http.StatusAccepted)
+	}
+	if got := post(captureRequest{ID: "2", Start: start, Duration: time.Minute, Interval: time.Second}); got != http.StatusConflict {
+		t.Errorf("second capture: got %d, want %d", got, http.StatusConflict)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const cgroupRoot = "/sys/fs/cgroup"
+
+func init() {
+	collectorFactories["cgroup-io"] = func(opts collectorOptions) (Collector, error) {
+		return newCgroupStats(opts.CgroupRoot)
+	}
+}
+
+// containerIDRegexp matches the container ID in cgroup directory names such
+// as docker-<id>.scope, cri-containerd-<id>.scope, crio-<id>.scope or the
+// plain <id> used by the cgroupfs driver.
+var containerIDRegexp = regexp.MustCompile(`(?:^|[-_])([0-9a-f]{64})(?:\.scope)?$`)
+
+// cgroupIO are the cumulative IO counters of one cgroup, summed over all
+// devices.
+type cgroupIO struct {
+	rbytes, wbytes, rios, wios float64
+}
+
+// containerIO are the per-second IO rates of one container.
+type containerIO struct {
+	ID               string
+	ReadIOPS         float64
+	WriteIOPS        float64
+	ReadBytesPerSec  float64
+	WriteBytesPerSec float64
+}
+
+// cgroupStats attributes IO to containers by walking the cgroup v2
+// hierarchy and reading each container cgroup's io.stat. Rates are only
+// known from the second reading of a container onwards.
+type cgroupStats struct {
+	root string
+
+	lock     sync.Mutex
+	prev     map[string]cgroupIO
+	prevTime time.Time
+}
+
+func newCgroupStats(root string) (*cgroupStats, error) {
+	if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err != nil {
+		return nil, fmt.Errorf("cgroup: %s is not a cgroup v2 hierarchy: %v", root, err)
+	}
+	return &cgroupStats{root: root}, nil
+}
+
+func (c *cgroupStats) rates() ([]containerIO, error) {
+	cur := map[string]cgroupIO{}
+	now := time.Now()
+	err := filepath.Walk(c.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// cgroups come and go while we walk them.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		match := containerIDRegexp.FindStringSubmatch(info.Name())
+		if match == nil {
+			return nil
+		}
+		// io.stat is hierarchical, so a container's nested cgroups are
+		// already accounted for.
+		if stats, err := readIOStat(filepath.Join(path, "io.stat")); err == nil {
+			cur[match[1]] = stats
+		}
+		return filepath.SkipDir
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cgroup: %v", err)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	prev, elapsed := c.prev, now.Sub(c.prevTime).Seconds()
+	c.prev, c.prevTime = cur, now
+	return containerRates(prev, cur, elapsed), nil
+}
+
+// containerRates returns the IO rates of the containers in two readings of
+// their counters, elapsed seconds apart. Containers new in cur, or whose
+// counters went backwards, are left out.
+func containerRates(prev, cur map[string]cgroupIO, elapsed float64) []containerIO {
+	rates := []containerIO{}
+	for id, io := range cur {
+		p, ok := prev[id]
+		if !ok || elapsed <= 0 || io.rios < p.rios || io.wios < p.wios {
+			continue
+		}
+		rates = append(rates, containerIO{
+			ID:               id,
+			ReadIOPS:         (io.rios - p.rios) / elapsed,
+			WriteIOPS:        (io.wios - p.wios) / elapsed,
+			ReadBytesPerSec:  (io.rbytes - p.rbytes) / elapsed,
+			WriteBytesPerSec: (io.wbytes - p.wbytes) / elapsed,
+		})
+	}
+	sort.Slice(rates, func(i, j int) bool { return rates[i].ID < rates[j].ID })
+	return rates
+}
+
+// counterRate returns the increase of a counter per second, if it didn't
+// reset.
+func counterRate(cur, prev, elapsed float64) (float64, bool) {
+	if cur < prev || elapsed <= 0 {
+		return 0, false
+	}
+	return (cur - prev) / elapsed, true
+}
+
+func readIOStat(path string) (cgroupIO, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return cgroupIO{}, err
+	}
+	defer f.Close()
+
+	// 8:0 rbytes=1459200 wbytes=314773504 rios=192 wios=353 dbytes=0 dios=0
+	stats := cgroupIO{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		for _, field := range fields[1:] {
+			parts := strings.SplitN(field, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			value, err := strconv.ParseFloat(parts[1], 64)
+			if err != nil {
+				continue
+			}
+			switch parts[0] {
+			case "rbytes":
+				stats.rbytes += value
+			case "wbytes":
+				stats.wbytes += value
+			case "rios":
+				stats.rios += value
+			case "wios":
+				stats.wios += value
+			}
+		}
+	}
+	return stats, scanner.Err()
+}
+
+var containerMetricDefs = []struct {
+	id, label, format string
+	value             func(containerIO) float64
+}{
+	{"container_read_iops", "Read IOPS", "", func(c containerIO) float64 { return c.ReadIOPS }},
+	{"container_write_iops", "Write IOPS", "", func(c containerIO) float64 { return c.WriteIOPS }},
+	{"container_read_bytes", "Read bytes/s", "filesize", func(c containerIO) float64 { return c.ReadBytesPerSec }},
+	{"container_write_bytes", "Write bytes/s", "filesize", func(c containerIO) float64 { return c.WriteBytesPerSec }},
+}
+
+func (c *cgroupStats) resetCounters() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.prev = nil
+}
+
+func (c *cgroupStats) Name() string { return "cgroup-io" }
+
+// Collect attaches the per-container IO rates to Scope's container nodes.
+func (c *cgroupStats) Collect(ctx context.Context) ([]Metric, error) {
+	containers, err := c.rates()
+	if err != nil {
+		return nil, err
+	}
+	return containerMetrics(containers, time.Now()), nil
+}
+
+// containerMetrics attaches IO rates to Scope's container nodes.
+func containerMetrics(containers []containerIO, now time.Time) []Metric {
+	metrics := []Metric{}
+	for _, container := range containers {
+		for i, def := range containerMetricDefs {
+			value := def.value(container)
+			metrics = append(metrics, Metric{
+				ID:       def.id,
+				Label:    def.label,
+				Format:   def.format,
+				Priority: 10 + float64(i)/10,
+				Value:    value,
+				Min:      0,
+				Max:      value,
+				Time:     now,
+				Topology: containerTopologyID,
+				NodeID:   fmt.Sprintf("%s;<container>", container.ID),
+			})
+		}
+	}
+	return metrics
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A Collector gathers metrics from one source: a kernel interface, an
+// external tool or a remote backend.
+type Collector interface {
+	Name() string
+	Collect(ctx context.Context) ([]Metric, error)
+}
+
+// Report topologies a Metric can be attached to.
+const (
+	hostTopologyID      = "host"
+	containerTopologyID = "container"
+	podTopologyID       = "pod"
+)
+
+// A Metric is one collected value, together with how Scope should show it.
+type Metric struct {
+	ID       string
+	Label    string
+	Format   string
+	Priority float64
+
+	Value    float64
+	Min, Max float64
+	Time     time.Time
+
+	// Topology and NodeID say which report node the metric belongs to.
+	// They default to the host topology and this host's node.
+	Topology string
+	NodeID   string
+}
+
+// A tableCollector also shows tables on the host node, rendered from its
+// latest collection.
+type tableCollector interface {
+	Collector
+	Tables() []table
+}
+
+// collectorResult is what a collector returned from one collection.
+type collectorResult struct {
+	metrics []Metric
+	tables  []table
+	err     error
+}
+
+// collectWithin collects from c, giving up after timeout if it is set.
+// Collectors not honouring ctx, e.g. blocked on a command, are left to
+// finish in the background and their late result dropped.
+func collectWithin(ctx context.Context, c Collector, timeout time.Duration) collectorResult {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	done := make(chan collectorResult, 1)
+	go func() {
+		var r collectorResult
+		r.metrics, r.err = c.Collect(ctx)
+		if tc, ok := c.(tableCollector); ok {
+			r.tables = tc.Tables()
+		}
+		done <- r
+	}()
+	select {
+	case r := <-done:
+		return r
+	case <-ctx.Done():
+		return collectorResult{err: fmt.Errorf("%s: collection abandoned: %w", c.Name(), ctx.Err())}
+	}
+}
+
+// A table is either a multicolumn table, with Rows mapping row IDs to
+// column values, or a property list, with Properties mapping labels to
+// values.
+type table struct {
+	Template   tableTemplate
+	Rows       map[string]map[string]string
+	Properties map[string]string
+}
+
+// entries renders the table into entries of the host node's latest map.
+func (t table) entries(ts time.Time) map[string]stringEntry {
+	latest := map[string]stringEntry{}
+	for rowID, row := range t.Rows {
+		addTableRow(latest, t.Template.Prefix, rowID, row, ts)
+	}
+	for label, value := range t.Properties {
+		latest[t.Template.Prefix+label] = stringEntry{Timestamp: ts, Value: value}
+	}
+	return latest
+}
+
+// collectorOptions are the settings collectors are built from.
+type collectorOptions struct {
+	DiskSource    string
+	DiskExclude   *regexp.Regexp
+	DiskExtended  bool
+	DiskLVM       bool
+	DiskLocalPVs  bool
+	CgroupRoot    string
+	ProcessTop    int
+	TraceDevices  []string
+	TraceDuration time.Duration
+
+	// BenchmarkDevices are the block devices that get a control running
+	// a fio benchmark for BenchmarkDuration, whose results are reported
+	// for BenchmarkTTL.
+	BenchmarkDevices  []string
+	BenchmarkDuration time.Duration
+	BenchmarkTTL      time.Duration
+
+	// SnapshotPVs are the volumes that get a control taking a snapshot,
+	// of the VolumeSnapshotClass SnapshotClass.
+	SnapshotPVs   []string
+	SnapshotClass string
+
+	// DockerSocket is where the Docker Engine API listens.
+	DockerSocket string
+
+	// CRIEndpoint is the container runtime crictl talks to, empty for
+	// crictl's default.
+	CRIEndpoint string
+
+	// SMARTInterval is how often the SMART data of drives is read.
+	SMARTInterval time.Duration
+
+	// CommandTimeout bounds every run of an external tool, such as
+	// iostat, 0 meaning none.
+	CommandTimeout time.Duration
+
+	PrometheusURL     string
+	PrometheusQueries []promQuery
+	HTTPClient        *http.Client
+
+	// InfluxDB configures the InfluxDB backend.
+	InfluxDB influxOptions
+	// Graphite configures the Graphite backend.
+	Graphite graphiteOptions
+
+	// PVTableQueries are the queries of the volume IOPS table.
+	PVTableQueries pvTableQueries
+
+	// PVShard, if set, tells which volumes this replica reports.
+	PVShard func(key string) bool
+	// InstanceHosts, set in aggregator mode, map the instance label of
+	// Prometheus series to the host they are reported on.
+	InstanceHosts *instanceHosts
+
+	// KubeletURL is the kubelet whose Summary API volume usage is read
+	// from, skipping certificate verification with KubeletInsecureTLS.
+	KubeletURL         string
+	KubeletInsecureTLS bool
+	// CStorExporterPort is where the exporters of cStor target pods
+	// listen.
+	CStorExporterPort int
+	// MayastorURL is the Mayastor REST control plane, and
+	// MayastorExporterPort where the io-engine metrics exporters listen.
+	MayastorURL          string
+	MayastorExporterPort int
+	// CadvisorURL is a standalone cAdvisor scraped for container IO
+	// instead of the kubelet's.
+	CadvisorURL string
+
+	// OrphanInterval is how often orphaned volume series are looked for,
+	// and OrphanWebhook, if set, where new ones are posted.
+	OrphanInterval time.Duration
+	OrphanWebhook  string
+
+	// Notifier delivers notifications to webhooks.
+	Notifier *notifier
+
+	// Pricing is what IO costs, estimated every CostInterval.
+	Pricing      ioPricing
+	CostInterval time.Duration
+
+	Microbursts microburstOptions
+
+	// LatencyQuery returns the classic latency histogram buckets of every
+	// volume, rolled up every LatencyInterval.
+	LatencyQuery    string
+	LatencyInterval time.Duration
+}
+
+// microburstOptions say how often, for how long and how sensitively
+// micro-bursts are looked for.
+type microburstOptions struct {
+	Every  time.Duration
+	Window time.Duration
+	// Factor is how many times the window's mean IOPS a 100ms step must
+	// reach to be part of a burst.
+	Factor float64
+	// MinIOPS keeps idle devices' single IOs from counting as bursts.
+	MinIOPS float64
+}
+
+// collectorFactories is the registry of collectors, by name. Platform
+// specific collectors register themselves from their own files.
+var collectorFactories = map[string]func(opts collectorOptions) (Collector, error){
+	"gopsutil": func(opts collectorOptions) (Collector, error) {
+		return newProcStatCollector("gopsutil", newGopsutilCPUStats()), nil
+	},
+	"diskstats": func(opts collectorOptions) (Collector, error) {
+		source, ok := diskSources[opts.DiskSource]
+		if !ok {
+			return nil, fmt.Errorf("unknown disk source %q (known: %s)", opts.DiskSource, strings.Join(diskSourceNames(), ", "))
+		}
+		var kube *kubeClient
+		if opts.DiskLocalPVs {
+			if localPVDevices == nil {
+				return nil, fmt.Errorf("diskstats: local volumes can't be mapped to devices on this platform")
+			}
+			var err error
+			if kube, err = newInClusterKubeClient(); err != nil {
+				return nil, err
+			}
+		}
+		return newDiskCollector(source(opts.DiskExclude), opts.DiskExtended, opts.DiskLVM, kube), nil
+	},
+	"blktrace": func(opts collectorOptions) (Collector, error) {
+		return newBlktracer(opts.TraceDevices, opts.TraceDuration), nil
+	},
+	"prometheus": func(opts collectorOptions) (Collector, error) {
+		c, err := newPrometheusCollector(opts.PrometheusURL, opts.PrometheusQueries, opts.HTTPClient, opts.PVShard)
+		if err != nil {
+			return nil, err
+		}
+		c.hosts = opts.InstanceHosts
+		return c, nil
+	},
+}
+
+// cpuSources are the collectors that can serve as the CPU source.
+var cpuSources = []string{"gopsutil"}
+
+// cpuFallbacks are the CPU sources standing in for others, by name, when
+// the tool those run isn't installed.
+var cpuFallbacks = map[string]string{}
+
+// diskSources are the block device statistics sources, by name.
+var diskSources = map[string]func(exclude *regexp.Regexp) diskRater{
+	"gopsutil": func(exclude *regexp.Regexp) diskRater {
+		return newGopsutilDiskStats(exclude)
+	},
+}
+
+func newCollector(name string, opts collectorOptions) (Collector, error) {
+	factory, ok := collectorFactories[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown collector %q (known: %s)", name, strings.Join(collectorNames(), ", "))
+	}
+	return factory(opts)
+}
+
+// newCPUCollectorFor builds the collector of a CPU source, falling back to
+// its stand-in if the tool it runs isn't installed. It also returns the
+// name of the source actually used.
+func newCPUCollectorFor(name string, opts collectorOptions) (Collector, string, error) {
+	c, err := newCollector(name, opts)
+	fallback, ok := cpuFallbacks[name]
+	if err == nil || !ok || !errors.Is(err, exec.ErrNotFound) {
+		return c, name, err
+	}
+	collectorLog(name).Warnf("CPU source %s unavailable (%v), falling back to %s", name, err, fallback)
+	c, err = newCollector(fallback, opts)
+	return c, fallback, err
+}
+
+func collectorNames() []string {
+	names := []string{}
+	for name := range collectorFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func validCPUSource(name string) bool {
+	for _, source := range cpuSources {
+		if source == name {
+			return true
+		}
+	}
+	return false
+}
+
+func cpuSourceNames() []string {
+	names := append([]string{}, cpuSources...)
+	sort.Strings(names)
+	return names
+}
+
+func diskSourceNames() []string {
+	names := []string{}
+	for name := range diskSources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// collectorSummary names a collector in the plugin inventory.
+func collectorSummary(c Collector) string {
+	if s, ok := c.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return c.Name()
+}
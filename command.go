@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// commandWaitDelay is how long a killed command's output is still waited
+// for, in case it left children holding its stdout open.
+const commandWaitDelay = time.Second
+
+// commandOutput runs an external tool, such as iostat, and returns its
+// standard output. The tool is killed once ctx is done or, if timeout is
+// set, after timeout, so a hung binary can't stall report generation.
+// Tools run in the C locale, so their output parses the same everywhere.
+func commandOutput(ctx context.Context, timeout time.Duration, name string, args ...string) ([]byte, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = append(os.Environ(), "LC_ALL=C")
+	cmd.WaitDelay = commandWaitDelay
+	out, err := cmd.Output()
+	if ctx.Err() != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			self.inc("iowait_command_timeouts_total", "command", name)
+		}
+		return nil, fmt.Errorf("%s killed: %w", name, ctx.Err())
+	}
+	return out, err
+}
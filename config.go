@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var configLog = componentLog("config")
+
+// A config file sets flags, one name=value per line, e.g.
+//
+//	# Volume metrics
+//	prometheus-query=write_iops=OpenEBS_write_iops
+//	thresholds=iowait=3x
+//
+// Flags given on the command line take precedence over the file.
+
+type configEntry struct {
+	name, value string
+}
+
+func readConfigFile(path string) ([]configEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+	defer f.Close()
+	entries := []configEntry{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("config: %s:%d: expected name=value", path, n)
+		}
+		name := strings.TrimLeft(strings.TrimSpace(parts[0]), "-")
+		if flag.Lookup(name) == nil {
+			return nil, fmt.Errorf("config: %s:%d: unknown flag %q", path, n, name)
+		}
+		entries = append(entries, configEntry{name, strings.TrimSpace(parts[1])})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+	return entries, nil
+}
+
+// commandLineFlags returns the names of the flags set on the command line.
+func commandLineFlags() map[string]bool {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	return set
+}
+
+// applyConfigFile sets the flags of a config file, except those given on
+// the command line.
+func applyConfigFile(path string, explicit map[string]bool) error {
+	entries, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if explicit[e.name] {
+			continue
+		}
+		if err := flag.Set(e.name, e.value); err != nil {
+			return fmt.Errorf("config: %s: %s: %v", path, e.name, err)
+		}
+	}
+	return nil
+}
+
+// configReloader re-reads the config file on SIGHUP or a POST to /-/reload,
+// without dropping the plugin socket. Only some settings can change that
+// way; changes to the others are logged as needing a restart. Settings
+// the file no longer sets go back to base, their values on the command
+// line or by default.
+type configReloader struct {
+	path     string
+	plugin   *Plugin
+	explicit map[string]bool
+	base     runtimeConfig
+}
+
+// reloadableFlags are the flags a reload applies.
+var reloadableFlags = map[string]bool{
+	"prometheus-query":    true,
+	"thresholds":          true,
+	"critical-thresholds": true,
+	"metric-ranges":       true,
+	"metric-formats":      true,
+	"metric-units":        true,
+	"cpu-priorities":      true,
+	"edge-interval":       true,
+	"poll-interval":       true,
+	"log-level":           true,
+}
+
+func (c *configReloader) reload() error {
+	entries, err := readConfigFile(c.path)
+	if err != nil {
+		return err
+	}
+	values := runtimeConfig{}
+	for name, vs := range c.base {
+		values[name] = vs
+	}
+	fromFile := map[string]bool{}
+	for _, e := range entries {
+		if c.explicit[e.name] {
+			continue
+		}
+		if !reloadableFlags[e.name] {
+			if flag.Lookup(e.name).Value.String() != e.value {
+				configLog.Warnf("%s changed, restart to apply it", e.name)
+			}
+			continue
+		}
+		if !fromFile[e.name] {
+			values[e.name], fromFile[e.name] = nil, true
+		}
+		values[e.name] = append(values[e.name], e.value)
+	}
+	if err := c.plugin.applyConfig(values); err != nil {
+		return fmt.Errorf("config: %s: %v", c.path, err)
+	}
+	configLog.Infof("Reloaded %s", c.path)
+	return nil
+}
+
+// runtimeConfig holds values of reloadable flags by name, several for
+// repeatable flags.
+type runtimeConfig map[string][]string
+
+// flagConfig returns the reloadable flags' current values, queries being
+// those of -prometheus-query, or the default ones if there are none.
+func flagConfig(queries promQueries) runtimeConfig {
+	if len(queries) == 0 {
+		queries = defaultPromQueries
+	}
+	config := runtimeConfig{}
+	for name := range reloadableFlags {
+		if name != "prometheus-query" {
+			config[name] = []string{flag.Lookup(name).Value.String()}
+		}
+	}
+	for _, q := range queries {
+		config["prometheus-query"] = append(config["prometheus-query"], q.ID+"="+q.Query)
+	}
+	return config
+}
+
+// applyConfig applies values of reloadable flags, all of them or, if one
+// is invalid, none. Flags missing from values keep their value.
+func (p *Plugin) applyConfig(values runtimeConfig) error {
+	var (
+		queries    promQueries
+		thresholds map[string]threshold
+		critical   map[string]threshold
+		ranges     map[string]metricRange
+		formats    map[string]string
+		units      map[string]string
+		priorities map[string]float64
+		interval   time.Duration
+		poll       *time.Duration
+		level      *logrus.Level
+		err        error
+	)
+	for name, vs := range values {
+		if len(vs) == 0 {
+			continue
+		}
+		last := vs[len(vs)-1]
+		switch name {
+		case "prometheus-query":
+			for _, v := range vs {
+				if err := queries.Set(v); err != nil {
+					return err
+				}
+			}
+		case "thresholds":
+			if thresholds, err = parseThresholds(last); err != nil {
+				return err
+			}
+		case "critical-thresholds":
+			if critical, err = parseThresholds(last); err != nil {
+				return err
+			}
+		case "metric-ranges":
+			if ranges, err = parseMetricRanges(last); err != nil {
+				return err
+			}
+		case "metric-formats":
+			if formats, err = parseMetricFormats(last); err != nil {
+				return err
+			}
+		case "metric-units":
+			if units, err = parseMetricStrings(last, "metric unit", "metric=unit"); err != nil {
+				return err
+			}
+		case "cpu-priorities":
+			if priorities, err = parseCPUPriorities(last); err != nil {
+				return err
+			}
+		case "edge-interval":
+			if interval, err = time.ParseDuration(last); err != nil || interval <= 0 {
+				return fmt.Errorf("invalid edge-interval %q", last)
+			}
+		case "poll-interval":
+			d, err := time.ParseDuration(last)
+			if err != nil || d < 0 {
+				return fmt.Errorf("invalid poll-interval %q", last)
+			}
+			poll = &d
+		case "log-level":
+			l, err := parseLogLevel(last)
+			if err != nil {
+				return err
+			}
+			level = &l
+		default:
+			return fmt.Errorf("%s can't be changed at runtime", name)
+		}
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, collector := range p.collectors {
+		if t, ok := collector.(*throttledCollector); ok {
+			if interval > 0 {
+				t.setInterval(interval)
+			}
+			collector = t.Collector
+		}
+		if prom, ok := collector.(*prometheusCollector); ok && queries != nil {
+			prom.setQueries(queries)
+		}
+	}
+	if thresholds != nil || critical != nil {
+		if thresholds == nil {
+			thresholds = p.thresholds
+		}
+		if critical == nil {
+			critical = p.criticalThresholds
+		}
+		addDefaultThresholds(thresholds, critical, p.defaultThresholds)
+		p.thresholds, p.criticalThresholds = thresholds, critical
+	}
+	if ranges != nil {
+		p.metricRanges = ranges
+	}
+	if formats != nil {
+		p.metricFormats = formats
+	}
+	if units != nil {
+		p.metricUnits = units
+	}
+	if priorities != nil {
+		p.cpuPriorities = priorities
+	}
+	if poll != nil {
+		p.pollInterval = *poll
+	}
+	if level != nil {
+		logrus.SetLevel(*level)
+	}
+	if p.config == nil {
+		p.config = runtimeConfig{}
+	}
+	for name, vs := range values {
+		if len(vs) > 0 {
+			p.config[name] = append([]string{}, vs...)
+		}
+	}
+	p.reports.invalidate()
+	return nil
+}
+
+func (c *configReloader) watchSignals() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		if err := c.reload(); err != nil {
+			configLog.Error(err)
+		}
+	}
+}
+
+func (c *configReloader) serveReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST to reload the config file", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := c.reload(); err != nil {
+		configLog.Error(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	costVolumeTableID        = "cost-volume-table"
+	costVolumeTablePrefix    = "cost-volume-table-"
+	costNamespaceTableID     = "cost-namespace-table"
+	costNamespaceTablePrefix = "cost-namespace-table-"
+
+	hoursPerMonth = 730
+
+	defaultCostIOPSQuery = "sum by (openebs_pv) (OpenEBS_read_iops + OpenEBS_write_iops)"
+)
+
+func init() {
+	collectorFactories["cost"] = func(opts collectorOptions) (Collector, error) {
+		prom, err := newPrometheusCollector(opts.PrometheusURL, nil, opts.HTTPClient, nil)
+		if err != nil {
+			return nil, err
+		}
+		// Without Kubernetes, costs are still estimated per volume.
+		kube, err := newInClusterKubeClient()
+		if err != nil {
+			collectorLog("cost").Warnf("Cost estimation without namespaces: %v", err)
+		}
+		c := newCostEstimator(prom, kube, opts.PVShard, opts.Pricing)
+		go c.watch(opts.CostInterval)
+		return c, nil
+	}
+}
+
+// ioPricing are IO prices, such as cloud or chargeback rates.
+type ioPricing struct {
+	PerIOPSMonth    float64 // per sustained IOPS per month
+	PerGB           float64 // per GB (10⁹ bytes) transferred
+	IOPSQuery       string  // IOPS per volume
+	ThroughputQuery string  // bytes per second per volume; empty ignores throughput
+}
+
+// hourly returns the cost of an hour of IO at the given rates.
+func (p ioPricing) hourly(iops, bytesPerSec float64) float64 {
+	return iops*p.PerIOPSMonth/hoursPerMonth + bytesPerSec*3600/1e9*p.PerGB
+}
+
+type volumeCost struct {
+	PV, Namespace     string
+	IOPS, BytesPerSec float64
+	Hourly            float64
+}
+
+// costEstimator periodically estimates the IO cost of every volume, and of
+// every namespace from the claims of its volumes, from their current IO
+// rates.
+type costEstimator struct {
+	prom    *prometheusCollector
+	kube    *kubeClient
+	owns    func(key string) bool
+	pricing ioPricing
+
+	lock    sync.Mutex
+	volumes []volumeCost
+	err     error
+}
+
+func newCostEstimator(prom *prometheusCollector, kube *kubeClient, owns func(key string) bool, pricing ioPricing) *costEstimator {
+	return &costEstimator{prom: prom, kube: kube, owns: owns, pricing: pricing}
+}
+
+func (c *costEstimator) Name() string { return "cost" }
+
+func (c *costEstimator) watch(interval time.Duration) {
+	c.estimate(context.Background())
+	for range time.Tick(interval) {
+		c.estimate(context.Background())
+	}
+}
+
+func (c *costEstimator) estimate(ctx context.Context) {
+	volumes, err := c.volumeCosts(ctx)
+	if err != nil {
+		collectorLog(c.Name()).Error(err)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.err = err
+	if err == nil {
+		c.volumes = volumes
+	}
+}
+
+func (c *costEstimator) volumeCosts(ctx context.Context) ([]volumeCost, error) {
+	iops, err := c.prom.perVolume(ctx, c.pricing.IOPSQuery)
+	if err != nil {
+		return nil, err
+	}
+	throughput := map[string]float64{}
+	if c.pricing.ThroughputQuery != "" {
+		if throughput, err = c.prom.perVolume(ctx, c.pricing.ThroughputQuery); err != nil {
+			return nil, err
+		}
+	}
+	namespaces, err := c.claimNamespaces(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pvs := map[string]bool{}
+	for pv := range iops {
+		pvs[pv] = true
+	}
+	for pv := range throughput {
+		pvs[pv] = true
+	}
+	volumes := []volumeCost{}
+	for pv := range pvs {
+		if c.owns != nil && !c.owns(pv) {
+			continue
+		}
+		v := volumeCost{PV: pv, Namespace: namespaces[pv], IOPS: iops[pv], BytesPerSec: throughput[pv]}
+		v.Hourly = c.pricing.hourly(v.IOPS, v.BytesPerSec)
+		volumes = append(volumes, v)
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].PV < volumes[j].PV })
+	return volumes, nil
+}
+
+// claimNamespaces returns the namespace of the claim of every bound volume.
+func (c *costEstimator) claimNamespaces(ctx context.Context) (map[string]string, error) {
+	namespaces := map[string]string{}
+	if c.kube == nil {
+		return namespaces, nil
+	}
+	pvs, err := c.kube.persistentVolumes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cost: %w", err)
+	}
+	for name, pv := range pvs {
+		namespaces[name] = pv.Namespace
+	}
+	return namespaces, nil
+}
+
+// Collect only reports errors of the latest estimate; costs are shown as
+// tables.
+func (c *costEstimator) Collect(ctx context.Context) ([]Metric, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return nil, c.err
+}
+
+func costColumns() []column {
+	return []column{
+		{ID: "iops", Label: "IOPS", DataType: "number"},
+		{ID: "mb_s", Label: "MB/s", DataType: "number"},
+		{ID: "hourly", Label: "Cost/hour", DataType: "number"},
+		{ID: "monthly", Label: "Cost/month", DataType: "number"},
+	}
+}
+
+func costRow(iops, bytesPerSec, hourly float64) map[string]string {
+	return map[string]string{
+		"iops":    formatNumber(iops),
+		"mb_s":    formatNumber(bytesPerSec / 1e6),
+		"hourly":  formatNumber(hourly),
+		"monthly": formatNumber(hourly * hoursPerMonth),
+	}
+}
+
+func (c *costEstimator) Tables() []table {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	volumes := map[string]map[string]string{}
+	totals := map[string]*volumeCost{}
+	for _, v := range c.volumes {
+		row := costRow(v.IOPS, v.BytesPerSec, v.Hourly)
+		row["pv"], row["namespace"] = v.PV, v.Namespace
+		volumes[v.PV] = row
+		ns := v.Namespace
+		if ns == "" {
+			ns = "(unknown)"
+		}
+		if totals[ns] == nil {
+			totals[ns] = &volumeCost{Namespace: ns}
+		}
+		totals[ns].IOPS += v.IOPS
+		totals[ns].BytesPerSec += v.BytesPerSec
+		totals[ns].Hourly += v.Hourly
+	}
+	namespaces := map[string]map[string]string{}
+	for ns, t := range totals {
+		row := costRow(t.IOPS, t.BytesPerSec, t.Hourly)
+		row["namespace"] = ns
+		namespaces[ns] = row
+	}
+	return []table{
+		{
+			Template: tableTemplate{
+				ID:      costVolumeTableID,
+				Label:   "Estimated IO cost per volume",
+				Prefix:  costVolumeTablePrefix,
+				Type:    "multicolumn-table",
+				Columns: append([]column{{ID: "pv", Label: "Volume"}, {ID: "namespace", Label: "Namespace"}}, costColumns()...),
+			},
+			Rows: volumes,
+		},
+		{
+			Template: tableTemplate{
+				ID:      costNamespaceTableID,
+				Label:   "Estimated IO cost per namespace",
+				Prefix:  costNamespaceTablePrefix,
+				Type:    "multicolumn-table",
+				Columns: append([]column{{ID: "namespace", Label: "Namespace"}}, costColumns()...),
+			},
+			Rows: namespaces,
+		},
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// cpuStats holds the CPU utilisation percentages reported by iostat -c.
+type cpuStats struct {
+	User   float64
+	Nice   float64
+	System float64
+	IOWait float64
+	Steal  float64
+	Idle   float64
+}
+
+// A cpuSource returns the latest CPU utilisation percentages, giving up
+// once ctx is done if it has to wait, e.g. on a command.
+type cpuSource func(ctx context.Context) (cpuStats, error)
+
+// cpuFields are the CPU metrics, in iostat -c order. Their default
+// priorities put IO wait first.
+var cpuFields = []struct {
+	id, label string
+	priority  float64
+	value     func(cpuStats) float64
+}{
+	{"user", "User", 0.3, func(s cpuStats) float64 { return s.User }},
+	{"nice", "Nice", 0.5, func(s cpuStats) float64 { return s.Nice }},
+	{"system", "System", 0.4, func(s cpuStats) float64 { return s.System }},
+	{"iowait", "IO Wait", 0.1, func(s cpuStats) float64 { return s.IOWait }},
+	{"steal", "Steal", 0.6, func(s cpuStats) float64 { return s.Steal }},
+	{"idle", "Idle", 0.2, func(s cpuStats) float64 { return s.Idle }},
+}
+
+// cpuFieldIDs returns the IDs of the CPU metrics, in iostat -c order.
+func cpuFieldIDs() []string {
+	ids := []string{}
+	for _, field := range cpuFields {
+		ids = append(ids, field.id)
+	}
+	return ids
+}
+
+// cpuFieldIndex returns the index of a CPU field in cpuFields, or 0.
+func cpuFieldIndex(id string) int {
+	for i, field := range cpuFields {
+		if field.id == id {
+			return i
+		}
+	}
+	return 0
+}
+
+// parseCPUPriorities parses a comma separated list of field=priority pairs.
+func parseCPUPriorities(s string) (map[string]float64, error) {
+	priorities, err := parseFloats(s, "CPU priority", "field=priority")
+	if err != nil {
+		return nil, err
+	}
+	for field := range priorities {
+		if !isCPUMetric(field) {
+			return nil, fmt.Errorf("invalid CPU priority: unknown field %q (known: %s)", field, strings.Join(cpuFieldIDs(), ", "))
+		}
+	}
+	return priorities, nil
+}
+
+func isCPUMetric(id string) bool {
+	for _, field := range cpuFields {
+		if field.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// cpuCollector reports the CPU utilisation of the host.
+type cpuCollector struct {
+	source  string
+	scanCPU cpuSource
+	reset   func()
+}
+
+func newCPUCollector(source string, scanCPU cpuSource) *cpuCollector {
+	return &cpuCollector{source: source, scanCPU: faultyCPUSource(scanCPU)}
+}
+
+// newProcStatCollector reports the CPU utilisation derived by a procStat,
+// resetting its counters on reboot.
+func newProcStatCollector(source string, stats *procStat) *cpuCollector {
+	c := newCPUCollector(source, stats.cpuStats)
+	c.reset = stats.resetCounters
+	return c
+}
+
+func (c *cpuCollector) resetCounters() {
+	if c.reset != nil {
+		c.reset()
+	}
+}
+
+func (c *cpuCollector) Name() string { return "cpu" }
+
+func (c *cpuCollector) String() string { return "cpu=" + c.source }
+
+func (c *cpuCollector) Collect(ctx context.Context) ([]Metric, error) {
+	stats, err := c.scanCPU(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	metrics := []Metric{}
+	for _, field := range cpuFields {
+		metrics = append(metrics, Metric{
+			ID:       field.id,
+			Label:    field.label,
+			Format:   "percent",
+			Priority: field.priority,
+			Value:    field.value(stats),
+			Min:      0,
+			Max:      100,
+			Time:     now,
+		})
+	}
+	return metrics, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import "time"
+
+// How CPU metrics are shown (-cpu-display).
+const (
+	// cpuDisplayAll shows every CPU field at once.
+	cpuDisplayAll = "all"
+	// cpuDisplayToggle shows idle or IO wait, with controls to switch.
+	cpuDisplayToggle = "toggle"
+	// cpuDisplayCycle shows one CPU field, with a control moving to the
+	// next one.
+	cpuDisplayCycle = "cycle"
+
+	cycleCPUControlID = "cycleCPUField"
+
+	cpuSourceKey = "iowait_cpu_source"
+)
+
+func validCPUDisplay(display string) bool {
+	switch display {
+	case cpuDisplayAll, cpuDisplayToggle, cpuDisplayCycle:
+		return true
+	}
+	return false
+}
+
+// singleCPUMetric tells whether only one CPU field is shown at a time.
+func (p *Plugin) singleCPUMetric() bool {
+	return p.cpuDisplay != cpuDisplayAll
+}
+
+// recordCPUSample adds a CPU sample to the history of its field, so that
+// switching back to a field shows its graph again instead of starting
+// afresh, and returns that history.
+func (p *Plugin) recordCPUSample(id string, s sample) []sample {
+	history := p.cpuHistory[id]
+	if n := len(history); n == 0 || !history[n-1].Date.Equal(s.Date) {
+		history = append(history, s)
+	}
+	if over := len(history) - p.cpuHistoryLen; p.cpuHistoryLen > 0 && over > 0 {
+		history = append([]sample{}, history[over:]...)
+	}
+	p.cpuHistory[id] = history
+	return append([]sample{}, history...)
+}
+
+// shedMemory keeps only the latest sample of every CPU field, and forgets
+// the rolling maxima of metrics.
+func (p *Plugin) shedMemory() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.maxima != nil {
+		p.maxima.reset()
+	}
+	for id, history := range p.cpuHistory {
+		if n := len(history); n > 1 {
+			p.cpuHistory[id] = []sample{history[n-1]}
+		}
+	}
+}
+
+func (p *Plugin) cycleCPUControl() controlDetails {
+	next := cpuFields[(p.cpuField+1)%len(cpuFields)]
+	return controlDetails{
+		id:    cycleCPUControlID,
+		human: "Show " + next.label,
+		icon:  "fa-step-forward",
+	}
+}
+
+// addCPUSource shows the CPU source in use on the host node, so a fallback
+// from a missing iostat is visible in the Scope UI.
+func (p *Plugin) addCPUSource(rpt *report) {
+	if p.cpuSource == "" {
+		return
+	}
+	hostNodeID := p.getTopologyHost()
+	n := rpt.Host.Nodes[hostNodeID]
+	if n.Latest == nil {
+		n.Latest = map[string]stringEntry{}
+	}
+	n.Latest[cpuSourceKey] = stringEntry{Timestamp: time.Now(), Value: p.cpuSource}
+	rpt.Host.Nodes[hostNodeID] = n
+	if rpt.Host.MetadataTemplates == nil {
+		rpt.Host.MetadataTemplates = map[string]metadataTemplate{}
+	}
+	rpt.Host.MetadataTemplates[cpuSourceKey] = metadataTemplate{
+		ID:       cpuSourceKey,
+		Label:    "CPU source",
+		Priority: 30,
+		From:     "latest",
+	}
+}
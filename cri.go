@@ -0,0 +1,156 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+func init() {
+	collectorFactories["cri-stats"] = func(opts collectorOptions) (Collector, error) {
+		if _, err := exec.LookPath("crictl"); err != nil {
+			return nil, fmt.Errorf("cri-stats: %w", err)
+		}
+		return newCRIStats(opts.CRIEndpoint, opts.CommandTimeout), nil
+	}
+}
+
+// protoUint64 is a uint64 as the CRI API's JSON renders it: a string, or a
+// number in older crictl versions.
+type protoUint64 uint64
+
+func (v *protoUint64) UnmarshalJSON(raw []byte) error {
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		var n uint64
+		if err := json.Unmarshal(raw, &n); err != nil {
+			return err
+		}
+		*v = protoUint64(n)
+		return nil
+	}
+	n, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return err
+	}
+	*v = protoUint64(n)
+	return nil
+}
+
+// criFilesystemUsage is a CRI FilesystemUsage.
+type criFilesystemUsage struct {
+	UsedBytes struct {
+		Value protoUint64 `json:"value"`
+	} `json:"usedBytes"`
+	InodesUsed struct {
+		Value protoUint64 `json:"value"`
+	} `json:"inodesUsed"`
+}
+
+// criStats reports the disk usage of the container runtime through crictl:
+// the writable layer of every container on its container node, and the
+// image filesystem on the host node, so containers filling the node disk
+// stand out.
+type criStats struct {
+	endpoint string
+	timeout  time.Duration
+}
+
+func newCRIStats(endpoint string, timeout time.Duration) *criStats {
+	return &criStats{endpoint: endpoint, timeout: timeout}
+}
+
+func (c *criStats) Name() string { return "cri-stats" }
+
+// crictl runs crictl, against the configured runtime endpoint if any, and
+// decodes its JSON output.
+func (c *criStats) crictl(ctx context.Context, v interface{}, args ...string) error {
+	command := args[0]
+	if c.endpoint != "" {
+		args = append([]string{"--runtime-endpoint", c.endpoint}, args...)
+	}
+	out, err := commandOutput(ctx, c.timeout, "crictl", args...)
+	if err != nil {
+		return fmt.Errorf("cri-stats: %w", err)
+	}
+	if err := json.Unmarshal(out, v); err != nil {
+		return fmt.Errorf("cri-stats: crictl %s: %v", command, err)
+	}
+	return nil
+}
+
+func (c *criStats) Collect(ctx context.Context) ([]Metric, error) {
+	stats := struct {
+		Stats []struct {
+			Attributes struct {
+				ID string `json:"id"`
+			} `json:"attributes"`
+			WritableLayer *criFilesystemUsage `json:"writableLayer"`
+		} `json:"stats"`
+	}{}
+	if err := c.crictl(ctx, &stats, "stats", "--output", "json"); err != nil {
+		return nil, err
+	}
+	// Older runtimes report one image filesystem, newer ones a list of
+	// image and container filesystems.
+	fsInfo := struct {
+		Status struct {
+			criFilesystemUsage
+			ImageFilesystems []criFilesystemUsage `json:"imageFilesystems"`
+		} `json:"status"`
+	}{}
+	if err := c.crictl(ctx, &fsInfo, "imagefsinfo", "--output", "json"); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	metrics := []Metric{}
+	for _, s := range stats.Stats {
+		if s.WritableLayer == nil {
+			continue
+		}
+		metrics = append(metrics, Metric{
+			ID:       "container_writable_layer_bytes",
+			Label:    "Writable layer",
+			Format:   "filesize",
+			Priority: 11,
+			Value:    float64(s.WritableLayer.UsedBytes.Value),
+			Time:     now,
+			Topology: containerTopologyID,
+			NodeID:   fmt.Sprintf("%s;<container>", s.Attributes.ID),
+		})
+	}
+	imageFilesystems := fsInfo.Status.ImageFilesystems
+	if len(imageFilesystems) == 0 {
+		imageFilesystems = []criFilesystemUsage{fsInfo.Status.criFilesystemUsage}
+	}
+	var used, inodes float64
+	for _, fs := range imageFilesystems {
+		used += float64(fs.UsedBytes.Value)
+		inodes += float64(fs.InodesUsed.Value)
+	}
+	metrics = append(metrics,
+		Metric{
+			ID:       "image_fs_used_bytes",
+			Label:    "Image filesystem used",
+			Format:   "filesize",
+			Priority: 26,
+			Value:    used,
+			Time:     now,
+		},
+		Metric{
+			ID:       "image_fs_inodes_used",
+			Label:    "Image filesystem inodes used",
+			Format:   "integer",
+			Priority: 26.1,
+			Value:    inodes,
+			Time:     now,
+		},
+	)
+	return metrics, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// claimVolumesMaxAge is how long the volumes bound to claims are cached.
+const claimVolumesMaxAge = time.Minute
+
+// kubeletVolumeStats are the kubelet's volume metrics, which cover every CSI
+// volume mounted on the node.
+var kubeletVolumeStats = map[string]bool{
+	"kubelet_volume_stats_capacity_bytes": true,
+	"kubelet_volume_stats_used_bytes":     true,
+	"kubelet_volume_stats_inodes":         true,
+	"kubelet_volume_stats_inodes_used":    true,
+}
+
+func init() {
+	collectorFactories["csi-volumes"] = func(opts collectorOptions) (Collector, error) {
+		kubelet, err := newKubeletClient(opts.KubeletURL, opts.KubeletInsecureTLS)
+		if err != nil {
+			return nil, err
+		}
+		kube, err := newInClusterKubeClient()
+		if err != nil {
+			return nil, err
+		}
+		return newCSIVolumeStats(kubelet, kube), nil
+	}
+}
+
+// csiVolumeStats reports the capacity and usage of the volumes mounted on
+// the node from the kubelet_volume_stats_* metrics of the kubelet, so that
+// volumes of any CSI driver, not just OpenEBS, are shown. The metrics are
+// by claim and reported, like the Prometheus ones, by volume.
+type csiVolumeStats struct {
+	kubelet *kubeClient
+	kube    *kubeClient
+
+	lock    sync.Mutex
+	volumes map[string]string // namespace/claim → volume
+	fetched time.Time
+}
+
+func newCSIVolumeStats(kubelet, kube *kubeClient) *csiVolumeStats {
+	return &csiVolumeStats{kubelet: kubelet, kube: kube}
+}
+
+func (c *csiVolumeStats) Name() string { return "csi-volumes" }
+
+// claimVolumes returns the volumes bound to claims, by namespace/claim,
+// keeping the previous ones should they not be refreshed.
+func (c *csiVolumeStats) claimVolumes(ctx context.Context) map[string]string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if time.Since(c.fetched) > claimVolumesMaxAge {
+		pvs, err := c.kube.persistentVolumes(ctx)
+		if err != nil {
+			collectorLog(c.Name()).Warnf("Cannot map claims to volumes: %v", err)
+		} else {
+			c.volumes = map[string]string{}
+			for name, pv := range pvs {
+				if pv.Claim != "" {
+					c.volumes[pv.Namespace+"/"+pv.Claim] = name
+				}
+			}
+			c.fetched = time.Now()
+		}
+	}
+	return c.volumes
+}
+
+func (c *csiVolumeStats) Collect(ctx context.Context) ([]Metric, error) {
+	raw, err := c.kubelet.getText(ctx, "/metrics")
+	if err != nil {
+		return nil, fmt.Errorf("csi-volumes: %w", err)
+	}
+	now := time.Now()
+	samples, err := parseExposition(raw, kubeletVolumeStats)
+	if err != nil {
+		return nil, fmt.Errorf("csi-volumes: %v", err)
+	}
+	stats := map[string]map[string]float64{}
+	for _, s := range samples {
+		claim := s.Labels["namespace"] + "/" + s.Labels["persistentvolumeclaim"]
+		if stats[claim] == nil {
+			stats[claim] = map[string]float64{}
+		}
+		stats[claim][s.Name] = s.Value
+	}
+	volumes := c.claimVolumes(ctx)
+	claims := []string{}
+	for claim := range stats {
+		claims = append(claims, claim)
+	}
+	sort.Strings(claims)
+	metrics := []Metric{}
+	for _, claim := range claims {
+		pv, ok := volumes[claim]
+		if !ok {
+			collectorLog(c.Name()).Debugf("No volume bound to claim %s", claim)
+			continue
+		}
+		s := stats[claim]
+		capacity, used := s["kubelet_volume_stats_capacity_bytes"], s["kubelet_volume_stats_used_bytes"]
+		metrics = append(metrics, Metric{
+			ID:       "csi_used_bytes_" + pv,
+			Label:    pv + " used",
+			Format:   "filesize",
+			Priority: 25,
+			Value:    used,
+			Max:      capacity,
+			Time:     now,
+		})
+		if capacity > 0 {
+			metrics = append(metrics, Metric{
+				ID:       "csi_used_percent_" + pv,
+				Label:    pv + " used %",
+				Format:   "percent",
+				Priority: 25.1,
+				Value:    100 * used / capacity,
+				Max:      100,
+				Time:     now,
+			})
+		}
+		if inodes := s["kubelet_volume_stats_inodes"]; inodes > 0 {
+			metrics = append(metrics, Metric{
+				ID:       "csi_inodes_used_percent_" + pv,
+				Label:    pv + " inodes used %",
+				Format:   "percent",
+				Priority: 25.2,
+				Value:    100 * s["kubelet_volume_stats_inodes_used"] / inodes,
+				Max:      100,
+				Time:     now,
+			})
+		}
+	}
+	return metrics, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// cstorTargetSelector selects the cStor target pods, labelled with the
+	// volume they serve.
+	cstorTargetSelector = "openebs.io/target=cstor-target"
+	cstorPVLabel        = "openebs.io/persistent-volume"
+)
+
+func init() {
+	collectorFactories["cstor"] = func(opts collectorOptions) (Collector, error) {
+		kube, err := newInClusterKubeClient()
+		if err != nil {
+			return nil, err
+		}
+		return newCStorTargets(kube, opts.CStorExporterPort, opts.PVShard, opts.InstanceHosts), nil
+	}
+}
+
+// cstorCounters are the cumulative IO counters of a cStor volume, as its
+// target's maya-exporter reports them.
+type cstorCounters struct {
+	reads, writes, readBytes, writeBytes float64
+}
+
+// cstorExporterMetrics are the exporter series the counters are read from.
+var cstorExporterMetrics = map[string]bool{
+	"openebs_reads":             true,
+	"openebs_writes":            true,
+	"openebs_total_read_bytes":  true,
+	"openebs_total_write_bytes": true,
+}
+
+// cstorTargets reads the IO of cStor volumes straight from the exporters
+// of their target pods, found through the Kubernetes API, for clusters
+// without Prometheus or Cortex. The IOPS are reported under the same IDs
+// as the default Prometheus queries, e.g. write_iops_<pv>. With owns set,
+// only the volumes it owns are reported; with hosts set, volumes are
+// reported on the host node of their target pod.
+type cstorTargets struct {
+	kube   *kubeClient
+	port   int
+	owns   func(key string) bool
+	hosts  *instanceHosts
+	client *http.Client
+
+	lock     sync.Mutex
+	prev     map[string]cstorCounters
+	prevTime time.Time
+}
+
+func newCStorTargets(kube *kubeClient, port int, owns func(key string) bool, hosts *instanceHosts) *cstorTargets {
+	return &cstorTargets{
+		kube:   kube,
+		port:   port,
+		owns:   owns,
+		hosts:  hosts,
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (c *cstorTargets) Name() string { return "cstor" }
+
+func (c *cstorTargets) resetCounters() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.prev = nil
+}
+
+// scrape reads the counters of the volume served by a target pod.
+func (c *cstorTargets) scrape(ctx context.Context, pod kubePod) (cstorCounters, error) {
+	exporter := &kubeClient{host: "http://" + net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(c.port)), client: c.client}
+	raw, err := exporter.getText(ctx, "/metrics")
+	if err != nil {
+		return cstorCounters{}, err
+	}
+	samples, err := parseExposition(raw, cstorExporterMetrics)
+	if err != nil {
+		return cstorCounters{}, err
+	}
+	counters := cstorCounters{}
+	for _, s := range samples {
+		switch s.Name {
+		case "openebs_reads":
+			counters.reads = s.Value
+		case "openebs_writes":
+			counters.writes = s.Value
+		case "openebs_total_read_bytes":
+			counters.readBytes = s.Value
+		case "openebs_total_write_bytes":
+			counters.writeBytes = s.Value
+		}
+	}
+	return counters, nil
+}
+
+func (c *cstorTargets) Collect(ctx context.Context) ([]Metric, error) {
+	pods, err := c.kube.runningPods(ctx, cstorTargetSelector)
+	if err != nil {
+		return nil, fmt.Errorf("cstor: %v", err)
+	}
+	cur := map[string]cstorCounters{}
+	nodeIDs := map[string]string{}
+	for _, pod := range pods {
+		pv := pod.Metadata.Labels[cstorPVLabel]
+		if pv == "" || pod.Status.PodIP == "" || c.owns != nil && !c.owns(pv) {
+			continue
+		}
+		counters, err := c.scrape(ctx, pod)
+		if err != nil {
+			collectorLog(c.Name()).Debugf("Target %s/%s: %v", pod.Metadata.Namespace, pod.Metadata.Name, err)
+			continue
+		}
+		cur[pv] = counters
+		if c.hosts != nil {
+			if host, ok := c.hosts.host(ctx, pod.Spec.NodeName); ok {
+				nodeIDs[pv] = hostNodeID(host)
+			}
+		}
+	}
+	now := time.Now()
+	c.lock.Lock()
+	prev, elapsed := c.prev, now.Sub(c.prevTime).Seconds()
+	c.prev, c.prevTime = cur, now
+	c.lock.Unlock()
+
+	pvs := []string{}
+	for pv := range cur {
+		pvs = append(pvs, pv)
+	}
+	sort.Strings(pvs)
+	metrics := []Metric{}
+	for _, pv := range pvs {
+		cc, p := cur[pv], prev[pv]
+		if _, ok := prev[pv]; !ok {
+			continue
+		}
+		for j, m := range []struct {
+			id, label, format string
+			cur, prev         float64
+		}{
+			{"read_iops", "read IOPS", "", cc.reads, p.reads},
+			{"write_iops", "write IOPS", "", cc.writes, p.writes},
+			{"read_bytes", "read bytes/s", "filesize", cc.readBytes, p.readBytes},
+			{"write_bytes", "write bytes/s", "filesize", cc.writeBytes, p.writeBytes},
+		} {
+			// A restarted target starts its counters over.
+			value, ok := counterRate(m.cur, m.prev, elapsed)
+			if !ok {
+				continue
+			}
+			metrics = append(metrics, Metric{
+				ID:       m.id + "_" + pv,
+				Label:    pv + " " + m.label,
+				Format:   m.format,
+				Priority: 20 + float64(j)/10,
+				Value:    value,
+				Min:      0,
+				Max:      value,
+				Time:     now,
+				NodeID:   nodeIDs[pv],
+			})
+		}
+	}
+	return metrics, nil
+}
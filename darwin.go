@@ -0,0 +1,135 @@
+//go:build darwin
+// +build darwin
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// On macOS, for local development against a local Scope, CPU statistics
+// come from a long running `iostat -w 1` and block device statistics from
+// gopsutil.
+
+const (
+	defaultCPUSource  = "iostat"
+	defaultDiskSource = "gopsutil"
+
+	// iostatRestartDelay is how long to wait before restarting iostat
+	// after it exited.
+	iostatRestartDelay = 5 * time.Second
+)
+
+func init() {
+	cpuSources = append(cpuSources, "iostat")
+	collectorFactories["iostat"] = func(opts collectorOptions) (Collector, error) {
+		return newCPUCollector("iostat", newIostatStream().cpuStats), nil
+	}
+}
+
+// iostatStream keeps the latest CPU utilisation printed every second by
+// the macOS iostat. Like on Linux, the first line covers the time since
+// boot.
+type iostatStream struct {
+	once  sync.Once
+	ready chan struct{}
+
+	lock    sync.Mutex
+	last    cpuStats
+	err     error
+	sampled bool
+}
+
+func newIostatStream() *iostatStream {
+	return &iostatStream{ready: make(chan struct{})}
+}
+
+func (s *iostatStream) cpuStats(ctx context.Context) (cpuStats, error) {
+	s.once.Do(func() { go s.run() })
+	select {
+	case <-s.ready:
+	case <-time.After(2 * time.Second):
+	case <-ctx.Done():
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.sampled && s.err == nil {
+		return cpuStats{}, fmt.Errorf("iowait: no iostat output yet")
+	}
+	return s.last, s.err
+}
+
+// run runs iostat, restarting it whenever it exits.
+func (s *iostatStream) run() {
+	for {
+		err := s.stream()
+		s.lock.Lock()
+		s.err = err
+		s.lock.Unlock()
+		s.markReady()
+		time.Sleep(iostatRestartDelay)
+	}
+}
+
+func (s *iostatStream) markReady() {
+	select {
+	case <-s.ready:
+	default:
+		close(s.ready)
+	}
+}
+
+func (s *iostatStream) stream() error {
+	cmd := exec.Command("iostat", "-C", "-w", "1")
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("iowait: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("iowait: %w", err)
+	}
+
+	//               disk0       cpu    load average
+	//     KB/t  tps  MB/s  us sy id   1m   5m   15m
+	//    25.44   24  0.60   5  3 92  1.94 1.95 1.90
+	user := -1
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		for i, field := range fields {
+			if field == "us" {
+				user = i
+			}
+		}
+		if user < 0 || len(fields) < user+3 {
+			continue
+		}
+		values := make([]float64, 3)
+		for i := range values {
+			if values[i], err = strconv.ParseFloat(fields[user+i], 64); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			// A (repeated) header line.
+			continue
+		}
+		s.lock.Lock()
+		s.last = cpuStats{User: values[0], System: values[1], Idle: values[2]}
+		s.err = nil
+		s.sampled = true
+		s.lock.Unlock()
+		s.markReady()
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("iowait: iostat: %w", err)
+	}
+	return fmt.Errorf("iowait: iostat exited")
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// A debugStater exposes internal state for diagnostic dumps, e.g. the
+// latest responses of an external API.
+type debugStater interface {
+	debugState() interface{}
+}
+
+// collectDebug records what the latest collection returned, for the
+// diagnostic dump, and when the collections in progress started. It is
+// locked on its own, since collections run without p.lock.
+type collectDebug struct {
+	lock    sync.Mutex
+	time    time.Time
+	metrics []Metric
+	errors  map[string]string
+	// succeeded is when a collection last had no errors.
+	succeeded time.Time
+
+	running map[int]time.Time
+	next    int
+}
+
+// begin notes a collection starting, and returns the token to record it
+// with.
+func (d *collectDebug) begin() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.running == nil {
+		d.running = map[int]time.Time{}
+	}
+	d.next++
+	d.running[d.next] = time.Now()
+	return d.next
+}
+
+// runningFor returns how long the oldest collection in progress has been
+// running, 0 if none is.
+func (d *collectDebug) runningFor() time.Duration {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	var longest time.Duration
+	for _, started := range d.running {
+		if age := time.Since(started); age > longest {
+			longest = age
+		}
+	}
+	return longest
+}
+
+func (d *collectDebug) record(token int, metrics []Metric, errors map[string]string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.running, token)
+	d.time, d.metrics, d.errors = time.Now(), metrics, errors
+	if len(errors) == 0 {
+		d.succeeded = d.time
+	}
+}
+
+// debugDump is everything needed to debug e.g. "why is my graph empty"
+// from the field.
+type debugDump struct {
+	Time            time.Time              `json:"time"`
+	Host            string                 `json:"host"`
+	Inventory       string                 `json:"inventory"`
+	Controls        pluginState            `json:"controls"`
+	CollectedAt     time.Time              `json:"collectedAt"`
+	Metrics         []Metric               `json:"metrics"`
+	CollectorErrors map[string]string      `json:"collectorErrors"`
+	Collectors      map[string]interface{} `json:"collectors"`
+	Notifications   interface{}            `json:"notifications,omitempty"`
+}
+
+// dumpState gathers the diagnostic dump. The caller holds p.lock.
+func (p *Plugin) dumpState() debugDump {
+	state := p.snapshotState()
+	state.CPUHistory, state.Baselines = nil, nil
+	dump := debugDump{
+		Time:       time.Now(),
+		Host:       p.HostID,
+		Inventory:  p.inventory(),
+		Controls:   state,
+		Collectors: map[string]interface{}{},
+	}
+	p.lastCollect.lock.Lock()
+	dump.CollectedAt, dump.Metrics, dump.CollectorErrors = p.lastCollect.time, p.lastCollect.metrics, p.lastCollect.errors
+	p.lastCollect.lock.Unlock()
+	for _, c := range p.collectors {
+		if t, ok := c.(*throttledCollector); ok {
+			c = t.Collector
+		}
+		if d, ok := c.(debugStater); ok {
+			dump.Collectors[c.Name()] = d.debugState()
+		}
+	}
+	if p.notifier != nil {
+		dump.Notifications = p.notifier.debugState()
+	}
+	return dump
+}
+
+// logState logs the diagnostic dump as JSON.
+func (p *Plugin) logState() {
+	p.lock.Lock()
+	dump := p.dumpState()
+	p.lock.Unlock()
+	raw, err := json.Marshal(dump)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	log.Infof("State: %s", raw)
+}
+
+// serveDebugState returns the diagnostic dump on /debug/state.
+func (p *Plugin) serveDebugState(w http.ResponseWriter, r *http.Request) {
+	p.lock.Lock()
+	dump := p.dumpState()
+	p.lock.Unlock()
+	writeJSON(w, dump)
+}
+
+// watchDebugSignal logs the diagnostic dump on every debug signal.
+func (p *Plugin) watchDebugSignal() {
+	signals := make(chan os.Signal, 1)
+	if !notifyDebugSignal(signals) {
+		return
+	}
+	for range signals {
+		p.logState()
+	}
+}
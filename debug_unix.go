@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyDebugSignal relays SIGUSR1, which asks for a diagnostic dump.
+func notifyDebugSignal(c chan os.Signal) bool {
+	signal.Notify(c, syscall.SIGUSR1)
+	return true
+}
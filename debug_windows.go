@@ -0,0 +1,6 @@
+package main
+
+import "os"
+
+// Windows has no SIGUSR1; use /debug/state instead.
+func notifyDebugSignal(c chan os.Signal) bool { return false }
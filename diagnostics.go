@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"time"
+)
+
+const (
+	diagnosticErrorKey       = "iowait_error"
+	diagnosticRemediationKey = "iowait_remediation"
+)
+
+// remediation suggests how to fix the error that kept the plugin from
+// producing any metrics.
+func remediation(err error) string {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return "iostat did not finish in time: check the host is not overloaded, raise -command-timeout, or run the plugin with -cpu-source=proc."
+	case errors.Is(err, exec.ErrNotFound):
+		return "iostat is not installed: install sysstat in the plugin image, or run the plugin with -cpu-source=proc."
+	case errors.Is(err, os.ErrPermission):
+		return "The plugin cannot read host statistics: run the container privileged, or with read access to /proc."
+	case errors.Is(err, os.ErrNotExist):
+		return "Host statistics are missing: make sure /proc is mounted in the plugin container."
+	}
+	return "Check the plugin logs for details, and run the plugin with -cpu-source=proc if iostat output cannot be parsed."
+}
+
+// diagnosticReport is served instead of a report when no metrics could be
+// collected, so the problem and how to fix it show up in the Scope UI
+// rather than only in the plugin logs.
+func (p *Plugin) diagnosticReport(err error) *report {
+	ts := time.Now()
+	rpt := &report{
+		Host: topology{
+			Nodes: map[string]node{
+				p.getTopologyHost(): {
+					Latest: map[string]stringEntry{
+						diagnosticErrorKey:       {Timestamp: ts, Value: err.Error()},
+						diagnosticRemediationKey: {Timestamp: ts, Value: remediation(err)},
+					},
+				},
+			},
+			MetadataTemplates: map[string]metadataTemplate{
+				diagnosticErrorKey: {
+					ID:       diagnosticErrorKey,
+					Label:    "IOWait plugin error",
+					Priority: 1,
+					From:     "latest",
+				},
+				diagnosticRemediationKey: {
+					ID:       diagnosticRemediationKey,
+					Label:    "IOWait plugin remediation",
+					Priority: 1.1,
+					From:     "latest",
+				},
+			},
+		},
+		Plugins: []pluginSpec{p.spec()},
+	}
+	return rpt
+}
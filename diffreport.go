@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reportDiffBases is how many recent reports deltas can be computed from.
+const reportDiffBases = 8
+
+// reportDelta is what /report?since=<etag> returns when the report
+// changed since the one with that ETag: the JSON Pointers (RFC 6901) of
+// the values set or removed since. Arrays, such as metric samples, are
+// replaced whole.
+type reportDelta struct {
+	Since   string                     `json:"since"`
+	ETag    string                     `json:"etag"`
+	Set     map[string]json.RawMessage `json:"set,omitempty"`
+	Removed []string                   `json:"removed,omitempty"`
+}
+
+// flatReport is a report flattened to its leaves by JSON Pointer, each
+// with its raw value and its material value, i.e. without timestamps.
+type flatReport map[string]struct{ raw, material []byte }
+
+// reportDiffer serves reports with an ETag over their material content,
+// so that probes on bandwidth constrained nodes can ask for
+// /report?since=<etag> and get a 304 when nothing but timestamps changed,
+// or a reportDelta. A full report is still sent every fullEvery.
+type reportDiffer struct {
+	fullEvery time.Duration
+
+	lock     sync.Mutex
+	bases    map[string]flatReport
+	order    []string
+	lastFull time.Time
+}
+
+func newReportDiffer(fullEvery time.Duration) *reportDiffer {
+	return &reportDiffer{fullEvery: fullEvery, bases: map[string]flatReport{}}
+}
+
+// flattenReport flattens a marshalled report and returns its ETag.
+func flattenReport(raw []byte) (flatReport, string, error) {
+	var doc interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, "", err
+	}
+	flat := flatReport{}
+	if err := flat.add("", doc); err != nil {
+		return nil, "", err
+	}
+	etag, err := materialETag(doc)
+	if err != nil {
+		return nil, "", err
+	}
+	return flat, etag, nil
+}
+
+func (f flatReport) add(path string, v interface{}) error {
+	if m, ok := v.(map[string]interface{}); ok && len(m) > 0 && !timestamped(m) {
+		for k, child := range m {
+			if err := f.add(path+"/"+strings.NewReplacer("~", "~0", "/", "~1").Replace(k), child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	material, err := json.Marshal(withoutTimes(v))
+	if err != nil {
+		return err
+	}
+	f[path] = struct{ raw, material []byte }{raw, material}
+	return nil
+}
+
+func timestamped(m map[string]interface{}) bool {
+	_, date := m["date"]
+	_, timestamp := m["timestamp"]
+	return date || timestamp
+}
+
+// withoutTimes drops the timestamps of samples and latest entries, which
+// change on every report.
+func withoutTimes(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := map[string]interface{}{}
+		for k, child := range v {
+			if k != "date" && k != "timestamp" {
+				m[k] = withoutTimes(child)
+			}
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, child := range v {
+			l[i] = withoutTimes(child)
+		}
+		return l
+	}
+	return v
+}
+
+func (d *reportDiffer) remember(etag string, flat flatReport) {
+	if _, ok := d.bases[etag]; ok {
+		return
+	}
+	d.bases[etag] = flat
+	d.order = append(d.order, etag)
+	if len(d.order) > reportDiffBases {
+		delete(d.bases, d.order[0])
+		d.order = d.order[1:]
+	}
+}
+
+// serve writes a marshalled report, as a 304 or a delta if the request
+// asks for one since a recent report.
+func (d *reportDiffer) serve(w http.ResponseWriter, r *http.Request, raw []byte) {
+	flat, etag, err := flattenReport(raw)
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusOK)
+		w.Write(raw)
+		return
+	}
+	since := strings.Trim(strings.TrimPrefix(r.URL.Query().Get("since"), "W/"), `"`)
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	base, known := d.bases[since]
+	d.remember(etag, flat)
+	w.Header().Set("ETag", `W/"`+etag+`"`)
+	match := r.Header.Get("If-None-Match")
+	switch {
+	case match != "" && etagMatches(match, etag):
+		w.WriteHeader(http.StatusNotModified)
+	case since == "" || !known || time.Since(d.lastFull) >= d.fullEvery:
+		d.lastFull = time.Now()
+		w.WriteHeader(http.StatusOK)
+		w.Write(raw)
+	case since == etag:
+		w.WriteHeader(http.StatusNotModified)
+	default:
+		delta := reportDelta{Since: since, ETag: etag, Set: map[string]json.RawMessage{}}
+		for path, leaf := range flat {
+			if old, ok := base[path]; !ok || string(old.material) != string(leaf.material) {
+				delta.Set[path] = leaf.raw
+			}
+		}
+		for path := range base {
+			if _, ok := flat[path]; !ok {
+				delta.Removed = append(delta.Removed, path)
+			}
+		}
+		sort.Strings(delta.Removed)
+		w.Header().Set("X-Report-Delta", "true")
+		writeJSON(w, delta)
+	}
+}
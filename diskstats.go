@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	diskTableID     = "disk-table"
+	diskTablePrefix = "disk-table-"
+)
+
+// diskCounters are the cumulative counters of one /proc/diskstats line.
+// See https://www.kernel.org/doc/Documentation/iostats.txt
+type diskCounters struct {
+	reads, readsMerged, sectorsRead, readTicks       float64
+	writes, writesMerged, sectorsWritten, writeTicks float64
+	inFlight, ioTicks, weightedTicks                 float64
+}
+
+type diskSample struct {
+	time    time.Time
+	devices map[string]diskCounters
+}
+
+// diskRates are the per-second rates of one block device between two
+// /proc/diskstats samples.
+type diskRates struct {
+	Device               string
+	ReadIOPS             float64
+	WriteIOPS            float64
+	SectorsReadPerSec    float64
+	SectorsWrittenPerSec float64
+	InFlight             float64
+
+	// Extended statistics, as reported by iostat -x.
+	ReadMergedPerSec  float64
+	WriteMergedPerSec float64
+	ReadAwait         float64 // ms
+	WriteAwait        float64 // ms
+	Await             float64 // ms
+	Svctm             float64 // ms
+	Util              float64 // percent
+	AvgQueueSize      float64
+}
+
+// A diskRater returns the per-device IO rates since its previous call.
+type diskRater interface {
+	rates() ([]diskRates, error)
+	sourceName() string
+}
+
+// diskStats reports per-device IO rates from cumulative counters, such as
+// those of /proc/diskstats. Like iostat, the first reading covers
+// the time since boot and every following reading covers the time since
+// the previous one.
+type diskStats struct {
+	source string
+	read   func() (*diskSample, error)
+	boot   func() (time.Time, error)
+
+	lock sync.Mutex
+	prev *diskSample
+}
+
+func (d *diskStats) sourceName() string { return d.source }
+
+// resetCounters makes the next reading cover the time since boot again.
+func (d *diskStats) resetCounters() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.prev = nil
+}
+
+func (d *diskStats) rates() ([]diskRates, error) {
+	cur, err := d.read()
+	if err != nil {
+		return nil, err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	prev := d.prev
+	if prev == nil {
+		boot, err := d.boot()
+		if err != nil {
+			return nil, err
+		}
+		prev = &diskSample{time: boot}
+	}
+	elapsed := cur.time.Sub(prev.time).Seconds()
+	if elapsed <= 0 {
+		return nil, fmt.Errorf("diskstats: no time elapsed since the previous sample")
+	}
+	d.prev = cur
+
+	rates := []diskRates{}
+	for device, c := range cur.devices {
+		p := prev.devices[device]
+		// Counters only go backwards if they wrapped or the device was
+		// replaced; start afresh.
+		if c.reads < p.reads || c.writes < p.writes {
+			p = diskCounters{}
+		}
+		reads, writes := c.reads-p.reads, c.writes-p.writes
+		readTicks, writeTicks := c.readTicks-p.readTicks, c.writeTicks-p.writeTicks
+		ioTicks := c.ioTicks - p.ioTicks
+		elapsedMs := elapsed * 1000
+		rates = append(rates, diskRates{
+			Device:               device,
+			ReadIOPS:             reads / elapsed,
+			WriteIOPS:            writes / elapsed,
+			SectorsReadPerSec:    (c.sectorsRead - p.sectorsRead) / elapsed,
+			SectorsWrittenPerSec: (c.sectorsWritten - p.sectorsWritten) / elapsed,
+			InFlight:             c.inFlight,
+			ReadMergedPerSec:     (c.readsMerged - p.readsMerged) / elapsed,
+			WriteMergedPerSec:    (c.writesMerged - p.writesMerged) / elapsed,
+			ReadAwait:            ratio(readTicks, reads),
+			WriteAwait:           ratio(writeTicks, writes),
+			Await:                ratio(readTicks+writeTicks, reads+writes),
+			Svctm:                ratio(ioTicks, reads+writes),
+			Util:                 math.Min(100, 100*ioTicks/elapsedMs),
+			AvgQueueSize:         (c.weightedTicks - p.weightedTicks) / elapsedMs,
+		})
+	}
+	sort.Slice(rates, func(i, j int) bool { return rates[i].Device < rates[j].Device })
+	return rates, nil
+}
+
+func ratio(a, b float64) float64 {
+	if b == 0 {
+		return 0
+	}
+	return a / b
+}
+
+// deviceMount is where a block device is mounted, and how full its
+// filesystem is.
+type deviceMount struct {
+	Mountpoint string
+	FSType     string
+	Used, Size uint64
+}
+
+// deviceMounts maps block devices to their mounts, by device name, where
+// the platform supports it.
+var deviceMounts func() (map[string]deviceMount, error)
+
+// localPVDevices maps block devices to the local volumes among pvs that
+// live on them on this host, by device name, where the platform supports
+// it.
+var localPVDevices func(pvs map[string]persistentVolume) map[string][]string
+
+// localPVsMaxAge is how long the volumes are cached for.
+const localPVsMaxAge = time.Minute
+
+func diskTableTemplate(withMounts bool) tableTemplate {
+	tmpl := tableTemplate{
+		ID:     diskTableID,
+		Label:  "Block devices",
+		Prefix: diskTablePrefix,
+		Type:   "multicolumn-table",
+		Columns: []column{
+			{ID: "device", Label: "Device"},
+			{ID: "r_iops", Label: "Read IOPS", DataType: "number"},
+			{ID: "w_iops", Label: "Write IOPS", DataType: "number"},
+			{ID: "rsec_s", Label: "Sectors read/s", DataType: "number"},
+			{ID: "wsec_s", Label: "Sectors written/s", DataType: "number"},
+			{ID: "in_flight", Label: "In-flight", DataType: "number"},
+		},
+	}
+	if withMounts {
+		tmpl.Columns = append(tmpl.Columns,
+			column{ID: "mountpoint", Label: "Mountpoint"},
+			column{ID: "fstype", Label: "Filesystem"},
+			column{ID: "used", Label: "Used"},
+		)
+	}
+	return tmpl
+}
+
+func formatNumber(v float64) string {
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
+
+// extendedDiskMetrics are the iostat -x style statistics reported as
+// per-device metrics when extended diskstats are enabled.
+var extendedDiskMetrics = []struct {
+	id, label, format string
+	max               float64
+	value             func(diskRates) float64
+}{
+	{"util", "%util", "percent", 100, func(r diskRates) float64 { return r.Util }},
+	{"await", "await (ms)", "", 0, func(r diskRates) float64 { return r.Await }},
+	{"r_await", "r_await (ms)", "", 0, func(r diskRates) float64 { return r.ReadAwait }},
+	{"w_await", "w_await (ms)", "", 0, func(r diskRates) float64 { return r.WriteAwait }},
+	{"svctm", "svctm (ms)", "", 0, func(r diskRates) float64 { return r.Svctm }},
+	{"aqu_sz", "avg queue size", "", 0, func(r diskRates) float64 { return r.AvgQueueSize }},
+	{"rrqm_s", "read merges/s", "", 0, func(r diskRates) float64 { return r.ReadMergedPerSec }},
+	{"wrqm_s", "write merges/s", "", 0, func(r diskRates) float64 { return r.WriteMergedPerSec }},
+}
+
+func diskMetricID(device, stat string) string {
+	return "disk_" + device + "_" + stat
+}
+
+// diskCollector shows the block devices table and, if extended, reports
+// the iostat -x style statistics of every device as metrics. With lvm, it
+// also reports the IOPS and throughput of LVM logical volumes, which the
+// table always names after their VG and LV rather than dm-N. With kube
+// set, it reports those of the device backing every local volume on this
+// host, such as OpenEBS LocalPV ones, as the volume's, since no target
+// exports their IO.
+type diskCollector struct {
+	stats    diskRater
+	extended bool
+	lvm      bool
+	kube     *kubeClient
+
+	lock       sync.Mutex
+	rates      []diskRates
+	mounts     map[string]deviceMount
+	volumes    map[string]logicalVolume
+	pvs        map[string]persistentVolume
+	pvsFetched time.Time
+}
+
+func newDiskCollector(stats diskRater, extended, lvm bool, kube *kubeClient) *diskCollector {
+	return &diskCollector{stats: stats, extended: extended, lvm: lvm, kube: kube}
+}
+
+func (c *diskCollector) Name() string { return "diskstats" }
+
+func (c *diskCollector) resetCounters() {
+	if r, ok := c.stats.(counterResetter); ok {
+		r.resetCounters()
+	}
+}
+
+func (c *diskCollector) String() string {
+	options := []string{}
+	if source := c.stats.sourceName(); source != defaultDiskSource {
+		options = append(options, source)
+	}
+	if c.extended {
+		options = append(options, "extended")
+	}
+	if c.lvm {
+		options = append(options, "lvm")
+	}
+	if c.kube != nil {
+		options = append(options, "localpv")
+	}
+	if len(options) == 0 {
+		return "diskstats"
+	}
+	return "diskstats=" + strings.Join(options, "+")
+}
+
+func (c *diskCollector) Collect(ctx context.Context) ([]Metric, error) {
+	rates, err := c.stats.rates()
+	var mounts map[string]deviceMount
+	if deviceMounts != nil {
+		var mountErr error
+		if mounts, mountErr = deviceMounts(); mountErr != nil {
+			collectorLog(c.Name()).Warnf("Cannot map devices to mounts: %v", mountErr)
+		}
+	}
+	devices := []string{}
+	for _, r := range rates {
+		devices = append(devices, r.Device)
+	}
+	volumes := logicalVolumes(sysBlockPath, devices)
+	c.lock.Lock()
+	c.rates = rates
+	c.mounts = mounts
+	c.volumes = volumes
+	c.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	metrics := []Metric{}
+	if c.lvm {
+		metrics = append(metrics, logicalVolumeMetrics(rates, volumes, now)...)
+	}
+	if c.kube != nil {
+		metrics = append(metrics, localPVMetrics(rates, localPVDevices(c.localPVs(ctx)), now)...)
+	}
+	if !c.extended {
+		return metrics, nil
+	}
+	for i, r := range rates {
+		for j, m := range extendedDiskMetrics {
+			value := m.value(r)
+			max := m.max
+			if max == 0 {
+				max = value
+			}
+			metrics = append(metrics, Metric{
+				ID:       diskMetricID(r.Device, m.id),
+				Label:    r.Device + " " + m.label,
+				Format:   m.format,
+				Priority: 10 + float64(i) + float64(j)/100,
+				Value:    value,
+				Min:      0,
+				Max:      max,
+				Time:     now,
+			})
+		}
+	}
+	return metrics, nil
+}
+
+// localPVs returns the cluster's volumes, keeping the previous ones should
+// they not be refreshed. The API server is queried without c.lock, which
+// Tables needs.
+func (c *diskCollector) localPVs(ctx context.Context) map[string]persistentVolume {
+	c.lock.Lock()
+	pvs, fetched := c.pvs, c.pvsFetched
+	c.lock.Unlock()
+	if time.Since(fetched) <= localPVsMaxAge {
+		return pvs
+	}
+	fresh, err := c.kube.persistentVolumes(ctx)
+	if err != nil {
+		collectorLog(c.Name()).Warnf("Cannot map devices to local volumes: %v", err)
+		return pvs
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.pvs, c.pvsFetched = fresh, time.Now()
+	return fresh
+}
+
+// localPVMetrics reports the IOPS and throughput of the devices among the
+// rates as those of the local volumes they back, under the IDs of other
+// volumes' metrics, e.g. write_iops_<pv>. Volumes sharing a device, such
+// as hostpath ones, all show the whole device's.
+func localPVMetrics(rates []diskRates, pvDevices map[string][]string, now time.Time) []Metric {
+	metrics := []Metric{}
+	for _, r := range rates {
+		for _, pv := range pvDevices[r.Device] {
+			for j, m := range lvMetrics {
+				value := m.value(r)
+				metrics = append(metrics, Metric{
+					ID:       localPVMetricIDs[m.id] + "_" + pv,
+					Label:    pv + " " + m.label + " (" + r.Device + ")",
+					Format:   m.format,
+					Priority: 20 + float64(j)/10,
+					Value:    value,
+					Min:      0,
+					Max:      value,
+					Time:     now,
+				})
+			}
+		}
+	}
+	return metrics
+}
+
+// localPVMetricIDs name the device statistics as volume metrics.
+var localPVMetricIDs = map[string]string{
+	"r_iops":  "read_iops",
+	"w_iops":  "write_iops",
+	"r_bytes": "read_bytes",
+	"w_bytes": "write_bytes",
+}
+
+// Tables renders the per-device rates of the latest collection.
+func (c *diskCollector) Tables() []table {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	rows := map[string]map[string]string{}
+	for _, r := range c.rates {
+		name := r.Device
+		if lv, ok := c.volumes[r.Device]; ok {
+			name = fmt.Sprintf("%s (%s)", lv, r.Device)
+		}
+		row := map[string]string{
+			"device":    name,
+			"r_iops":    formatNumber(r.ReadIOPS),
+			"w_iops":    formatNumber(r.WriteIOPS),
+			"rsec_s":    formatNumber(r.SectorsReadPerSec),
+			"wsec_s":    formatNumber(r.SectorsWrittenPerSec),
+			"in_flight": formatNumber(r.InFlight),
+		}
+		if m, ok := c.mounts[r.Device]; ok {
+			row["mountpoint"], row["fstype"] = m.Mountpoint, m.FSType
+			if m.Size > 0 {
+				row["used"] = fmt.Sprintf("%s / %s (%.0f%%)", formatSize(m.Used), formatSize(m.Size), 100*float64(m.Used)/float64(m.Size))
+			}
+		}
+		rows[r.Device] = row
+	}
+	return []table{{Template: diskTableTemplate(deviceMounts != nil), Rows: rows}}
+}
@@ -0,0 +1,15 @@
+// Command iowait is a Weave Scope plugin reporting host and storage IO
+// metrics.
+//
+// It is a single command, not a library: everything lives in package main,
+// so there is no importable or versioned Go API yet. Publishing one, under
+// a v2 module path, first needs the collectors, report building and
+// controls split into their own packages; until then the extension points
+// below are internal and may change between releases:
+//
+//   - Collector gathers metrics from one source. Collectors register in
+//     collectorFactories; a tableCollector also renders host tables.
+//   - reportHook post-processes a report before it is served.
+//   - controlDetails, returned by Plugin.allControlDetails, declares the
+//     controls the Control handler accepts.
+package main
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultDockerSocket = "/var/run/docker.sock"
+
+func init() {
+	collectorFactories["docker-stats"] = func(opts collectorOptions) (Collector, error) {
+		return newDockerStats(opts.DockerSocket), nil
+	}
+}
+
+// dockerStats attributes IO to containers from the blkio statistics of the
+// Docker Engine API, for plain Docker hosts without Kubernetes or
+// Prometheus. Like the cgroup collector, rates are only known from the
+// second reading of a container onwards.
+type dockerStats struct {
+	socket string
+	client *http.Client
+
+	lock     sync.Mutex
+	prev     map[string]cgroupIO
+	prevTime time.Time
+}
+
+func newDockerStats(socket string) *dockerStats {
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+	}
+	return &dockerStats{
+		socket: socket,
+		client: &http.Client{Transport: &http.Transport{DialContext: dial}},
+	}
+}
+
+func (d *dockerStats) Name() string { return "docker-stats" }
+
+func (d *dockerStats) resetCounters() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.prev = nil
+}
+
+// get decodes the response of the Docker Engine API at path.
+func (d *dockerStats) get(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequest("GET", "http://docker"+path, nil)
+	if err != nil {
+		return fmt.Errorf("docker-stats: %v", err)
+	}
+	res, err := d.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("docker-stats: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("docker-stats: GET %s: %s", path, res.Status)
+	}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return fmt.Errorf("docker-stats: GET %s: %v", path, err)
+	}
+	return nil
+}
+
+// blkioEntry is one device and operation of the Docker blkio statistics.
+// Operations are capitalised with cgroup v1 and lowercase with v2.
+type blkioEntry struct {
+	Op    string  `json:"op"`
+	Value float64 `json:"value"`
+}
+
+// containerIO returns the cumulative IO counters of a running container.
+// With cgroup v2 Docker only reports bytes, not operations.
+func (d *dockerStats) containerIO(ctx context.Context, id string) (cgroupIO, error) {
+	stats := struct {
+		BlkioStats struct {
+			ServiceBytes []blkioEntry `json:"io_service_bytes_recursive"`
+			Serviced     []blkioEntry `json:"io_serviced_recursive"`
+		} `json:"blkio_stats"`
+	}{}
+	if err := d.get(ctx, "/containers/"+id+"/stats?stream=false&one-shot=true", &stats); err != nil {
+		return cgroupIO{}, err
+	}
+	io := cgroupIO{}
+	for _, e := range stats.BlkioStats.ServiceBytes {
+		switch strings.ToLower(e.Op) {
+		case "read":
+			io.rbytes += e.Value
+		case "write":
+			io.wbytes += e.Value
+		}
+	}
+	for _, e := range stats.BlkioStats.Serviced {
+		switch strings.ToLower(e.Op) {
+		case "read":
+			io.rios += e.Value
+		case "write":
+			io.wios += e.Value
+		}
+	}
+	return io, nil
+}
+
+// Collect attaches the per-container IO rates to Scope's container nodes.
+func (d *dockerStats) Collect(ctx context.Context) ([]Metric, error) {
+	containers := []struct {
+		ID string `json:"Id"`
+	}{}
+	if err := d.get(ctx, "/containers/json", &containers); err != nil {
+		return nil, err
+	}
+	cur := map[string]cgroupIO{}
+	for _, c := range containers {
+		io, err := d.containerIO(ctx, c.ID)
+		if err != nil {
+			// Containers come and go while we read them.
+			collectorLog(d.Name()).Debugf("Container %s: %v", c.ID, err)
+			continue
+		}
+		cur[c.ID] = io
+	}
+	now := time.Now()
+
+	d.lock.Lock()
+	prev, elapsed := d.prev, now.Sub(d.prevTime).Seconds()
+	d.prev, d.prevTime = cur, now
+	d.lock.Unlock()
+	return containerMetrics(containerRates(prev, cur, elapsed), now), nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+)
+
+// dryRun writes one report, indented, as Scope would get it from /report,
+// so that its topology and metrics can be checked without running Scope.
+// If no collector works it writes the diagnostic report Scope would show,
+// and returns the error.
+func (p *Plugin) dryRun(ctx context.Context, w io.Writer) error {
+	rpt, reportErr := p.makeReport(ctx)
+	if reportErr != nil {
+		rpt = p.diagnosticReport(reportErr)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(*rpt); err != nil {
+		return err
+	}
+	return reportErr
+}
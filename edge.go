@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	powerSupplyDir = "/sys/class/power_supply"
+	meminfoPath    = "/proc/meminfo"
+
+	// Hosts with at most edgeMaxCPUs CPUs or less than edgeMinMemory bytes
+	// of memory are considered constrained edge devices.
+	edgeMaxCPUs   = 2
+	edgeMinMemory = 2 << 30
+)
+
+// heavyCollectors are left out in edge mode: they run external tools or
+// walk every process or cgroup on each collection.
+var heavyCollectors = map[string]bool{
+	"iostat":     true,
+	"process-io": true,
+	"blktrace":   true,
+	"benchmark":  true,
+	"cgroup-io":  true,
+	"microburst": true,
+}
+
+func heavyCollectorNames() []string {
+	names := []string{}
+	for name := range heavyCollectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// edgeMode tells whether the plugin should run in edge mode ("on", "off" or
+// "auto", which detects constrained hosts), and why.
+func edgeMode(mode string) (bool, string, error) {
+	switch mode {
+	case "on":
+		return true, "forced", nil
+	case "off":
+		return false, "", nil
+	case "auto":
+		reason := detectEdge(powerSupplyDir, meminfoPath)
+		return reason != "", reason, nil
+	}
+	return false, "", fmt.Errorf("invalid edge mode %q, expected auto, on or off", mode)
+}
+
+// detectEdge returns why the host looks like a constrained edge device, or
+// "" if it doesn't.
+func detectEdge(powerSupplies, meminfo string) string {
+	if onBattery(powerSupplies) {
+		return "on battery"
+	}
+	if n := runtime.NumCPU(); n <= edgeMaxCPUs {
+		return fmt.Sprintf("%d CPUs", n)
+	}
+	if total, err := memTotal(meminfo); err == nil && total < edgeMinMemory {
+		return fmt.Sprintf("%d MiB of memory", total>>20)
+	}
+	return ""
+}
+
+// onBattery tells whether a battery is discharging, i.e. the host is not on
+// mains power.
+func onBattery(dir string) bool {
+	supplies, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	for _, supply := range supplies {
+		path := filepath.Join(dir, supply.Name())
+		if readSysfs(filepath.Join(path, "type")) == "Battery" && readSysfs(filepath.Join(path, "status")) == "Discharging" {
+			return true
+		}
+	}
+	return false
+}
+
+func readSysfs(path string) string {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(raw))
+}
+
+// memTotal reads the host's memory size, in bytes, from /proc/meminfo.
+func memTotal(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("%s: %v", path, err)
+			}
+			return kb << 10, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("%s: no MemTotal", path)
+}
+
+// edgeCollectors drops the heavy collectors from a list of collector names.
+// A heavy CPU source, the first name, is replaced by the platform's default
+// one, or kept if it is the default.
+func edgeCollectors(names []string) []string {
+	kept := []string{}
+	for i, name := range names {
+		if i == 0 && heavyCollectors[name] {
+			kept = append(kept, defaultCPUSource)
+			continue
+		}
+		if !heavyCollectors[name] {
+			kept = append(kept, name)
+		}
+	}
+	return kept
+}
+
+// throttledCollector collects at most once per interval and otherwise
+// returns the previous collection, however often Scope asks for reports.
+type throttledCollector struct {
+	Collector
+	interval time.Duration
+
+	lock    sync.Mutex
+	last    time.Time
+	metrics []Metric
+	err     error
+}
+
+func newThrottledCollector(c Collector, interval time.Duration) *throttledCollector {
+	return &throttledCollector{Collector: c, interval: interval}
+}
+
+func (t *throttledCollector) setInterval(interval time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.interval = interval
+}
+
+func (t *throttledCollector) String() string {
+	return fmt.Sprintf("%s@%s", collectorSummary(t.Collector), t.interval)
+}
+
+func (t *throttledCollector) Collect(ctx context.Context) ([]Metric, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.last.IsZero() && time.Since(t.last) < t.interval {
+		return t.metrics, t.err
+	}
+	t.metrics, t.err = t.Collector.Collect(ctx)
+	t.last = time.Now()
+	return t.metrics, t.err
+}
+
+func (t *throttledCollector) shedMemory() {
+	if s, ok := t.Collector.(memoryShedder); ok {
+		s.shedMemory()
+	}
+}
+
+func (t *throttledCollector) resetCounters() {
+	if r, ok := t.Collector.(counterResetter); ok {
+		r.resetCounters()
+	}
+}
+
+func (t *throttledCollector) Tables() []table {
+	if tc, ok := t.Collector.(tableCollector); ok {
+		return tc.Tables()
+	}
+	return nil
+}
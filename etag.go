@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+)
+
+// materialETag hashes a decoded report without its timestamps, which change
+// on every report, so that it only changes with what reports show.
+func materialETag(doc interface{}) (string, error) {
+	material, err := json.Marshal(withoutTimes(doc))
+	if err != nil {
+		return "", err
+	}
+	h := fnv.New64a()
+	h.Write(material)
+	return fmt.Sprintf("%016x", h.Sum64()), nil
+}
+
+// reportETag returns the ETag of a marshalled report.
+func reportETag(raw []byte) (string, error) {
+	var doc interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return "", err
+	}
+	return materialETag(doc)
+}
+
+// etagMatches tells whether an If-None-Match header matches etag, which it
+// does weakly: reports are only the same but for their timestamps.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || strings.Trim(candidate, `"`) == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// serveReport writes a marshalled report with its ETag, or a 304 if the
+// request's If-None-Match matches it.
+func serveReport(w http.ResponseWriter, r *http.Request, raw []byte) {
+	etag, err := reportETag(raw)
+	if err != nil {
+		log.Error(err)
+		w.WriteHeader(http.StatusOK)
+		w.Write(raw)
+		return
+	}
+	w.Header().Set("ETag", `W/"`+etag+`"`)
+	if match := r.Header.Get("If-None-Match"); match != "" && etagMatches(match, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(raw)
+}
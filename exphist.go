@@ -0,0 +1,92 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// expHistogram is an exponential histogram, as in OpenTelemetry: bucket i
+// counts the values in (base^i, base^(i+1)], with base = 2^(2^-scale).
+// Histograms of the same scale merge exactly by adding their buckets, so
+// quantiles of a merged histogram are those of the merged distributions,
+// with a relative error bounded by the bucket width, unlike averages of
+// per-volume averages or quantiles.
+type expHistogram struct {
+	scale  int
+	counts map[int]float64
+	zero   float64 // values <= 0
+	total  float64
+}
+
+func newExpHistogram(scale int) *expHistogram {
+	return &expHistogram{scale: scale, counts: map[int]float64{}}
+}
+
+func (h *expHistogram) index(v float64) int {
+	return int(math.Ceil(math.Log2(v)*math.Exp2(float64(h.scale)))) - 1
+}
+
+// bound returns the lower bound of bucket i.
+func (h *expHistogram) bound(i int) float64 {
+	return math.Exp2(float64(i) / math.Exp2(float64(h.scale)))
+}
+
+// add counts count values of v.
+func (h *expHistogram) add(v, count float64) {
+	if count <= 0 {
+		return
+	}
+	h.total += count
+	if v <= 0 {
+		h.zero += count
+		return
+	}
+	h.counts[h.index(v)] += count
+}
+
+// addBucket counts values known to lie in (lower, upper], as given by a
+// bucket of a classic Prometheus histogram, at their geometric midpoint.
+func (h *expHistogram) addBucket(lower, upper, count float64) {
+	switch {
+	case math.IsInf(upper, 1):
+		h.add(lower, count)
+	case lower <= 0:
+		h.add(upper/2, count)
+	default:
+		h.add(math.Sqrt(lower*upper), count)
+	}
+}
+
+func (h *expHistogram) merge(o *expHistogram) {
+	for i, count := range o.counts {
+		h.counts[i] += count
+	}
+	h.zero += o.zero
+	h.total += o.total
+}
+
+// quantile returns the q-quantile (0 <= q <= 1), estimated as the
+// geometric midpoint of the bucket it falls in.
+func (h *expHistogram) quantile(q float64) float64 {
+	if h.total == 0 {
+		return 0
+	}
+	rank := q * h.total
+	if rank <= h.zero {
+		return 0
+	}
+	seen := h.zero
+	indexes := []int{}
+	for i := range h.counts {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	for _, i := range indexes {
+		seen += h.counts[i]
+		if seen >= rank {
+			return math.Sqrt(h.bound(i) * h.bound(i+1))
+		}
+	}
+	last := indexes[len(indexes)-1]
+	return h.bound(last + 1)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// nodeAddressesMaxAge is how long the addresses of Kubernetes nodes are
+// cached for mapping instances to hosts.
+const nodeAddressesMaxAge = 5 * time.Minute
+
+// instanceHosts map the instance label of Prometheus series to the hosts
+// they come from, so that an aggregator reports the series of every node
+// on that node rather than on its own host. Instances are looked up, with
+// and without their port, in the static mapping, then among the addresses
+// of the Kubernetes nodes; instances named after their host map to it.
+type instanceHosts struct {
+	static map[string]string
+	kube   *kubeClient
+
+	lock    sync.Mutex
+	nodes   map[string]string
+	fetched time.Time
+	// unknown are the instances already logged as unmapped.
+	unknown map[string]bool
+}
+
+// parseInstanceHosts parses a comma separated list of instance=host pairs.
+func parseInstanceHosts(s string) (map[string]string, error) {
+	hosts := map[string]string{}
+	for _, pair := range splitList(s) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid instance host %q, expected instance=host", pair)
+		}
+		hosts[parts[0]] = parts[1]
+	}
+	return hosts, nil
+}
+
+// newInstanceHosts maps instances with the static mapping and, if kube is
+// set, the addresses of the Kubernetes nodes.
+func newInstanceHosts(static map[string]string, kube *kubeClient) *instanceHosts {
+	return &instanceHosts{static: static, kube: kube, unknown: map[string]bool{}}
+}
+
+// host returns the host ID of an instance, false if it is unknown.
+func (h *instanceHosts) host(ctx context.Context, instance string) (string, bool) {
+	addr := instance
+	if host, _, err := net.SplitHostPort(instance); err == nil {
+		addr = host
+	}
+	for _, key := range []string{instance, addr} {
+		if host, ok := h.static[key]; ok {
+			return host, true
+		}
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.kube != nil && time.Since(h.fetched) > nodeAddressesMaxAge {
+		// Failures are retried after the max age too, not on every series.
+		h.fetched = time.Now()
+		if nodes, err := h.kube.nodeAddresses(ctx); err != nil {
+			collectorLog("prometheus").Warnf("Cannot map instances to nodes: %v", err)
+		} else {
+			h.nodes = nodes
+		}
+	}
+	if host, ok := h.nodes[addr]; ok {
+		return host, true
+	}
+	if addr != "" && net.ParseIP(addr) == nil {
+		return addr, true
+	}
+	if !h.unknown[instance] {
+		h.unknown[instance] = true
+		collectorLog("prometheus").Warnf("No host for instance %s, reporting its series on this host", instance)
+	}
+	return "", false
+}
@@ -0,0 +1,138 @@
+//go:build faults
+// +build faults
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fault injection for resilience testing. It is only compiled in with
+// `go build -tags faults` and is configured through the IOWAIT_FAULTS
+// environment variable, e.g.
+//
+//	IOWAIT_FAULTS=cortex-5xx=0.5,slow-cpu=3s,socket-eof=0.1,partial-json=0.2
+//
+// Probabilities are between 0 and 1; slow-cpu is a delay added to every
+// CPU statistics collection. cortex-5xx and partial-json only affect the
+// Cortex queries.
+type faultConfig struct {
+	cortex5xx   float64
+	slowCPU     time.Duration
+	socketEOF   float64
+	partialJSON float64
+}
+
+var faults = loadFaults(os.Getenv("IOWAIT_FAULTS"))
+
+func loadFaults(spec string) faultConfig {
+	cfg := faultConfig{}
+	for _, item := range splitList(spec) {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			log.Fatalf("invalid fault %q, expected name=value", item)
+		}
+		var err error
+		switch parts[0] {
+		case "cortex-5xx":
+			cfg.cortex5xx, err = strconv.ParseFloat(parts[1], 64)
+		case "slow-cpu":
+			cfg.slowCPU, err = time.ParseDuration(parts[1])
+		case "socket-eof":
+			cfg.socketEOF, err = strconv.ParseFloat(parts[1], 64)
+		case "partial-json":
+			cfg.partialJSON, err = strconv.ParseFloat(parts[1], 64)
+		default:
+			err = fmt.Errorf("unknown fault")
+		}
+		if err != nil {
+			log.Fatalf("invalid fault %q: %v", item, err)
+		}
+	}
+	log.Warnf("Fault injection enabled: %+v", cfg)
+	return cfg
+}
+
+func inject(probability float64) bool {
+	return probability > 0 && rand.Float64() < probability
+}
+
+type faultyRoundTripper struct {
+	next http.RoundTripper
+}
+
+func (f faultyRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if inject(faults.cortex5xx) {
+		return &http.Response{
+			Status:     "503 Service Unavailable",
+			StatusCode: http.StatusServiceUnavailable,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{},
+			Body:       http.NoBody,
+			Request:    req,
+		}, nil
+	}
+	res, err := f.next.RoundTrip(req)
+	if err != nil || !inject(faults.partialJSON) {
+		return res, err
+	}
+	raw, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	raw = raw[:len(raw)/2]
+	res.Body, res.ContentLength = ioutil.NopCloser(bytes.NewReader(raw)), int64(len(raw))
+	return res, nil
+}
+
+// faultyCortexClient makes the Cortex queries of a client fail with a 503
+// or get truncated responses. The plugin's other HTTP clients are left
+// alone.
+func faultyCortexClient(client *http.Client) *http.Client {
+	next := client.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	faulty := *client
+	faulty.Transport = faultyRoundTripper{next: next}
+	return &faulty
+}
+
+// faultyCPUSource delays every CPU statistics collection.
+func faultyCPUSource(src cpuSource) cpuSource {
+	return func(ctx context.Context) (cpuStats, error) {
+		select {
+		case <-time.After(faults.slowCPU):
+		case <-ctx.Done():
+			return cpuStats{}, ctx.Err()
+		}
+		return src(ctx)
+	}
+}
+
+// faultyHandler drops connections from Scope without a response.
+func faultyHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if inject(faults.socketEOF) {
+			if hj, ok := w.(http.Hijacker); ok {
+				if conn, _, err := hj.Hijack(); err == nil {
+					conn.Close()
+					return
+				}
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
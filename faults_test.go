@@ -0,0 +1,137 @@
+//go:build faults
+// +build faults
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The degraded paths of the plugin, run with `go test -tags faults`.
+
+// withFaults injects faults for the duration of a test.
+func withFaults(t *testing.T, cfg faultConfig) {
+	saved := faults
+	faults = cfg
+	t.Cleanup(func() { faults = saved })
+}
+
+// cortexServer answers every query with a write_iops sample of a volume,
+// counting the queries.
+func cortexServer(t *testing.T) (*httptest.Server, *int32) {
+	var queries int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&queries, 1)
+		fmt.Fprint(w, `{"status":"success","data":{"resultType":"vector","result":[`+
+			`{"metric":{"openebs_pv":"pvc-0a1b2c3d"},"value":[1600000000,"42"]}]}}`)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &queries
+}
+
+func newTestPrometheusCollector(t *testing.T, url string) *prometheusCollector {
+	c, err := newPrometheusCollector(url, []promQuery{{ID: "write_iops", Query: "OpenEBS_write_iops"}}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCortex5xxOpensBreaker(t *testing.T) {
+	srv, queries := cortexServer(t)
+	c := newTestPrometheusCollector(t, srv.URL)
+
+	withFaults(t, faultConfig{cortex5xx: 1})
+	for i := 0; i < breakerFailures; i++ {
+		if _, err := c.Collect(context.Background()); err == nil || errors.Is(err, errBreakerOpen) {
+			t.Fatalf("collection %d: got %v, want a 503", i, err)
+		}
+	}
+
+	// Cortex recovered, but the breaker spares it until the cooldown.
+	faults.cortex5xx = 0
+	if _, err := c.Collect(context.Background()); !errors.Is(err, errBreakerOpen) {
+		t.Fatalf("got %v, want %v", err, errBreakerOpen)
+	}
+	if n := atomic.LoadInt32(queries); n != 0 {
+		t.Errorf("Cortex got %d queries, want none", n)
+	}
+
+	c.lock.Lock()
+	c.openUntil = time.Now()
+	c.lock.Unlock()
+	metrics, err := c.Collect(context.Background())
+	if err != nil || len(metrics) != 1 {
+		t.Fatalf("after the cooldown: got %v, %v, want a metric", metrics, err)
+	}
+}
+
+func TestCortexPartialJSONServesStaleMetrics(t *testing.T) {
+	srv, _ := cortexServer(t)
+	c := newTestPrometheusCollector(t, srv.URL)
+
+	withFaults(t, faultConfig{})
+	fresh, err := c.Collect(context.Background())
+	if err != nil || len(fresh) != 1 {
+		t.Fatalf("got %v, %v, want a metric", fresh, err)
+	}
+
+	faults.partialJSON = 1
+	stale, err := c.Collect(context.Background())
+	if err == nil {
+		t.Fatal("truncated response parsed")
+	}
+	if !reflect.DeepEqual(stale, fresh) {
+		t.Errorf("got %v, want the stale %v", stale, fresh)
+	}
+}
+
+func TestSlowCPUHitsCollectorTimeout(t *testing.T) {
+	withFaults(t, faultConfig{slowCPU: time.Minute})
+	c := newCPUCollector("test", func(context.Context) (cpuStats, error) { return cpuStats{}, nil })
+
+	start := time.Now()
+	r := collectWithin(context.Background(), c, 50*time.Millisecond)
+	if !errors.Is(r.err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want %v", r.err, context.DeadlineExceeded)
+	}
+	if len(r.metrics) != 0 {
+		t.Errorf("got %d metrics, want none", len(r.metrics))
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("collection took %s", elapsed)
+	}
+}
+
+func TestSocketEOFDropsConnection(t *testing.T) {
+	srv := httptest.NewServer(faultyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "{}")
+	})))
+	defer srv.Close()
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+
+	withFaults(t, faultConfig{socketEOF: 1})
+	if res, err := client.Get(srv.URL + "/report"); err == nil {
+		res.Body.Close()
+		t.Fatalf("got %s, want the connection dropped", res.Status)
+	}
+
+	// The server keeps serving once the fault is gone.
+	faults.socketEOF = 0
+	res, err := client.Get(srv.URL + "/report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("got %s, want 200 OK", res.Status)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const benchmarkControlPrefix = "benchmark_"
+
+func init() {
+	collectorFactories["benchmark"] = func(opts collectorOptions) (Collector, error) {
+		return newBenchmarker(opts.BenchmarkDevices, opts.BenchmarkDuration, opts.BenchmarkTTL), nil
+	}
+}
+
+// benchmarker runs short, bounded fio micro-benchmarks of a block device
+// on demand and reports the achieved IOPS and latencies as metrics for a
+// while, so observed load can be compared with what the device can do.
+// The benchmark only reads, so it can run against devices in use.
+type benchmarker struct {
+	devices  []string
+	duration time.Duration
+	ttl      time.Duration
+
+	lock    sync.Mutex
+	running map[string]bool
+	results map[string]benchmarkResult
+}
+
+// benchmarkResult is the outcome of one fio run.
+type benchmarkResult struct {
+	Finished time.Time
+	IOPS     float64
+	// MeanLatency and P99Latency are completion latencies.
+	MeanLatency time.Duration
+	P99Latency  time.Duration
+	Err         error
+}
+
+// fioOutput is the part of fio's JSON output the plugin uses.
+type fioOutput struct {
+	Jobs []struct {
+		Read struct {
+			IOPS   float64 `json:"iops"`
+			ClatNs struct {
+				Mean       float64            `json:"mean"`
+				Percentile map[string]float64 `json:"percentile"`
+			} `json:"clat_ns"`
+		} `json:"read"`
+	} `json:"jobs"`
+}
+
+func newBenchmarker(devices []string, duration, ttl time.Duration) *benchmarker {
+	return &benchmarker{
+		devices:  devices,
+		duration: duration,
+		ttl:      ttl,
+		running:  map[string]bool{},
+		results:  map[string]benchmarkResult{},
+	}
+}
+
+func (b *benchmarker) deviceForControl(controlID string) (string, bool) {
+	for _, device := range b.devices {
+		if benchmarkControlPrefix+device == controlID {
+			return device, true
+		}
+	}
+	return "", false
+}
+
+func (b *benchmarker) controlDetails() []controlDetails {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	details := []controlDetails{}
+	for _, device := range b.devices {
+		details = append(details, controlDetails{
+			id:    benchmarkControlPrefix + device,
+			human: fmt.Sprintf("Benchmark %s for %s", device, b.duration),
+			icon:  "fa-tachometer",
+			dead:  b.running[device],
+		})
+	}
+	return details
+}
+
+// start benchmarks device in the background.
+func (b *benchmarker) start(device string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.running[device] {
+		return fmt.Errorf("fio: a benchmark of %s is already running", device)
+	}
+	b.running[device] = true
+	go func() {
+		result, err := b.run(device)
+		if err != nil {
+			collectorLog(b.Name()).Error(err)
+			result.Err = err
+		}
+		result.Finished = time.Now()
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		b.running[device] = false
+		b.results[device] = result
+	}()
+	return nil
+}
+
+func (b *benchmarker) run(device string) (benchmarkResult, error) {
+	seconds := strconv.Itoa(int((b.duration + time.Second - 1) / time.Second))
+	// fio stops on its own after the runtime; the timeout is only a
+	// safety net against a wedged device.
+	out, err := commandOutput(context.Background(), b.duration+10*time.Second, "fio",
+		"--name=iowait", "--filename=/dev/"+device, "--readonly", "--rw=randread",
+		"--bs=4k", "--direct=1", "--ioengine=libaio", "--iodepth=32",
+		"--runtime="+seconds, "--time_based", "--output-format=json")
+	if err != nil {
+		return benchmarkResult{}, fmt.Errorf("fio: %s: %w", device, err)
+	}
+	result := fioOutput{}
+	if err := json.Unmarshal(out, &result); err != nil {
+		return benchmarkResult{}, fmt.Errorf("fio: %s: invalid output: %v", device, err)
+	}
+	if len(result.Jobs) == 0 {
+		return benchmarkResult{}, fmt.Errorf("fio: %s: no job in output", device)
+	}
+	read := result.Jobs[0].Read
+	return benchmarkResult{
+		IOPS:        read.IOPS,
+		MeanLatency: time.Duration(read.ClatNs.Mean),
+		P99Latency:  time.Duration(read.ClatNs.Percentile["99.000000"]),
+	}, nil
+}
+
+func (b *benchmarker) Name() string { return "benchmark" }
+
+// Collect reports the results of the benchmarks that finished within the
+// TTL. Failed benchmarks are only logged.
+func (b *benchmarker) Collect(ctx context.Context) ([]Metric, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	metrics := []Metric{}
+	for i, device := range b.devices {
+		r, ok := b.results[device]
+		if !ok || r.Err != nil {
+			continue
+		}
+		if time.Since(r.Finished) > b.ttl {
+			delete(b.results, device)
+			continue
+		}
+		for j, m := range []struct {
+			stat, label, format string
+			value               float64
+		}{
+			{"bench_iops", "benchmark IOPS", "integer", r.IOPS},
+			{"bench_lat_ms", "benchmark latency (ms)", "", float64(r.MeanLatency) / float64(time.Millisecond)},
+			{"bench_p99_ms", "benchmark p99 latency (ms)", "", float64(r.P99Latency) / float64(time.Millisecond)},
+		} {
+			metrics = append(metrics, Metric{
+				ID:       diskMetricID(device, m.stat),
+				Label:    device + " " + m.label,
+				Format:   m.format,
+				Priority: 40 + float64(i) + float64(j)/10,
+				Value:    m.value,
+				Min:      0,
+				Max:      m.value,
+				Time:     r.Finished,
+			})
+		}
+	}
+	return metrics, nil
+}
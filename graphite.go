@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+func init() {
+	collectorFactories["graphite"] = func(opts collectorOptions) (Collector, error) {
+		c, err := newGraphiteCollector(opts.Graphite, opts.HTTPClient, opts.PVShard)
+		if err != nil {
+			return nil, err
+		}
+		c.hosts = opts.InstanceHosts
+		return c, nil
+	}
+}
+
+// graphiteOptions are the settings of the Graphite backend.
+type graphiteOptions struct {
+	URL string
+	// From is how far back targets are rendered, e.g. -5min.
+	From    string
+	Queries []promQuery
+}
+
+// graphiteCollector renders targets through the Graphite render API, so
+// legacy monitoring stacks can feed the Scope graphs too. The latest
+// datapoint of every series is reported like a Prometheus result. Series
+// of a volume are told by their openebs_pv tag or, when a target returns
+// several series, by their name, e.g. given by aliasByNode.
+type graphiteCollector struct {
+	opts   graphiteOptions
+	client *http.Client
+	owns   func(key string) bool
+	hosts  *instanceHosts
+}
+
+func newGraphiteCollector(opts graphiteOptions, client *http.Client, owns func(key string) bool) (*graphiteCollector, error) {
+	if opts.URL == "" {
+		return nil, fmt.Errorf("graphite: no URL configured")
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	opts.URL = strings.TrimSuffix(opts.URL, "/")
+	return &graphiteCollector{opts: opts, client: client, owns: owns}, nil
+}
+
+func (c *graphiteCollector) Name() string { return "graphite" }
+
+func (c *graphiteCollector) Collect(ctx context.Context) ([]Metric, error) {
+	metrics := []Metric{}
+	for i, q := range c.opts.Queries {
+		samples, err := c.render(ctx, q.Query)
+		if err != nil {
+			return metrics, fmt.Errorf("graphite: target %q: %v", q.Query, err)
+		}
+		for _, s := range samples {
+			if m, ok := s.metric(ctx, q.ID, i, c.owns, c.hosts); ok {
+				metrics = append(metrics, m)
+			}
+		}
+	}
+	return metrics, nil
+}
+
+// graphiteSeries is one series of a /render?format=json response, whose
+// datapoints are [value, timestamp] pairs with null values for gaps.
+type graphiteSeries struct {
+	Target     string            `json:"target"`
+	Tags       map[string]string `json:"tags"`
+	Datapoints [][2]*json.Number `json:"datapoints"`
+}
+
+func (c *graphiteCollector) render(ctx context.Context, target string) ([]querySample, error) {
+	params := url.Values{"target": {target}, "format": {"json"}, "from": {c.opts.From}}
+	req, err := http.NewRequest("GET", c.opts.URL+"/render?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return nil, fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	series := []graphiteSeries{}
+	decoder := json.NewDecoder(res.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&series); err != nil {
+		return nil, err
+	}
+	return graphiteSamples(series), nil
+}
+
+// graphiteSamples returns the latest non-null datapoint of every series.
+func graphiteSamples(series []graphiteSeries) []querySample {
+	samples := []querySample{}
+	for _, s := range series {
+		for i := len(s.Datapoints) - 1; i >= 0; i-- {
+			point := s.Datapoints[i]
+			if point[0] == nil || point[1] == nil {
+				continue
+			}
+			value, err1 := point[0].Float64()
+			ts, err2 := point[1].Int64()
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			pv := s.Tags[pvTag]
+			if pv == "" && len(series) > 1 {
+				pv = s.Target
+			}
+			samples = append(samples, querySample{
+				PV:       pv,
+				Instance: s.Tags[instanceTag],
+				Time:     time.Unix(ts, 0),
+				Value:    value,
+			})
+			break
+		}
+	}
+	return samples
+}
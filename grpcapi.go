@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var grpcLog = componentLog("grpc")
+
+// The messages of iowait.proto. They are declared here with the struct tags
+// protoc-gen-go generates, so that building the plugin needs no protoc.
+type (
+	pbReportRequest  struct{}
+	pbControlRequest struct {
+		NodeId  string `protobuf:"bytes,1,opt,name=node_id,json=nodeId,proto3" json:"node_id,omitempty"`
+		Control string `protobuf:"bytes,2,opt,name=control,proto3" json:"control,omitempty"`
+	}
+	pbControlResponse struct {
+		ShortcutReport *pbReport `protobuf:"bytes,1,opt,name=shortcut_report,json=shortcutReport,proto3" json:"shortcut_report,omitempty"`
+	}
+	pbReport struct {
+		Host      *pbTopology     `protobuf:"bytes,1,opt,name=host,proto3" json:"host,omitempty"`
+		Container *pbTopology     `protobuf:"bytes,2,opt,name=container,proto3" json:"container,omitempty"`
+		Pod       *pbTopology     `protobuf:"bytes,3,opt,name=pod,proto3" json:"pod,omitempty"`
+		Plugins   []*pbPluginSpec `protobuf:"bytes,4,rep,name=plugins,proto3" json:"plugins,omitempty"`
+		Shortcut  bool            `protobuf:"varint,5,opt,name=shortcut,proto3" json:"shortcut,omitempty"`
+	}
+	pbPluginSpec struct {
+		Id          string   `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+		Label       string   `protobuf:"bytes,2,opt,name=label,proto3" json:"label,omitempty"`
+		Description string   `protobuf:"bytes,3,opt,name=description,proto3" json:"description,omitempty"`
+		Interfaces  []string `protobuf:"bytes,4,rep,name=interfaces,proto3" json:"interfaces,omitempty"`
+		ApiVersion  string   `protobuf:"bytes,5,opt,name=api_version,json=apiVersion,proto3" json:"api_version,omitempty"`
+	}
+	pbTopology struct {
+		Nodes             map[string]*pbNode             `protobuf:"bytes,1,rep,name=nodes,proto3" json:"nodes,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+		MetricTemplates   map[string]*pbMetricTemplate   `protobuf:"bytes,2,rep,name=metric_templates,json=metricTemplates,proto3" json:"metric_templates,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+		MetadataTemplates map[string]*pbMetadataTemplate `protobuf:"bytes,3,rep,name=metadata_templates,json=metadataTemplates,proto3" json:"metadata_templates,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+		TableTemplates    map[string]*pbTableTemplate    `protobuf:"bytes,4,rep,name=table_templates,json=tableTemplates,proto3" json:"table_templates,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+		Controls          map[string]*pbControl          `protobuf:"bytes,5,rep,name=controls,proto3" json:"controls,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	}
+	pbNode struct {
+		Metrics        map[string]*pbMetric       `protobuf:"bytes,1,rep,name=metrics,proto3" json:"metrics,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+		Latest         map[string]*pbStringEntry  `protobuf:"bytes,2,rep,name=latest,proto3" json:"latest,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+		LatestControls map[string]*pbControlEntry `protobuf:"bytes,3,rep,name=latest_controls,json=latestControls,proto3" json:"latest_controls,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	}
+	pbMetric struct {
+		Samples []*pbSample `protobuf:"bytes,1,rep,name=samples,proto3" json:"samples,omitempty"`
+		Min     float64     `protobuf:"fixed64,2,opt,name=min,proto3" json:"min,omitempty"`
+		Max     float64     `protobuf:"fixed64,3,opt,name=max,proto3" json:"max,omitempty"`
+	}
+	pbSample struct {
+		Date  int64   `protobuf:"varint,1,opt,name=date,proto3" json:"date,omitempty"`
+		Value float64 `protobuf:"fixed64,2,opt,name=value,proto3" json:"value,omitempty"`
+	}
+	pbStringEntry struct {
+		Timestamp int64  `protobuf:"varint,1,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+		Value     string `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+	}
+	pbControlEntry struct {
+		Timestamp int64 `protobuf:"varint,1,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+		Dead      bool  `protobuf:"varint,2,opt,name=dead,proto3" json:"dead,omitempty"`
+	}
+	pbMetricTemplate struct {
+		Id       string  `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+		Label    string  `protobuf:"bytes,2,opt,name=label,proto3" json:"label,omitempty"`
+		Format   string  `protobuf:"bytes,3,opt,name=format,proto3" json:"format,omitempty"`
+		Priority float64 `protobuf:"fixed64,4,opt,name=priority,proto3" json:"priority,omitempty"`
+	}
+	pbMetadataTemplate struct {
+		Id       string  `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+		Label    string  `protobuf:"bytes,2,opt,name=label,proto3" json:"label,omitempty"`
+		DataType string  `protobuf:"bytes,3,opt,name=data_type,json=dataType,proto3" json:"data_type,omitempty"`
+		Priority float64 `protobuf:"fixed64,4,opt,name=priority,proto3" json:"priority,omitempty"`
+		From     string  `protobuf:"bytes,5,opt,name=from,proto3" json:"from,omitempty"`
+	}
+	pbTableTemplate struct {
+		Id      string      `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+		Label   string      `protobuf:"bytes,2,opt,name=label,proto3" json:"label,omitempty"`
+		Prefix  string      `protobuf:"bytes,3,opt,name=prefix,proto3" json:"prefix,omitempty"`
+		Type    string      `protobuf:"bytes,4,opt,name=type,proto3" json:"type,omitempty"`
+		Columns []*pbColumn `protobuf:"bytes,5,rep,name=columns,proto3" json:"columns,omitempty"`
+	}
+	pbColumn struct {
+		Id       string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+		Label    string `protobuf:"bytes,2,opt,name=label,proto3" json:"label,omitempty"`
+		DataType string `protobuf:"bytes,3,opt,name=data_type,json=dataType,proto3" json:"data_type,omitempty"`
+	}
+	pbControl struct {
+		Id    string `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+		Human string `protobuf:"bytes,2,opt,name=human,proto3" json:"human,omitempty"`
+		Icon  string `protobuf:"bytes,3,opt,name=icon,proto3" json:"icon,omitempty"`
+		Rank  int32  `protobuf:"varint,4,opt,name=rank,proto3" json:"rank,omitempty"`
+	}
+)
+
+func (m *pbReportRequest) Reset()         { *m = pbReportRequest{} }
+func (m *pbReportRequest) String() string { return proto.CompactTextString(m) }
+func (*pbReportRequest) ProtoMessage()    {}
+
+func (m *pbControlRequest) Reset()         { *m = pbControlRequest{} }
+func (m *pbControlRequest) String() string { return proto.CompactTextString(m) }
+func (*pbControlRequest) ProtoMessage()    {}
+
+func (m *pbControlResponse) Reset()         { *m = pbControlResponse{} }
+func (m *pbControlResponse) String() string { return proto.CompactTextString(m) }
+func (*pbControlResponse) ProtoMessage()    {}
+
+func (m *pbReport) Reset()         { *m = pbReport{} }
+func (m *pbReport) String() string { return proto.CompactTextString(m) }
+func (*pbReport) ProtoMessage()    {}
+
+func (m *pbPluginSpec) Reset()         { *m = pbPluginSpec{} }
+func (m *pbPluginSpec) String() string { return proto.CompactTextString(m) }
+func (*pbPluginSpec) ProtoMessage()    {}
+
+func (m *pbTopology) Reset()         { *m = pbTopology{} }
+func (m *pbTopology) String() string { return proto.CompactTextString(m) }
+func (*pbTopology) ProtoMessage()    {}
+
+func (m *pbNode) Reset()         { *m = pbNode{} }
+func (m *pbNode) String() string { return proto.CompactTextString(m) }
+func (*pbNode) ProtoMessage()    {}
+
+func (m *pbMetric) Reset()         { *m = pbMetric{} }
+func (m *pbMetric) String() string { return proto.CompactTextString(m) }
+func (*pbMetric) ProtoMessage()    {}
+
+func (m *pbSample) Reset()         { *m = pbSample{} }
+func (m *pbSample) String() string { return proto.CompactTextString(m) }
+func (*pbSample) ProtoMessage()    {}
+
+func (m *pbStringEntry) Reset()         { *m = pbStringEntry{} }
+func (m *pbStringEntry) String() string { return proto.CompactTextString(m) }
+func (*pbStringEntry) ProtoMessage()    {}
+
+func (m *pbControlEntry) Reset()         { *m = pbControlEntry{} }
+func (m *pbControlEntry) String() string { return proto.CompactTextString(m) }
+func (*pbControlEntry) ProtoMessage()    {}
+
+func (m *pbMetricTemplate) Reset()         { *m = pbMetricTemplate{} }
+func (m *pbMetricTemplate) String() string { return proto.CompactTextString(m) }
+func (*pbMetricTemplate) ProtoMessage()    {}
+
+func (m *pbMetadataTemplate) Reset()         { *m = pbMetadataTemplate{} }
+func (m *pbMetadataTemplate) String() string { return proto.CompactTextString(m) }
+func (*pbMetadataTemplate) ProtoMessage()    {}
+
+func (m *pbTableTemplate) Reset()         { *m = pbTableTemplate{} }
+func (m *pbTableTemplate) String() string { return proto.CompactTextString(m) }
+func (*pbTableTemplate) ProtoMessage()    {}
+
+func (m *pbColumn) Reset()         { *m = pbColumn{} }
+func (m *pbColumn) String() string { return proto.CompactTextString(m) }
+func (*pbColumn) ProtoMessage()    {}
+
+func (m *pbControl) Reset()         { *m = pbControl{} }
+func (m *pbControl) String() string { return proto.CompactTextString(m) }
+func (*pbControl) ProtoMessage()    {}
+
+func init() {
+	for name, m := range map[string]proto.Message{
+		"iowait.ReportRequest":    (*pbReportRequest)(nil),
+		"iowait.ControlRequest":   (*pbControlRequest)(nil),
+		"iowait.ControlResponse":  (*pbControlResponse)(nil),
+		"iowait.Report":           (*pbReport)(nil),
+		"iowait.PluginSpec":       (*pbPluginSpec)(nil),
+		"iowait.Topology":         (*pbTopology)(nil),
+		"iowait.Node":             (*pbNode)(nil),
+		"iowait.Metric":           (*pbMetric)(nil),
+		"iowait.Sample":           (*pbSample)(nil),
+		"iowait.StringEntry":      (*pbStringEntry)(nil),
+		"iowait.ControlEntry":     (*pbControlEntry)(nil),
+		"iowait.MetricTemplate":   (*pbMetricTemplate)(nil),
+		"iowait.MetadataTemplate": (*pbMetadataTemplate)(nil),
+		"iowait.TableTemplate":    (*pbTableTemplate)(nil),
+		"iowait.Column":           (*pbColumn)(nil),
+		"iowait.Control":          (*pbControl)(nil),
+	} {
+		proto.RegisterType(m, name)
+	}
+}
+
+func pbTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// reportToPB converts a report to its protobuf message.
+func reportToPB(rpt *report) *pbReport {
+	if rpt == nil {
+		return nil
+	}
+	out := &pbReport{
+		Host:      topologyToPB(&rpt.Host),
+		Container: topologyToPB(rpt.Container),
+		Pod:       topologyToPB(rpt.Pod),
+		Shortcut:  rpt.Shortcut,
+	}
+	for _, spec := range rpt.Plugins {
+		out.Plugins = append(out.Plugins, &pbPluginSpec{
+			Id:          spec.ID,
+			Label:       spec.Label,
+			Description: spec.Description,
+			Interfaces:  spec.Interfaces,
+			ApiVersion:  spec.APIVersion,
+		})
+	}
+	return out
+}
+
+func topologyToPB(t *topology) *pbTopology {
+	if t == nil {
+		return nil
+	}
+	out := &pbTopology{
+		Nodes:             map[string]*pbNode{},
+		MetricTemplates:   map[string]*pbMetricTemplate{},
+		MetadataTemplates: map[string]*pbMetadataTemplate{},
+		TableTemplates:    map[string]*pbTableTemplate{},
+		Controls:          map[string]*pbControl{},
+	}
+	for id, n := range t.Nodes {
+		pn := &pbNode{
+			Metrics:        map[string]*pbMetric{},
+			Latest:         map[string]*pbStringEntry{},
+			LatestControls: map[string]*pbControlEntry{},
+		}
+		for mid, m := range n.Metrics {
+			pm := &pbMetric{Min: m.Min, Max: m.Max}
+			for _, smp := range m.Samples {
+				pm.Samples = append(pm.Samples, &pbSample{Date: pbTime(smp.Date), Value: smp.Value})
+			}
+			pn.Metrics[mid] = pm
+		}
+		for key, e := range n.Latest {
+			pn.Latest[key] = &pbStringEntry{Timestamp: pbTime(e.Timestamp), Value: e.Value}
+		}
+		for key, e := range n.LatestControls {
+			pn.LatestControls[key] = &pbControlEntry{Timestamp: pbTime(e.Timestamp), Dead: e.Value.Dead}
+		}
+		out.Nodes[id] = pn
+	}
+	for id, tmpl := range t.MetricTemplates {
+		out.MetricTemplates[id] = &pbMetricTemplate{Id: tmpl.ID, Label: tmpl.Label, Format: tmpl.Format, Priority: tmpl.Priority}
+	}
+	for id, tmpl := range t.MetadataTemplates {
+		out.MetadataTemplates[id] = &pbMetadataTemplate{Id: tmpl.ID, Label: tmpl.Label, DataType: tmpl.Datatype, Priority: tmpl.Priority, From: tmpl.From}
+	}
+	for id, tmpl := range t.TableTemplates {
+		pt := &pbTableTemplate{Id: tmpl.ID, Label: tmpl.Label, Prefix: tmpl.Prefix, Type: tmpl.Type}
+		for _, col := range tmpl.Columns {
+			pt.Columns = append(pt.Columns, &pbColumn{Id: col.ID, Label: col.Label, DataType: col.DataType})
+		}
+		out.TableTemplates[id] = pt
+	}
+	for id, c := range t.Controls {
+		out.Controls[id] = &pbControl{Id: c.ID, Human: c.Human, Icon: c.Icon, Rank: int32(c.Rank)}
+	}
+	return out
+}
+
+// pluginServer is the Plugin service of iowait.proto.
+type pluginServer interface {
+	Report(context.Context, *pbReportRequest) (*pbReport, error)
+	Control(context.Context, *pbControlRequest) (*pbControlResponse, error)
+}
+
+// grpcAPI serves the report and control functionality over gRPC, for
+// consumers other than Scope and typed clients in tests and tooling.
+type grpcAPI struct {
+	plugin *Plugin
+	// tenants, set with -public-tokens, authorize the calls.
+	tenants *tenantFilter
+}
+
+// authorize is the interceptor requiring one of the tokens of the
+// read-only API, as a bearer token in the authorization metadata.
+// Controls need a token showing everything, and reports only show what
+// the token may see.
+func (a *grpcAPI) authorize(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	token := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for _, auth := range md.Get("authorization") {
+			if strings.HasPrefix(auth, "Bearer ") {
+				token = strings.TrimPrefix(auth, "Bearer ")
+			}
+		}
+	}
+	scope, ok := a.tenants.tokenScope(token)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "missing or unknown token")
+	}
+	if info.FullMethod == "/iowait.Plugin/Control" && !scope.all {
+		return nil, status.Error(codes.PermissionDenied, "controls need a token for every namespace")
+	}
+	return handler(context.WithValue(ctx, tenantScopeKey{}, scope), req)
+}
+
+func (a *grpcAPI) Report(ctx context.Context, _ *pbReportRequest) (*pbReport, error) {
+	ctx, sp := startServerSpan(ctx, "grpc.report")
+	defer sp.end()
+	// The report is the one served on the socket, sharing its cache.
+	raw, err := a.plugin.reportJSON(ctx)
+	if err != nil {
+		sp.setError(err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	rpt := &report{}
+	if err := json.Unmarshal(raw, rpt); err != nil {
+		sp.setError(err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if scope, ok := ctx.Value(tenantScopeKey{}).(tenantScope); ok {
+		if v, ok := a.tenants.scopeView(ctx, scope); ok {
+			rpt = filterReport(rpt, v)
+		}
+	}
+	return reportToPB(rpt), nil
+}
+
+func (a *grpcAPI) Control(ctx context.Context, req *pbControlRequest) (*pbControlResponse, error) {
+	ctx, sp := startServerSpan(ctx, "grpc.control")
+	defer sp.end()
+	rpt, err := a.plugin.control(ctx, request{NodeID: req.NodeId, Control: req.Control})
+	if errors.Is(err, errControlRejected) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &pbControlResponse{ShortcutReport: reportToPB(rpt)}, nil
+}
+
+// pluginServiceDesc describes the Plugin service, as protoc-gen-go-grpc
+// would generate it.
+var pluginServiceDesc = grpc.ServiceDesc{
+	ServiceName: "iowait.Plugin",
+	HandlerType: (*pluginServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Report",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				in := new(pbReportRequest)
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				if interceptor == nil {
+					return srv.(pluginServer).Report(ctx, in)
+				}
+				info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/iowait.Plugin/Report"}
+				return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+					return srv.(pluginServer).Report(ctx, req.(*pbReportRequest))
+				})
+			},
+		},
+		{
+			MethodName: "Control",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				in := new(pbControlRequest)
+				if err := dec(in); err != nil {
+					return nil, err
+				}
+				if interceptor == nil {
+					return srv.(pluginServer).Control(ctx, in)
+				}
+				info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/iowait.Plugin/Control"}
+				return interceptor(ctx, in, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+					return srv.(pluginServer).Control(ctx, req.(*pbControlRequest))
+				})
+			},
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "iowait.proto",
+}
+
+// serveGRPC serves the gRPC API on a TCP address. It runs controls, so it
+// requires the tokens of the read-only API, or without them is only served
+// on a loopback address.
+func serveGRPC(addr string, plugin *Plugin, tenants *tenantFilter) error {
+	api := &grpcAPI{plugin: plugin, tenants: tenants}
+	opts := []grpc.ServerOption{}
+	if tenants != nil {
+		opts = append(opts, grpc.UnaryInterceptor(api.authorize))
+	} else {
+		loopback, err := isLoopbackAddr(addr)
+		if err != nil {
+			return fmt.Errorf("invalid -grpc-addr %q: %v", addr, err)
+		}
+		if !loopback {
+			return fmt.Errorf("invalid -grpc-addr %q: without -public-tokens the gRPC API is only served on localhost", addr)
+		}
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %q: %v", addr, err)
+	}
+	server := grpc.NewServer(opts...)
+	server.RegisterService(&pluginServiceDesc, api)
+	grpcLog.Infof("gRPC API listening on: tcp://%s", ln.Addr())
+	go func() {
+		if err := server.Serve(ln); err != nil {
+			grpcLog.Error(err)
+		}
+	}()
+	return nil
+}
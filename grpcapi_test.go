@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestGRPCAuthorize(t *testing.T) {
+	api := &grpcAPI{tenants: &tenantFilter{tokens: map[string]tenantScope{
+		"admin": {all: true, namespaces: map[string]bool{"*": true}},
+		"team":  {namespaces: map[string]bool{"team": true}},
+	}}}
+	for _, tc := range []struct {
+		method, auth string
+		want         codes.Code
+	}{
+		{method: "Report", want: codes.Unauthenticated},
+		{method: "Report", auth: "Bearer nope", want: codes.Unauthenticated},
+		{method: "Report", auth: "team", want: codes.Unauthenticated},
+		{method: "Report", auth: "Bearer team", want: codes.OK},
+		{method: "Report", auth: "Bearer admin", want: codes.OK},
+		{method: "Control", auth: "Bearer team", want: codes.PermissionDenied},
+		{method: "Control", auth: "Bearer admin", want: codes.OK},
+	} {
+		ctx := context.Background()
+		if tc.auth != "" {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", tc.auth))
+		}
+		info := &grpc.UnaryServerInfo{FullMethod: "/iowait.Plugin/" + tc.method}
+		_, err := api.authorize(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			if _, ok := ctx.Value(tenantScopeKey{}).(tenantScope); !ok {
+				t.Errorf("%s with %q: no scope passed on", tc.method, tc.auth)
+			}
+			return nil, nil
+		})
+		if got := status.Code(err); got != tc.want {
+			t.Errorf("%s with %q: got %s, want %s", tc.method, tc.auth, got, tc.want)
+		}
+	}
+}
+
+func TestServeGRPCLoopbackOnly(t *testing.T) {
+	if err := serveGRPC(":0", &Plugin{}, nil); err == nil {
+		t.Error("served on every address without tokens")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var socketLog = componentLog("socket")
+
+// Warm standby lets a new plugin instance take over from a running one
+// without a gap in Scope's graphs:
+//
+//  1. the new instance listens on a temporary socket next to the plugin
+//     socket and warms its collectors;
+//  2. it atomically renames the temporary socket over the plugin socket,
+//     so new connections from the probe reach it;
+//  3. the old instance notices it no longer owns the plugin socket, stops
+//     accepting connections, drains in-flight requests and exits without
+//     removing the socket.
+type socketOwner struct {
+	path    string
+	tmpPath string
+	info    os.FileInfo
+}
+
+// listenStandby listens on a temporary socket next to socketPath, leaving
+// any instance currently serving socketPath untouched.
+func listenStandby(socketPath string) (net.Listener, *socketOwner, error) {
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0700); err != nil {
+		return nil, nil, fmt.Errorf("failed to create directory %q: %v", filepath.Dir(socketPath), err)
+	}
+	// The old and new instances of a DaemonSet rollout usually both run as
+	// PID 1, so the temporary socket gets a random name rather than one
+	// derived from the PID, which the other instance could remove.
+	tmp, err := os.CreateTemp(filepath.Dir(socketPath), filepath.Base(socketPath)+".*.standby")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create standby socket next to %q: %v", socketPath, err)
+	}
+	tmpPath := tmp.Name()
+	tmp.Close()
+	os.Remove(tmpPath)
+	listener, err := net.Listen("unix", tmpPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to listen on %q: %v", tmpPath, err)
+	}
+	// The socket is renamed later, so closing the listener must not unlink
+	// whatever path it was created at: that may belong to another instance.
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	socketLog.Infof("Listening on standby socket: unix://%s", tmpPath)
+	return listener, &socketOwner{path: socketPath, tmpPath: tmpPath}, nil
+}
+
+// takeOver renames the standby socket over the plugin socket.
+func (o *socketOwner) takeOver() error {
+	if err := os.Rename(o.tmpPath, o.path); err != nil {
+		return fmt.Errorf("failed to take over %q: %v", o.path, err)
+	}
+	info, err := os.Stat(o.path)
+	if err != nil {
+		return fmt.Errorf("failed to take over %q: %v", o.path, err)
+	}
+	o.info = info
+	socketLog.Infof("Listening on: unix://%s", o.path)
+	return nil
+}
+
+// owned tells whether the plugin socket is still the one we created.
+func (o *socketOwner) owned() bool {
+	if o.info == nil {
+		return false
+	}
+	info, err := os.Stat(o.path)
+	return err == nil && os.SameFile(o.info, info)
+}
+
+// release removes our sockets, leaving a newer instance's socket alone,
+// and the socket directory once it is empty.
+func (o *socketOwner) release() {
+	if o.owned() {
+		os.Remove(o.path)
+	}
+	if o.tmpPath != "" {
+		os.Remove(o.tmpPath)
+	}
+	os.Remove(filepath.Dir(o.path))
+}
+
+// watch calls lost once another instance has taken over the plugin socket.
+func (o *socketOwner) watch(interval time.Duration, lost func()) {
+	for range time.Tick(interval) {
+		if !o.owned() {
+			lost()
+			return
+		}
+	}
+}
+
+// warmUp primes the delta based collectors so the first report served
+// after a takeover covers a short, recent interval rather than the time
+// since boot.
+func (p *Plugin) warmUp(d time.Duration) error {
+	_, err := p.makeReport(context.Background())
+	time.Sleep(d)
+	return err
+}
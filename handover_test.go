@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestListenStandbyDistinctSockets checks that two instances, e.g. both
+// PID 1 in their containers, don't share a standby socket.
+func TestListenStandbyDistinctSockets(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "iowait.sock")
+	old, oldOwner, err := listenStandby(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	standby, owner, err := listenStandby(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer standby.Close()
+	if owner.tmpPath == oldOwner.tmpPath {
+		t.Fatalf("both instances listen on %s", owner.tmpPath)
+	}
+
+	oldOwner.release()
+	if _, err := os.Stat(owner.tmpPath); err != nil {
+		t.Errorf("releasing the other instance removed the standby socket: %v", err)
+	}
+	if err := owner.takeOver(); err != nil {
+		t.Fatal(err)
+	}
+	if !owner.owned() {
+		t.Error("plugin socket not owned after the takeover")
+	}
+}
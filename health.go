@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var healthLog = componentLog("health")
+
+// healthChecker serves the liveness and readiness probes. The plugin is
+// live as long as it can serve reports at all, i.e. no collection nor
+// p.lock is wedged for longer than timeout. It is ready when it owns its
+// socket, a collection succeeded within the last intervals collection
+// intervals, Prometheus, if used, answers and the latest self check, if
+// any, got a fresh report from the socket.
+type healthChecker struct {
+	plugin    *Plugin
+	prom      *prometheusCollector
+	interval  time.Duration
+	intervals int
+	timeout   time.Duration
+
+	lock  sync.Mutex
+	owner *socketOwner
+	// selfCheck must have succeeded within selfCheckWindow.
+	selfCheck       *selfCheck
+	selfCheckWindow time.Duration
+}
+
+func newHealthChecker(plugin *Plugin, prom *prometheusCollector, interval time.Duration, intervals int, timeout time.Duration) *healthChecker {
+	return &healthChecker{plugin: plugin, prom: prom, interval: interval, intervals: intervals, timeout: timeout}
+}
+
+// setOwner records the plugin socket once it is listened on, or taken over
+// from the active instance in warm standby.
+func (h *healthChecker) setOwner(owner *socketOwner) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.owner = owner
+}
+
+func (h *healthChecker) setSelfCheck(c *selfCheck, window time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.selfCheck, h.selfCheckWindow = c, window
+}
+
+func (h *healthChecker) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", h.serveHealthz)
+	mux.HandleFunc("/readyz", h.serveReadyz)
+	return mux
+}
+
+// healthCheck is the outcome of one check: "" if it passed.
+type healthCheck struct {
+	name    string
+	failure string
+}
+
+func writeHealth(w http.ResponseWriter, checks []healthCheck) {
+	status, lines := http.StatusOK, []string{}
+	for _, c := range checks {
+		if c.failure != "" {
+			status = http.StatusServiceUnavailable
+			lines = append(lines, fmt.Sprintf("[-]%s failed: %s", c.name, c.failure))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("[+]%s ok", c.name))
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprintln(w, strings.Join(lines, "\n"))
+}
+
+func (h *healthChecker) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, []healthCheck{{"report", h.checkReports()}})
+}
+
+func (h *healthChecker) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), h.timeout)
+	defer cancel()
+	checks := []healthCheck{
+		{"socket", h.checkSocket()},
+		{"collection", h.checkCollection(ctx)},
+	}
+	if h.prom != nil {
+		checks = append(checks, healthCheck{"prometheus", h.checkPrometheus(ctx)})
+	}
+	h.lock.Lock()
+	selfCheck, window := h.selfCheck, h.selfCheckWindow
+	h.lock.Unlock()
+	if selfCheck != nil {
+		failure := ""
+		if err := selfCheck.status(window); err != nil {
+			failure = err.Error()
+		}
+		checks = append(checks, healthCheck{"self-check", failure})
+	}
+	writeHealth(w, checks)
+}
+
+// checkReports tells whether no collection has been running for longer
+// than the timeout, and p.lock can be taken within it. A report stuck on
+// either blocks every later one.
+func (h *healthChecker) checkReports() string {
+	if running := h.plugin.lastCollect.runningFor(); running > h.timeout {
+		return fmt.Sprintf("collection running for %s", running.Round(time.Second))
+	}
+	locked := make(chan struct{})
+	go func() {
+		h.plugin.lock.Lock()
+		h.plugin.lock.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return ""
+	case <-time.After(h.timeout):
+		return fmt.Sprintf("reports blocked for over %s", h.timeout)
+	}
+}
+
+func (h *healthChecker) checkSocket() string {
+	h.lock.Lock()
+	owner := h.owner
+	h.lock.Unlock()
+	switch {
+	case owner == nil:
+		return "not listening yet"
+	case !owner.owned():
+		return fmt.Sprintf("%s is not ours", owner.path)
+	}
+	return ""
+}
+
+// checkCollection collects itself if nothing did for an interval, e.g.
+// because Scope stopped asking for reports, so that readiness reflects the
+// collectors rather than Scope.
+func (h *healthChecker) checkCollection(ctx context.Context) string {
+	if h.plugin.paused() {
+		return ""
+	}
+	last := &h.plugin.lastCollect
+	last.lock.Lock()
+	collected := last.time
+	last.lock.Unlock()
+	if time.Since(collected) > h.interval {
+		h.plugin.collect(ctx)
+	}
+
+	last.lock.Lock()
+	defer last.lock.Unlock()
+	window := time.Duration(h.intervals) * h.interval
+	if time.Since(last.succeeded) <= window {
+		return ""
+	}
+	errors := []string{}
+	for name, err := range last.errors {
+		errors = append(errors, name+": "+err)
+	}
+	sort.Strings(errors)
+	if last.succeeded.IsZero() {
+		return fmt.Sprintf("no collection succeeded yet (%s)", strings.Join(errors, "; "))
+	}
+	return fmt.Sprintf("no collection succeeded for %s (%s)", time.Since(last.succeeded).Round(time.Second), strings.Join(errors, "; "))
+}
+
+func (h *healthChecker) checkPrometheus(ctx context.Context) string {
+	if _, err := h.prom.query(ctx, "vector(1)"); err != nil {
+		return err.Error()
+	}
+	return ""
+}
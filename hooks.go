@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A reportHook post-processes a report after it has been built and before
+// it is serialized. Hooks run in the order they are configured, so
+// formatting policies live here instead of in the collectors.
+type reportHook func(rpt *report)
+
+// hookConfig holds the settings used by the built-in report hooks.
+type hookConfig struct {
+	Precision   int
+	MaxLabelLen int
+	Scales      map[string]float64
+
+	// SummaryWindow is the window summarized by the summary hook.
+	SummaryWindow time.Duration
+}
+
+var reportHookFactories = map[string]func(cfg hookConfig) reportHook{
+	"convert":  convertUnitsHook,
+	"round":    roundValuesHook,
+	"truncate": truncateLabelsHook,
+	"summary":  summaryHook,
+}
+
+// newReportHooks builds the hook pipeline from a list of hook names.
+func newReportHooks(names []string, cfg hookConfig) ([]reportHook, error) {
+	hooks := []reportHook{}
+	for _, name := range names {
+		factory, ok := reportHookFactories[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown report hook %q (known: %s)", name, strings.Join(reportHookNames(), ", "))
+		}
+		hooks = append(hooks, factory(cfg))
+	}
+	return hooks, nil
+}
+
+func reportHookNames() []string {
+	names := []string{}
+	for name := range reportHookFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func applyReportHooks(rpt *report, hooks []reportHook) {
+	for _, hook := range hooks {
+		hook(rpt)
+	}
+}
+
+// convertUnitsHook multiplies the samples and bounds of the configured
+// metrics by a fixed factor, e.g. to turn bytes into megabytes.
+func convertUnitsHook(cfg hookConfig) reportHook {
+	return func(rpt *report) {
+		for _, t := range rpt.topologies() {
+			for _, n := range t.Nodes {
+				for id, m := range n.Metrics {
+					factor, ok := cfg.Scales[id]
+					if !ok {
+						continue
+					}
+					for i := range m.Samples {
+						m.Samples[i].Value *= factor
+					}
+					m.Min *= factor
+					m.Max *= factor
+					n.Metrics[id] = m
+				}
+			}
+		}
+	}
+}
+
+// roundValuesHook rounds every sample, and the graph range, to
+// cfg.Precision decimal places.
+func roundValuesHook(cfg hookConfig) reportHook {
+	scale := math.Pow(10, float64(cfg.Precision))
+	round := func(v float64) float64 { return math.Round(v*scale) / scale }
+	return func(rpt *report) {
+		for _, t := range rpt.topologies() {
+			for _, n := range t.Nodes {
+				for id, m := range n.Metrics {
+					for i := range m.Samples {
+						m.Samples[i].Value = round(m.Samples[i].Value)
+					}
+					m.Min = round(m.Min)
+					m.Max = round(m.Max)
+					n.Metrics[id] = m
+				}
+			}
+		}
+	}
+}
+
+// truncateLabelsHook shortens metric template and control labels longer
+// than cfg.MaxLabelLen characters.
+func truncateLabelsHook(cfg hookConfig) reportHook {
+	return func(rpt *report) {
+		for _, t := range rpt.topologies() {
+			for id, tmpl := range t.MetricTemplates {
+				tmpl.Label = truncateLabel(tmpl.Label, cfg.MaxLabelLen)
+				t.MetricTemplates[id] = tmpl
+			}
+			for id, ctrl := range t.Controls {
+				ctrl.Human = truncateLabel(ctrl.Human, cfg.MaxLabelLen)
+				t.Controls[id] = ctrl
+			}
+		}
+	}
+}
+
+func truncateLabel(label string, max int) string {
+	runes := []rune(label)
+	if max <= 0 || len(runes) <= max {
+		return label
+	}
+	if max == 1 {
+		return "…"
+	}
+	return string(runes[:max-1]) + "…"
+}
+
+// parseScales parses a comma separated list of metric=factor pairs.
+func parseScales(s string) (map[string]float64, error) {
+	return parseFloats(s, "metric scale", "metric=factor")
+}
+
+// parseFloats parses a comma separated list of name=number pairs.
+func parseFloats(s, what, syntax string) (map[string]float64, error) {
+	values := map[string]float64{}
+	for _, pair := range splitList(s) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid %s %q, expected %s", what, pair, syntax)
+		}
+		value, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", what, pair, err)
+		}
+		values[parts[0]] = value
+	}
+	return values, nil
+}
+
+// parseLimits parses a comma separated list of metric=count pairs.
+func parseLimits(s string) (map[string]int, error) {
+	limits := map[string]int{}
+	for _, pair := range splitList(s) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid metric limit %q, expected metric=count", pair)
+		}
+		limit, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid metric limit %q: %v", pair, err)
+		}
+		limits[parts[0]] = limit
+	}
+	return limits, nil
+}
+
+// splitList splits a comma separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	items := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestRoundValuesHook(t *testing.T) {
+	rpt := &report{Host: topology{Nodes: map[string]node{
+		"host": {Metrics: map[string]metric{
+			"write_iops": {
+				Samples: []sample{{Value: 1.005}, {Value: -2.345}, {Value: -0.25}},
+				Min:     -2.345,
+				Max:     1.005,
+			},
+		}},
+	}}}
+	roundValuesHook(hookConfig{Precision: 1})(rpt)
+	m := rpt.Host.Nodes["host"].Metrics["write_iops"]
+	for i, want := range []float64{1, -2.3, -0.3} {
+		if got := m.Samples[i].Value; got != want {
+			t.Errorf("sample %d: got %v, want %v", i, got, want)
+		}
+	}
+	if m.Min != -2.3 || m.Max != 1 {
+		t.Errorf("got range %v..%v, want -2.3..1", m.Min, m.Max)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Scope probes name their host node after SCOPE_HOSTNAME or, without it,
+// their host name. In a DaemonSet pod, the plugin's own host name is that
+// of the pod unless it runs in the host network, so its metrics would land
+// on a node Scope doesn't know.
+
+// resolveHostID returns the ID of the host node metrics are attached to,
+// and where it comes from: the -hostname flag, the Scope probe running on
+// the host if discover is set, the NODE_NAME environment variable (e.g.
+// from the Kubernetes downward API) or, failing those, the host name.
+func resolveHostID(flagValue string, discover bool) (string, string) {
+	if flagValue != "" {
+		return flagValue, "-hostname"
+	}
+	if discover {
+		if id := discoverProbeHostID("/proc"); id != "" {
+			return id, "Scope probe"
+		}
+		log.Warnf("No Scope probe found to discover the host ID from; is the plugin running with hostPID?")
+	}
+	if name := os.Getenv("NODE_NAME"); name != "" {
+		return name, "NODE_NAME"
+	}
+	name, _ := os.Hostname()
+	return name, "host name"
+}
+
+// discoverProbeHostID looks among the processes under procDir for a Scope
+// probe, and returns the host ID it reports under: its SCOPE_HOSTNAME or,
+// as it runs in the host network, the host name of its root filesystem.
+func discoverProbeHostID(procDir string) string {
+	entries, err := ioutil.ReadDir(procDir)
+	if err != nil {
+		return ""
+	}
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err != nil {
+			continue
+		}
+		dir := filepath.Join(procDir, entry.Name())
+		cmdline, err := ioutil.ReadFile(filepath.Join(dir, "cmdline"))
+		if err != nil || !isScopeProbe(strings.Split(string(bytes.TrimRight(cmdline, "\x00")), "\x00")) {
+			continue
+		}
+		if environ, err := ioutil.ReadFile(filepath.Join(dir, "environ")); err == nil {
+			for _, v := range strings.Split(string(environ), "\x00") {
+				if name := strings.TrimPrefix(v, "SCOPE_HOSTNAME="); name != v && name != "" {
+					return name
+				}
+			}
+		}
+		if name := readSysfs(filepath.Join(dir, "root", "etc", "hostname")); name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// isScopeProbe tells whether a command line is that of a Scope probe,
+// either scope-probe or the scope binary in probe mode.
+func isScopeProbe(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	switch filepath.Base(args[0]) {
+	case "scope-probe":
+		return true
+	case "scope":
+		for i, arg := range args[1:] {
+			switch strings.TrimLeft(arg, "-") {
+			case "mode=probe":
+				return true
+			case "mode":
+				if i+2 < len(args) && args[i+2] == "probe" {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	defaultPluginID = "iowait"
+
+	// Scope probes look for plugin sockets under pluginsDir.
+	pluginsDir = "/var/run/scope/plugins"
+)
+
+var pluginIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// pluginIdentity is how the plugin presents itself in Scope. Instances with
+// different IDs, e.g. one per storage engine, don't collide in the plugin
+// list or on disk.
+type pluginIdentity struct {
+	id, label   string
+	description string            // replaces the default description
+	icons       map[string]string // control ID → icon overrides
+}
+
+func newPluginIdentity(id, label, description, icons string) (pluginIdentity, error) {
+	if !pluginIDPattern.MatchString(id) {
+		return pluginIdentity{}, fmt.Errorf("invalid plugin ID %q, expected lowercase letters, digits, - and _", id)
+	}
+	if label == "" {
+		label = id
+	}
+	iconMap := map[string]string{}
+	for _, pair := range splitList(icons) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return pluginIdentity{}, fmt.Errorf("invalid control icon %q, expected control=icon", pair)
+		}
+		iconMap[parts[0]] = parts[1]
+	}
+	return pluginIdentity{id: id, label: label, description: description, icons: iconMap}, nil
+}
+
+// socketPath is where the plugin listens. We put the socket in a
+// sub-directory to have more control on the permissions.
+func (i pluginIdentity) socketPath() string {
+	return filepath.Join(pluginsDir, i.id, i.id+".sock")
+}
+
+// icon returns the icon of a control, or def if it isn't overridden.
+func (i pluginIdentity) icon(controlID, def string) string {
+	if icon, ok := i.icons[controlID]; ok {
+		return icon
+	}
+	return def
+}
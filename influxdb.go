@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	influxQL = "influxql"
+	flux     = "flux"
+
+	// pvTag and instanceTag are the tags series of a volume and of an
+	// instance are grouped by, as the Prometheus labels are; Graphite
+	// series carry them too.
+	pvTag       = "openebs_pv"
+	instanceTag = "instance"
+)
+
+func init() {
+	collectorFactories["influxdb"] = func(opts collectorOptions) (Collector, error) {
+		c, err := newInfluxCollector(opts.InfluxDB, opts.HTTPClient, opts.PVShard)
+		if err != nil {
+			return nil, err
+		}
+		c.hosts = opts.InstanceHosts
+		return c, nil
+	}
+}
+
+// influxOptions are the settings of the InfluxDB backend.
+type influxOptions struct {
+	URL string
+	// Language is influxql, for the 1.x /query API (also served by 2.x
+	// for mapped buckets), or flux, for the 2.x /api/v2/query API.
+	Language string
+	// Database is the InfluxQL database, Org the Flux organisation.
+	Database, Org string
+	// Token, if set, authenticates requests: an API token, or
+	// user:password for 1.x.
+	Token   string
+	Queries []promQuery
+}
+
+// influxCollector runs queries against InfluxDB, for storage metrics kept
+// in Influx rather than Cortex, and reports their results like the
+// Prometheus collector does: the last point of every series, one metric
+// per volume for series grouped by the openebs_pv tag.
+type influxCollector struct {
+	opts   influxOptions
+	client *http.Client
+	owns   func(key string) bool
+	hosts  *instanceHosts
+}
+
+func newInfluxCollector(opts influxOptions, client *http.Client, owns func(key string) bool) (*influxCollector, error) {
+	if opts.URL == "" {
+		return nil, fmt.Errorf("influxdb: no URL configured")
+	}
+	switch opts.Language {
+	case influxQL:
+		if opts.Database == "" {
+			return nil, fmt.Errorf("influxdb: InfluxQL queries need a database")
+		}
+	case flux:
+		if opts.Org == "" {
+			return nil, fmt.Errorf("influxdb: Flux queries need an organisation")
+		}
+	default:
+		return nil, fmt.Errorf("influxdb: unknown query language %q (known: %s, %s)", opts.Language, influxQL, flux)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	opts.URL = strings.TrimSuffix(opts.URL, "/")
+	return &influxCollector{opts: opts, client: client, owns: owns}, nil
+}
+
+func (c *influxCollector) Name() string { return "influxdb" }
+
+func (c *influxCollector) String() string { return "influxdb=" + c.opts.Language }
+
+func (c *influxCollector) Collect(ctx context.Context) ([]Metric, error) {
+	metrics := []Metric{}
+	for i, q := range c.opts.Queries {
+		samples, err := c.query(ctx, q.Query)
+		if err != nil {
+			return metrics, fmt.Errorf("influxdb: query %q: %v", q.Query, err)
+		}
+		for _, s := range samples {
+			if m, ok := s.metric(ctx, q.ID, i, c.owns, c.hosts); ok {
+				metrics = append(metrics, m)
+			}
+		}
+	}
+	return metrics, nil
+}
+
+func (c *influxCollector) query(ctx context.Context, query string) ([]querySample, error) {
+	var req *http.Request
+	var err error
+	if c.opts.Language == influxQL {
+		params := url.Values{"db": {c.opts.Database}, "q": {query}, "epoch": {"ms"}}
+		req, err = http.NewRequest("GET", c.opts.URL+"/query?"+params.Encode(), nil)
+	} else {
+		params := url.Values{"org": {c.opts.Org}}
+		req, err = http.NewRequest("POST", c.opts.URL+"/api/v2/query?"+params.Encode(), strings.NewReader(query))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/vnd.flux")
+			req.Header.Set("Accept", "application/csv")
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.opts.Token != "" {
+		req.Header.Set("Authorization", "Token "+c.opts.Token)
+	}
+	res, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return nil, fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	if c.opts.Language == influxQL {
+		return parseInfluxQLResponse(res.Body)
+	}
+	return parseFluxCSV(res.Body)
+}
+
+// parseInfluxQLResponse returns the last point of every series of an
+// InfluxQL response with millisecond epoch times, e.g.
+//
+//	{"results": [{"series": [{"tags": {"openebs_pv": "pvc-1"},
+//	  "columns": ["time", "last"], "values": [[1600000000000, 12.5]]}]}]}
+func parseInfluxQLResponse(r io.Reader) ([]querySample, error) {
+	response := struct {
+		Results []struct {
+			Error  string `json:"error"`
+			Series []struct {
+				Tags   map[string]string `json:"tags"`
+				Values [][]interface{}   `json:"values"`
+			} `json:"series"`
+		} `json:"results"`
+	}{}
+	if err := json.NewDecoder(r).Decode(&response); err != nil {
+		return nil, err
+	}
+	samples := []querySample{}
+	for _, result := range response.Results {
+		if result.Error != "" {
+			return nil, fmt.Errorf("%s", result.Error)
+		}
+		for _, series := range result.Series {
+			if len(series.Values) == 0 {
+				continue
+			}
+			// The first column is the time, the next the value.
+			point := series.Values[len(series.Values)-1]
+			if len(point) < 2 {
+				continue
+			}
+			ms, ok1 := point[0].(float64)
+			value, ok2 := point[1].(float64)
+			if !ok1 || !ok2 {
+				continue
+			}
+			samples = append(samples, querySample{
+				PV:       series.Tags[pvTag],
+				Instance: series.Tags[instanceTag],
+				Time:     time.Unix(0, int64(ms)*int64(time.Millisecond)),
+				Value:    value,
+			})
+		}
+	}
+	return samples, nil
+}
+
+// parseFluxCSV returns the last record of every table of a Flux response
+// in CSV without annotations: tables, each with a header row, separated by
+// empty lines, e.g.
+//
+//	,result,table,_time,_value,openebs_pv
+//	,_result,0,2020-09-13T12:26:40Z,12.5,pvc-1
+func parseFluxCSV(r io.Reader) ([]querySample, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	samples := []querySample{}
+	var header map[string]int
+	last := map[string]querySample{}
+	tables := []string{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		// The reader skips the empty lines between tables, so header rows
+		// are told by their columns; errors come as a table of their own.
+		isHeader := false
+		for _, name := range record {
+			isHeader = isHeader || name == "_value" || name == "error"
+		}
+		if isHeader {
+			header = map[string]int{}
+			for i, name := range record {
+				header[name] = i
+			}
+			continue
+		}
+		if header == nil {
+			continue
+		}
+		column := func(name string) string {
+			if i, ok := header[name]; ok && i < len(record) {
+				return record[i]
+			}
+			return ""
+		}
+		if column("error") != "" {
+			return nil, fmt.Errorf("%s", column("error"))
+		}
+		value, err := strconv.ParseFloat(column("_value"), 64)
+		if err != nil {
+			continue
+		}
+		ts, err := time.Parse(time.RFC3339Nano, column("_time"))
+		if err != nil {
+			ts = time.Now()
+		}
+		table := column("result") + "/" + column("table")
+		if _, ok := last[table]; !ok {
+			tables = append(tables, table)
+		}
+		last[table] = querySample{PV: column(pvTag), Instance: column(instanceTag), Time: ts, Value: value}
+	}
+	for _, table := range tables {
+		samples = append(samples, last[table])
+	}
+	return samples, nil
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	pvInfoTableID     = "pv-info-table"
+	pvInfoTablePrefix = "pv-info-table-"
+
+	// informerRetryInterval is how long an informer waits before listing
+	// again after a failure.
+	informerRetryInterval = 5 * time.Second
+)
+
+// errWatchExpired ends a watch whose resource version is too old, so the
+// informer lists afresh.
+var errWatchExpired = errors.New("kubernetes: watch expired")
+
+func init() {
+	collectorFactories["pv-info"] = func(opts collectorOptions) (Collector, error) {
+		kube, err := newInClusterKubeClient()
+		if err != nil {
+			return nil, err
+		}
+		d := newPVDetails(kube, opts.PVShard)
+		go d.volumes.run()
+		go d.claims.run()
+		return d, nil
+	}
+}
+
+// kubeInformer keeps a cache of the objects of an API collection, listed
+// once and then kept up to date by watching it, so that reports never wait
+// on the Kubernetes API.
+type kubeInformer struct {
+	kube   *kubeClient
+	name   string
+	path   string
+	decode func(raw json.RawMessage) (interface{}, error)
+
+	lock    sync.Mutex
+	objects map[string]interface{}
+	synced  bool
+}
+
+// objectMeta is the metadata every object is keyed and versioned by.
+type objectMeta struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+}
+
+func (m objectMeta) key() string {
+	if m.Metadata.Namespace == "" {
+		return m.Metadata.Name
+	}
+	return m.Metadata.Namespace + "/" + m.Metadata.Name
+}
+
+func newKubeInformer(kube *kubeClient, name, path string, decode func(raw json.RawMessage) (interface{}, error)) *kubeInformer {
+	return &kubeInformer{kube: kube, name: name, path: path, decode: decode, objects: map[string]interface{}{}}
+}
+
+// run lists and watches the collection forever, listing afresh whenever
+// the watch fails or expires.
+func (i *kubeInformer) run() {
+	ctx := context.Background()
+	for {
+		version, err := i.relist(ctx)
+		for err == nil {
+			version, err = i.watchFrom(ctx, version)
+		}
+		if err == errWatchExpired {
+			collectorLog("pv-info").Debugf("Watch of %s expired, listing again", i.name)
+			continue
+		}
+		collectorLog("pv-info").Warnf("Cannot watch %s: %v", i.name, err)
+		time.Sleep(informerRetryInterval)
+	}
+}
+
+// relist replaces the cache with the current objects, returning the
+// resource version to watch from.
+func (i *kubeInformer) relist(ctx context.Context) (string, error) {
+	list := struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []json.RawMessage `json:"items"`
+	}{}
+	if err := i.kube.get(ctx, i.path, &list); err != nil {
+		return "", err
+	}
+	objects := map[string]interface{}{}
+	for _, raw := range list.Items {
+		meta := objectMeta{}
+		if err := json.Unmarshal(raw, &meta); err != nil {
+			return "", fmt.Errorf("kubernetes: %s: %v", i.name, err)
+		}
+		obj, err := i.decode(raw)
+		if err != nil {
+			return "", fmt.Errorf("kubernetes: %s: %v", i.name, err)
+		}
+		objects[meta.key()] = obj
+	}
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.objects = objects
+	i.synced = true
+	return list.Metadata.ResourceVersion, nil
+}
+
+// watchFrom applies the changes since a resource version to the cache,
+// returning the latest resource version seen.
+func (i *kubeInformer) watchFrom(ctx context.Context, version string) (string, error) {
+	err := i.kube.watch(ctx, i.path, version, func(event watchEvent) error {
+		if event.Type == "ERROR" {
+			status := struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			}{}
+			if err := json.Unmarshal(event.Object, &status); err == nil && status.Code == 410 {
+				return errWatchExpired
+			}
+			return fmt.Errorf("kubernetes: watch %s: %s", i.name, event.Object)
+		}
+		meta := objectMeta{}
+		if err := json.Unmarshal(event.Object, &meta); err != nil {
+			return fmt.Errorf("kubernetes: watch %s: %v", i.name, err)
+		}
+		version = meta.Metadata.ResourceVersion
+		if event.Type == "BOOKMARK" {
+			return nil
+		}
+		var obj interface{}
+		if event.Type != "DELETED" {
+			var err error
+			if obj, err = i.decode(event.Object); err != nil {
+				return fmt.Errorf("kubernetes: watch %s: %v", i.name, err)
+			}
+		}
+		i.lock.Lock()
+		defer i.lock.Unlock()
+		if obj == nil {
+			delete(i.objects, meta.key())
+		} else {
+			i.objects[meta.key()] = obj
+		}
+		return nil
+	})
+	return version, err
+}
+
+// snapshot returns the cached objects by key, namespace/name for
+// namespaced ones, and whether they were listed yet.
+func (i *kubeInformer) snapshot() (map[string]interface{}, bool) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	objects := make(map[string]interface{}, len(i.objects))
+	for key, obj := range i.objects {
+		objects[key] = obj
+	}
+	return objects, i.synced
+}
+
+// persistentVolumeClaim is the part of a Kubernetes PersistentVolumeClaim
+// the plugin uses.
+type persistentVolumeClaim struct {
+	Requested string
+}
+
+func decodePV(raw json.RawMessage) (interface{}, error) {
+	obj := pvObject{}
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return nil, err
+	}
+	return obj.persistentVolume(), nil
+}
+
+func decodePVC(raw json.RawMessage) (interface{}, error) {
+	obj := struct {
+		Spec struct {
+			Resources struct {
+				Requests struct {
+					Storage string `json:"storage"`
+				} `json:"requests"`
+			} `json:"resources"`
+		} `json:"spec"`
+	}{}
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return nil, err
+	}
+	return persistentVolumeClaim{Requested: obj.Spec.Resources.Requests.Storage}, nil
+}
+
+// accessModeAbbreviations are how kubectl abbreviates access modes.
+var accessModeAbbreviations = map[string]string{
+	"ReadWriteOnce":    "RWO",
+	"ReadOnlyMany":     "ROX",
+	"ReadWriteMany":    "RWX",
+	"ReadWriteOncePod": "RWOP",
+}
+
+func abbreviateAccessModes(modes []string) string {
+	abbreviated := []string{}
+	for _, mode := range modes {
+		if short, ok := accessModeAbbreviations[mode]; ok {
+			mode = short
+		}
+		abbreviated = append(abbreviated, mode)
+	}
+	sort.Strings(abbreviated)
+	return strings.Join(abbreviated, ",")
+}
+
+// pvDetails shows a table of the PersistentVolumes of the cluster, with
+// their claim, storage class, capacity and access modes, from informers
+// watching the volumes and their claims.
+type pvDetails struct {
+	volumes *kubeInformer
+	claims  *kubeInformer
+	owns    func(key string) bool
+}
+
+func newPVDetails(kube *kubeClient, owns func(key string) bool) *pvDetails {
+	return &pvDetails{
+		volumes: newKubeInformer(kube, "PersistentVolumes", "/api/v1/persistentvolumes", decodePV),
+		claims:  newKubeInformer(kube, "PersistentVolumeClaims", "/api/v1/persistentvolumeclaims", decodePVC),
+		owns:    owns,
+	}
+}
+
+func (d *pvDetails) Name() string { return "pv-info" }
+
+// Collect only tells whether the volumes were listed yet: the table is
+// rendered from the informers' caches.
+func (d *pvDetails) Collect(ctx context.Context) ([]Metric, error) {
+	if _, synced := d.volumes.snapshot(); !synced {
+		return nil, fmt.Errorf("pv-info: PersistentVolumes not listed yet")
+	}
+	return nil, nil
+}
+
+func (d *pvDetails) Tables() []table {
+	volumes, _ := d.volumes.snapshot()
+	claims, _ := d.claims.snapshot()
+	rows := map[string]map[string]string{}
+	for name, obj := range volumes {
+		pv := obj.(persistentVolume)
+		if d.owns != nil && !d.owns(name) {
+			continue
+		}
+		row := map[string]string{
+			"pv":            name,
+			"storage_class": pv.StorageClass,
+			"capacity":      pv.Capacity,
+			"access_modes":  abbreviateAccessModes(pv.AccessModes),
+			"status":        pv.Phase,
+		}
+		if pv.Claim != "" {
+			key := pv.Namespace + "/" + pv.Claim
+			row["claim"] = key
+			if claim, ok := claims[key].(persistentVolumeClaim); ok {
+				row["requested"] = claim.Requested
+			}
+		}
+		rows[name] = row
+	}
+	return []table{{
+		Template: tableTemplate{
+			ID:     pvInfoTableID,
+			Label:  "Volume details",
+			Prefix: pvInfoTablePrefix,
+			Type:   "multicolumn-table",
+			Columns: []column{
+				{ID: "pv", Label: "Volume"},
+				{ID: "claim", Label: "Claim"},
+				{ID: "storage_class", Label: "Storage class"},
+				{ID: "capacity", Label: "Capacity"},
+				{ID: "requested", Label: "Requested"},
+				{ID: "access_modes", Label: "Access modes"},
+				{ID: "status", Label: "Status"},
+			},
+		},
+		Rows: rows,
+	}}
+}
@@ -0,0 +1,81 @@
+#!/bin/bash
+# End-to-end test of the plugin against a real Scope app and probe: checks
+# through the Scope API that the plugin is registered, that its metrics and
+# controls show up on the host node and that a control round trip works.
+#
+# Opt-in, run with `make integration-test`. Needs docker, docker-compose,
+# curl and jq, and port 4040 to be free.
+
+set -euo pipefail
+
+DIR="$(cd "$(dirname "${BASH_SOURCE[0]}")" && pwd)"
+export SCOPE_VERSION=${SCOPE_VERSION:-1.13.2}
+export IOWAIT_IMAGE=${IOWAIT_IMAGE:-weaveworksplugins/scope-iowait:latest}
+SCOPE=http://localhost:4040
+TIMEOUT=${TIMEOUT:-90}
+COMPOSE="docker-compose -p iowait-e2e -f $DIR/docker-compose.yml"
+
+failed=0
+
+cleanup() {
+    if [ "$failed" != 0 ]; then
+        $COMPOSE logs >&2 || true
+    fi
+    $COMPOSE down -v >/dev/null 2>&1 || true
+}
+trap cleanup EXIT
+
+# eventually <description> <command...> retries the command until it
+# succeeds or TIMEOUT seconds passed.
+eventually() {
+    local what=$1
+    shift
+    for _ in $(seq "$TIMEOUT"); do
+        if "$@" >/dev/null 2>&1; then
+            echo "ok: $what"
+            return 0
+        fi
+        sleep 1
+    done
+    echo "FAIL: $what" >&2
+    failed=1
+    exit 1
+}
+
+urlencode() {
+    jq -rn --arg s "$1" '$s|@uri'
+}
+
+plugin_ok() {
+    curl -sf "$SCOPE/api/report" | jq -e '.Plugins[] | select(.id == "iowait" and .status == "ok")'
+}
+
+host_node() {
+    curl -sf "$SCOPE/api/topology/hosts/$(urlencode "$HOST_NODE")"
+}
+
+has_metric() {
+    host_node | jq -e --arg id "$1" '.node.metrics[] | select(.id == $id)'
+}
+
+has_control() {
+    host_node | jq -e --arg id "$1" '.node.controls[].controls[] | select(.id == $id)'
+}
+
+run_control() {
+    local probe
+    probe=$(host_node | jq -r --arg id "$1" '.node.controls[] | select(any(.controls[]; .id == $id)) | .probeId')
+    curl -sf -X POST "$SCOPE/api/control/$(urlencode "$probe")/$(urlencode "$HOST_NODE")/$1"
+}
+
+$COMPOSE up -d
+
+eventually "Scope app is up" curl -sf "$SCOPE/api"
+eventually "the plugin is registered" plugin_ok
+HOST_NODE="$(hostname);<host>"
+eventually "the host node shows the idle metric" has_metric idle
+eventually "the host node shows the IO wait control" has_control switchToIOWait
+eventually "the IO wait control runs" run_control switchToIOWait
+eventually "the host node shows the IO wait metric" has_metric iowait
+eventually "the host node shows the idle control" has_control switchToIdle
+echo "PASS"
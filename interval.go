@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	pollIntervalControlPrefix = "pollInterval_"
+	// refreshControlID collects at once, whatever the poll interval and
+	// the report cache, for users investigating an incident.
+	refreshControlID = "refreshNow"
+
+	pollIntervalKey = "iowait_poll_interval"
+)
+
+// pollIntervalPresets are the collection intervals controls switch
+// between, trading freshness for load on busy nodes.
+var pollIntervalPresets = []time.Duration{time.Second, 5 * time.Second, 30 * time.Second}
+
+// pollIntervalForControl returns the interval a poll interval control
+// switches to.
+func pollIntervalForControl(controlID string) (time.Duration, bool) {
+	for _, interval := range pollIntervalPresets {
+		if pollIntervalControlPrefix+interval.String() == controlID {
+			return interval, true
+		}
+	}
+	return 0, false
+}
+
+// pollIntervalControls switch between the preset intervals, the one in
+// effect being dead. The caller holds p.lock.
+func (p *Plugin) pollIntervalControls() []controlDetails {
+	details := []controlDetails{}
+	for _, interval := range pollIntervalPresets {
+		details = append(details, controlDetails{
+			id:    pollIntervalControlPrefix + interval.String(),
+			human: "Collect every " + interval.String(),
+			icon:  "fa-hourglass-half",
+			dead:  p.pollInterval == interval,
+		})
+	}
+	return details
+}
+
+// setPollInterval changes the collection interval, recording it in the
+// runtime config so that it is exported with the state. The caller holds
+// p.lock.
+func (p *Plugin) setPollInterval(interval time.Duration) {
+	p.pollInterval = interval
+	if p.config == nil {
+		p.config = runtimeConfig{}
+	}
+	p.config["poll-interval"] = []string{interval.String()}
+}
+
+// addPollInterval shows the collection interval in effect on the host
+// node.
+func (p *Plugin) addPollInterval(rpt *report) {
+	value := "every report"
+	if p.pollInterval > 0 {
+		value = fmt.Sprintf("every %s", p.pollInterval)
+	}
+	hostNodeID := p.getTopologyHost()
+	n := rpt.Host.Nodes[hostNodeID]
+	if n.Latest == nil {
+		n.Latest = map[string]stringEntry{}
+	}
+	n.Latest[pollIntervalKey] = stringEntry{Timestamp: time.Now(), Value: value}
+	rpt.Host.Nodes[hostNodeID] = n
+	if rpt.Host.MetadataTemplates == nil {
+		rpt.Host.MetadataTemplates = map[string]metadataTemplate{}
+	}
+	rpt.Host.MetadataTemplates[pollIntervalKey] = metadataTemplate{
+		ID:       pollIntervalKey,
+		Label:    "Collection interval",
+		Priority: 31,
+		From:     "latest",
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestPollIntervalReusesCollection checks reports within the poll
+// interval reuse the latest collection without recording its samples in
+// the baselines again.
+func TestPollIntervalReusesCollection(t *testing.T) {
+	p := newBaselineTestPlugin()
+	p.pollInterval = time.Minute
+	for i := 0; i < 3; i++ {
+		if _, err := p.makeReport(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls := atomic.LoadInt32(&p.collectors[0].(*fixedCollector).calls); calls != 1 {
+		t.Errorf("collected %d times, want once", calls)
+	}
+	if got := recordedCount(p); got != 1 {
+		t.Errorf("got %d samples recorded, want 1", got)
+	}
+}
+
+func TestPollIntervalRestored(t *testing.T) {
+	p := newBaselineTestPlugin()
+	p.pollInterval = 5 * time.Second
+	s := p.snapshotState()
+
+	restored := newBaselineTestPlugin()
+	restored.restoreState(s)
+	if restored.pollInterval != 5*time.Second {
+		t.Errorf("got poll interval %s, want 5s", restored.pollInterval)
+	}
+
+	// States saved before the interval was kept leave it alone.
+	restored.pollInterval = time.Second
+	s.PollInterval = nil
+	restored.restoreState(s)
+	if restored.pollInterval != time.Second {
+		t.Errorf("got poll interval %s, want 1s", restored.pollInterval)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// inventory summarises the enabled collectors and features, so capability
+// drift across a fleet shows up when comparing Scope plugin panes.
+func (p *Plugin) inventory() string {
+	collectors := []string{}
+	for _, c := range p.collectors {
+		collectors = append(collectors, collectorSummary(c))
+	}
+	parts := []string{"version " + version}
+	if commit != "" {
+		parts = append(parts, "commit "+commit)
+	}
+	if buildDate != "" {
+		parts = append(parts, "built "+buildDate)
+	}
+	parts = append(parts, "collectors: "+strings.Join(collectors, ","))
+	if len(p.hookNames) > 0 {
+		parts = append(parts, "hooks: "+strings.Join(p.hookNames, ","))
+	}
+	if p.warmStandby {
+		parts = append(parts, "warm-standby")
+	}
+	if p.edge {
+		parts = append(parts, "edge")
+	}
+	if p.memoryLimit > 0 {
+		parts = append(parts, fmt.Sprintf("memory-limit=%dMiB", p.memoryLimit>>20))
+	}
+	return strings.Join(parts, "; ")
+}
+
+func (p *Plugin) description() string {
+	description := p.identity.description
+	if description == "" {
+		description = "Adds a graph of CPU IO Wait to hosts"
+	}
+	return fmt.Sprintf("%s (%s)", description, p.inventory())
+}
@@ -0,0 +1,169 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	cpuSources = append(cpuSources, "iostat")
+	cpuFallbacks["iostat"] = "proc"
+	collectorFactories["iostat"] = func(opts collectorOptions) (Collector, error) {
+		if _, err := exec.LookPath("iostat"); err != nil {
+			return nil, fmt.Errorf("iowait: %w", err)
+		}
+		return newCPUCollector("iostat", newIostatCPU(opts.CommandTimeout).cpuStats), nil
+	}
+}
+
+// iostatCPU gets the CPU utilisation from iostat, which requires sysstat
+// to be installed, killing iostat if it runs longer than timeout. It asks
+// for JSON output, which sysstat 11.5.1 and later support, and otherwise
+// parses the text output by its column headers, so the layout of neither
+// the banner nor the columns matters.
+type iostatCPU struct {
+	timeout time.Duration
+
+	lock   sync.Mutex
+	noJSON bool
+}
+
+func newIostatCPU(timeout time.Duration) *iostatCPU {
+	return &iostatCPU{timeout: timeout}
+}
+
+func (s *iostatCPU) cpuStats(ctx context.Context) (cpuStats, error) {
+	s.lock.Lock()
+	noJSON := s.noJSON
+	s.lock.Unlock()
+	if !noJSON {
+		out, err := commandOutput(ctx, s.timeout, "iostat", "-c", "-o", "JSON")
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			if err != nil {
+				return cpuStats{}, fmt.Errorf("iowait: %w", err)
+			}
+			return parseIostatJSON(out)
+		}
+		// Older versions reject -o with their usage.
+		collectorLog("cpu").Infof("iostat has no JSON output, parsing its text output instead")
+		s.lock.Lock()
+		s.noJSON = true
+		s.lock.Unlock()
+	}
+	out, err := commandOutput(ctx, s.timeout, "iostat", "-c")
+	if err != nil {
+		return cpuStats{}, fmt.Errorf("iowait: %w", err)
+	}
+	return parseIostatText(out)
+}
+
+// iostatJSON is the part of the iostat -o JSON output holding the CPU
+// utilisation.
+type iostatJSON struct {
+	Sysstat struct {
+		Hosts []struct {
+			Statistics []struct {
+				AvgCPU *struct {
+					User   float64 `json:"user"`
+					Nice   float64 `json:"nice"`
+					System float64 `json:"system"`
+					IOWait float64 `json:"iowait"`
+					Steal  float64 `json:"steal"`
+					Idle   float64 `json:"idle"`
+				} `json:"avg-cpu"`
+			} `json:"statistics"`
+		} `json:"hosts"`
+	} `json:"sysstat"`
+}
+
+// parseIostatJSON parses the latest CPU utilisation of iostat -c -o JSON.
+//
+//	{"sysstat": {"hosts": [{"nodename": "a109563eab38", ...,
+//	  "statistics": [{"avg-cpu": {"user": 2.37, "nice": 0.00, "system": 1.58,
+//	    "iowait": 0.01, "steal": 0.00, "idle": 96.04}}]}]}}
+func parseIostatJSON(out []byte) (cpuStats, error) {
+	var doc iostatJSON
+	if err := json.Unmarshal(out, &doc); err != nil {
+		return cpuStats{}, fmt.Errorf("iowait: invalid iostat JSON output: %v", err)
+	}
+	for _, host := range doc.Sysstat.Hosts {
+		for i := len(host.Statistics) - 1; i >= 0; i-- {
+			if cpu := host.Statistics[i].AvgCPU; cpu != nil {
+				return cpuStats{
+					User:   cpu.User,
+					Nice:   cpu.Nice,
+					System: cpu.System,
+					IOWait: cpu.IOWait,
+					Steal:  cpu.Steal,
+					Idle:   cpu.Idle,
+				}, nil
+			}
+		}
+	}
+	return cpuStats{}, fmt.Errorf("iowait: no avg-cpu in iostat output: %q", out)
+}
+
+// iostatColumns map the iostat -c column headers to the CPU statistics.
+var iostatColumns = map[string]func(*cpuStats) *float64{
+	"%user":   func(s *cpuStats) *float64 { return &s.User },
+	"%nice":   func(s *cpuStats) *float64 { return &s.Nice },
+	"%system": func(s *cpuStats) *float64 { return &s.System },
+	"%iowait": func(s *cpuStats) *float64 { return &s.IOWait },
+	"%steal":  func(s *cpuStats) *float64 { return &s.Steal },
+	"%idle":   func(s *cpuStats) *float64 { return &s.Idle },
+}
+
+// parseIostatText parses the latest CPU utilisation of iostat -c, by the
+// column headers of its avg-cpu section. Columns it doesn't know, such as
+// %guest on some versions, are skipped.
+//
+//	Linux 4.2.0-25-generic (a109563eab38)	04/01/16	_x86_64_(4 CPU)
+//
+//	avg-cpu:  %user   %nice %system %iowait  %steal   %idle
+//	           2.37    0.00    1.58    0.01    0.00   96.04
+func parseIostatText(out []byte) (cpuStats, error) {
+	var (
+		stats   cpuStats
+		headers []string
+		found   bool
+	)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) > 0 && fields[0] == "avg-cpu:":
+			headers = fields[1:]
+		case headers != nil && len(fields) > 0:
+			if len(fields) != len(headers) {
+				return cpuStats{}, fmt.Errorf("iowait: unexpected output: %q", out)
+			}
+			for i, header := range headers {
+				field, ok := iostatColumns[header]
+				if !ok {
+					continue
+				}
+				// The decimal separator follows the locale.
+				value, err := strconv.ParseFloat(strings.Replace(fields[i], ",", ".", 1), 64)
+				if err != nil {
+					return cpuStats{}, fmt.Errorf("iowait: invalid iostat value %q: %v", fields[i], err)
+				}
+				*field(&stats) = value
+			}
+			headers, found = nil, true
+		}
+	}
+	if !found {
+		return cpuStats{}, fmt.Errorf("iowait: unexpected output: %q", out)
+	}
+	return stats, nil
+}
@@ -0,0 +1,105 @@
+//go:build linux
+// +build linux
+
+package main
+
+import "testing"
+
+func TestParseIostatText(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		out     string
+		want    cpuStats
+		wantErr bool
+	}{
+		{
+			name: "since boot",
+			out: `Linux 4.2.0-25-generic (a109563eab38) 	04/01/16 	_x86_64_	(4 CPU)
+
+avg-cpu:  %user   %nice %system %iowait  %steal   %idle
+           2.37    0.00    1.58    0.01    0.00   96.04
+
+`,
+			want: cpuStats{User: 2.37, System: 1.58, IOWait: 0.01, Idle: 96.04},
+		},
+		{
+			name: "latest of several reports",
+			out: `Linux 5.15.0 (node-1) 	10/14/26 	_x86_64_	(8 CPU)
+
+avg-cpu:  %user   %nice %system %iowait  %steal   %idle
+           2.37    0.00    1.58    0.01    0.00   96.04
+
+avg-cpu:  %user   %nice %system %iowait  %steal   %idle
+          10.00    0.50    5.00   20.25    0.25   64.00
+
+`,
+			want: cpuStats{User: 10, Nice: 0.5, System: 5, IOWait: 20.25, Steal: 0.25, Idle: 64},
+		},
+		{
+			name: "unknown column and decimal comma",
+			out: `avg-cpu:  %user   %nice %system %iowait  %steal  %guest   %idle
+           2,50    0,00    1,50    3,00    0,00    1,00   92,00
+`,
+			want: cpuStats{User: 2.5, System: 1.5, IOWait: 3, Idle: 92},
+		},
+		{name: "no avg-cpu", out: "Linux 4.2.0-25-generic (a109563eab38)\n", wantErr: true},
+		{
+			name:    "missing column",
+			out:     "avg-cpu:  %user   %nice %system %iowait  %steal   %idle\n 2.37 0.00 1.58\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid value",
+			out:     "avg-cpu:  %user   %nice %system %iowait  %steal   %idle\n 2.37 0.00 1.58 n/a 0.00 96.04\n",
+			wantErr: true,
+		},
+	} {
+		got, err := parseIostatText([]byte(tc.out))
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tc.name, err, tc.wantErr)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestParseIostatJSON(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		out     string
+		want    cpuStats
+		wantErr bool
+	}{
+		{
+			name: "since boot",
+			out: `{"sysstat": {"hosts": [{"nodename": "a109563eab38", "sysname": "Linux", "release": "4.2.0-25-generic",
+				"machine": "x86_64", "number-of-cpus": 4, "date": "04/01/16",
+				"statistics": [{"avg-cpu": {"user": 2.37, "nice": 0.00, "system": 1.58, "iowait": 0.01, "steal": 0.00, "idle": 96.04}}]}]}}`,
+			want: cpuStats{User: 2.37, System: 1.58, IOWait: 0.01, Idle: 96.04},
+		},
+		{
+			name: "latest of several reports",
+			out: `{"sysstat": {"hosts": [{"nodename": "node-1", "statistics": [
+				{"avg-cpu": {"user": 2.37, "nice": 0.00, "system": 1.58, "iowait": 0.01, "steal": 0.00, "idle": 96.04}},
+				{"avg-cpu": {"user": 10.00, "nice": 0.50, "system": 5.00, "iowait": 20.25, "steal": 0.25, "idle": 64.00}}]}]}}`,
+			want: cpuStats{User: 10, Nice: 0.5, System: 5, IOWait: 20.25, Steal: 0.25, Idle: 64},
+		},
+		{
+			name:    "no statistics",
+			out:     `{"sysstat": {"hosts": [{"nodename": "node-1", "statistics": []}]}}`,
+			wantErr: true,
+		},
+		{name: "text output", out: "avg-cpu:  %user\n 2.37\n", wantErr: true},
+	} {
+		got, err := parseIostatJSON([]byte(tc.out))
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tc.name, err, tc.wantErr)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sysISCSISessionPath    = "/sys/class/iscsi_session"
+	sysISCSIConnectionPath = "/sys/class/iscsi_connection"
+)
+
+func init() {
+	collectorFactories["iscsi"] = func(opts collectorOptions) (Collector, error) {
+		if _, err := os.Stat(sysISCSISessionPath); err != nil {
+			return nil, fmt.Errorf("iscsi: %v", err)
+		}
+		return newISCSIStats(sysISCSISessionPath, sysISCSIConnectionPath, opts.CommandTimeout), nil
+	}
+}
+
+// iscsiSession is an iSCSI session and the cumulative statistics of its
+// connection.
+type iscsiSession struct {
+	ID, Target, State string
+	// Portal is the address:port of the target.
+	Portal string
+
+	txBytes, rxBytes         float64
+	timeoutErrs, digestErrs  float64
+	retransmits              float64
+	hasStats, hasRetransmits bool
+}
+
+// name is what the metrics of a session are named after: the volume of
+// OpenEBS targets, e.g. iqn.2016-09.com.openebs.jiva:pvc-1234 is pvc-1234,
+// or else the session, e.g. session3.
+func (s iscsiSession) name() string {
+	if i := strings.LastIndex(s.Target, ":"); i >= 0 && i+1 < len(s.Target) {
+		return s.Target[i+1:]
+	}
+	return "session" + s.ID
+}
+
+// iscsiStats reports the state and transport statistics of the host's
+// iSCSI sessions, such as those of OpenEBS Jiva and cStor volumes, so
+// that transport problems behind high IO wait show: the bytes sent and
+// received and the TCP retransmits to the portal per second, and the
+// timeout and digest errors. Statistics need iscsiadm, and retransmits ss.
+type iscsiStats struct {
+	sessionDir, connectionDir string
+	timeout                   time.Duration
+	iscsiadm, ss              bool
+
+	lock     sync.Mutex
+	prev     map[string]iscsiSession
+	prevTime time.Time
+}
+
+func newISCSIStats(sessionDir, connectionDir string, timeout time.Duration) *iscsiStats {
+	_, iscsiadm := exec.LookPath("iscsiadm")
+	_, ss := exec.LookPath("ss")
+	return &iscsiStats{
+		sessionDir:    sessionDir,
+		connectionDir: connectionDir,
+		timeout:       timeout,
+		iscsiadm:      iscsiadm == nil,
+		ss:            ss == nil,
+	}
+}
+
+func (c *iscsiStats) Name() string { return "iscsi" }
+
+func (c *iscsiStats) resetCounters() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.prev = nil
+}
+
+// sessions lists the sessions and the portal of their first connection.
+func (c *iscsiStats) sessions() ([]iscsiSession, error) {
+	paths, err := filepath.Glob(filepath.Join(c.sessionDir, "session*"))
+	if err != nil {
+		return nil, err
+	}
+	sessions := []iscsiSession{}
+	for _, path := range paths {
+		s := iscsiSession{
+			ID:     strings.TrimPrefix(filepath.Base(path), "session"),
+			Target: readSysfs(filepath.Join(path, "targetname")),
+			State:  readSysfs(filepath.Join(path, "state")),
+		}
+		conn := filepath.Join(c.connectionDir, "connection"+s.ID+":0")
+		if addr := readSysfs(filepath.Join(conn, "persistent_address")); addr != "" {
+			s.Portal = addr + ":" + readSysfs(filepath.Join(conn, "persistent_port"))
+		}
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].name() < sessions[j].name() })
+	return sessions, nil
+}
+
+// readStats reads the statistics iscsiadm -m session -r <id> -s prints:
+//
+//	iSCSI SNMP:
+//		txdata_octets: 7233404
+//		rxdata_octets: 23398540
+//		...
+//		timeout_err: 0
+func (c *iscsiStats) readStats(ctx context.Context, s *iscsiSession) error {
+	out, err := commandOutput(ctx, c.timeout, "iscsiadm", "-m", "session", "-r", s.ID, "-s")
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		parts := strings.SplitN(strings.TrimSpace(scanner.Text()), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil {
+			continue
+		}
+		switch parts[0] {
+		case "txdata_octets":
+			s.txBytes = v
+		case "rxdata_octets":
+			s.rxBytes = v
+		case "timeout_err":
+			s.timeoutErrs = v
+		case "digest_err":
+			s.digestErrs = v
+		}
+	}
+	s.hasStats = true
+	return scanner.Err()
+}
+
+// ssRetransRegexp matches the total retransmits of ss -i, e.g. retrans:0/12.
+var ssRetransRegexp = regexp.MustCompile(`\bretrans:\d+/(\d+)`)
+
+// readRetransmits sums the TCP retransmits of the connections to a portal.
+func (c *iscsiStats) readRetransmits(ctx context.Context, s *iscsiSession) error {
+	out, err := commandOutput(ctx, c.timeout, "ss", "-tinH", "dst", s.Portal)
+	if err != nil {
+		return err
+	}
+	for _, m := range ssRetransRegexp.FindAllSubmatch(out, -1) {
+		v, _ := strconv.ParseFloat(string(m[1]), 64)
+		s.retransmits += v
+	}
+	s.hasRetransmits = true
+	return nil
+}
+
+func (c *iscsiStats) Collect(ctx context.Context) ([]Metric, error) {
+	sessions, err := c.sessions()
+	if err != nil {
+		return nil, fmt.Errorf("iscsi: %v", err)
+	}
+	for i := range sessions {
+		s := &sessions[i]
+		if c.iscsiadm {
+			if err := c.readStats(ctx, s); err != nil {
+				collectorLog(c.Name()).Debugf("Session %s: %v", s.ID, err)
+			}
+		}
+		if c.ss && s.Portal != "" {
+			if err := c.readRetransmits(ctx, s); err != nil {
+				collectorLog(c.Name()).Debugf("Session %s: %v", s.ID, err)
+			}
+		}
+	}
+	now := time.Now()
+	cur := map[string]iscsiSession{}
+	for _, s := range sessions {
+		cur[s.ID] = s
+	}
+	c.lock.Lock()
+	prev, elapsed := c.prev, now.Sub(c.prevTime).Seconds()
+	c.prev, c.prevTime = cur, now
+	c.lock.Unlock()
+
+	metrics := []Metric{}
+	for i, s := range sessions {
+		name := s.name()
+		priority := 21 + float64(i)/10
+		metric := func(id, label, format string, value float64, j int) Metric {
+			return Metric{
+				ID:       id + "_" + name,
+				Label:    name + " " + label,
+				Format:   format,
+				Priority: priority + float64(j)/100,
+				Value:    value,
+				Max:      value,
+				Time:     now,
+			}
+		}
+		up := 0.0
+		if s.State == "LOGGED_IN" {
+			up = 1
+		}
+		m := metric("iscsi_logged_in", "iSCSI logged in", "integer", up, 0)
+		m.Max = 1
+		metrics = append(metrics, m)
+		if s.hasStats {
+			metrics = append(metrics,
+				metric("iscsi_timeout_errors", "iSCSI timeout errors", "integer", s.timeoutErrs, 3),
+				metric("iscsi_digest_errors", "iSCSI digest errors", "integer", s.digestErrs, 4),
+			)
+		}
+		p, ok := prev[s.ID]
+		if !ok || p.Target != s.Target {
+			continue
+		}
+		if s.hasStats && p.hasStats {
+			tx, ok1 := counterRate(s.txBytes, p.txBytes, elapsed)
+			rx, ok2 := counterRate(s.rxBytes, p.rxBytes, elapsed)
+			if ok1 && ok2 {
+				metrics = append(metrics,
+					metric("iscsi_tx_bytes", "iSCSI sent/s", "filesize", tx, 1),
+					metric("iscsi_rx_bytes", "iSCSI received/s", "filesize", rx, 2),
+				)
+			}
+		}
+		if s.hasRetransmits && p.hasRetransmits {
+			// Connections to the portal may have been re-established.
+			if retransmits, ok := counterRate(s.retransmits, p.retransmits, elapsed); ok {
+				metrics = append(metrics, metric("iscsi_retransmits", "TCP retransmits/s", "", retransmits, 5))
+			}
+		}
+	}
+	return metrics, nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// jivaControllerSelector selects the Jiva controller pods, labelled
+	// with the volume they serve like cStor targets.
+	jivaControllerSelector = "openebs.io/controller=jiva-controller"
+	jivaControllerPort     = 9501
+
+	jivaTableID     = "jiva-table"
+	jivaTablePrefix = "jiva-table-"
+)
+
+func init() {
+	collectorFactories["jiva"] = func(opts collectorOptions) (Collector, error) {
+		kube, err := newInClusterKubeClient()
+		if err != nil {
+			return nil, err
+		}
+		return newJivaReplicas(kube, opts.PVShard, opts.InstanceHosts), nil
+	}
+}
+
+// jivaReplica is a replica of a Jiva volume, as its controller lists it.
+type jivaReplica struct {
+	// Address is the replica's REST API, e.g. tcp://10.1.1.2:9502.
+	Address string `json:"address"`
+	// Mode is RW when in sync, WO while rebuilding and ERR when failed.
+	Mode string `json:"mode"`
+}
+
+// jivaVolume is the replica status of a Jiva volume.
+type jivaVolume struct {
+	PV     string
+	NodeID string
+	// Modes counts the replicas by mode.
+	Modes map[string]int
+	// Rebuild is the progress of the slowest rebuilding replica, if any.
+	Rebuild    float64
+	Rebuilding bool
+}
+
+// Degraded returns the number of replicas that are not in sync.
+func (v jivaVolume) Degraded() int {
+	n := 0
+	for mode, count := range v.Modes {
+		if mode != "RW" {
+			n += count
+		}
+	}
+	return n
+}
+
+func (v jivaVolume) status() string {
+	switch {
+	case v.Modes["RW"] == 0:
+		return "offline"
+	case v.Rebuilding:
+		return "rebuilding"
+	case v.Degraded() > 0:
+		return "degraded"
+	}
+	return "healthy"
+}
+
+// jivaReplicas reports the replica status of Jiva volumes from the REST APIs
+// of their controllers, found through the Kubernetes API, and the rebuild
+// progress of rebuilding (WO) replicas, estimated from the blocks they
+// hold compared to an RW replica. The jiva_degraded metric of volumes
+// counts their replicas out of sync and has a warning threshold by
+// default. With owns set, only the volumes it owns are reported; with
+// hosts set, volumes are reported on the host node of their controller.
+type jivaReplicas struct {
+	kube   *kubeClient
+	owns   func(key string) bool
+	hosts  *instanceHosts
+	client *http.Client
+
+	lock    sync.Mutex
+	volumes []jivaVolume
+}
+
+func newJivaReplicas(kube *kubeClient, owns func(key string) bool, hosts *instanceHosts) *jivaReplicas {
+	return &jivaReplicas{
+		kube:   kube,
+		owns:   owns,
+		hosts:  hosts,
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (j *jivaReplicas) Name() string { return "jiva" }
+
+// get decodes the response of the Jiva REST API at host:port and path.
+func (j *jivaReplicas) get(ctx context.Context, hostport, path string, v interface{}) error {
+	req, err := http.NewRequest("GET", "http://"+hostport+path, nil)
+	if err != nil {
+		return fmt.Errorf("jiva: %v", err)
+	}
+	res, err := j.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("jiva: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("jiva: GET %s%s: %s", hostport, path, res.Status)
+	}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return fmt.Errorf("jiva: GET %s%s: %v", hostport, path, err)
+	}
+	return nil
+}
+
+// usedBlocks returns the blocks a replica holds.
+func (j *jivaReplicas) usedBlocks(ctx context.Context, r jivaReplica) (float64, error) {
+	u, err := url.Parse(r.Address)
+	if err != nil {
+		return 0, err
+	}
+	usage := struct {
+		UsedBlocks string `json:"usedBlocks"`
+	}{}
+	if err := j.get(ctx, u.Host, "/v1/replicas/1/volusage", &usage); err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(usage.UsedBlocks, 64)
+}
+
+// volume reads the replica status of the volume of a controller pod.
+func (j *jivaReplicas) volume(ctx context.Context, pod kubePod) (jivaVolume, error) {
+	replicas := struct {
+		Data []jivaReplica `json:"data"`
+	}{}
+	controller := net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(jivaControllerPort))
+	if err := j.get(ctx, controller, "/v1/replicas", &replicas); err != nil {
+		return jivaVolume{}, err
+	}
+	v := jivaVolume{PV: pod.Metadata.Labels[cstorPVLabel], Modes: map[string]int{}}
+	synced := 0.0
+	for _, r := range replicas.Data {
+		v.Modes[r.Mode]++
+		if r.Mode == "RW" && synced == 0 {
+			if used, err := j.usedBlocks(ctx, r); err == nil {
+				synced = used
+			}
+		}
+	}
+	if v.Modes["WO"] == 0 || synced == 0 {
+		return v, nil
+	}
+	v.Rebuild = 100
+	for _, r := range replicas.Data {
+		if r.Mode != "WO" {
+			continue
+		}
+		used, err := j.usedBlocks(ctx, r)
+		if err != nil {
+			collectorLog(j.Name()).Debugf("Replica %s of %s: %v", r.Address, v.PV, err)
+			continue
+		}
+		v.Rebuilding = true
+		if progress := 100 * used / synced; progress < v.Rebuild {
+			v.Rebuild = progress
+		}
+	}
+	return v, nil
+}
+
+func (j *jivaReplicas) Collect(ctx context.Context) ([]Metric, error) {
+	pods, err := j.kube.runningPods(ctx, jivaControllerSelector)
+	if err != nil {
+		return nil, fmt.Errorf("jiva: %v", err)
+	}
+	volumes := []jivaVolume{}
+	for _, pod := range pods {
+		pv := pod.Metadata.Labels[cstorPVLabel]
+		if pv == "" || pod.Status.PodIP == "" || j.owns != nil && !j.owns(pv) {
+			continue
+		}
+		v, err := j.volume(ctx, pod)
+		if err != nil {
+			collectorLog(j.Name()).Debugf("Controller %s/%s: %v", pod.Metadata.Namespace, pod.Metadata.Name, err)
+			continue
+		}
+		if j.hosts != nil {
+			if host, ok := j.hosts.host(ctx, pod.Spec.NodeName); ok {
+				v.NodeID = hostNodeID(host)
+			}
+		}
+		volumes = append(volumes, v)
+	}
+	sort.Slice(volumes, func(a, b int) bool { return volumes[a].PV < volumes[b].PV })
+	j.lock.Lock()
+	j.volumes = volumes
+	j.lock.Unlock()
+
+	now := time.Now()
+	metrics := []Metric{}
+	for _, v := range volumes {
+		replicas := 0
+		for _, count := range v.Modes {
+			replicas += count
+		}
+		metrics = append(metrics, Metric{
+			ID:       "jiva_degraded_" + v.PV,
+			Label:    v.PV + " replicas out of sync",
+			Format:   "integer",
+			Priority: 22,
+			Value:    float64(v.Degraded()),
+			Max:      float64(replicas),
+			Time:     now,
+			NodeID:   v.NodeID,
+		})
+		if v.Rebuilding {
+			metrics = append(metrics, Metric{
+				ID:       "jiva_rebuild_percent_" + v.PV,
+				Label:    v.PV + " rebuild",
+				Format:   "percent",
+				Priority: 22.1,
+				Value:    v.Rebuild,
+				Max:      100,
+				Time:     now,
+				NodeID:   v.NodeID,
+			})
+		}
+	}
+	return metrics, nil
+}
+
+func (j *jivaReplicas) Tables() []table {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	rows := map[string]map[string]string{}
+	for _, v := range j.volumes {
+		modes := []string{}
+		for _, mode := range []string{"RW", "WO", "ERR"} {
+			modes = append(modes, fmt.Sprintf("%s %d", mode, v.Modes[mode]))
+		}
+		rebuild := ""
+		if v.Rebuilding {
+			rebuild = formatNumber(v.Rebuild) + "%"
+		}
+		rows[v.PV] = map[string]string{
+			"pv":       v.PV,
+			"replicas": strings.Join(modes, ", "),
+			"status":   v.status(),
+			"rebuild":  rebuild,
+		}
+	}
+	return []table{{
+		Template: tableTemplate{
+			ID:     jivaTableID,
+			Label:  "Jiva volumes",
+			Prefix: jivaTablePrefix,
+			Type:   "multicolumn-table",
+			Columns: []column{
+				{ID: "pv", Label: "Volume"},
+				{ID: "replicas", Label: "Replicas"},
+				{ID: "status", Label: "Status"},
+				{ID: "rebuild", Label: "Rebuild"},
+			},
+		},
+		Rows: rows,
+	}}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubeClient is a minimal Kubernetes API client using the pod's service
+// account, enough to read the few objects the plugin needs.
+type kubeClient struct {
+	host   string
+	token  string
+	client *http.Client
+}
+
+func newInClusterKubeClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("kubernetes: not running in a cluster")
+	}
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes: %w", err)
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("kubernetes: no certificate in %s/ca.crt", serviceAccountDir)
+	}
+	return &kubeClient{
+		host:  "https://" + net.JoinHostPort(host, port),
+		token: string(token),
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+// get decodes the object at an API path, e.g. /api/v1/namespaces/x/pods/y.
+func (k *kubeClient) get(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequest("GET", k.host+path, nil)
+	if err != nil {
+		return fmt.Errorf("kubernetes: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+k.token)
+	req.Header.Set("Accept", "application/json")
+	res, err := k.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("kubernetes: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("kubernetes: GET %s: %s", path, res.Status)
+	}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return fmt.Errorf("kubernetes: GET %s: %v", path, err)
+	}
+	return nil
+}
+
+// watchEvent is one event of a Kubernetes watch: ADDED, MODIFIED, DELETED,
+// BOOKMARK or ERROR, whose object is then a Status.
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// watch streams the events of the API collection at path, from a resource
+// version, until the server ends the watch, ctx is done or handle fails.
+func (k *kubeClient) watch(ctx context.Context, path, resourceVersion string, handle func(watchEvent) error) error {
+	query := url.Values{
+		"watch":               {"1"},
+		"resourceVersion":     {resourceVersion},
+		"allowWatchBookmarks": {"true"},
+		"timeoutSeconds":      {"300"},
+	}
+	req, err := http.NewRequest("GET", k.host+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return fmt.Errorf("kubernetes: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+k.token)
+	req.Header.Set("Accept", "application/json")
+	// The client's timeout would cut the stream short.
+	client := *k.client
+	client.Timeout = 0
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("kubernetes: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("kubernetes: watch %s: %s", path, res.Status)
+	}
+	decoder := json.NewDecoder(res.Body)
+	for {
+		event := watchEvent{}
+		if err := decoder.Decode(&event); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("kubernetes: watch %s: %v", path, err)
+		}
+		if err := handle(event); err != nil {
+			return err
+		}
+	}
+}
+
+// getText returns the plain text at a path, e.g. the Prometheus metrics of
+// a kubelet.
+func (k *kubeClient) getText(ctx context.Context, path string) ([]byte, error) {
+	req, err := http.NewRequest("GET", k.host+path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes: %v", err)
+	}
+	if k.token != "" {
+		req.Header.Set("Authorization", "Bearer "+k.token)
+	}
+	res, err := k.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("kubernetes: GET %s: %s", path, res.Status)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("kubernetes: GET %s: %v", path, err)
+	}
+	return body, nil
+}
+
+// mergePatch applies a JSON merge patch to the object at an API path.
+func (k *kubeClient) mergePatch(ctx context.Context, path string, patch interface{}) error {
+	body, err := json.Marshal(patch)
+	if err != nil {
+		return fmt.Errorf("kubernetes: %v", err)
+	}
+	req, err := http.NewRequest("PATCH", k.host+path, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("kubernetes: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+k.token)
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	res, err := k.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("kubernetes: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("kubernetes: PATCH %s: %s", path, res.Status)
+	}
+	return nil
+}
+
+// endpoints is the part of a Kubernetes Endpoints object the plugin uses.
+type endpoints struct {
+	Subsets []struct {
+		Addresses []struct {
+			IP string `json:"ip"`
+		} `json:"addresses"`
+	} `json:"subsets"`
+}
+
+// readyAddresses returns the IPs of the ready endpoints of a service.
+func (k *kubeClient) readyAddresses(ctx context.Context, namespace, name string) ([]string, error) {
+	ep := endpoints{}
+	if err := k.get(ctx, "/api/v1/namespaces/"+namespace+"/endpoints/"+name, &ep); err != nil {
+		return nil, err
+	}
+	ips := []string{}
+	for _, subset := range ep.Subsets {
+		for _, addr := range subset.Addresses {
+			ips = append(ips, addr.IP)
+		}
+	}
+	return ips, nil
+}
+
+// create creates an object in the API collection at path, decoding the
+// created object into v.
+func (k *kubeClient) create(ctx context.Context, path string, obj, v interface{}) error {
+	body, err := json.Marshal(obj)
+	if err != nil {
+		return fmt.Errorf("kubernetes: %v", err)
+	}
+	req, err := http.NewRequest("POST", k.host+path, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("kubernetes: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+k.token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	res, err := k.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("kubernetes: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated && res.StatusCode != http.StatusOK {
+		return fmt.Errorf("kubernetes: POST %s: %s", path, res.Status)
+	}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return fmt.Errorf("kubernetes: POST %s: %v", path, err)
+	}
+	return nil
+}
+
+// persistentVolume is the part of a Kubernetes PersistentVolume the plugin
+// uses. Namespace and Claim are those of its claim, empty if unbound.
+type persistentVolume struct {
+	Name         string
+	Namespace    string
+	Claim        string
+	StorageClass string
+	Capacity     string
+	AccessModes  []string
+	Phase        string
+	// LocalPath is the path of local and hostPath volumes, such as
+	// OpenEBS LocalPV ones, on their node.
+	LocalPath string
+}
+
+// pvObject is the part of a PersistentVolume object persistentVolume is
+// read from.
+type pvObject struct {
+	Metadata struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Spec struct {
+		StorageClassName string `json:"storageClassName"`
+		Capacity         struct {
+			Storage string `json:"storage"`
+		} `json:"capacity"`
+		AccessModes []string `json:"accessModes"`
+		ClaimRef    *struct {
+			Namespace string `json:"namespace"`
+			Name      string `json:"name"`
+		} `json:"claimRef"`
+		Local *struct {
+			Path string `json:"path"`
+		} `json:"local"`
+		HostPath *struct {
+			Path string `json:"path"`
+		} `json:"hostPath"`
+	} `json:"spec"`
+	Status struct {
+		Phase string `json:"phase"`
+	} `json:"status"`
+}
+
+func (o pvObject) persistentVolume() persistentVolume {
+	pv := persistentVolume{
+		Name:         o.Metadata.Name,
+		StorageClass: o.Spec.StorageClassName,
+		Capacity:     o.Spec.Capacity.Storage,
+		AccessModes:  o.Spec.AccessModes,
+		Phase:        o.Status.Phase,
+	}
+	if o.Spec.ClaimRef != nil {
+		pv.Namespace = o.Spec.ClaimRef.Namespace
+		pv.Claim = o.Spec.ClaimRef.Name
+	}
+	switch {
+	case o.Spec.Local != nil:
+		pv.LocalPath = o.Spec.Local.Path
+	case o.Spec.HostPath != nil:
+		pv.LocalPath = o.Spec.HostPath.Path
+	}
+	return pv
+}
+
+// persistentVolumes returns the PersistentVolumes of the cluster, by name.
+func (k *kubeClient) persistentVolumes(ctx context.Context) (map[string]persistentVolume, error) {
+	list := struct {
+		Items []pvObject `json:"items"`
+	}{}
+	if err := k.get(ctx, "/api/v1/persistentvolumes", &list); err != nil {
+		return nil, err
+	}
+	pvs := map[string]persistentVolume{}
+	for _, item := range list.Items {
+		pv := item.persistentVolume()
+		pvs[pv.Name] = pv
+	}
+	return pvs, nil
+}
+
+// persistentVolume returns one PersistentVolume.
+func (k *kubeClient) persistentVolume(ctx context.Context, name string) (persistentVolume, error) {
+	obj := pvObject{}
+	if err := k.get(ctx, "/api/v1/persistentvolumes/"+name, &obj); err != nil {
+		return persistentVolume{}, err
+	}
+	return obj.persistentVolume(), nil
+}
+
+// kubePod is the part of a Kubernetes Pod the plugin uses.
+type kubePod struct {
+	Metadata struct {
+		Name      string            `json:"name"`
+		Namespace string            `json:"namespace"`
+		Labels    map[string]string `json:"labels"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName string `json:"nodeName"`
+	} `json:"spec"`
+	Status struct {
+		PodIP string `json:"podIP"`
+	} `json:"status"`
+}
+
+// runningPods returns the running pods of all namespaces matching a label
+// selector.
+func (k *kubeClient) runningPods(ctx context.Context, selector string) ([]kubePod, error) {
+	list := struct {
+		Items []kubePod `json:"items"`
+	}{}
+	query := url.Values{
+		"labelSelector": {selector},
+		"fieldSelector": {"status.phase=Running"},
+	}
+	if err := k.get(ctx, "/api/v1/pods?"+query.Encode(), &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// nodeAddresses returns the names of the cluster's nodes by their
+// addresses, internal and external IPs as well as host names.
+func (k *kubeClient) nodeAddresses(ctx context.Context) (map[string]string, error) {
+	list := struct {
+		Items []struct {
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+			Status struct {
+				Addresses []struct {
+					Address string `json:"address"`
+				} `json:"addresses"`
+			} `json:"status"`
+		} `json:"items"`
+	}{}
+	if err := k.get(ctx, "/api/v1/nodes", &list); err != nil {
+		return nil, err
+	}
+	names := map[string]string{}
+	for _, item := range list.Items {
+		names[item.Metadata.Name] = item.Metadata.Name
+		for _, addr := range item.Status.Addresses {
+			names[addr.Address] = item.Metadata.Name
+		}
+	}
+	return names, nil
+}
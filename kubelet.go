@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultKubeletURL = "https://127.0.0.1:10250"
+
+	volumeUsageTableID     = "volume-usage-table"
+	volumeUsageTablePrefix = "volume-usage-table-"
+)
+
+func init() {
+	collectorFactories["kubelet-volumes"] = func(opts collectorOptions) (Collector, error) {
+		kubelet, err := newKubeletClient(opts.KubeletURL, opts.KubeletInsecureTLS)
+		if err != nil {
+			return nil, err
+		}
+		return newKubeletVolumes(kubelet), nil
+	}
+}
+
+// newKubeletClient talks to a kubelet with the pod's service account, which
+// must be allowed to get nodes/stats. Kubelets often serve self-signed
+// certificates, which only insecure skips verifying.
+func newKubeletClient(url string, insecure bool) (*kubeClient, error) {
+	kube, err := newInClusterKubeClient()
+	if err != nil {
+		return nil, err
+	}
+	transport := kube.client.Transport.(*http.Transport).Clone()
+	if insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &kubeClient{
+		host:   strings.TrimSuffix(url, "/"),
+		token:  kube.token,
+		client: &http.Client{Timeout: kube.client.Timeout, Transport: transport},
+	}, nil
+}
+
+// statsSummary is the part of the kubelet Summary API the plugin uses.
+type statsSummary struct {
+	Pods []struct {
+		PodRef struct {
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+			UID       string `json:"uid"`
+		} `json:"podRef"`
+		Volumes []struct {
+			Name   string `json:"name"`
+			PVCRef *struct {
+				Name      string `json:"name"`
+				Namespace string `json:"namespace"`
+			} `json:"pvcRef"`
+			Time           time.Time `json:"time"`
+			CapacityBytes  float64   `json:"capacityBytes"`
+			UsedBytes      float64   `json:"usedBytes"`
+			AvailableBytes float64   `json:"availableBytes"`
+			Inodes         float64   `json:"inodes"`
+			InodesUsed     float64   `json:"inodesUsed"`
+		} `json:"volume"`
+	} `json:"pods"`
+}
+
+// volumeUsage is the usage of a claim's volume, as seen by a pod using it.
+type volumeUsage struct {
+	Claim, Pod, PodUID        string
+	Capacity, Used, Available float64
+	Inodes, InodesUsed        float64
+	Time                      time.Time
+}
+
+// kubeletVolumes reports the usage of the volumes of claims from the local
+// kubelet's Summary API: metrics on the pods using them and a table on the
+// host node. Unlike the OpenEBS exporter it covers every kind of volume.
+type kubeletVolumes struct {
+	kubelet *kubeClient
+
+	lock   sync.Mutex
+	usages []volumeUsage
+}
+
+func newKubeletVolumes(kubelet *kubeClient) *kubeletVolumes {
+	return &kubeletVolumes{kubelet: kubelet}
+}
+
+func (k *kubeletVolumes) Name() string { return "kubelet-volumes" }
+
+func (k *kubeletVolumes) usage(ctx context.Context) ([]volumeUsage, error) {
+	summary := statsSummary{}
+	if err := k.kubelet.get(ctx, "/stats/summary", &summary); err != nil {
+		return nil, fmt.Errorf("kubelet-volumes: %w", err)
+	}
+	usages := []volumeUsage{}
+	for _, pod := range summary.Pods {
+		for _, vol := range pod.Volumes {
+			if vol.PVCRef == nil {
+				continue
+			}
+			usages = append(usages, volumeUsage{
+				Claim:      vol.PVCRef.Namespace + "/" + vol.PVCRef.Name,
+				Pod:        pod.PodRef.Namespace + "/" + pod.PodRef.Name,
+				Capacity:   vol.CapacityBytes,
+				Used:       vol.UsedBytes,
+				Available:  vol.AvailableBytes,
+				Inodes:     vol.Inodes,
+				InodesUsed: vol.InodesUsed,
+				PodUID:     pod.PodRef.UID,
+				Time:       vol.Time,
+			})
+		}
+	}
+	return usages, nil
+}
+
+// Collect attaches the usage of every claim to the pods using it.
+func (k *kubeletVolumes) Collect(ctx context.Context) ([]Metric, error) {
+	usages, err := k.usage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	k.lock.Lock()
+	k.usages = usages
+	k.lock.Unlock()
+	metrics := []Metric{}
+	for _, u := range usages {
+		claim := u.Claim[strings.Index(u.Claim, "/")+1:]
+		nodeID := fmt.Sprintf("%s;<pod>", u.PodUID)
+		ts := u.Time
+		if ts.IsZero() {
+			ts = time.Now()
+		}
+		metrics = append(metrics, Metric{
+			ID:       "volume_used_" + claim,
+			Label:    claim + " used",
+			Format:   "filesize",
+			Priority: 10,
+			Value:    u.Used,
+			Max:      u.Capacity,
+			Time:     ts,
+			Topology: podTopologyID,
+			NodeID:   nodeID,
+		})
+		if u.Capacity > 0 {
+			metrics = append(metrics, Metric{
+				ID:       "volume_used_percent_" + claim,
+				Label:    claim + " used %",
+				Format:   "percent",
+				Priority: 10.1,
+				Value:    100 * u.Used / u.Capacity,
+				Max:      100,
+				Time:     ts,
+				Topology: podTopologyID,
+				NodeID:   nodeID,
+			})
+		}
+		if u.Inodes > 0 {
+			metrics = append(metrics, Metric{
+				ID:       "volume_inodes_used_percent_" + claim,
+				Label:    claim + " inodes used %",
+				Format:   "percent",
+				Priority: 10.2,
+				Value:    100 * u.InodesUsed / u.Inodes,
+				Max:      100,
+				Time:     ts,
+				Topology: podTopologyID,
+				NodeID:   nodeID,
+			})
+		}
+	}
+	return metrics, nil
+}
+
+func (k *kubeletVolumes) Tables() []table {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	rows := map[string]map[string]string{}
+	for _, u := range k.usages {
+		row := map[string]string{
+			"claim":     u.Claim,
+			"pod":       u.Pod,
+			"capacity":  formatSize(uint64(u.Capacity)),
+			"used":      formatSize(uint64(u.Used)),
+			"available": formatSize(uint64(u.Available)),
+		}
+		if u.Inodes > 0 {
+			row["inodes_used"] = fmt.Sprintf("%.1f%%", 100*u.InodesUsed/u.Inodes)
+		}
+		rows[u.Claim] = row
+	}
+	return []table{{
+		Template: tableTemplate{
+			ID:     volumeUsageTableID,
+			Label:  "Volume usage",
+			Prefix: volumeUsageTablePrefix,
+			Type:   "multicolumn-table",
+			Columns: []column{
+				{ID: "claim", Label: "Claim"},
+				{ID: "pod", Label: "Pod"},
+				{ID: "capacity", Label: "Capacity"},
+				{ID: "used", Label: "Used"},
+				{ID: "available", Label: "Available"},
+				{ID: "inodes_used", Label: "Inodes used"},
+			},
+		},
+		Rows: rows,
+	}}
+}
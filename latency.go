@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	latencyTableID     = "latency-rollup-table"
+	latencyTablePrefix = "latency-rollup-table-"
+
+	// latencyHistogramScale gives buckets about 9% wide.
+	latencyHistogramScale = 3
+)
+
+func init() {
+	collectorFactories["latency-rollup"] = func(opts collectorOptions) (Collector, error) {
+		if opts.LatencyQuery == "" {
+			return nil, fmt.Errorf("latency rollup: no histogram query configured")
+		}
+		prom, err := newPrometheusCollector(opts.PrometheusURL, nil, opts.HTTPClient, nil)
+		if err != nil {
+			return nil, err
+		}
+		// Without Kubernetes, volumes are only rolled up together.
+		kube, err := newInClusterKubeClient()
+		if err != nil {
+			collectorLog("latency-rollup").Warnf("Latency rollups without namespaces and storage classes: %v", err)
+		}
+		r := newLatencyRollup(prom, kube, opts.PVShard, opts.LatencyQuery)
+		go r.watch(opts.LatencyInterval)
+		return r, nil
+	}
+}
+
+// latencyStats are the latency quantiles of one rollup group.
+type latencyStats struct {
+	Group         string
+	Volumes       int
+	Count         float64
+	P50, P95, P99 float64
+}
+
+// latencyRollup merges the latency histograms of volumes into rollups per
+// namespace, per storage class and over all volumes, and shows their
+// quantiles in a table.
+type latencyRollup struct {
+	prom  *prometheusCollector
+	kube  *kubeClient
+	owns  func(key string) bool
+	query string
+
+	lock   sync.Mutex
+	groups []latencyStats
+	err    error
+}
+
+func newLatencyRollup(prom *prometheusCollector, kube *kubeClient, owns func(key string) bool, query string) *latencyRollup {
+	return &latencyRollup{prom: prom, kube: kube, owns: owns, query: query}
+}
+
+func (r *latencyRollup) Name() string { return "latency-rollup" }
+
+func (r *latencyRollup) watch(interval time.Duration) {
+	r.rollUp(context.Background())
+	for range time.Tick(interval) {
+		r.rollUp(context.Background())
+	}
+}
+
+func (r *latencyRollup) rollUp(ctx context.Context) {
+	groups, err := r.latencies(ctx)
+	if err != nil {
+		collectorLog(r.Name()).Error(err)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.err = err
+	if err == nil {
+		r.groups = groups
+	}
+}
+
+// volumeHistograms turns the classic le buckets returned by the query into
+// an exponential histogram per volume.
+func (r *latencyRollup) volumeHistograms(ctx context.Context) (map[string]*expHistogram, error) {
+	result, err := r.prom.query(ctx, r.query)
+	if err != nil {
+		return nil, err
+	}
+	type bucket struct{ le, cumulative float64 }
+	buckets := map[string][]bucket{}
+	for _, s := range result.Data.Result {
+		pv := s.Metric.OpenebsPv
+		if pv == "" || (r.owns != nil && !r.owns(pv)) {
+			continue
+		}
+		le, err := strconv.ParseFloat(s.Metric.Le, 64)
+		if err != nil {
+			return nil, fmt.Errorf("latency rollup: series without a valid le label: %q", s.Metric.Le)
+		}
+		_, count, err := parseSampleValue(s.Value)
+		if err != nil {
+			return nil, fmt.Errorf("latency rollup: %v", err)
+		}
+		buckets[pv] = append(buckets[pv], bucket{le, count})
+	}
+	histograms := map[string]*expHistogram{}
+	for pv, bs := range buckets {
+		sort.Slice(bs, func(i, j int) bool { return bs[i].le < bs[j].le })
+		h := newExpHistogram(latencyHistogramScale)
+		lower, prev := 0.0, 0.0
+		for _, b := range bs {
+			h.addBucket(lower, b.le, b.cumulative-prev)
+			lower, prev = b.le, math.Max(prev, b.cumulative)
+		}
+		histograms[pv] = h
+	}
+	return histograms, nil
+}
+
+func (r *latencyRollup) latencies(ctx context.Context) ([]latencyStats, error) {
+	histograms, err := r.volumeHistograms(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pvs := map[string]persistentVolume{}
+	if r.kube != nil {
+		if pvs, err = r.kube.persistentVolumes(ctx); err != nil {
+			return nil, fmt.Errorf("latency rollup: %w", err)
+		}
+	}
+	merged := map[string]*expHistogram{}
+	volumes := map[string]int{}
+	add := func(group string, h *expHistogram) {
+		if merged[group] == nil {
+			merged[group] = newExpHistogram(latencyHistogramScale)
+		}
+		merged[group].merge(h)
+		volumes[group]++
+	}
+	for name, h := range histograms {
+		add("all", h)
+		if pv, ok := pvs[name]; ok {
+			if pv.Namespace != "" {
+				add("namespace/"+pv.Namespace, h)
+			}
+			if pv.StorageClass != "" {
+				add("storageclass/"+pv.StorageClass, h)
+			}
+		}
+	}
+	groups := []latencyStats{}
+	for group, h := range merged {
+		groups = append(groups, latencyStats{
+			Group:   group,
+			Volumes: volumes[group],
+			Count:   h.total,
+			P50:     h.quantile(0.5),
+			P95:     h.quantile(0.95),
+			P99:     h.quantile(0.99),
+		})
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Group < groups[j].Group })
+	return groups, nil
+}
+
+// Collect only reports errors of the latest rollup; rollups are shown as a
+// table.
+func (r *latencyRollup) Collect(ctx context.Context) ([]Metric, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return nil, r.err
+}
+
+// formatLatency keeps three significant digits, as latencies in seconds
+// are often well below formatNumber's two decimal places.
+func formatLatency(v float64) string {
+	return strconv.FormatFloat(v, 'g', 3, 64)
+}
+
+func (r *latencyRollup) Tables() []table {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	rows := map[string]map[string]string{}
+	for _, g := range r.groups {
+		rows[g.Group] = map[string]string{
+			"group":   g.Group,
+			"volumes": strconv.Itoa(g.Volumes),
+			"count":   formatNumber(g.Count),
+			"p50":     formatLatency(g.P50),
+			"p95":     formatLatency(g.P95),
+			"p99":     formatLatency(g.P99),
+		}
+	}
+	return []table{{
+		Template: tableTemplate{
+			ID:     latencyTableID,
+			Label:  "Volume latency rollups",
+			Prefix: latencyTablePrefix,
+			Type:   "multicolumn-table",
+			Columns: []column{
+				{ID: "group", Label: "Group"},
+				{ID: "volumes", Label: "Volumes", DataType: "number"},
+				{ID: "count", Label: "IOs", DataType: "number"},
+				{ID: "p50", Label: "p50", DataType: "number"},
+				{ID: "p95", Label: "p95", DataType: "number"},
+				{ID: "p99", Label: "p99", DataType: "number"},
+			},
+		},
+		Rows: rows,
+	}}
+}
@@ -0,0 +1,51 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+func init() {
+	localPVDevices = readLocalPVDevices
+}
+
+// readLocalPVDevices maps block devices to the local volumes whose path
+// exists on this host: the device of the filesystem holding the path, or
+// the device itself for raw block volumes.
+func readLocalPVDevices(pvs map[string]persistentVolume) map[string][]string {
+	devices := map[string][]string{}
+	for name, pv := range pvs {
+		if pv.LocalPath == "" {
+			continue
+		}
+		var st syscall.Stat_t
+		if err := syscall.Stat(filepath.Join(hostRootPath, pv.LocalPath), &st); err != nil {
+			// The volume is on another node.
+			continue
+		}
+		dev := uint64(st.Dev)
+		if st.Mode&syscall.S_IFMT == syscall.S_IFBLK {
+			dev = uint64(st.Rdev)
+		}
+		// The major and minor numbers, encoded as glibc's makedev does.
+		major := (dev>>8)&0xfff | (dev>>32)&0xfffff000
+		minor := dev&0xff | (dev>>12)&0xffffff00
+		link, err := os.Readlink(filepath.Join(sysDevBlockPath, fmt.Sprintf("%d:%d", major, minor)))
+		if err != nil {
+			// Not on a block device, e.g. on tmpfs.
+			continue
+		}
+		device := filepath.Base(link)
+		devices[device] = append(devices[device], name)
+	}
+	for _, pvs := range devices {
+		sort.Strings(pvs)
+	}
+	return devices
+}
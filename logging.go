@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// log is the plugin's logger. Components log through entries derived from
+// it with componentLog, so every line carries a component field, and
+// collectors add a collector field with collectorLog.
+var log = componentLog("plugin")
+
+func componentLog(component string) *logrus.Entry {
+	return logrus.WithField("component", component)
+}
+
+func collectorLog(name string) *logrus.Entry {
+	return componentLog("collector").WithField("collector", name)
+}
+
+// parseLogLevel parses a -log-level: debug, info, warn or error.
+func parseLogLevel(s string) (logrus.Level, error) {
+	switch s {
+	case "debug", "info", "warn", "error":
+		return logrus.ParseLevel(s)
+	}
+	return 0, fmt.Errorf("invalid log level %q, expected debug, info, warn or error", s)
+}
+
+// logOptions configure the plugin's logger.
+type logOptions struct {
+	Level  string
+	Format string // text or json
+	File   string // empty logs to stderr
+	// The log file is rotated once it reaches MaxSize bytes or is MaxAge
+	// old, whichever comes first; 0 disables either. MaxBackups rotated
+	// files are kept.
+	MaxSize    string
+	MaxAge     time.Duration
+	MaxBackups int
+}
+
+func setupLogging(opts logOptions) error {
+	level, err := parseLogLevel(opts.Level)
+	if err != nil {
+		return err
+	}
+	switch opts.Format {
+	case "text":
+		logrus.SetFormatter(&logrus.TextFormatter{FullTimestamp: true, DisableColors: opts.File != ""})
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("invalid log format %q, expected text or json", opts.Format)
+	}
+	if opts.File != "" {
+		maxSize, err := parseBytes(opts.MaxSize)
+		if err != nil {
+			return fmt.Errorf("invalid -log-max-size: %v", err)
+		}
+		if opts.MaxAge < 0 || opts.MaxBackups < 0 {
+			return fmt.Errorf("invalid log rotation: -log-max-age and -log-max-backups must not be negative")
+		}
+		f, err := openRotatingFile(opts.File, maxSize, opts.MaxAge, opts.MaxBackups)
+		if err != nil {
+			return err
+		}
+		logrus.SetOutput(f)
+	}
+	logrus.SetLevel(level)
+	return nil
+}
+
+// rotatingFile is a log file rotated by size and age: the current file is
+// renamed to <path>.1, the previous <path>.1 to <path>.2 and so on, and the
+// oldest beyond maxBackups are removed.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	lock   sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open appends to the log file, whose age counts from its last
+// modification if it already exists.
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("log file: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("log file: %v", err)
+	}
+	r.f, r.size, r.opened = f, info.Size(), time.Now()
+	if info.Size() > 0 {
+		r.opened = info.ModTime()
+	}
+	return nil
+}
+
+func (r *rotatingFile) Write(b []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.size > 0 && r.due(len(b)) {
+		if err := r.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "error: rotating %s: %v\n", r.path, err)
+		}
+	}
+	n, err := r.f.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) due(n int) bool {
+	return (r.maxSize > 0 && r.size+int64(n) > r.maxSize) ||
+		(r.maxAge > 0 && time.Since(r.opened) >= r.maxAge)
+}
+
+// rotate moves the current file aside before opening a new one, so that if
+// either fails logging carries on to the current file.
+func (r *rotatingFile) rotate() error {
+	if r.maxBackups > 0 {
+		os.Remove(r.backup(r.maxBackups))
+		for i := r.maxBackups - 1; i >= 1; i-- {
+			os.Rename(r.backup(i), r.backup(i+1))
+		}
+		if err := os.Rename(r.path, r.backup(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(r.path); err != nil {
+		return err
+	}
+	old := r.f
+	if err := r.open(); err != nil {
+		return err
+	}
+	return old.Close()
+}
+
+func (r *rotatingFile) backup(i int) string {
+	return fmt.Sprintf("%s.%d", r.path, i)
+}
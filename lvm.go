@@ -0,0 +1,91 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// logicalVolume names an LVM logical volume.
+type logicalVolume struct {
+	VG, LV string
+}
+
+func (l logicalVolume) String() string { return l.VG + "/" + l.LV }
+
+// logicalVolumes maps the device-mapper devices among devices, dm-N, that
+// are LVM logical volumes to their VG and LV names.
+func logicalVolumes(sysBlock string, devices []string) map[string]logicalVolume {
+	volumes := map[string]logicalVolume{}
+	for _, device := range devices {
+		if !strings.HasPrefix(device, "dm-") {
+			continue
+		}
+		dir := filepath.Join(sysBlock, device, "dm")
+		if !strings.HasPrefix(readSysfs(filepath.Join(dir, "uuid")), "LVM-") {
+			continue
+		}
+		if vg, lv, ok := splitDMName(readSysfs(filepath.Join(dir, "name"))); ok {
+			volumes[device] = logicalVolume{VG: vg, LV: lv}
+		}
+	}
+	return volumes
+}
+
+// splitDMName splits the device-mapper name of a logical volume, e.g.
+// "data--vg-lv--0", into its VG and LV names, "data-vg" and "lv-0":
+// dashes within names are doubled.
+func splitDMName(name string) (string, string, bool) {
+	for i := 0; i < len(name); i++ {
+		if name[i] != '-' {
+			continue
+		}
+		if i+1 < len(name) && name[i+1] == '-' {
+			i++
+			continue
+		}
+		unescape := func(s string) string { return strings.Replace(s, "--", "-", -1) }
+		return unescape(name[:i]), unescape(name[i+1:]), i > 0 && i+1 < len(name)
+	}
+	return "", "", false
+}
+
+// lvMetrics are the statistics reported for every logical volume.
+var lvMetrics = []struct {
+	id, label, format string
+	value             func(diskRates) float64
+}{
+	{"r_iops", "read IOPS", "", func(r diskRates) float64 { return r.ReadIOPS }},
+	{"w_iops", "write IOPS", "", func(r diskRates) float64 { return r.WriteIOPS }},
+	{"r_bytes", "read bytes/s", "filesize", func(r diskRates) float64 { return r.SectorsReadPerSec * 512 }},
+	{"w_bytes", "write bytes/s", "filesize", func(r diskRates) float64 { return r.SectorsWrittenPerSec * 512 }},
+}
+
+func lvMetricID(lv logicalVolume, stat string) string {
+	return "lv_" + lv.VG + "_" + lv.LV + "_" + stat
+}
+
+// logicalVolumeMetrics reports the IOPS and throughput of the logical
+// volumes among the devices' rates.
+func logicalVolumeMetrics(rates []diskRates, volumes map[string]logicalVolume, now time.Time) []Metric {
+	metrics := []Metric{}
+	for i, r := range rates {
+		lv, ok := volumes[r.Device]
+		if !ok {
+			continue
+		}
+		for j, m := range lvMetrics {
+			value := m.value(r)
+			metrics = append(metrics, Metric{
+				ID:       lvMetricID(lv, m.id),
+				Label:    lv.String() + " " + m.label,
+				Format:   m.format,
+				Priority: 15 + float64(i)/10 + float64(j)/100,
+				Value:    value,
+				Max:      value,
+				Time:     now,
+			})
+		}
+	}
+	return metrics
+}
@@ -1,132 +1,1006 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
 	"os"
-	"os/exec"
 	"os/signal"
 	"path/filepath"
-	"strconv"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
 )
 
-func setupSocket(socketPath string) (net.Listener, error) {
-	os.RemoveAll(filepath.Dir(socketPath))
+// setupSocket listens on socketPath. It only ever touches that socket, so
+// other plugins in /var/run/scope/plugins are left alone: a stale socket,
+// left by an instance that didn't exit cleanly, is replaced, while one
+// served by a running instance is an error.
+func setupSocket(socketPath string) (net.Listener, *socketOwner, error) {
 	if err := os.MkdirAll(filepath.Dir(socketPath), 0700); err != nil {
-		return nil, fmt.Errorf("failed to create directory %q: %v", filepath.Dir(socketPath), err)
+		return nil, nil, fmt.Errorf("failed to create directory %q: %v", filepath.Dir(socketPath), err)
+	}
+	if err := removeStaleSocket(socketPath); err != nil {
+		return nil, nil, err
 	}
 	listener, err := net.Listen("unix", socketPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to listen on %q: %v", socketPath, err)
+		return nil, nil, fmt.Errorf("failed to listen on %q: %v", socketPath, err)
+	}
+	// release removes the socket, and only if it is still ours.
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		listener.Close()
+		return nil, nil, fmt.Errorf("failed to listen on %q: %v", socketPath, err)
+	}
+
+	socketLog.Infof("Listening on: unix://%s", socketPath)
+	return listener, &socketOwner{path: socketPath, info: info}, nil
+}
+
+// isLoopbackAddr tells whether a TCP address, e.g. localhost:6060, is on
+// a loopback interface, only reachable from the host.
+func isLoopbackAddr(addr string) (bool, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false, err
 	}
+	ip := net.ParseIP(host)
+	return host == "localhost" || (ip != nil && ip.IsLoopback()), nil
+}
 
-	log.Printf("Listening on: unix://%s", socketPath)
-	return listener, nil
+// removeStaleSocket removes the socket at path if nothing serves it.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check %q: %v", path, err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%q exists and is not a socket, not replacing it", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%q is served by a running instance; stop it first or start this one with -warm-standby", path)
+	}
+	socketLog.Infof("Removing stale socket %s", path)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale socket %q: %v", path, err)
+	}
+	return nil
 }
 
-func setupSignals(socketPath string) {
+func setupSignals(cleanup func()) {
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-interrupt
-		os.RemoveAll(filepath.Dir(socketPath))
+		cleanup()
 		os.Exit(0)
 	}()
 }
 
-//Iops is the structure for IOPS Json
-type Iops struct {
-	Status string `json:"status"`
-	Data   struct {
-		ResultType string `json:"resultType"`
-		Result     []struct {
-			Metric struct {
-				Name              string `json:"__name__"`
-				Instance          string `json:"instance"`
-				Job               string `json:"job"`
-				KubernetesPodName string `json:"kubernetes_pod_name"`
-				OpenebsPv         string `json:"openebs_pv"`
-			} `json:"metric"`
-			Value []interface{} `json:"value"`
-		} `json:"result"`
-	} `json:"data"`
-}
-
-func getValue(body []byte) (*Iops, error) {
-	var s = new(Iops)
-	err := json.Unmarshal(body, &s)
-	if err != nil {
-		fmt.Println("whoops:", err)
-	}
-	return s, err
-}
-
 func main() {
-	// We put the socket in a sub-directory to have more control on the permissions
-	const socketPath = "/var/run/scope/plugins/iowait/iowait.sock"
-	hostID, _ := os.Hostname()
+	var (
+		trainScript   = flag.String("training-script", "", "Training mode: file of timed OpenEBS failure scenarios ("+strings.Join(trainingScenarioNames(), ", ")+") simulated in reports, for rehearsing storage incidents")
+		hostname      = flag.String("hostname", "", "ID of the Scope host node metrics are attached to (default $NODE_NAME, e.g. from the Kubernetes downward API, else the host name)")
+		discoverHost  = flag.Bool("discover-host-id", false, "Take the host node ID from the Scope probe running on the host, found among the host's processes (needs hostPID), unless -hostname is set")
+		dryRun        = flag.Bool("dry-run", false, "Print one report as indented JSON to stdout and exit, without serving Scope; also run by the report subcommand")
+		showVersion   = flag.Bool("version", false, "Print the version, git commit and build date, and exit")
+		logLevel      = flag.String("log-level", "info", "Minimum level logged: debug, info, warn or error; debug logs every request and raw Prometheus responses")
+		logFormat     = flag.String("log-format", "text", "Log format: text or json, one object per line, for shipping to e.g. ELK or Loki")
+		logFile       = flag.String("log-file", "", "File to log to instead of stderr, rotated by -log-max-size and -log-max-age")
+		logMaxSize    = flag.String("log-max-size", "100MiB", "Size at which the log file is rotated, with an optional B, KiB, MiB or GiB suffix (0 disables it)")
+		logMaxAge     = flag.Duration("log-max-age", 24*time.Hour, "Age at which the log file is rotated (0 disables it)")
+		logBackups    = flag.Int("log-max-backups", 5, "Number of rotated log files kept, as <log-file>.1 (the newest) to <log-file>.N")
+		configFile    = flag.String("config", "", "File of name=value lines setting flags, reloaded on SIGHUP or a POST to /-/reload on the plugin socket; command line flags take precedence")
+		pluginID      = flag.String("plugin-id", defaultPluginID, "ID of the plugin in Scope; it also names the socket, so instances with different IDs can run side by side")
+		pluginLabel   = flag.String("plugin-label", "", "Label of the plugin in Scope's plugin list (default the plugin ID)")
+		pluginDesc    = flag.String("plugin-description", "", "Description of the plugin in Scope's plugin list, before the inventory (default describes the IO wait graph)")
+		controlIcons  = flag.String("control-icons", "", "Comma separated list of control=icon pairs overriding the Font Awesome icons of controls (e.g. switchToIdle=fa-bed)")
+		hookNames     = flag.String("report-hooks", "", "Comma separated, ordered list of report hooks to apply ("+strings.Join(reportHookNames(), ", ")+")")
+		hookCfg       hookConfig
+		metricScale   = flag.String("metric-scale", "", "Comma separated list of metric=factor pairs used by the convert hook")
+		cpuSource     = flag.String("cpu-source", defaultCPUSource, "Where CPU statistics are read from ("+strings.Join(cpuSourceNames(), ", ")+")")
+		promURL       = flag.String("prometheus-url", defaultPrometheusURL, "URL of the Prometheus compatible API (e.g. Cortex) queried for volume metrics; empty disables it")
+		queries       promQueries
+		influxURL     = flag.String("influxdb-url", "", "URL of the InfluxDB server queried with -influxdb-query for volume metrics kept in Influx; empty disables it")
+		influxLang    = flag.String("influxdb-language", influxQL, "Language of the InfluxDB queries ("+influxQL+" or "+flux+")")
+		influxDB      = flag.String("influxdb-database", "", "Database InfluxQL queries run against")
+		influxOrg     = flag.String("influxdb-org", "", "Organisation Flux queries run in")
+		influxToken   = flag.String("influxdb-token", "", "InfluxDB API token, or user:password for InfluxDB 1.x")
+		influxQueries promQueries
+		graphiteURL   = flag.String("graphite-url", "", "URL of the Graphite server whose render API renders the -graphite-query targets; empty disables it")
+		graphiteFrom  = flag.String("graphite-from", "-5min", "How far back Graphite targets are rendered, in the render API's from syntax")
+		graphiteQuery promQueries
+		diskTable     = flag.Bool("diskstats", true, "Report per-device IO statistics from /proc/diskstats as a table on the host node")
+		diskSource    = flag.String("disk-source", defaultDiskSource, "Where block device statistics are read from ("+strings.Join(diskSourceNames(), ", ")+")")
+		zfs           = flag.Bool("zfs", false, "Report the read/write operations, bandwidth and capacity of every ZFS pool, e.g. of OpenEBS localpv-zfs, as metrics and in a table; needs zpool")
+		diskLVM       = flag.Bool("diskstats-lvm", false, "Also report the read/write IOPS and throughput of every LVM logical volume as metrics, named after its VG and LV")
+		diskLocalPVs  = flag.Bool("diskstats-localpv", false, "Also report the read/write IOPS and throughput of the device backing every local or hostPath PersistentVolume on this host, e.g. OpenEBS LocalPV, as the volume's metrics")
+		diskExtended  = flag.Bool("diskstats-extended", false, "Also report iostat -x style statistics (await, svctm, %util, queue size) of every block device as metrics")
+		diskExclude   = flag.String("diskstats-exclude", `^(loop|ram|zram)\d+$`, "Regular expression of block devices left out of the diskstats table")
+		bursts        = flag.Bool("microbursts", false, "Sample /proc/diskstats every 100ms during short windows and report the IO micro-bursts and peak 100ms IOPS of every block device as metrics")
+		burstEvery    = flag.Duration("microburst-interval", 15*time.Second, "Pause between micro-burst sampling windows")
+		burstWindow   = flag.Duration("microburst-window", 2*time.Second, "How long every micro-burst sampling window lasts")
+		burstFactor   = flag.Float64("microburst-factor", 4, "How many times the window's mean IOPS a 100ms step must reach to count as a burst")
+		burstMinIOPS  = flag.Float64("microburst-min-iops", 100, "Minimum IOPS of a 100ms step to count as a burst")
+		smart         = flag.Bool("smart", false, "Report the SMART health, temperature, bad sectors and power-on hours of every drive found by smartctl, flagging failing drives as critical unless smart_failed has a threshold")
+		smartEvery    = flag.Duration("smart-interval", 30*time.Minute, "How often the SMART data of the drives is read; reading it is slow and wakes sleeping drives")
+		nfs           = flag.Bool("nfs", false, "Report the operation rates and READ/WRITE round trip times of every NFS mount from /proc/1/mountstats, on the pod node for pod volumes")
+		mayastor      = flag.Bool("mayastor", false, "Report the IOPS, throughput and latency of every Mayastor volume from the io-engine metrics exporters, found through the Kubernetes API, and the pool and volume topology from the Mayastor REST API")
+		mayastorURL   = flag.String("mayastor-url", defaultMayastorURL, "URL of the Mayastor REST API")
+		mayastorPort  = flag.Int("mayastor-exporter-port", 9502, "Port the metrics exporters of the Mayastor io-engine pods listen on")
+		jiva          = flag.Bool("jiva", false, "Report the replica modes and rebuild progress of every Jiva volume from the REST API of its controller pod, found through the Kubernetes API, flagging volumes with replicas out of sync as a warning unless jiva_degraded has a threshold")
+		cstor         = flag.Bool("cstor-targets", false, "Report the IOPS and throughput of every cStor volume straight from the exporter of its target pod, found through the Kubernetes API, without Prometheus")
+		cstorPort     = flag.Int("cstor-exporter-port", 9500, "Port the exporters of cStor target pods listen on")
+		iscsi         = flag.Bool("iscsi", false, "Report the state, throughput, errors and TCP retransmits of every iSCSI session, e.g. of OpenEBS Jiva and cStor volumes, from /sys/class/iscsi_session, iscsiadm and ss")
+		nvme          = flag.Bool("nvme", false, "Report the temperature, endurance used, media errors and unsafe shutdowns of every NVMe controller from its SMART log; needs CAP_SYS_ADMIN")
+		mdraid        = flag.Bool("mdraid", true, "Report the health and resync progress of software RAID arrays from /proc/mdstat, when the host has any, flagging degraded arrays as critical unless md_degraded has a threshold")
+		psi           = flag.Bool("psi", true, "Report IO Pressure Stall Information from /proc/pressure/io, when the kernel supports it")
+		cgroupIO      = flag.Bool("cgroup-io", true, "Report per-container IO from the cgroup v2 io.stat files, when the host uses cgroup v2")
+		cgroupDir     = flag.String("cgroup-root", cgroupRoot, "Where the host's cgroup v2 hierarchy is mounted")
+		procIO        = flag.Bool("process-io", false, "Report the processes doing the most IO, from /proc/<pid>/io, as a table on the host node")
+		processTop    = flag.Int("process-io-top", 10, "How many processes the process IO table lists")
+		traceDevs     = flag.String("blktrace-devices", "", "Comma separated list of block devices (e.g. sda,nvme0n1) that get a control to run a short blktrace capture")
+		traceLength   = flag.Duration("blktrace-duration", 5*time.Second, "How long a blktrace capture runs")
+		benchDevs     = flag.String("benchmark-devices", "", "Comma separated list of block devices (e.g. sda,nvme0n1) that get a control to run a short, read-only fio benchmark")
+		benchLength   = flag.Duration("benchmark-duration", 10*time.Second, "How long a fio benchmark runs")
+		benchTTL      = flag.Duration("benchmark-ttl", 10*time.Minute, "How long the results of a fio benchmark are reported")
+		snapshotPVs   = flag.String("snapshot-pvs", "", "Comma separated list of OpenEBS PersistentVolumes that get a control taking a CSI snapshot of their claim; needs to run in the cluster")
+		snapshotClass = flag.String("snapshot-class", "", "VolumeSnapshotClass of the snapshots taken by controls (default the cluster's default class)")
+		warmStandby   = flag.Bool("warm-standby", false, "Take over the plugin socket from a running instance without a reporting gap, instead of replacing it")
+		warmup        = flag.Duration("warmup", time.Second, "How long to warm collectors up before taking over the plugin socket in warm standby mode")
+		drainTimeout  = flag.Duration("drain-timeout", 10*time.Second, "How long to wait for in-flight requests after another instance took over the plugin socket")
+		maxSamples    = flag.Int("max-samples", 0, "Maximum number of samples per metric served by the history of the read-only API (0 means unlimited)")
+		metricLimit   = flag.String("metric-max-samples", "", "Comma separated list of metric=count pairs overriding -max-samples for individual metrics")
+		thinMethod    = flag.String("thin-method", "lttb", "Sample thinning algorithm of the history of the read-only API (stride or lttb)")
+		shardEPs      = flag.String("shard-endpoints", "", "namespace/service whose ready endpoints are the aggregator replicas sharing the Prometheus volumes by consistent hashing; empty reports every volume")
+		aggregator    = flag.Bool("aggregator", false, "Report Prometheus series on the host node of their instance label, mapped by -instance-hosts or the Kubernetes nodes, so one replica enriches every host of the cluster")
+		instanceHosts = flag.String("instance-hosts", "", "Comma separated list of instance=host pairs mapping the instance label of Prometheus series, with or without its port, to Scope host IDs in aggregator mode")
+		shardSelf     = flag.String("shard-self", os.Getenv("POD_IP"), "Address of this replica among the -shard-endpoints (default $POD_IP)")
+		orphans       = flag.Bool("orphaned-pvs", false, "Show a table of volumes with series in Prometheus but no PersistentVolume in Kubernetes; needs to run in the cluster")
+		orphanEvery   = flag.Duration("orphaned-pvs-interval", 5*time.Minute, "How often orphaned volume series are looked for")
+		orphanHook    = flag.String("orphaned-pvs-webhook", "", "URL new orphaned volumes are posted to as JSON; empty only logs them")
+		notifyPath    = flag.String("notify-journal", "", "File notifications are written ahead to until their webhook accepts them, so they survive restarts; empty keeps them in memory only")
+		notifyMaxAge  = flag.Duration("notify-max-age", 24*time.Hour, "How long undelivered notifications are retried before being dropped (0 retries forever)")
+		kubeletVols   = flag.Bool("kubelet-volumes", false, "Show the capacity, usage and inodes of the volumes of claims, read from the kubelet's Summary API, on the pods using them and in a table on the host node; needs to run in the cluster")
+		kubeletURL    = flag.String("kubelet-url", defaultKubeletURL, "URL of the local kubelet, e.g. https://$NODE_IP:10250")
+		kubeletTLS    = flag.Bool("kubelet-insecure-tls", false, "Skip verifying the certificate of the kubelet, which is often self-signed")
+		csiVolumes    = flag.Bool("csi-volume-stats", false, "Show the capacity and usage of every volume mounted on the node, of any CSI driver, from the kubelet_volume_stats_* metrics of the kubelet at -kubelet-url; needs to run in the cluster")
+		dockerStats   = flag.Bool("docker-stats", false, "Show per-container IO from the blkio statistics of the Docker Engine API, for plain Docker hosts without cgroup v2, Kubernetes or Prometheus")
+		dockerSocket  = flag.String("docker-socket", defaultDockerSocket, "Unix socket of the Docker Engine API")
+		criStats      = flag.Bool("cri-stats", false, "Show the writable layer size of every container and the image filesystem usage of the container runtime (containerd, CRI-O), read with crictl")
+		criEndpoint   = flag.String("cri-endpoint", "", "Runtime endpoint crictl talks to, e.g. unix:///run/containerd/containerd.sock (default crictl's)")
+		cadvisor      = flag.Bool("cadvisor", false, "Show per-container IO from cAdvisor's container_fs_* and blkio metrics, for kernels without cgroup v2; by default from the kubelet's /metrics/cadvisor at -kubelet-url")
+		cadvisorURL   = flag.String("cadvisor-url", "", "URL of a standalone cAdvisor scraped by -cadvisor instead of the kubelet, e.g. http://127.0.0.1:8080")
+		pvInfo        = flag.Bool("pv-info", false, "Show a table of the PersistentVolumes with their claim, storage class, capacity and access modes, kept up to date by watching the Kubernetes API; needs to run in the cluster")
+		pvTable       = flag.Bool("pv-table", false, "Show a table of the read and write IOPS and the latency of every volume on the host node")
+		pvReadQuery   = flag.String("pv-read-iops-query", defaultPVReadIOPSQuery, "PromQL query returning the read IOPS of every volume, by openebs_pv")
+		pvWriteQuery  = flag.String("pv-write-iops-query", defaultPVWriteIOPSQuery, "PromQL query returning the write IOPS of every volume, by openebs_pv")
+		pvLatQuery    = flag.String("pv-latency-query", defaultPVLatencyQuery, "PromQL query returning the latency of every volume, by openebs_pv; empty leaves latencies out of the table")
+		costPerIOPS   = flag.Float64("cost-per-iops-month", 0, "Price of one sustained IOPS for a month, used to estimate the IO cost of volumes and namespaces; 0 with -cost-per-gb=0 disables cost estimation")
+		costPerGB     = flag.Float64("cost-per-gb", 0, "Price of one GB (10^9 bytes) of IO throughput")
+		costIOPSQuery = flag.String("cost-iops-query", defaultCostIOPSQuery, "PromQL query returning the IOPS of every volume, by openebs_pv")
+		costBpsQuery  = flag.String("cost-throughput-query", "", "PromQL query returning the throughput of every volume in bytes per second, by openebs_pv; empty ignores throughput")
+		costEvery     = flag.Duration("cost-interval", time.Minute, "How often IO costs are estimated")
+		latencyQuery  = flag.String("latency-histogram-query", "", "PromQL query returning the latency histogram buckets of every volume, by openebs_pv and le (e.g. sum by (openebs_pv, le) (increase(latency_seconds_bucket[5m]))), rolled up per namespace and storage class; empty disables rollups")
+		latencyEvery  = flag.Duration("latency-rollup-interval", time.Minute, "How often volume latencies are rolled up")
+		shardRefresh  = flag.Duration("shard-refresh", 30*time.Second, "How often the -shard-endpoints membership is refreshed")
+		cpuDisplay    = flag.String("cpu-display", "all", "How CPU metrics are shown: all shows every field at once, toggle shows idle or IO wait with a control to switch, cycle shows one field with a control moving to the next")
+		cpuHistory    = flag.Int("cpu-history", 60, "Number of samples kept per CPU field when only one is shown, so switching back to a field keeps its graph")
+		cpuPriority   = flag.String("cpu-priorities", "", "Comma separated list of field=priority pairs ordering the CPU metrics (default iowait first, then idle, user, system, nice and steal)")
+		memLimit      = flag.String("memory-limit", "", "Soft memory limit of the plugin, e.g. 64MiB (default $GOMEMLIMIT); close to it, history is dropped to stay within the pod's memory request")
+		memShedRatio  = flag.Float64("memory-shed-ratio", 0.9, "Fraction of the memory limit above which history is dropped")
+		runtimeStats  = flag.Bool("runtime-metrics", false, "Report the plugin's own Go runtime statistics (memory, goroutines, GC) as metrics on the host node")
+		replAddr      = flag.String("replication-addr", "", "Loopback TCP address (e.g. 127.0.0.1:9102) where the active instance serves its control state to a warm standby over gRPC; empty disables replication")
+		replInterval  = flag.Duration("replication-interval", time.Second, "How often the active instance sends its control state to a standby")
+		stateCodecID  = flag.String("state-codec", "json", "How the plugin state is serialized (json or gob)")
+		thresholdList = flag.String("thresholds", "", "Comma separated list of metric=limit pairs flagging metrics above an absolute limit as a warning, or with an x suffix (e.g. iowait=3x) above a factor of what is typical for the hour over the trailing week; a metric prefix (e.g. write_iops) applies to the metrics of every volume")
+		criticalList  = flag.String("critical-thresholds", "", "Comma separated list of metric=limit pairs, like -thresholds, flagging metrics as critical")
+		rangeList     = flag.String("metric-ranges", "", "Comma separated list of metric=min:max pairs fixing the range metrics are graphed within (e.g. write_iops=0:5000); a metric prefix applies to the metrics of every volume")
+		maxWindow     = flag.Duration("metric-max-window", time.Hour, "Window over which the graph maximum of metrics without a range, other than percentages, follows their highest value (0 follows the latest value)")
+		formatList    = flag.String("metric-formats", "", "Comma separated list of metric=format pairs setting how Scope renders metrics: number, integer, filesize (bytes) or percent; a metric prefix applies to the metrics of every volume")
+		unitList      = flag.String("metric-units", "", "Comma separated list of metric=unit pairs adding a unit to the label of metrics (e.g. write_iops=IOPS,disk_sda_await=ms); a metric prefix applies to the metrics of every volume")
+		thresholdStep = flag.Float64("threshold-step", 0.1, "Fraction by which the controls on the host node raise or lower the thresholds of a metric (0 disables the controls)")
+		stateFile     = flag.String("state-file", "", "File where the control state is saved and restored from at startup; empty disables it")
+		stateEvery    = flag.Duration("state-save-interval", 5*time.Minute, "How often the state is also saved periodically; 0 only saves it after controls and on exit")
+		stateCM       = flag.String("state-configmap", "", "namespace/name of an existing ConfigMap where the control state of every host is saved under its host ID, instead of -state-file")
+		edge          = flag.String("edge-mode", "auto", "Run in edge mode on constrained hosts: auto detects battery powered or small hosts, on forces it, off disables it")
+		pollInterval  = flag.Duration("poll-interval", 0, "How long a collection is reused by further reports, e.g. 5s on busy nodes; controls on the host node switch between 1s, 5s and 30s (0 collects for every report)")
+		edgeInterval  = flag.Duration("edge-interval", 30*time.Second, "How often collectors gather data in edge mode; reports in between repeat the last values")
+		captureAddr   = flag.String("capture-listen", "", "TCP address (e.g. :9101) serving the synchronised capture API; empty disables captures")
+		captureLeader = flag.Bool("capture-leader", false, "Add a control that runs a synchronised capture on every -capture-peers instance")
+		capturePeers  = flag.String("capture-peers", "", "Comma separated host:port list of the instances captured by the leader; a name resolving to several addresses (e.g. a headless service) expands to all of them")
+		captureAdv    = flag.String("capture-advertise", "", "host:port under which users download the leader's capture artifacts (default: the hostname and the -capture-listen port)")
+		publicAddr    = flag.String("public-addr", "", "TCP address (e.g. :8080) serving a read-only API: status page, latest report, metric history and a Grafana JSON datasource; controls stay on the plugin socket; empty disables it")
+		publicWindow  = flag.Duration("public-history", time.Hour, "How much metric history the read-only API keeps")
+		publicTokens  = flag.String("public-tokens", "", "File of token=namespace,namespace lines: the read-only and gRPC APIs then require one of the tokens, which only shows the volumes of its namespaces (* shows everything, and runs gRPC controls)")
+		enablePprof   = flag.Bool("enable-pprof", false, "Serve Go profiles under /debug/pprof/ on the plugin socket, to diagnose CPU and memory use")
+		pprofAddr     = flag.String("pprof-addr", "", "Loopback TCP address (e.g. localhost:6060) also serving the profiles with -enable-pprof")
+		commandLimit  = flag.Duration("command-timeout", 3*time.Second, "How long external tools such as iostat may run before being killed and their collection counted as failed (0 waits for them)")
+		collectLimit  = flag.Duration("collector-timeout", 5*time.Second, "How long each collector may take; collectors run concurrently, and one that times out is left out of the report (0 waits for them all)")
+		reportTTL     = flag.Duration("report-cache-ttl", 0, "How long a report is served from cache to further /report requests, e.g. 1s when Scope polls faster than metrics change; concurrent requests always share one collection")
+		reportDiff    = flag.Bool("report-diff", false, "Serve /report with an ETag and, to /report?since=<etag>, a 304 or only what changed since, for probes on bandwidth constrained nodes")
+		reportFull    = flag.Duration("report-full-interval", 5*time.Minute, "How often -report-diff still sends a full report")
+		statsdAddr    = flag.String("statsd-addr", "", "UDP address (e.g. localhost:8125) of a StatsD server every collected metric is also sent to as a gauge; empty disables it")
+		statsdPrefix  = flag.String("statsd-prefix", "iowait.", "Prefix of the names of the metrics sent to StatsD")
+		statsdTags    = flag.Bool("statsd-dogstatsd", false, "Send DogStatsD tags: volume metrics are named after their query and tagged with pv, and every metric with its host, pod or container")
+		otlpEndpoint  = flag.String("otlp-endpoint", "", "OTLP/HTTP endpoint of an OpenTelemetry collector (e.g. http://otel-collector:4318) every collection is also pushed to; empty disables it")
+		otlpHeaders   = flag.String("otlp-headers", "", "Comma separated list of name=value headers sent with every OTLP export, e.g. for authentication")
+		otlpTraces    = flag.Bool("otlp-traces", false, "Also export spans of report and control handling, collections, collectors and Prometheus queries to -otlp-endpoint")
+		otlpPrefix    = flag.String("otlp-prefix", "iowait.", "Prefix of the names of the metrics pushed over OTLP")
+		pushURL       = flag.String("push-url", "", "URL of the Scope app (e.g. http://scope-app:4040) reports are also published to, as probes do, for plugins running off-host; empty disables it")
+		pushToken     = flag.String("push-token", "", "Token the Scope app authenticates pushed reports with, e.g. a Weave Cloud service token")
+		pushInterval  = flag.Duration("push-interval", 3*time.Second, "How often reports are pushed to -push-url")
+		pushShortcuts = flag.Bool("push-shortcuts", false, "Also push a shortcut report as soon as a collection finds a node crossed a threshold")
+		pushProbeID   = flag.String("push-probe-id", "", "Probe ID reports are pushed as (default: the host ID)")
+		grpcAddr      = flag.String("grpc-addr", "", "TCP address (e.g. 127.0.0.1:9102) serving the report and control functionality over gRPC, see iowait.proto; only loopback addresses without -public-tokens; empty disables it")
+		metricsAddr   = flag.String("metrics-addr", "", "TCP address (e.g. :9101) serving the plugin's own metrics on /metrics in Prometheus format; empty disables it")
+		healthAddr    = flag.String("health-addr", "", "TCP address (e.g. :8081) serving the /healthz and /readyz probes, which are also served on the plugin socket; empty only serves them on the socket")
+		readyInterval = flag.Duration("ready-interval", 30*time.Second, "Collection interval readiness is judged by: /readyz collects itself if nothing did for that long")
+		readyMissed   = flag.Int("ready-intervals", 3, "Number of ready-intervals without a successful collection after which /readyz fails")
+		checkInterval = flag.Duration("self-check-interval", time.Minute, "How often the plugin fetches a report from its own socket, as Scope does, to check it is valid and fresh; /readyz fails once this fails (0 disables it)")
+		checkMaxAge   = flag.Duration("self-check-max-age", 2*time.Minute, "How old the newest sample of a self-checked report may be")
+		healthTimeout = flag.Duration("health-timeout", 10*time.Second, "How long /healthz waits for a report in progress, and /readyz for Prometheus")
+		captureDir    = flag.String("capture-dir", defaultCaptureDir(), "Where the leader stores capture artifacts")
+		captureLen    = flag.Duration("capture-duration", time.Minute, "How long a synchronised capture runs")
+		captureEvery  = flag.Duration("capture-interval", time.Second, "How often a synchronised capture samples the collectors")
+	)
+	flag.IntVar(&hookCfg.Precision, "round-precision", 2, "Number of decimal places kept by the round hook")
+	flag.IntVar(&hookCfg.MaxLabelLen, "max-label-length", 32, "Maximum label length kept by the truncate hook")
+	flag.DurationVar(&hookCfg.SummaryWindow, "summary-window", 5*time.Minute, "Window summarized by the summary hook")
+	flag.Var(&queries, "prometheus-query", "Instant query reported as a metric, as id=promql; can be repeated (default write_iops=OpenEBS_write_iops)")
+	flag.Var(&influxQueries, "influxdb-query", "InfluxDB query whose latest points are reported as a metric, as id=query; can be repeated")
+	flag.Var(&graphiteQuery, "graphite-query", "Graphite target whose latest datapoints are reported as a metric, as id=target; can be repeated")
+	flag.Parse()
 
-	url := "cortex-agent-service.maya-system.svc.cluster.local:80/api/v1/query?query=OpenEBS_write_iops"
+	if *showVersion {
+		fmt.Println(currentBuild())
+		return
+	}
+
+	explicitFlags := commandLineFlags()
+	// Reloads reset the flags the config file no longer sets to these.
+	baseConfig := flagConfig(queries)
+	if *configFile != "" {
+		if err := applyConfigFile(*configFile, explicitFlags); err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	// Get request to url
-	res, err := http.Get(url)
+	err := setupLogging(logOptions{
+		Level:      *logLevel,
+		Format:     *logFormat,
+		File:       *logFile,
+		MaxSize:    *logMaxSize,
+		MaxAge:     *logMaxAge,
+		MaxBackups: *logBackups,
+	})
 	if err != nil {
-		panic(err.Error())
+		log.Fatal(err)
 	}
 
-	body, err := ioutil.ReadAll(res.Body)
+	identity, err := newPluginIdentity(*pluginID, *pluginLabel, *pluginDesc, *controlIcons)
+	if err != nil {
+		log.Fatal(err)
+	}
+	socketPath := identity.socketPath()
+	scales, err := parseScales(*metricScale)
+	if err != nil {
+		log.Fatal(err)
+	}
+	hookCfg.Scales = scales
+	metricLimits, err := parseLimits(*metricLimit)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := validThinMethod(*thinMethod); err != nil {
+		log.Fatal(err)
+	}
+	thresholds, err := parseThresholds(*thresholdList)
+	if err != nil {
+		log.Fatal(err)
+	}
+	criticalThresholds, err := parseThresholds(*criticalList)
 	if err != nil {
-		panic(err.Error())
+		log.Fatal(err)
+	}
+	// Degraded RAID arrays and failing drives are critical, and Jiva
+	// volumes with replicas out of sync a warning, unless configured
+	// otherwise.
+	defaultThresholds := map[string]bool{}
+	for id, d := range map[string]struct{ enabled, critical bool }{
+		"md_degraded":   {*mdraid, true},
+		"smart_failed":  {*smart, true},
+		"jiva_degraded": {*jiva, false},
+	} {
+		if d.enabled {
+			defaultThresholds[id] = d.critical
+		}
+	}
+	addDefaultThresholds(thresholds, criticalThresholds, defaultThresholds)
+	metricRanges, err := parseMetricRanges(*rangeList)
+	if err != nil {
+		log.Fatal(err)
+	}
+	metricFormats, err := parseMetricFormats(*formatList)
+	if err != nil {
+		log.Fatal(err)
+	}
+	metricUnits, err := parseMetricStrings(*unitList, "metric unit", "metric=unit")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if hookCfg.SummaryWindow <= 0 {
+		log.Fatalf("invalid -summary-window %s, expected a positive duration", hookCfg.SummaryWindow)
+	}
+	if !validCPUDisplay(*cpuDisplay) {
+		log.Fatalf("invalid -cpu-display %q, expected all, toggle or cycle", *cpuDisplay)
+	}
+	if !validCPUSource(*cpuSource) {
+		log.Fatalf("invalid -cpu-source %q, expected one of %s", *cpuSource, strings.Join(cpuSourceNames(), ", "))
+	}
+	cpuPriorities, err := parseCPUPriorities(*cpuPriority)
+	if err != nil {
+		log.Fatal(err)
+	}
+	activeHooks := splitList(*hookNames)
+	hooks, err := newReportHooks(activeHooks, hookCfg)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	s, err := getValue([]byte(body))
+	hostID, hostIDSource := resolveHostID(*hostname, *discoverHost)
+	log.WithField("nodeID", hostID).Infof("Starting %s on %s (from %s)...", currentBuild(), hostID, hostIDSource)
+
+	exclude, err := regexp.Compile(*diskExclude)
+	if err != nil {
+		log.Fatalf("invalid -diskstats-exclude: %v", err)
+	}
+	if len(queries) == 0 {
+		queries = defaultPromQueries
+	}
+	httpClient := &http.Client{}
+	notifier, err := newNotifier(*notifyPath, httpClient, *notifyMaxAge)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go notifier.run()
+	opts := collectorOptions{
+		DiskSource:        *diskSource,
+		DiskExclude:       exclude,
+		DiskExtended:      *diskExtended,
+		DiskLVM:           *diskLVM,
+		DiskLocalPVs:      *diskLocalPVs,
+		CgroupRoot:        *cgroupDir,
+		ProcessTop:        *processTop,
+		TraceDevices:      splitList(*traceDevs),
+		TraceDuration:     *traceLength,
+		BenchmarkDevices:  splitList(*benchDevs),
+		BenchmarkDuration: *benchLength,
+		BenchmarkTTL:      *benchTTL,
+		SnapshotPVs:       splitList(*snapshotPVs),
+		SnapshotClass:     *snapshotClass,
+		CommandTimeout:    *commandLimit,
+		SMARTInterval:     *smartEvery,
+		PrometheusURL:     *promURL,
+		PrometheusQueries: queries,
+		InfluxDB: influxOptions{
+			URL:      *influxURL,
+			Language: *influxLang,
+			Database: *influxDB,
+			Org:      *influxOrg,
+			Token:    *influxToken,
+			Queries:  influxQueries,
+		},
+		Graphite: graphiteOptions{
+			URL:     *graphiteURL,
+			From:    *graphiteFrom,
+			Queries: graphiteQuery,
+		},
+		HTTPClient:     httpClient,
+		OrphanInterval: *orphanEvery,
+		OrphanWebhook:  *orphanHook,
+		Notifier:       notifier,
+		Pricing: ioPricing{
+			PerIOPSMonth:    *costPerIOPS,
+			PerGB:           *costPerGB,
+			IOPSQuery:       *costIOPSQuery,
+			ThroughputQuery: *costBpsQuery,
+		},
+		PVTableQueries: pvTableQueries{
+			ReadIOPS:  *pvReadQuery,
+			WriteIOPS: *pvWriteQuery,
+			Latency:   *pvLatQuery,
+		},
+		CostInterval:         *costEvery,
+		KubeletURL:           *kubeletURL,
+		KubeletInsecureTLS:   *kubeletTLS,
+		CadvisorURL:          *cadvisorURL,
+		CStorExporterPort:    *cstorPort,
+		MayastorURL:          *mayastorURL,
+		MayastorExporterPort: *mayastorPort,
+		CRIEndpoint:          *criEndpoint,
+		DockerSocket:         *dockerSocket,
+		LatencyQuery:         *latencyQuery,
+		LatencyInterval:      *latencyEvery,
+		Microbursts: microburstOptions{
+			Every:   *burstEvery,
+			Window:  *burstWindow,
+			Factor:  *burstFactor,
+			MinIOPS: *burstMinIOPS,
+		},
+	}
+	if *aggregator {
+		static, err := parseInstanceHosts(*instanceHosts)
+		if err != nil {
+			log.Fatalf("invalid -instance-hosts: %v", err)
+		}
+		kube, err := newInClusterKubeClient()
+		if err != nil {
+			log.Warnf("Aggregator: instances only mapped by -instance-hosts and their names: %v", err)
+			kube = nil
+		}
+		opts.InstanceHosts = newInstanceHosts(static, kube)
+	}
+	if *shardEPs != "" {
+		sharder, err := newPVSharder(*shardEPs, *shardSelf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := sharder.refresh(context.Background()); err != nil {
+			log.Errorf("%v", err)
+		}
+		go sharder.watch(*shardRefresh)
+		opts.PVShard = sharder.owns
+	}
+	names := []string{*cpuSource}
+	for name, enabled := range map[string]bool{
+		"diskstats":       *diskTable,
+		"psi":             *psi,
+		"mdraid":          *mdraid,
+		"nvme":            *nvme,
+		"nfs":             *nfs,
+		"iscsi":           *iscsi,
+		"cstor":           *cstor,
+		"jiva":            *jiva,
+		"mayastor":        *mayastor,
+		"smart":           *smart,
+		"cgroup-io":       *cgroupIO,
+		"process-io":      *procIO,
+		"blktrace":        len(opts.TraceDevices) > 0,
+		"benchmark":       len(opts.BenchmarkDevices) > 0,
+		"snapshot":        len(opts.SnapshotPVs) > 0,
+		"prometheus":      *promURL != "",
+		"influxdb":        *influxURL != "",
+		"graphite":        *graphiteURL != "",
+		"orphaned-pvs":    *orphans && *promURL != "",
+		"microburst":      *bursts,
+		"latency-rollup":  *latencyQuery != "" && *promURL != "",
+		"cost":            (*costPerIOPS > 0 || *costPerGB > 0) && *promURL != "",
+		"pv-table":        *pvTable && *promURL != "",
+		"pv-info":         *pvInfo,
+		"kubelet-volumes": *kubeletVols,
+		"cadvisor":        *cadvisor,
+		"csi-volumes":     *csiVolumes,
+		"cri-stats":       *criStats,
+		"docker-stats":    *dockerStats,
+		"zfs":             *zfs,
+	} {
+		if enabled {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names[1:])
+	edgeOn, edgeReason, err := edgeMode(*edge)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if edgeOn {
+		log.Infof("Edge mode (%s): collecting every %s, without %s", edgeReason, *edgeInterval, strings.Join(heavyCollectorNames(), ", "))
+		names = edgeCollectors(names)
+	}
 
-	logrus.Infof("%+v", s)
+	plugin := &Plugin{
+		HostID:             hostID,
+		identity:           identity,
+		boot:               readBootIdentity(),
+		diskExclude:        exclude,
+		thresholds:         thresholds,
+		criticalThresholds: criticalThresholds,
+		defaultThresholds:  defaultThresholds,
+		thresholdStep:      *thresholdStep,
+		metricRanges:       metricRanges,
+		metricFormats:      metricFormats,
+		metricUnits:        metricUnits,
+		maxima:             newRollingMaxima(*maxWindow),
+		baselines:          baselines{},
+		cpuDisplay:         *cpuDisplay,
+		cpuHistory:         map[string][]sample{},
+		cpuHistoryLen:      *cpuHistory,
+		cpuField:           cpuFieldIndex("iowait"),
+		cpuPriorities:      cpuPriorities,
+		hooks:              hooks,
+		hookNames:          activeHooks,
+		warmStandby:        *warmStandby,
+		edge:               edgeOn,
+		notifier:           notifier,
+		config:             flagConfig(queries),
+		reports:            newReportCache(*reportTTL),
+		collectTimeout:     *collectLimit,
+		pollInterval:       *pollInterval,
+	}
+	plugin.stream = newSampleStream(plugin.getTopologyHost())
+	if *statsdAddr != "" {
+		if plugin.statsd, err = newStatsdExporter(*statsdAddr, *statsdPrefix, *statsdTags, plugin.HostID); err != nil {
+			log.Fatal(err)
+		}
+		statsdLog.Infof("Sending metrics to StatsD at %s", *statsdAddr)
+	}
+	if *otlpEndpoint != "" {
+		headers, err := parseOTLPHeaders(*otlpHeaders)
+		if err != nil {
+			log.Fatalf("invalid -otlp-headers: %v", err)
+		}
+		kube, err := newInClusterKubeClient()
+		if err != nil {
+			otlpLog.Infof("Volume metrics exported without their namespaces: %v", err)
+			kube = nil
+		}
+		plugin.otlp = newOTLPExporter(*otlpEndpoint, headers, httpClient, *otlpPrefix, plugin.HostID, kube)
+		go plugin.otlp.run()
+		otlpLog.Infof("Pushing metrics to %s", plugin.otlp.endpoint)
+		if *otlpTraces {
+			traces = newSpanTracer(*otlpEndpoint, headers, httpClient, plugin.HostID)
+			go traces.run()
+			otlpLog.Infof("Exporting spans to %s", traces.endpoint)
+		}
+	}
+	if *trainScript != "" {
+		steps, err := readTrainingScript(*trainScript)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Warnf("Training mode: reports include %d simulated scenarios from %s", len(steps), *trainScript)
+		// Before the other hooks, so that simulated metrics are formatted
+		// like real ones.
+		plugin.hooks = append([]reportHook{trainingHook(steps, plugin.getTopologyHost(), time.Now())}, plugin.hooks...)
+		plugin.hookNames = append([]string{"training"}, plugin.hookNames...)
+	}
+	if *reportDiff {
+		plugin.differ = newReportDiffer(*reportFull)
+	}
+	unavailable := map[string]error{}
+	for i, name := range names {
+		var (
+			c   Collector
+			err error
+		)
+		if i == 0 {
+			c, plugin.cpuSource, err = newCPUCollectorFor(name, opts)
+		} else {
+			c, err = newCollector(name, opts)
+		}
+		if err != nil {
+			// The CPU source, first, comes straight from the command line.
+			if i == 0 {
+				log.Fatal(err)
+			}
+			collectorLog(name).Warnf("Collector %s unavailable: %v", name, err)
+			unavailable[name] = err
+			continue
+		}
+		if tracer, ok := c.(*blktracer); ok {
+			plugin.tracer = tracer
+		}
+		if bench, ok := c.(*benchmarker); ok {
+			plugin.bench = bench
+		}
+		if snapshots, ok := c.(*snapshotter); ok {
+			plugin.snapshots = snapshots
+		}
+		if edgeOn {
+			c = newThrottledCollector(c, *edgeInterval)
+		}
+		plugin.collectors = append(plugin.collectors, c)
+	}
 
-	// Handle the exit signal
-	setupSignals(socketPath)
+	if *captureAddr != "" {
+		if err := validCapture(*captureLen, *captureEvery); err != nil {
+			log.Fatalf("invalid -capture-duration or -capture-interval: %v", err)
+		}
+		ln, err := net.Listen("tcp", *captureAddr)
+		if err != nil {
+			log.Fatalf("failed to listen on %q: %v", *captureAddr, err)
+		}
+		advertise := *captureAdv
+		if advertise == "" {
+			_, port, _ := net.SplitHostPort(ln.Addr().String())
+			advertise = net.JoinHostPort(hostID, port)
+		}
+		if *captureLeader {
+			if err := os.MkdirAll(*captureDir, 0755); err != nil {
+				log.Fatalf("failed to create directory %q: %v", *captureDir, err)
+			}
+		}
+		plugin.capture = newCaptureServer(plugin, *captureDir, advertise, splitList(*capturePeers), *captureLeader, *captureLen, *captureEvery)
+		plugin.collectors = append(plugin.collectors, plugin.capture)
+		captureLog.Infof("Capture API listening on: tcp://%s", ln.Addr())
+		go func() {
+			if err := http.Serve(ln, plugin.capture.handler()); err != nil {
+				captureLog.Error(err)
+			}
+		}()
+	}
 
-	log.Printf("Starting on %s...\n", hostID)
+	var tenants *tenantFilter
+	if *publicTokens != "" {
+		if tenants, err = newTenantFilter(*publicTokens); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *publicAddr != "" {
+		ln, err := net.Listen("tcp", *publicAddr)
+		if err != nil {
+			log.Fatalf("failed to listen on %q: %v", *publicAddr, err)
+		}
+		plugin.public = newPublicAPI(plugin, *publicWindow, tenants, newSampleThinner(*thinMethod, *maxSamples, metricLimits))
+		publicLog.Infof("Read-only API listening on: tcp://%s", ln.Addr())
+		go func() {
+			if err := http.Serve(ln, plugin.public.handler()); err != nil {
+				publicLog.Error(err)
+			}
+		}()
+	}
 
-	// Check we can get the iowait for the system
-	_, err = iowait()
+	limit, err := setMemoryLimit(*memLimit)
 	if err != nil {
 		log.Fatal(err)
 	}
+	var guard *memoryGuard
+	if limit > 0 {
+		shedders := []memoryShedder{plugin}
+		if plugin.public != nil {
+			shedders = append(shedders, plugin.public)
+		}
+		for _, c := range plugin.collectors {
+			if s, ok := c.(memoryShedder); ok {
+				shedders = append(shedders, s)
+			}
+		}
+		guard = newMemoryGuard(limit, *memShedRatio, shedders)
+		go guard.watch(5 * time.Second)
+		plugin.memoryLimit = limit
+	}
+	if *runtimeStats {
+		plugin.collectors = append(plugin.collectors, newRuntimeCollector(guard))
+	}
 
-	listener, err := setupSocket(socketPath)
+	codec, err := newStateCodec(*stateCodecID)
 	if err != nil {
 		log.Fatal(err)
 	}
+	switch {
+	case *stateCM != "":
+		if plugin.store, err = newConfigMapStateStore(*stateCM, hostID); err != nil {
+			log.Fatal(err)
+		}
+	case *stateFile != "":
+		plugin.store = &fileStateStore{path: *stateFile, codec: codec}
+	}
+	plugin.loadState()
+	if plugin.store != nil && *stateEvery > 0 {
+		go plugin.saveStateEvery(*stateEvery)
+	}
+
+	// Check we can get the iowait for the system. Keep going if we can't,
+	// reports then tell the user what is wrong.
+	if _, err := plugin.collectors[0].Collect(context.Background()); err != nil {
+		log.Error(err)
+	}
+
+	if flag.Arg(0) == "check" {
+		ctx, cancel := context.WithTimeout(context.Background(), *healthTimeout)
+		defer cancel()
+		check := &preflight{plugin: plugin, socketPath: socketPath, promURL: *promURL, client: httpClient, unavailable: unavailable}
+		if !check.run(ctx, os.Stdout) {
+			os.Exit(1)
+		}
+		return
+	}
+	if *dryRun || flag.Arg(0) == "report" {
+		if err := plugin.dryRun(context.Background(), os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	var replicator *stateReplicator
+	if *replAddr != "" {
+		// The state is served unauthenticated, to the standby on the host.
+		loopback, err := isLoopbackAddr(*replAddr)
+		if err != nil {
+			log.Fatalf("invalid -replication-addr %q: %v", *replAddr, err)
+		}
+		if !loopback {
+			log.Fatalf("invalid -replication-addr %q: the state is only replicated on localhost", *replAddr)
+		}
+		replicator = newStateReplicator(plugin, *replAddr, codec, *replInterval)
+	}
+
+	if *readyInterval <= 0 || *readyMissed < 1 || *healthTimeout <= 0 {
+		log.Fatal("invalid -ready-interval, -ready-intervals or -health-timeout, expected positive values")
+	}
+	var healthProm *prometheusCollector
+	if *promURL != "" {
+		if healthProm, err = newPrometheusCollector(*promURL, nil, httpClient, nil); err != nil {
+			log.Fatal(err)
+		}
+	}
+	health := newHealthChecker(plugin, healthProm, *readyInterval, *readyMissed, *healthTimeout)
+	if *metricsAddr != "" {
+		ln, err := net.Listen("tcp", *metricsAddr)
+		if err != nil {
+			log.Fatalf("failed to listen on %q: %v", *metricsAddr, err)
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", self.serveMetrics)
+		log.Infof("Metrics listening on: tcp://%s/metrics", ln.Addr())
+		go func() {
+			if err := http.Serve(ln, mux); err != nil {
+				log.Error(err)
+			}
+		}()
+	}
+	if *grpcAddr != "" {
+		if err := serveGRPC(*grpcAddr, plugin, tenants); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *healthAddr != "" {
+		ln, err := net.Listen("tcp", *healthAddr)
+		if err != nil {
+			log.Fatalf("failed to listen on %q: %v", *healthAddr, err)
+		}
+		log.Infof("Health probes listening on: tcp://%s", ln.Addr())
+		go func() {
+			if err := http.Serve(ln, health.handler()); err != nil {
+				log.Error(err)
+			}
+		}()
+	}
+
+	// The plugin socket has its own mux: net/http/pprof registers on the
+	// default one, and profiles are opt-in.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/report", plugin.Report)
+	mux.Handle("/healthz", health.handler())
+	mux.Handle("/readyz", health.handler())
+	mux.HandleFunc("/control", plugin.Control)
+	mux.HandleFunc("/version", serveVersion)
+	mux.HandleFunc("/stream", plugin.serveStream)
+	mux.HandleFunc("/debug/state", plugin.serveDebugState)
+	mux.HandleFunc("/admin/state/export", plugin.serveStateExport)
+	mux.HandleFunc("/admin/state/import", plugin.serveStateImport)
+	if *enablePprof {
+		registerPprof(mux)
+		if *pprofAddr != "" {
+			if err := servePprof(*pprofAddr); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+	go plugin.watchDebugSignal()
+	if *configFile != "" {
+		reloader := &configReloader{path: *configFile, plugin: plugin, explicit: explicitFlags, base: baseConfig}
+		mux.HandleFunc("/-/reload", reloader.serveReload)
+		go reloader.watchSignals()
+	}
+	server := &http.Server{Handler: faultyHandler(mux)}
+
+	var (
+		listener net.Listener
+		owner    *socketOwner
+	)
+	if *warmStandby {
+		listener, owner, err = listenStandby(socketPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		followCtx, stopFollowing := context.WithCancel(context.Background())
+		if replicator != nil {
+			go replicator.follow(followCtx)
+		}
+		if err := plugin.warmUp(*warmup); err != nil {
+			socketLog.Errorf("warming up: %v", err)
+		}
+		if err := owner.takeOver(); err != nil {
+			owner.release()
+			log.Fatal(err)
+		}
+		stopFollowing()
+		health.setOwner(owner)
+		if replicator != nil {
+			replicator.adopt()
+			go replicator.serve()
+		}
+	} else {
+		listener, owner, err = setupSocket(socketPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		health.setOwner(owner)
+		if replicator != nil {
+			go replicator.serve()
+		}
+	}
+	// Whichever way it got the socket, a later -warm-standby instance may
+	// take it over.
+	go owner.watch(time.Second, func() {
+		socketLog.Infof("Socket taken over by another instance, draining")
+		if replicator != nil {
+			// Let the new instance fetch the final state first.
+			time.Sleep(*replInterval)
+			replicator.stop()
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			socketLog.Errorf("draining: %v", err)
+		}
+	})
+	cleanup := func() {
+		plugin.lock.Lock()
+		plugin.saveState()
+		plugin.lock.Unlock()
+		owner.release()
+	}
 	defer func() {
 		listener.Close()
-		os.RemoveAll(filepath.Dir(socketPath))
+		cleanup()
 	}()
 
-	plugin := &Plugin{HostID: hostID}
-	http.HandleFunc("/report", plugin.Report)
-	http.HandleFunc("/control", plugin.Control)
-	if err := http.Serve(listener, nil); err != nil {
-		log.Printf("error: %v", err)
+	if *pushURL != "" {
+		probeID := *pushProbeID
+		if probeID == "" {
+			probeID = plugin.HostID
+		}
+		pusher := newReportPusher(*pushURL, *pushToken, probeID, plugin)
+		pushLog.Infof("Pushing reports to %s every %s", pusher.url, *pushInterval)
+		if *pushShortcuts {
+			plugin.lock.Lock()
+			plugin.shortcuts = make(chan *report, 1)
+			plugin.lock.Unlock()
+			go pusher.pushShortcuts(plugin.shortcuts)
+		}
+		go pusher.watch(*pushInterval)
+	}
+	if *checkInterval > 0 {
+		check := newSelfCheck(socketPath, identity.id, plugin.getTopologyHost(), *healthTimeout, *checkMaxAge)
+		health.setSelfCheck(check, time.Duration(*readyMissed)*(*checkInterval))
+		go check.watch(*checkInterval)
+	}
+
+	// Handle the exit signal
+	setupSignals(cleanup)
+
+	if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		log.Error(err)
 	}
 }
 
 // Plugin groups the methods a plugin needs
 type Plugin struct {
-	HostID string
+	HostID   string
+	identity pluginIdentity
 
+	// lock guards the plugin state. It isn't held while collecting, so
+	// that controls never wait on e.g. iostat: collections are swapped in
+	// whole as latest instead.
 	lock       sync.Mutex
 	iowaitMode bool
+	// pausedSince is when collection was paused, zero if it isn't.
+	pausedSince time.Time
+	// pollInterval is how long collections are reused for, 0 collecting
+	// for every report.
+	pollInterval time.Duration
+
+	// cpuDisplay says how CPU metrics are shown (see cpudisplay.go), with
+	// cpuField the field shown in cycle mode and cpuHistory the samples
+	// kept per field when only one is shown. cpuPriorities overrides the
+	// priorities of CPU fields.
+	cpuDisplay    string
+	cpuField      int
+	cpuHistory    map[string][]sample
+	cpuHistoryLen int
+	cpuPriorities map[string]float64
+	// cpuSource is the CPU source in use, which is not the -cpu-source
+	// one if that fell back to another.
+	cpuSource string
+
+	// storage is the host's storage inventory, read again every
+	// storageInventoryMaxAge, without the devices matching diskExclude.
+	storage     storageInventory
+	diskExclude *regexp.Regexp
+
+	// thresholds and criticalThresholds flag metrics exceeding them,
+	// possibly relative to the baselines learnt for them.
+	thresholds         map[string]threshold
+	criticalThresholds map[string]threshold
+	// defaultThresholds are the metrics flagged unless configured
+	// otherwise, see addDefaultThresholds.
+	defaultThresholds map[string]bool
+	baselines         baselines
+	// thresholdScales are the scales of thresholds adjusted by controls,
+	// by threshold key, each press scaling by 1+thresholdStep.
+	thresholdScales map[string]float64
+	thresholdStep   float64
+	// statusLevels are the IO status levels of the nodes in the latest
+	// report, see trackStatuses.
+	statusLevels map[string]thresholdLevel
+	// shortcuts, set with -push-shortcuts, pass the reports in which a
+	// node crossed a threshold to the pusher.
+	shortcuts chan *report
+
+	// metricRanges fix the graph range of metrics, and maxima track that
+	// of the other metrics that aren't percentages.
+	metricRanges map[string]metricRange
+	maxima       *rollingMaxima
+	// metricFormats and metricUnits override the formats and add units
+	// to the labels of metrics, by metric key.
+	metricFormats map[string]string
+	metricUnits   map[string]string
+
+	// store, if set, persists the control state across restarts.
+	store stateStore
+	// config is the runtime config in effect, see applyConfig.
+	config runtimeConfig
+
+	// boot identifies the running kernel; rebootEvent describes the latest
+	// reboot noticed, at rebootTime.
+	boot        bootIdentity
+	rebootEvent string
+	rebootTime  time.Time
+
+	collectors []Collector
+	stream     *sampleStream
+	statsd     *statsdExporter
+	otlp       *otlpExporter
+	tracer     *blktracer
+	bench      *benchmarker
+	snapshots  *snapshotter
+	capture    *captureServer
+	public     *publicAPI
+	notifier   *notifier
+	differ     *reportDiffer
+	reports    *reportCache
+	// latest is the latest *collection, which reports can be built from
+	// without collecting, and lastCollect what it returned for debugging.
+	latest      atomic.Value
+	lastCollect collectDebug
+	// collectTimeout bounds every collector's collection, 0 meaning none.
+	collectTimeout time.Duration
+	hooks          []reportHook
+
+	// Settings only used to describe the plugin's inventory.
+	hookNames   []string
+	warmStandby bool
+	edge        bool
+	memoryLimit int64
 }
 
 type request struct {
@@ -139,18 +1013,62 @@ type response struct {
 }
 
 type report struct {
-	Host    topology
-	Plugins []pluginSpec
+	Host      topology
+	Container *topology `json:",omitempty"`
+	Pod       *topology `json:",omitempty"`
+	Plugins   []pluginSpec
+	// Shortcut marks the reports pushed as soon as a status changes, which
+	// the Scope app shows without waiting for its next update.
+	Shortcut bool `json:",omitempty"`
+}
+
+// topology returns the report topology with the given ID, creating it if
+// needed.
+func (r *report) topology(id string) *topology {
+	switch id {
+	case containerTopologyID:
+		if r.Container == nil {
+			r.Container = &topology{
+				Nodes:           map[string]node{},
+				MetricTemplates: map[string]metricTemplate{},
+			}
+		}
+		return r.Container
+	case podTopologyID:
+		if r.Pod == nil {
+			r.Pod = &topology{
+				Nodes:           map[string]node{},
+				MetricTemplates: map[string]metricTemplate{},
+			}
+		}
+		return r.Pod
+	}
+	return &r.Host
+}
+
+// topologies returns every topology carried by the report.
+func (r *report) topologies() []*topology {
+	topologies := []*topology{&r.Host}
+	if r.Container != nil {
+		topologies = append(topologies, r.Container)
+	}
+	if r.Pod != nil {
+		topologies = append(topologies, r.Pod)
+	}
+	return topologies
 }
 
 type topology struct {
-	Nodes           map[string]node           `json:"nodes"`
-	MetricTemplates map[string]metricTemplate `json:"metric_templates"`
-	Controls        map[string]control        `json:"controls"`
+	Nodes             map[string]node             `json:"nodes"`
+	MetricTemplates   map[string]metricTemplate   `json:"metric_templates"`
+	MetadataTemplates map[string]metadataTemplate `json:"metadata_templates,omitempty"`
+	TableTemplates    map[string]tableTemplate    `json:"table_templates,omitempty"`
+	Controls          map[string]control          `json:"controls"`
 }
 
 type node struct {
 	Metrics        map[string]metric       `json:"metrics"`
+	Latest         map[string]stringEntry  `json:"latest,omitempty"`
 	LatestControls map[string]controlEntry `json:"latestControls,omitempty"`
 }
 
@@ -174,6 +1092,11 @@ type controlData struct {
 	Dead bool `json:"dead"`
 }
 
+type stringEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     string    `json:"value"`
+}
+
 type metricTemplate struct {
 	ID       string  `json:"id"`
 	Label    string  `json:"label,omitempty"`
@@ -181,6 +1104,39 @@ type metricTemplate struct {
 	Priority float64 `json:"priority,omitempty"`
 }
 
+type metadataTemplate struct {
+	ID       string  `json:"id"`
+	Label    string  `json:"label,omitempty"`
+	Datatype string  `json:"dataType,omitempty"`
+	Priority float64 `json:"priority,omitempty"`
+	From     string  `json:"from,omitempty"`
+}
+
+type tableTemplate struct {
+	ID      string   `json:"id"`
+	Label   string   `json:"label"`
+	Prefix  string   `json:"prefix"`
+	Type    string   `json:"type"`
+	Columns []column `json:"columns,omitempty"`
+}
+
+type column struct {
+	ID       string `json:"id"`
+	Label    string `json:"label"`
+	DataType string `json:"dataType,omitempty"`
+}
+
+// tableEntryKeySeparator separates the row and column IDs of multicolumn
+// table entries in a node's latest map.
+const tableEntryKeySeparator = "___"
+
+// addTableRow stores one row of a multicolumn table in a node's latest map.
+func addTableRow(latest map[string]stringEntry, prefix, rowID string, row map[string]string, ts time.Time) {
+	for col, value := range row {
+		latest[prefix+rowID+tableEntryKeySeparator+col] = stringEntry{Timestamp: ts, Value: value}
+	}
+}
+
 type control struct {
 	ID    string `json:"id"`
 	Human string `json:"human"`
@@ -196,54 +1152,219 @@ type pluginSpec struct {
 	APIVersion  string   `json:"api_version,omitempty"`
 }
 
-func (p *Plugin) makeReport() (*report, error) {
-	metrics, err := p.metrics()
-	if err != nil {
-		return nil, err
+// A collection is what the collectors returned at once.
+type collection struct {
+	metrics []Metric
+	tables  []table
+	err     error
+	// collected is when the collectors returned.
+	collected time.Time
+	// recorded is set once the collection's metrics were recorded in the
+	// baselines, which must happen once however many reports show them.
+	recorded bool
+}
+
+// makeReport collects and builds a report. The caller doesn't hold p.lock:
+// it is only taken to build the report once collected.
+func (p *Plugin) makeReport(ctx context.Context) (*report, error) {
+	defer func(start time.Time) {
+		self.observe("iowait_report_duration_seconds", time.Since(start))
+	}(time.Now())
+	p.lock.Lock()
+	p.checkReboot()
+	paused := !p.pausedSince.IsZero()
+	interval := p.pollInterval
+	p.lock.Unlock()
+	c := &collection{}
+	if !paused {
+		// Within the poll interval the latest collection is reused.
+		latest, _ := p.latest.Load().(*collection)
+		if latest != nil && interval > 0 && time.Since(latest.collected) < interval {
+			c = latest
+		} else {
+			// Reports reusing the collection then know its metrics are
+			// recorded in the baselines.
+			c = p.collect(ctx)
+		}
+	}
+	_, sp := startSpan(ctx, "build")
+	defer sp.end()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	rpt, err := p.buildReport(c)
+	sp.setError(err)
+	return rpt, err
+}
+
+// latestReport builds a report from the latest collection, or with no
+// metrics before the first one. The caller holds p.lock.
+func (p *Plugin) latestReport() (*report, error) {
+	c, _ := p.latest.Load().(*collection)
+	if c == nil {
+		c = &collection{}
+	}
+	return p.buildReport(c)
+}
+
+// buildReport builds a report from a collection. The caller holds p.lock.
+func (p *Plugin) buildReport(c *collection) (*report, error) {
+	metrics, tables := c.metrics, c.tables
+	if len(metrics) == 0 && len(tables) == 0 && c.err != nil {
+		return nil, c.err
 	}
+
+	hostNodeID := p.getTopologyHost()
 	rpt := &report{
 		Host: topology{
 			Nodes: map[string]node{
-				p.getTopologyHost(): {
-					Metrics:        metrics,
+				hostNodeID: {
+					Metrics:        map[string]metric{},
+					Latest:         map[string]stringEntry{},
 					LatestControls: p.latestControls(),
 				},
 			},
-			MetricTemplates: p.metricTemplates(),
+			MetricTemplates: map[string]metricTemplate{},
+			TableTemplates:  map[string]tableTemplate{},
 			Controls:        p.controls(),
 		},
-		Plugins: []pluginSpec{
-			{
-				ID:          "iowait",
-				Label:       "iowait",
-				Description: "Adds a graph of CPU IO Wait to hosts",
-				Interfaces:  []string{"reporter", "controller"},
-				APIVersion:  "1",
-			},
-		},
+		Plugins: []pluginSpec{p.spec()},
+	}
+	shownCPUMetric, _ := p.metricIDAndName()
+	statuses := map[statusNode]thresholdLevel{}
+	for _, m := range metrics {
+		samples := []sample{{Date: m.Time, Value: m.Value}}
+		if isCPUMetric(m.ID) {
+			if p.singleCPUMetric() {
+				samples = p.recordCPUSample(m.ID, samples[0])
+				if m.ID != shownCPUMetric {
+					continue
+				}
+			}
+			if priority, ok := p.cpuPriorities[m.ID]; ok {
+				m.Priority = priority
+			}
+		}
+		t := rpt.topology(m.Topology)
+		nodeID := m.NodeID
+		if nodeID == "" {
+			nodeID = hostNodeID
+		}
+		n, ok := t.Nodes[nodeID]
+		if !ok {
+			n = node{Metrics: map[string]metric{}}
+		}
+		tmpl := p.formatMetric(metricTemplate{
+			ID:       m.ID,
+			Label:    m.Label,
+			Format:   m.Format,
+			Priority: m.Priority,
+		})
+		m.Format = tmpl.Format
+		m = p.scaleMetric(nodeID, m)
+		n.Metrics[m.ID] = metric{
+			Samples: samples,
+			Min:     m.Min,
+			Max:     m.Max,
+		}
+		t.Nodes[nodeID] = n
+		t.MetricTemplates[m.ID] = tmpl
+		if level, ok := p.checkThreshold(t, nodeID, m, !c.recorded); ok {
+			key := statusNode{t, nodeID}
+			if level >= statuses[key] {
+				statuses[key] = level
+			}
+		}
+	}
+	for key, level := range statuses {
+		setStatus(key.topology, key.nodeID, level, time.Now())
+	}
+	crossed := p.trackStatuses(statuses)
+	c.recorded = true
+	now := time.Now()
+	for _, tbl := range tables {
+		rpt.Host.TableTemplates[tbl.Template.ID] = tbl.Template
+		for key, entry := range tbl.entries(now) {
+			rpt.Host.Nodes[hostNodeID].Latest[key] = entry
+		}
+	}
+	p.addRebootEvent(rpt)
+	p.addCPUSource(rpt)
+	p.addPausedStatus(rpt)
+	p.addPollInterval(rpt)
+	p.addStorageInventory(rpt)
+	applyReportHooks(rpt, p.hooks)
+	if p.public != nil {
+		p.public.observe(rpt)
+	}
+	if crossed {
+		p.queueShortcut(rpt)
 	}
 	return rpt, nil
 }
 
-func (p *Plugin) metrics() (map[string]metric, error) {
-	value, err := p.metricValue()
-	if err != nil {
-		return nil, err
-	}
-	id, _ := p.metricIDAndName()
-	metrics := map[string]metric{
-		id: {
-			Samples: []sample{
-				{
-					Date:  time.Now(),
-					Value: value,
-				},
-			},
-			Min: 0,
-			Max: 100,
-		},
+// collect gathers the metrics and tables of every collector concurrently,
+// each within the collector timeout, and returns them as the latest
+// collection. A failing or slow collector doesn't fail or delay the
+// others; the collection's error is the first, in collector order. The
+// caller doesn't hold p.lock.
+func (p *Plugin) collect(ctx context.Context) *collection {
+	ctx, sp := startSpan(ctx, "collect")
+	defer sp.end()
+	token := p.lastCollect.begin()
+	results := make([]collectorResult, len(p.collectors))
+	var g errgroup.Group
+	for i, c := range p.collectors {
+		i, c := i, c
+		g.Go(func() error {
+			ctx, sp := startSpan(ctx, "collector", otlpAttr("collector", c.Name()))
+			results[i] = collectWithin(ctx, c, p.collectTimeout)
+			sp.setError(results[i].err)
+			sp.end()
+			return nil
+		})
+	}
+	g.Wait()
+
+	var (
+		metrics  []Metric
+		tables   []table
+		firstErr error
+		errors   = map[string]string{}
+	)
+	for i, r := range results {
+		name := p.collectors[i].Name()
+		if r.err != nil {
+			collectorLog(name).Errorf("%v", r.err)
+			self.inc("iowait_collection_errors_total", "collector", name)
+			errors[name] = r.err.Error()
+			if firstErr == nil {
+				firstErr = r.err
+			}
+		}
+		metrics = append(metrics, r.metrics...)
+		tables = append(tables, r.tables...)
+	}
+	p.lastCollect.record(token, metrics, errors)
+	c := &collection{metrics: metrics, tables: tables, err: firstErr, collected: time.Now()}
+	p.latest.Store(c)
+	p.stream.publish(metrics)
+	if p.statsd != nil {
+		p.statsd.send(metrics)
+	}
+	if p.otlp != nil {
+		p.otlp.export(metrics)
+	}
+	return c
+}
+
+func (p *Plugin) spec() pluginSpec {
+	return pluginSpec{
+		ID:          p.identity.id,
+		Label:       p.identity.label,
+		Description: p.description(),
+		Interfaces:  []string{"reporter", "controller"},
+		APIVersion:  "1",
 	}
-	return metrics, nil
 }
 
 func (p *Plugin) latestControls() map[string]controlEntry {
@@ -260,25 +1381,13 @@ func (p *Plugin) latestControls() map[string]controlEntry {
 	return ctrls
 }
 
-func (p *Plugin) metricTemplates() map[string]metricTemplate {
-	id, name := p.metricIDAndName()
-	return map[string]metricTemplate{
-		id: {
-			ID:       id,
-			Label:    name,
-			Format:   "percent",
-			Priority: 0.1,
-		},
-	}
-}
-
 func (p *Plugin) controls() map[string]control {
 	ctrls := map[string]control{}
 	for _, details := range p.allControlDetails() {
 		ctrls[details.id] = control{
 			ID:    details.id,
 			Human: details.human,
-			Icon:  details.icon,
+			Icon:  p.identity.icon(details.id, details.icon),
 			Rank:  1,
 		}
 	}
@@ -288,61 +1397,76 @@ func (p *Plugin) controls() map[string]control {
 // Report is called by scope when a new report is needed. It is part of the
 // "reporter" interface, which all plugins must implement.
 func (p *Plugin) Report(w http.ResponseWriter, r *http.Request) {
-	p.lock.Lock()
-	defer p.lock.Unlock()
-	log.Println(r.URL.String())
-	rpt, err := p.makeReport()
+	log.Debugf("%s %s", r.Method, r.URL)
+	ctx, sp := startServerSpan(r.Context(), "report")
+	defer sp.end()
+	raw, err := p.reportJSON(ctx)
 	if err != nil {
-		log.Printf("error: %v", err)
+		sp.setError(err)
+		log.Error(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	raw, err := json.Marshal(*rpt)
-	if err != nil {
-		log.Printf("error: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if p.differ != nil {
+		p.differ.serve(w, r, raw)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
-	w.Write(raw)
+	serveReport(w, r, raw)
+}
+
+// reportJSON returns the serialized report, from the report cache or
+// shared with the requests already waiting for one, or a diagnostic report
+// should building it fail.
+func (p *Plugin) reportJSON(ctx context.Context) ([]byte, error) {
+	sp := spanOf(ctx)
+	return p.reports.get(func() ([]byte, bool, error) {
+		// The report is shared by the requests waiting for it, so it
+		// isn't tied to the context of the one building it.
+		rpt, err := p.makeReport(detachSpan(ctx))
+		cacheable := err == nil
+		if err != nil {
+			log.Error(err)
+			sp.setError(err)
+			rpt = p.diagnosticReport(err)
+		}
+		_, serialize := startSpan(ctx, "serialize")
+		raw, err := json.Marshal(*rpt)
+		serialize.setError(err)
+		serialize.end()
+		return raw, cacheable, err
+	})
 }
 
+// errControlRejected is returned for controls that aren't this plugin's.
+var errControlRejected = errors.New("control rejected")
+
 // Control is called by scope when a control is activated. It is part
 // of the "controller" interface.
 func (p *Plugin) Control(w http.ResponseWriter, r *http.Request) {
-	p.lock.Lock()
-	defer p.lock.Unlock()
-	log.Println(r.URL.String())
+	log.Debugf("%s %s", r.Method, r.URL)
+	ctx, sp := startServerSpan(r.Context(), "control")
+	defer sp.end()
 	xreq := request{}
 	err := json.NewDecoder(r.Body).Decode(&xreq)
 	if err != nil {
-		log.Printf("Bad request: %v", err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	thisNodeID := p.getTopologyHost()
-	if xreq.NodeID != thisNodeID {
-		log.Printf("Bad nodeID, expected %q, got %q", thisNodeID, xreq.NodeID)
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-	expectedControlID, _, _ := p.controlDetails()
-	if expectedControlID != xreq.Control {
-		log.Printf("Bad control, expected %q, got %q", expectedControlID, xreq.Control)
+		log.Warnf("Bad request: %v", err)
+		self.inc("iowait_controls_total", "control", "", "result", "rejected")
+		sp.setAttr("result", "rejected")
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	p.iowaitMode = !p.iowaitMode
-	rpt, err := p.makeReport()
+	rpt, err := p.control(ctx, xreq)
 	if err != nil {
-		log.Printf("error: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 	res := response{ShortcutReport: rpt}
+	_, serialize := startSpan(ctx, "serialize")
 	raw, err := json.Marshal(res)
+	serialize.setError(err)
+	serialize.end()
 	if err != nil {
-		log.Printf("error: %v", err)
+		log.Error(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -350,26 +1474,109 @@ func (p *Plugin) Control(w http.ResponseWriter, r *http.Request) {
 	w.Write(raw)
 }
 
+// control runs a control and returns the shortcut report showing its
+// effect, or errControlRejected if the control or node isn't this
+// plugin's. Controls that fail are still answered with the report.
+func (p *Plugin) control(ctx context.Context, xreq request) (*report, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	sp := spanOf(ctx)
+	// Rejected controls aren't labelled, their IDs come from the caller.
+	control, result := "", "rejected"
+	defer func() {
+		self.inc("iowait_controls_total", "control", control, "result", result)
+		sp.setAttr("control", control)
+		sp.setAttr("result", result)
+	}()
+	thisNodeID := p.getTopologyHost()
+	if xreq.NodeID != thisNodeID {
+		log.WithField("nodeID", xreq.NodeID).Warnf("Bad nodeID, expected %q", thisNodeID)
+		return nil, fmt.Errorf("%w: unknown node %q", errControlRejected, xreq.NodeID)
+	}
+	control, result = xreq.Control, "ok"
+	if device, ok := p.traceDevice(xreq.Control); ok {
+		if err := p.tracer.start(device); err != nil {
+			log.Error(err)
+			result = "failed"
+		}
+	} else if device, ok := p.benchmarkDevice(xreq.Control); ok {
+		if err := p.bench.start(device); err != nil {
+			log.Error(err)
+			result = "failed"
+		}
+	} else if pv, ok := p.snapshotPV(xreq.Control); ok {
+		if err := p.snapshots.start(pv); err != nil {
+			log.Error(err)
+			result = "failed"
+		}
+	} else if p.capture != nil && p.capture.leader && xreq.Control == clusterCaptureControlID {
+		if err := p.capture.startCluster(); err != nil {
+			log.Error(err)
+			result = "failed"
+		}
+	} else if xreq.Control == refreshControlID {
+		// Collecting doesn't hold p.lock, see collect. The shortcut
+		// report below then shows the new collection.
+		p.lock.Unlock()
+		err := p.collect(ctx).err
+		p.lock.Lock()
+		if err != nil {
+			log.Error(err)
+			result = "failed"
+		}
+	} else if key, raise, ok := p.thresholdForControl(xreq.Control); ok {
+		p.adjustThreshold(key, raise)
+	} else if interval, ok := pollIntervalForControl(xreq.Control); ok {
+		p.setPollInterval(interval)
+	} else if xreq.Control == pauseControlID || xreq.Control == resumeControlID {
+		p.setPaused(xreq.Control == pauseControlID)
+	} else if p.cpuDisplay == cpuDisplayCycle && xreq.Control == cycleCPUControlID {
+		p.cpuField = (p.cpuField + 1) % len(cpuFields)
+	} else if p.cpuDisplay != cpuDisplayToggle {
+		log.WithField("nodeID", xreq.NodeID).Warnf("Bad control %q", xreq.Control)
+		control, result = "", "rejected"
+		return nil, fmt.Errorf("%w: unknown control %q", errControlRejected, xreq.Control)
+	} else {
+		expectedControlID, _, _ := p.controlDetails()
+		if expectedControlID != xreq.Control {
+			log.WithField("nodeID", xreq.NodeID).Warnf("Bad control, expected %q, got %q", expectedControlID, xreq.Control)
+			control, result = "", "rejected"
+			return nil, fmt.Errorf("%w: unknown control %q", errControlRejected, xreq.Control)
+		}
+		p.iowaitMode = !p.iowaitMode
+	}
+	p.saveState()
+	p.reports.invalidate()
+	// The shortcut report only needs to show the new state, so it doesn't
+	// wait for a collection.
+	rpt, err := p.latestReport()
+	if err != nil {
+		log.Error(err)
+		rpt = p.diagnosticReport(err)
+	}
+	return rpt, nil
+}
+
 func (p *Plugin) getTopologyHost() string {
-	store := fmt.Sprintf("%s;<host>", p.HostID)
-	logrus.Infof("%+v", store)
-	return store
+	return hostNodeID(p.HostID)
+}
+
+// hostNodeID returns the ID of a host's node in Scope reports.
+func hostNodeID(hostID string) string {
+	return fmt.Sprintf("%s;<host>", hostID)
 }
 
 func (p *Plugin) metricIDAndName() (string, string) {
+	if p.cpuDisplay == cpuDisplayCycle {
+		field := cpuFields[p.cpuField]
+		return field.id, field.label
+	}
 	if p.iowaitMode {
 		return "iowait", "IO Wait"
 	}
 	return "idle", "Idle"
 }
 
-func (p *Plugin) metricValue() (float64, error) {
-	if p.iowaitMode {
-		return iowait()
-	}
-	return idle()
-}
-
 type controlDetails struct {
 	id    string
 	human string
@@ -378,70 +1585,79 @@ type controlDetails struct {
 }
 
 func (p *Plugin) allControlDetails() []controlDetails {
-	return []controlDetails{
-		{
-			id:    "switchToIdle",
-			human: "Switch to idle",
-			icon:  "fa-gears",
-			dead:  !p.iowaitMode,
-		},
-		{
-			id:    "switchToIOWait",
-			human: "Switch to IO wait",
-			icon:  "fa-clock-o",
-			dead:  p.iowaitMode,
-		},
+	details := []controlDetails{}
+	switch p.cpuDisplay {
+	case cpuDisplayCycle:
+		details = append(details, p.cycleCPUControl())
+	case cpuDisplayToggle:
+		details = append(details,
+			controlDetails{
+				id:    "switchToIdle",
+				human: "Switch to idle",
+				icon:  "fa-gears",
+				dead:  !p.iowaitMode,
+			},
+			controlDetails{
+				id:    "switchToIOWait",
+				human: "Switch to IO wait",
+				icon:  "fa-clock-o",
+				dead:  p.iowaitMode,
+			},
+		)
 	}
-}
-
-func (p *Plugin) controlDetails() (string, string, string) {
-	for _, details := range p.allControlDetails() {
-		if !details.dead {
-			return details.id, details.human, details.icon
-		}
+	details = append(details, controlDetails{
+		id:    refreshControlID,
+		human: "Refresh now",
+		icon:  "fa-refresh",
+		dead:  !p.pausedSince.IsZero(),
+	})
+	details = append(details, p.pauseControls()...)
+	details = append(details, p.pollIntervalControls()...)
+	details = append(details, p.thresholdControls()...)
+	if p.tracer != nil {
+		details = append(details, p.tracer.controlDetails()...)
 	}
-	return "", "", ""
-}
-
-func iowait() (float64, error) {
-	return iostatValue(3)
-}
-
-func idle() (float64, error) {
-	return iostatValue(5)
-}
-
-func iostatValue(idx int) (float64, error) {
-	values, err := iostat()
-	if err != nil {
-		return 0, err
+	if p.bench != nil {
+		details = append(details, p.bench.controlDetails()...)
 	}
-	if idx >= len(values) {
-		return 0, fmt.Errorf("invalid iostat field index %d", idx)
+	if p.snapshots != nil {
+		details = append(details, p.snapshots.controlDetails()...)
 	}
+	if p.capture != nil {
+		details = append(details, p.capture.controlDetails()...)
+	}
+	return details
+}
 
-	return strconv.ParseFloat(values[idx], 64)
+// traceDevice returns the device traced by a blktrace control.
+func (p *Plugin) traceDevice(controlID string) (string, bool) {
+	if p.tracer == nil {
+		return "", false
+	}
+	return p.tracer.deviceForControl(controlID)
 }
 
-// Get the latest iostat values
-func iostat() ([]string, error) {
-	out, err := exec.Command("iostat", "-c").Output()
-	if err != nil {
-		return nil, fmt.Errorf("iowait: %v", err)
+// benchmarkDevice returns the device benchmarked by a benchmark control.
+func (p *Plugin) benchmarkDevice(controlID string) (string, bool) {
+	if p.bench == nil {
+		return "", false
 	}
+	return p.bench.deviceForControl(controlID)
+}
 
-	// Linux 4.2.0-25-generic (a109563eab38)	04/01/16	_x86_64_(4 CPU)
-	//
-	// avg-cpu:  %user   %nice %system %iowait  %steal   %idle
-	//	          2.37    0.00    1.58    0.01    0.00   96.04
-	lines := strings.Split(string(out), "\n")
-	if len(lines) < 4 {
-		return nil, fmt.Errorf("iowait: unexpected output: %q", out)
+// snapshotPV returns the volume snapshotted by a snapshot control.
+func (p *Plugin) snapshotPV(controlID string) (string, bool) {
+	if p.snapshots == nil {
+		return "", false
 	}
+	return p.snapshots.pvForControl(controlID)
+}
 
-	values := strings.Fields(lines[3])
-	if len(values) != 6 {
-		return nil, fmt.Errorf("iowait: unexpected output: %q", out)
+func (p *Plugin) controlDetails() (string, string, string) {
+	for _, details := range p.allControlDetails() {
+		if !details.dead {
+			return details.id, details.human, details.icon
+		}
 	}
-	return values, nil
+	return "", "", ""
 }
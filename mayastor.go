@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMayastorURL = "http://mayastor-api-rest.mayastor.svc.cluster.local:8081"
+	// mayastorIOEngineSelector selects the io-engine pods, whose metrics
+	// exporter reports the IO of the volume targets (nexuses) they host.
+	mayastorIOEngineSelector = "app=io-engine"
+
+	mayastorVolumesTableID     = "mayastor-volumes-table"
+	mayastorVolumesTablePrefix = "mayastor-volumes-table-"
+	mayastorPoolsTableID       = "mayastor-pools-table"
+	mayastorPoolsTablePrefix   = "mayastor-pools-table-"
+)
+
+func init() {
+	collectorFactories["mayastor"] = func(opts collectorOptions) (Collector, error) {
+		kube, err := newInClusterKubeClient()
+		if err != nil {
+			return nil, err
+		}
+		return newMayastorStats(kube, opts.MayastorURL, opts.MayastorExporterPort, opts.PVShard, opts.InstanceHosts), nil
+	}
+}
+
+// mayastorCounters are the cumulative IO counters of a Mayastor volume.
+type mayastorCounters struct {
+	reads, writes, readBytes, writeBytes float64
+	// readLatency and writeLatency are the total time, in microseconds,
+	// the reads and writes took.
+	readLatency, writeLatency float64
+}
+
+var mayastorExporterMetrics = map[string]bool{
+	"volume_num_read_ops":     true,
+	"volume_num_write_ops":    true,
+	"volume_bytes_read":       true,
+	"volume_bytes_written":    true,
+	"volume_read_latency_us":  true,
+	"volume_write_latency_us": true,
+}
+
+// mayastorVolume is a volume as the Mayastor REST API reports it.
+type mayastorVolume struct {
+	Spec struct {
+		UUID        string `json:"uuid"`
+		NumReplicas int    `json:"num_replicas"`
+	} `json:"spec"`
+	State struct {
+		Status string `json:"status"`
+		Target struct {
+			Node string `json:"node"`
+		} `json:"target"`
+		ReplicaTopology map[string]struct {
+			Node  string `json:"node"`
+			Pool  string `json:"pool"`
+			State string `json:"state"`
+		} `json:"replica_topology"`
+	} `json:"state"`
+}
+
+// mayastorPool is a disk pool as the Mayastor REST API reports it.
+type mayastorPool struct {
+	ID    string `json:"id"`
+	State struct {
+		Node     string   `json:"node"`
+		Disks    []string `json:"disks"`
+		Status   string   `json:"status"`
+		Capacity uint64   `json:"capacity"`
+		Used     uint64   `json:"used"`
+	} `json:"state"`
+}
+
+// mayastorPV returns the PersistentVolume of a volume, named after it.
+func mayastorPV(uuid string) string { return "pvc-" + uuid }
+
+// mayastorStats covers Mayastor, the newer OpenEBS engine: the IOPS,
+// throughput and latency of every volume, scraped from the metrics
+// exporters of the io-engine pods found through the Kubernetes API, and
+// the pool and volume topology from the REST control plane. Metrics use
+// the IDs of the cStor ones, e.g. write_iops_<pv>. With owns set, only the
+// volumes it owns are reported; with hosts set, volumes are reported on
+// the host node of the io-engine hosting their target.
+type mayastorStats struct {
+	kube   *kubeClient
+	url    string
+	port   int
+	owns   func(key string) bool
+	hosts  *instanceHosts
+	client *http.Client
+
+	lock     sync.Mutex
+	prev     map[string]mayastorCounters
+	prevTime time.Time
+	volumes  []mayastorVolume
+	pools    []mayastorPool
+}
+
+func newMayastorStats(kube *kubeClient, url string, port int, owns func(key string) bool, hosts *instanceHosts) *mayastorStats {
+	return &mayastorStats{
+		kube:   kube,
+		url:    strings.TrimSuffix(url, "/"),
+		port:   port,
+		owns:   owns,
+		hosts:  hosts,
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (m *mayastorStats) Name() string { return "mayastor" }
+
+func (m *mayastorStats) resetCounters() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.prev = nil
+}
+
+// get decodes the response of the REST control plane at path.
+func (m *mayastorStats) get(ctx context.Context, path string, v interface{}) error {
+	req, err := http.NewRequest("GET", m.url+path, nil)
+	if err != nil {
+		return fmt.Errorf("mayastor: %v", err)
+	}
+	res, err := m.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("mayastor: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("mayastor: GET %s: %s", path, res.Status)
+	}
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return fmt.Errorf("mayastor: GET %s: %v", path, err)
+	}
+	return nil
+}
+
+// scrape reads the counters of the volumes whose target an io-engine pod
+// hosts, by PV.
+func (m *mayastorStats) scrape(ctx context.Context, pod kubePod) (map[string]mayastorCounters, error) {
+	exporter := &kubeClient{host: "http://" + net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(m.port)), client: m.client}
+	raw, err := exporter.getText(ctx, "/metrics")
+	if err != nil {
+		return nil, err
+	}
+	samples, err := parseExposition(raw, mayastorExporterMetrics)
+	if err != nil {
+		return nil, err
+	}
+	volumes := map[string]mayastorCounters{}
+	for _, s := range samples {
+		pv := s.Labels["pv_name"]
+		if pv == "" {
+			continue
+		}
+		c := volumes[pv]
+		switch s.Name {
+		case "volume_num_read_ops":
+			c.reads = s.Value
+		case "volume_num_write_ops":
+			c.writes = s.Value
+		case "volume_bytes_read":
+			c.readBytes = s.Value
+		case "volume_bytes_written":
+			c.writeBytes = s.Value
+		case "volume_read_latency_us":
+			c.readLatency = s.Value
+		case "volume_write_latency_us":
+			c.writeLatency = s.Value
+		}
+		volumes[pv] = c
+	}
+	return volumes, nil
+}
+
+// topology reads the volumes and pools from the REST control plane.
+func (m *mayastorStats) topology(ctx context.Context) ([]mayastorVolume, []mayastorPool, error) {
+	// Recent versions page volumes, older ones return a plain list.
+	page := struct {
+		Entries []mayastorVolume `json:"entries"`
+	}{}
+	raw := json.RawMessage{}
+	if err := m.get(ctx, "/v0/volumes", &raw); err != nil {
+		return nil, nil, err
+	}
+	volumes := []mayastorVolume{}
+	if err := json.Unmarshal(raw, &volumes); err != nil {
+		if err := json.Unmarshal(raw, &page); err != nil {
+			return nil, nil, fmt.Errorf("mayastor: GET /v0/volumes: %v", err)
+		}
+		volumes = page.Entries
+	}
+	pools := []mayastorPool{}
+	if err := m.get(ctx, "/v0/pools", &pools); err != nil {
+		return nil, nil, err
+	}
+	owned := []mayastorVolume{}
+	for _, v := range volumes {
+		if m.owns == nil || m.owns(mayastorPV(v.Spec.UUID)) {
+			owned = append(owned, v)
+		}
+	}
+	sort.Slice(owned, func(i, j int) bool { return owned[i].Spec.UUID < owned[j].Spec.UUID })
+	sort.Slice(pools, func(i, j int) bool { return pools[i].ID < pools[j].ID })
+	return owned, pools, nil
+}
+
+func (m *mayastorStats) Collect(ctx context.Context) ([]Metric, error) {
+	volumes, pools, err := m.topology(ctx)
+	if err != nil {
+		// The IO statistics don't need the control plane.
+		collectorLog(m.Name()).Warnf("Cannot read the topology: %v", err)
+	} else {
+		m.lock.Lock()
+		m.volumes, m.pools = volumes, pools
+		m.lock.Unlock()
+	}
+	pods, err := m.kube.runningPods(ctx, mayastorIOEngineSelector)
+	if err != nil {
+		return nil, fmt.Errorf("mayastor: %v", err)
+	}
+	cur := map[string]mayastorCounters{}
+	nodeIDs := map[string]string{}
+	for _, pod := range pods {
+		if pod.Status.PodIP == "" {
+			continue
+		}
+		counters, err := m.scrape(ctx, pod)
+		if err != nil {
+			collectorLog(m.Name()).Debugf("io-engine %s/%s: %v", pod.Metadata.Namespace, pod.Metadata.Name, err)
+			continue
+		}
+		nodeID := ""
+		if m.hosts != nil {
+			if host, ok := m.hosts.host(ctx, pod.Spec.NodeName); ok {
+				nodeID = hostNodeID(host)
+			}
+		}
+		for pv, c := range counters {
+			if m.owns != nil && !m.owns(pv) {
+				continue
+			}
+			cur[pv], nodeIDs[pv] = c, nodeID
+		}
+	}
+	now := time.Now()
+	m.lock.Lock()
+	prev, elapsed := m.prev, now.Sub(m.prevTime).Seconds()
+	m.prev, m.prevTime = cur, now
+	m.lock.Unlock()
+
+	pvs := []string{}
+	for pv := range cur {
+		pvs = append(pvs, pv)
+	}
+	sort.Strings(pvs)
+	metrics := []Metric{}
+	for _, pv := range pvs {
+		c, p := cur[pv], prev[pv]
+		if _, ok := prev[pv]; !ok {
+			continue
+		}
+		reads, ok1 := counterRate(c.reads, p.reads, elapsed)
+		writes, ok2 := counterRate(c.writes, p.writes, elapsed)
+		readBytes, ok3 := counterRate(c.readBytes, p.readBytes, elapsed)
+		writeBytes, ok4 := counterRate(c.writeBytes, p.writeBytes, elapsed)
+		if !ok1 || !ok2 || !ok3 || !ok4 {
+			// The target moved or restarted.
+			continue
+		}
+		latency := func(total, prevTotal, ops, prevOps float64) float64 {
+			if ops <= prevOps {
+				return 0
+			}
+			return (total - prevTotal) / (ops - prevOps) / 1000
+		}
+		for j, s := range []struct {
+			id, label, format string
+			value             float64
+		}{
+			{"read_iops", "read IOPS", "", reads},
+			{"write_iops", "write IOPS", "", writes},
+			{"read_bytes", "read bytes/s", "filesize", readBytes},
+			{"write_bytes", "write bytes/s", "filesize", writeBytes},
+			{"read_latency", "read latency (ms)", "", latency(c.readLatency, p.readLatency, c.reads, p.reads)},
+			{"write_latency", "write latency (ms)", "", latency(c.writeLatency, p.writeLatency, c.writes, p.writes)},
+		} {
+			metrics = append(metrics, Metric{
+				ID:       s.id + "_" + pv,
+				Label:    pv + " " + s.label,
+				Format:   s.format,
+				Priority: 20 + float64(j)/10,
+				Value:    s.value,
+				Min:      0,
+				Max:      s.value,
+				Time:     now,
+				NodeID:   nodeIDs[pv],
+			})
+		}
+	}
+	return metrics, nil
+}
+
+func (m *mayastorStats) Tables() []table {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	volumeRows := map[string]map[string]string{}
+	for _, v := range m.volumes {
+		replicas := []string{}
+		for _, r := range v.State.ReplicaTopology {
+			replicas = append(replicas, fmt.Sprintf("%s on %s (%s)", r.Pool, r.Node, strings.ToLower(r.State)))
+		}
+		sort.Strings(replicas)
+		pv := mayastorPV(v.Spec.UUID)
+		volumeRows[pv] = map[string]string{
+			"pv":       pv,
+			"status":   strings.ToLower(v.State.Status),
+			"target":   v.State.Target.Node,
+			"replicas": fmt.Sprintf("%d/%d: %s", len(replicas), v.Spec.NumReplicas, strings.Join(replicas, ", ")),
+		}
+	}
+	poolRows := map[string]map[string]string{}
+	for _, p := range m.pools {
+		poolRows[p.ID] = map[string]string{
+			"pool":     p.ID,
+			"node":     p.State.Node,
+			"disks":    strings.Join(p.State.Disks, ", "),
+			"status":   strings.ToLower(p.State.Status),
+			"used":     formatSize(p.State.Used),
+			"capacity": formatSize(p.State.Capacity),
+		}
+	}
+	return []table{
+		{
+			Template: tableTemplate{
+				ID:     mayastorVolumesTableID,
+				Label:  "Mayastor volumes",
+				Prefix: mayastorVolumesTablePrefix,
+				Type:   "multicolumn-table",
+				Columns: []column{
+					{ID: "pv", Label: "Volume"},
+					{ID: "status", Label: "Status"},
+					{ID: "target", Label: "Target node"},
+					{ID: "replicas", Label: "Replicas"},
+				},
+			},
+			Rows: volumeRows,
+		},
+		{
+			Template: tableTemplate{
+				ID:     mayastorPoolsTableID,
+				Label:  "Mayastor pools",
+				Prefix: mayastorPoolsTablePrefix,
+				Type:   "multicolumn-table",
+				Columns: []column{
+					{ID: "pool", Label: "Pool"},
+					{ID: "node", Label: "Node"},
+					{ID: "disks", Label: "Disks"},
+					{ID: "status", Label: "Status"},
+					{ID: "used", Label: "Used"},
+					{ID: "capacity", Label: "Capacity"},
+				},
+			},
+			Rows: poolRows,
+		},
+	}
+}
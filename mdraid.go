@@ -0,0 +1,202 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	mdstatPath = "/proc/mdstat"
+
+	mdraidTableID     = "mdraid-table"
+	mdraidTablePrefix = "mdraid-table-"
+)
+
+func init() {
+	collectorFactories["mdraid"] = func(opts collectorOptions) (Collector, error) {
+		return newMDRaid(mdstatPath)
+	}
+}
+
+// mdArray is the state of a software RAID array in /proc/mdstat.
+type mdArray struct {
+	Name, State, Level string
+	// Devices and Active are the numbers of devices the array has and of
+	// those that are in sync, [2/1] in /proc/mdstat; Failed counts the
+	// devices marked (F).
+	Devices, Active, Failed int
+	// Sync is the running resync, recovery, reshape, check or repair, if
+	// any, and SyncPercent its progress.
+	Sync        string
+	SyncPercent float64
+}
+
+// Degraded returns the number of devices the array is missing.
+func (a mdArray) Degraded() int {
+	if a.Devices > a.Active {
+		return a.Devices - a.Active
+	}
+	return 0
+}
+
+var (
+	// md0 : active raid1 sdb1[1] sda1[0](F)
+	mdArrayRegexp = regexp.MustCompile(`^(md\S+) : (\S+)(?: \([^)]*\))*(?: (\S+))?`)
+	// 1048512 blocks super 1.2 [2/1] [U_]
+	mdDevicesRegexp = regexp.MustCompile(`\[(\d+)/(\d+)\] \[[U_]+\]`)
+	// [=>...]  recovery =  8.5% (89216/1048512) finish=0.7min speed=22304K/sec
+	mdSyncRegexp = regexp.MustCompile(`(resync|recovery|reshape|check|repair)\s*=\s*([\d.]+)%`)
+)
+
+func readMDStat(path string) ([]mdArray, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("mdraid: %v", err)
+	}
+	defer f.Close()
+	arrays := []mdArray{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if m := mdArrayRegexp.FindStringSubmatch(line); m != nil {
+			a := mdArray{Name: m[1], State: m[2], Level: m[3]}
+			if !strings.HasPrefix(a.Level, "raid") && a.Level != "linear" {
+				// Inactive arrays list their devices right away.
+				a.Level = ""
+			}
+			a.Failed = strings.Count(line, "(F)")
+			arrays = append(arrays, a)
+			continue
+		}
+		if len(arrays) == 0 {
+			continue
+		}
+		a := &arrays[len(arrays)-1]
+		if m := mdDevicesRegexp.FindStringSubmatch(line); m != nil {
+			a.Devices, _ = strconv.Atoi(m[1])
+			a.Active, _ = strconv.Atoi(m[2])
+		}
+		if m := mdSyncRegexp.FindStringSubmatch(line); m != nil {
+			a.Sync = m[1]
+			a.SyncPercent, _ = strconv.ParseFloat(m[2], 64)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("mdraid: %v", err)
+	}
+	return arrays, nil
+}
+
+// mdRaid reports the health of the host's software RAID arrays: the number
+// of devices every array is missing, which has a critical threshold by
+// default, and the progress of resyncs and recoveries.
+type mdRaid struct {
+	path string
+
+	lock   sync.Mutex
+	arrays []mdArray
+}
+
+// newMDRaid fails on kernels without the md driver.
+func newMDRaid(path string) (*mdRaid, error) {
+	if _, err := readMDStat(path); err != nil {
+		return nil, err
+	}
+	return &mdRaid{path: path}, nil
+}
+
+func (r *mdRaid) Name() string { return "mdraid" }
+
+func (r *mdRaid) Collect(ctx context.Context) ([]Metric, error) {
+	arrays, err := readMDStat(r.path)
+	if err != nil {
+		return nil, err
+	}
+	r.lock.Lock()
+	r.arrays = arrays
+	r.lock.Unlock()
+
+	now := time.Now()
+	metrics := []Metric{}
+	for i, a := range arrays {
+		if a.Devices == 0 {
+			continue
+		}
+		metrics = append(metrics, Metric{
+			ID:       "md_degraded_" + a.Name,
+			Label:    a.Name + " missing devices",
+			Format:   "integer",
+			Priority: 17 + float64(i)/10,
+			Value:    float64(a.Degraded()),
+			Max:      float64(a.Devices),
+			Time:     now,
+		})
+		if a.Sync != "" {
+			metrics = append(metrics, Metric{
+				ID:       "md_sync_percent_" + a.Name,
+				Label:    a.Name + " " + a.Sync,
+				Format:   "percent",
+				Priority: 17.05 + float64(i)/10,
+				Value:    a.SyncPercent,
+				Max:      100,
+				Time:     now,
+			})
+		}
+	}
+	return metrics, nil
+}
+
+func (r *mdRaid) Tables() []table {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	rows := map[string]map[string]string{}
+	for _, a := range r.arrays {
+		health := "ok"
+		switch {
+		case a.State != "active":
+			health = a.State
+		case a.Degraded() > 0:
+			health = fmt.Sprintf("degraded, %d missing", a.Degraded())
+		}
+		if a.Failed > 0 {
+			health += fmt.Sprintf(", %d failed", a.Failed)
+		}
+		sync := ""
+		if a.Sync != "" {
+			sync = fmt.Sprintf("%s %s%%", a.Sync, formatNumber(a.SyncPercent))
+		}
+		rows[a.Name] = map[string]string{
+			"array":   a.Name,
+			"level":   a.Level,
+			"devices": fmt.Sprintf("%d/%d", a.Active, a.Devices),
+			"health":  health,
+			"sync":    sync,
+		}
+	}
+	return []table{{
+		Template: tableTemplate{
+			ID:     mdraidTableID,
+			Label:  "RAID arrays",
+			Prefix: mdraidTablePrefix,
+			Type:   "multicolumn-table",
+			Columns: []column{
+				{ID: "array", Label: "Array"},
+				{ID: "level", Label: "Level"},
+				{ID: "devices", Label: "In sync"},
+				{ID: "health", Label: "Health"},
+				{ID: "sync", Label: "Sync"},
+			},
+		},
+		Rows: rows,
+	}}
+}
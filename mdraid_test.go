@@ -0,0 +1,94 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReadMDStat(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		mdstat string
+		want   []mdArray
+	}{
+		{
+			name:   "no arrays",
+			mdstat: "Personalities : \nunused devices: <none>\n",
+			want:   []mdArray{},
+		},
+		{
+			name: "healthy",
+			mdstat: `Personalities : [raid1] [raid6] [raid5] [raid4]
+md0 : active raid1 sdb1[1] sda1[0]
+      1048512 blocks super 1.2 [2/2] [UU]
+
+md1 : active raid5 sde[3] sdd[1] sdc[0]
+      2095104 blocks super 1.2 level 5, 512k chunk, algorithm 2 [3/3] [UUU]
+      bitmap: 0/1 pages [0KB], 65536KB chunk
+
+unused devices: <none>
+`,
+			want: []mdArray{
+				{Name: "md0", State: "active", Level: "raid1", Devices: 2, Active: 2},
+				{Name: "md1", State: "active", Level: "raid5", Devices: 3, Active: 3},
+			},
+		},
+		{
+			name: "degraded and recovering",
+			mdstat: `Personalities : [raid1]
+md0 : active raid1 sdc1[2] sdb1[1](F) sda1[0]
+      1048512 blocks super 1.2 [2/1] [U_]
+      [=>...................]  recovery =  8.5% (89216/1048512) finish=0.7min speed=22304K/sec
+
+unused devices: <none>
+`,
+			want: []mdArray{
+				{Name: "md0", State: "active", Level: "raid1", Devices: 2, Active: 1, Failed: 1, Sync: "recovery", SyncPercent: 8.5},
+			},
+		},
+		{
+			name: "read-only and inactive",
+			mdstat: `Personalities : [raid1]
+md126 : active (auto-read-only) raid1 sdb[1] sda[0]
+      1953383488 blocks super 1.2 [2/2] [UU]
+        resync=PENDING
+
+md127 : inactive sdc[0](S)
+      976630488 blocks super 1.2
+
+unused devices: <none>
+`,
+			want: []mdArray{
+				{Name: "md126", State: "active", Level: "raid1", Devices: 2, Active: 2},
+				{Name: "md127", State: "inactive"},
+			},
+		},
+	} {
+		got, err := readMDStat(writeTestFile(t, "mdstat", tc.mdstat))
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMDArrayDegraded(t *testing.T) {
+	for _, tc := range []struct {
+		array mdArray
+		want  int
+	}{
+		{mdArray{Devices: 2, Active: 2}, 0},
+		{mdArray{Devices: 3, Active: 1}, 2},
+		{mdArray{}, 0},
+	} {
+		if got := tc.array.Degraded(); got != tc.want {
+			t.Errorf("%+v: got %d, want %d", tc.array, got, tc.want)
+		}
+	}
+}
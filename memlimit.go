@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var memoryLog = componentLog("memory")
+
+// A memoryShedder gives memory back, e.g. by dropping history, when the
+// plugin gets close to its memory limit.
+type memoryShedder interface {
+	shedMemory()
+}
+
+// memoryGuard keeps the plugin within its soft memory limit (-memory-limit
+// or GOMEMLIMIT), so the DaemonSet stays within its pod memory request:
+// once the memory used by the Go runtime exceeds ratio of the limit, every
+// shedder is asked to give memory back.
+type memoryGuard struct {
+	limit    int64
+	ratio    float64
+	shedders []memoryShedder
+
+	lock     sync.Mutex
+	degraded bool
+	sheds    int
+}
+
+// setMemoryLimit sets the soft memory limit from a -memory-limit value and
+// returns the effective limit, which is GOMEMLIMIT when the value is empty.
+// It returns 0 if there is no limit.
+func setMemoryLimit(value string) (int64, error) {
+	if value != "" {
+		limit, err := parseBytes(value)
+		if err != nil {
+			return 0, fmt.Errorf("invalid -memory-limit: %v", err)
+		}
+		debug.SetMemoryLimit(limit)
+	}
+	if limit := debug.SetMemoryLimit(-1); limit != math.MaxInt64 {
+		return limit, nil
+	}
+	return 0, nil
+}
+
+// parseBytes parses a byte count with an optional B, KiB, MiB, GiB or TiB
+// suffix, as GOMEMLIMIT does.
+func parseBytes(s string) (int64, error) {
+	for i, unit := range []string{"TiB", "GiB", "MiB", "KiB", "B"} {
+		if !strings.HasSuffix(s, unit) {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSuffix(s, unit), 10, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid size %q", s)
+		}
+		return n << (10 * uint(4-i)), nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n, nil
+}
+
+func newMemoryGuard(limit int64, ratio float64, shedders []memoryShedder) *memoryGuard {
+	return &memoryGuard{limit: limit, ratio: ratio, shedders: shedders}
+}
+
+// runtimeMemory is the memory used by the Go runtime, as accounted for by
+// the soft memory limit.
+func runtimeMemory(m *runtime.MemStats) uint64 {
+	return m.Sys - m.HeapReleased
+}
+
+// check sheds memory if the plugin is over its threshold.
+func (g *memoryGuard) check() {
+	m := runtime.MemStats{}
+	runtime.ReadMemStats(&m)
+	over := float64(runtimeMemory(&m)) > g.ratio*float64(g.limit)
+
+	g.lock.Lock()
+	if over != g.degraded {
+		if over {
+			memoryLog.Warnf("Memory use %d MiB is close to the %d MiB limit, dropping history", runtimeMemory(&m)>>20, g.limit>>20)
+		} else {
+			memoryLog.Infof("Memory use back under the limit")
+		}
+		g.degraded = over
+	}
+	if over {
+		g.sheds++
+	}
+	g.lock.Unlock()
+	if !over {
+		return
+	}
+
+	// Shedders take their own locks, which may be held by a report asking
+	// for the guard's state: don't hold the guard's lock meanwhile.
+	for _, s := range g.shedders {
+		s.shedMemory()
+	}
+	debug.FreeOSMemory()
+}
+
+func (g *memoryGuard) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		g.check()
+	}
+}
+
+func (g *memoryGuard) state() (degraded bool, sheds int) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.degraded, g.sheds
+}
+
+// runtimeCollector reports the plugin's own Go runtime statistics.
+type runtimeCollector struct {
+	guard *memoryGuard
+}
+
+func newRuntimeCollector(guard *memoryGuard) *runtimeCollector {
+	return &runtimeCollector{guard: guard}
+}
+
+func (c *runtimeCollector) Name() string { return "runtime" }
+
+type runtimeStat struct {
+	id, label string
+	value     float64
+}
+
+func (c *runtimeCollector) Collect(ctx context.Context) ([]Metric, error) {
+	m := runtime.MemStats{}
+	runtime.ReadMemStats(&m)
+	now := time.Now()
+	var lastPause float64
+	if m.NumGC > 0 {
+		lastPause = float64(m.PauseNs[(m.NumGC+255)%256]) / float64(time.Millisecond)
+	}
+	stats := []runtimeStat{
+		{"go_memory_bytes", "Plugin memory", float64(runtimeMemory(&m))},
+		{"go_heap_inuse_bytes", "Plugin heap in use", float64(m.HeapInuse)},
+		{"go_goroutines", "Plugin goroutines", float64(runtime.NumGoroutine())},
+		{"go_gc_count", "Plugin GC cycles", float64(m.NumGC)},
+		{"go_gc_last_pause_ms", "Plugin last GC pause (ms)", lastPause},
+	}
+	if c.guard != nil {
+		degraded, _ := c.guard.state()
+		v := 0.0
+		if degraded {
+			v = 1
+		}
+		stats = append(stats, runtimeStat{"go_memory_degraded", "Plugin memory degraded", v})
+	}
+	metrics := []Metric{}
+	for i, s := range stats {
+		metrics = append(metrics, Metric{
+			ID:       s.id,
+			Label:    s.label,
+			Priority: 90 + float64(i)/10,
+			Value:    s.value,
+			Min:      0,
+			Max:      s.value,
+			Time:     now,
+		})
+	}
+	return metrics, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// metricFormats are the formats Scope renders metric values in: "" as a
+// plain number, "integer" without decimals, "filesize" in bytes with a
+// binary prefix and "percent" as a percentage.
+var metricFormats = []string{"", "integer", "filesize", "percent"}
+
+// metricKeys returns the keys settings of a metric are looked up by, most
+// specific first: its ID, then every ID prefix followed by an underscore,
+// longest first, so that e.g. write_iops applies to the write_iops_<pv>
+// of every volume.
+func metricKeys(id string) []string {
+	keys := []string{id}
+	for i := strings.LastIndex(id, "_"); i > 0; i = strings.LastIndex(id[:i], "_") {
+		keys = append(keys, id[:i])
+	}
+	return keys
+}
+
+// volumeMetricRegexp matches the IDs of volume metrics, <query>_<volume>.
+var volumeMetricRegexp = regexp.MustCompile(`^(.+)_(pvc-[0-9a-f-]+)$`)
+
+// splitVolumeMetric returns the query and volume of a volume metric ID, and
+// false for other metrics.
+func splitVolumeMetric(id string) (query, pv string, ok bool) {
+	match := volumeMetricRegexp.FindStringSubmatch(id)
+	if match == nil {
+		return "", "", false
+	}
+	return match[1], match[2], true
+}
+
+// parseMetricFormats parses a comma separated list of metric=format pairs.
+func parseMetricFormats(s string) (map[string]string, error) {
+	formats, err := parseMetricStrings(s, "metric format", "metric=format")
+	if err != nil {
+		return nil, err
+	}
+	for id, format := range formats {
+		if format == "number" {
+			formats[id] = ""
+			continue
+		}
+		if !validMetricFormat(format) {
+			return nil, fmt.Errorf("invalid metric format %q for %s, expected number, integer, filesize or percent", format, id)
+		}
+	}
+	return formats, nil
+}
+
+func validMetricFormat(format string) bool {
+	for _, f := range metricFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// parseMetricStrings parses a comma separated list of metric=value pairs.
+func parseMetricStrings(s, what, syntax string) (map[string]string, error) {
+	values := map[string]string{}
+	for _, pair := range splitList(s) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid %s %q, expected %s", what, pair, syntax)
+		}
+		values[parts[0]] = parts[1]
+	}
+	return values, nil
+}
+
+// lookupMetric returns the setting of a metric among settings by metric
+// key.
+func lookupMetric(settings map[string]string, id string) (string, bool) {
+	for _, key := range metricKeys(id) {
+		if v, ok := settings[key]; ok {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// formatMetric applies the configured format and unit of a metric to its
+// template, the unit as a label suffix, e.g. "pvc-1 write_iops (IOPS)".
+// The caller holds p.lock.
+func (p *Plugin) formatMetric(tmpl metricTemplate) metricTemplate {
+	if format, ok := lookupMetric(p.metricFormats, tmpl.ID); ok {
+		tmpl.Format = format
+	}
+	if unit, ok := lookupMetric(p.metricUnits, tmpl.ID); ok && unit != "" {
+		label := tmpl.Label
+		if label == "" {
+			label = tmpl.ID
+		}
+		tmpl.Label = fmt.Sprintf("%s (%s)", label, unit)
+	}
+	return tmpl
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rollingMaxStep is the resolution of rolling maxima.
+const rollingMaxStep = time.Minute
+
+// A metricRange fixes the bounds metric graphs are drawn within.
+type metricRange struct {
+	Min, Max float64
+}
+
+// parseMetricRanges parses a comma separated list of metric=min:max pairs.
+func parseMetricRanges(s string) (map[string]metricRange, error) {
+	ranges := map[string]metricRange{}
+	for _, pair := range splitList(s) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid metric range %q, expected metric=min:max", pair)
+		}
+		bounds := strings.SplitN(parts[1], ":", 2)
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("invalid metric range %q, expected metric=min:max", pair)
+		}
+		min, err := strconv.ParseFloat(bounds[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metric range %q: %v", pair, err)
+		}
+		max, err := strconv.ParseFloat(bounds[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metric range %q: %v", pair, err)
+		}
+		if max <= min {
+			return nil, fmt.Errorf("invalid metric range %q, expected min < max", pair)
+		}
+		ranges[parts[0]] = metricRange{Min: min, Max: max}
+	}
+	return ranges, nil
+}
+
+// rangeFor returns the configured range of a metric: the one of its ID or,
+// like thresholds, of the longest ID prefix followed by an underscore.
+func rangeFor(ranges map[string]metricRange, id string) (metricRange, bool) {
+	for _, key := range metricKeys(id) {
+		if r, ok := ranges[key]; ok {
+			return r, true
+		}
+	}
+	return metricRange{}, false
+}
+
+// maxBucket is the highest value of a metric during one step.
+type maxBucket struct {
+	Start time.Time
+	Max   float64
+}
+
+// rollingMaxima track the highest value of every metric over a trailing
+// window, so that graphs of unbounded metrics, such as IOPS, scale to what
+// the metric recently reached rather than jumping with every sample.
+type rollingMaxima struct {
+	window  time.Duration
+	buckets map[string][]maxBucket
+}
+
+func newRollingMaxima(window time.Duration) *rollingMaxima {
+	return &rollingMaxima{window: window, buckets: map[string][]maxBucket{}}
+}
+
+// observe records a value and returns the highest value over the window.
+func (r *rollingMaxima) observe(key string, t time.Time, v float64) float64 {
+	if r.window <= 0 {
+		return v
+	}
+	start := t.Truncate(rollingMaxStep)
+	buckets := r.buckets[key]
+	if n := len(buckets); n > 0 && buckets[n-1].Start.Equal(start) {
+		if v > buckets[n-1].Max {
+			buckets[n-1].Max = v
+		}
+	} else {
+		buckets = append(buckets, maxBucket{Start: start, Max: v})
+	}
+	i := 0
+	for i < len(buckets) && buckets[i].Start.Before(t.Add(-r.window)) {
+		i++
+	}
+	buckets = buckets[i:]
+	r.buckets[key] = buckets
+	max := v
+	for _, b := range buckets {
+		if b.Max > max {
+			max = b.Max
+		}
+	}
+	return max
+}
+
+// reset forgets every maximum, e.g. to shed memory.
+func (r *rollingMaxima) reset() {
+	r.buckets = map[string][]maxBucket{}
+}
+
+// scaleMetric sets the graph range of a metric: the configured one if any
+// and, for metrics other than percentages, 0 to the rolling maximum. The
+// caller holds p.lock.
+func (p *Plugin) scaleMetric(nodeID string, m Metric) Metric {
+	if r, ok := rangeFor(p.metricRanges, m.ID); ok {
+		m.Min, m.Max = r.Min, r.Max
+		return m
+	}
+	if m.Format == "percent" || p.maxima == nil {
+		return m
+	}
+	m.Max = p.maxima.observe(nodeID+"/"+m.ID, m.Time, m.Value)
+	if m.Min > m.Max {
+		m.Min = m.Max
+	}
+	return m
+}
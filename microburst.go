@@ -0,0 +1,159 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// microburstStep is the resolution bursts are detected at.
+const microburstStep = 100 * time.Millisecond
+
+func init() {
+	collectorFactories["microburst"] = func(opts collectorOptions) (Collector, error) {
+		m := newMicroburstDetector(diskStatsPath, opts.DiskExclude, opts.Microbursts)
+		go m.watch()
+		return m, nil
+	}
+}
+
+// deviceBursts are the micro-bursts of one device during the latest window.
+type deviceBursts struct {
+	Device   string
+	Bursts   int
+	PeakIOPS float64
+}
+
+// microburstDetector samples /proc/diskstats every 100ms during a short
+// window, repeated periodically, to find IO micro-bursts that coarser
+// sampling, such as 15 second Prometheus scrapes, averages away.
+type microburstDetector struct {
+	path    string
+	exclude *regexp.Regexp
+	opts    microburstOptions
+
+	lock   sync.Mutex
+	latest []deviceBursts
+	time   time.Time
+	err    error
+}
+
+func newMicroburstDetector(path string, exclude *regexp.Regexp, opts microburstOptions) *microburstDetector {
+	return &microburstDetector{path: path, exclude: exclude, opts: opts}
+}
+
+func (m *microburstDetector) Name() string { return "microburst" }
+
+func (m *microburstDetector) watch() {
+	for {
+		bursts, err := m.sampleWindow()
+		if err != nil {
+			collectorLog(m.Name()).Error(err)
+		}
+		m.lock.Lock()
+		m.err = err
+		if err == nil {
+			m.latest, m.time = bursts, time.Now()
+		}
+		m.lock.Unlock()
+		time.Sleep(m.opts.Every)
+	}
+}
+
+// sampleWindow samples the window and finds the bursts of every device.
+func (m *microburstDetector) sampleWindow() ([]deviceBursts, error) {
+	ticker := time.NewTicker(microburstStep)
+	defer ticker.Stop()
+	prev, err := readDiskStats(m.path, m.exclude)
+	if err != nil {
+		return nil, err
+	}
+	steps := map[string][]float64{}
+	for end := prev.time.Add(m.opts.Window); prev.time.Before(end); {
+		<-ticker.C
+		cur, err := readDiskStats(m.path, m.exclude)
+		if err != nil {
+			return nil, err
+		}
+		elapsed := cur.time.Sub(prev.time).Seconds()
+		for device, c := range cur.devices {
+			p, ok := prev.devices[device]
+			if !ok || elapsed <= 0 || c.reads < p.reads || c.writes < p.writes {
+				continue
+			}
+			steps[device] = append(steps[device], (c.reads-p.reads+c.writes-p.writes)/elapsed)
+		}
+		prev = cur
+	}
+
+	bursts := []deviceBursts{}
+	for device, iops := range steps {
+		bursts = append(bursts, findBursts(device, iops, m.opts))
+	}
+	sort.Slice(bursts, func(i, j int) bool { return bursts[i].Device < bursts[j].Device })
+	return bursts, nil
+}
+
+// findBursts counts the runs of consecutive steps above the burst level.
+func findBursts(device string, iops []float64, opts microburstOptions) deviceBursts {
+	b := deviceBursts{Device: device}
+	mean := 0.0
+	for _, v := range iops {
+		mean += v
+		if v > b.PeakIOPS {
+			b.PeakIOPS = v
+		}
+	}
+	if len(iops) > 0 {
+		mean /= float64(len(iops))
+	}
+	level := opts.Factor * mean
+	if level < opts.MinIOPS {
+		level = opts.MinIOPS
+	}
+	inBurst := false
+	for _, v := range iops {
+		above := v >= level
+		if above && !inBurst {
+			b.Bursts++
+		}
+		inBurst = above
+	}
+	return b
+}
+
+func (m *microburstDetector) Collect(ctx context.Context) ([]Metric, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	metrics := []Metric{}
+	for i, b := range m.latest {
+		metrics = append(metrics,
+			Metric{
+				ID:       diskMetricID(b.Device, "bursts"),
+				Label:    b.Device + " micro-bursts",
+				Format:   "integer",
+				Priority: 30 + float64(i),
+				Value:    float64(b.Bursts),
+				Min:      0,
+				Max:      float64(b.Bursts),
+				Time:     m.time,
+			},
+			Metric{
+				ID:       diskMetricID(b.Device, "peak_iops_100ms"),
+				Label:    b.Device + " peak IOPS (100ms)",
+				Format:   "integer",
+				Priority: 30 + float64(i) + 0.5,
+				Value:    b.PeakIOPS,
+				Min:      0,
+				Max:      b.PeakIOPS,
+				Time:     m.time,
+			},
+		)
+	}
+	return metrics, m.err
+}
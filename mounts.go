@@ -0,0 +1,94 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	// With hostPID, the mounts of the host are those of its init process,
+	// and its root filesystem is reachable through /proc/1/root.
+	hostMountInfoPath = "/proc/1/mountinfo"
+	hostRootPath      = "/proc/1/root"
+	selfMountInfoPath = "/proc/self/mountinfo"
+	sysDevBlockPath   = "/sys/dev/block"
+)
+
+func init() {
+	deviceMounts = readDeviceMounts
+}
+
+// readDeviceMounts maps the block devices to where they are mounted on the
+// host, or in the plugin's container if the host's mounts can't be read.
+func readDeviceMounts() (map[string]deviceMount, error) {
+	path, root := hostMountInfoPath, hostRootPath
+	f, err := os.Open(path)
+	if err != nil {
+		path, root = selfMountInfoPath, ""
+		if f, err = os.Open(path); err != nil {
+			return nil, err
+		}
+	}
+	defer f.Close()
+	mounts := map[string]deviceMount{}
+	// wholeFS tells whether a device's mount is of its whole filesystem,
+	// which is preferred to bind mounts of its subdirectories.
+	wholeFS := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i, field := range fields {
+			if field == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 5 || len(fields) < sep+2 {
+			continue
+		}
+		link, err := os.Readlink(filepath.Join(sysDevBlockPath, fields[2]))
+		if err != nil {
+			// Not a block device, e.g. tmpfs or overlay.
+			continue
+		}
+		device := filepath.Base(link)
+		mountpoint := unescapeMountPath(fields[4])
+		whole := fields[3] == "/"
+		prev, ok := mounts[device]
+		if ok && !(whole && !wholeFS[device] || whole == wholeFS[device] && len(mountpoint) < len(prev.Mountpoint)) {
+			continue
+		}
+		mounts[device] = deviceMount{Mountpoint: mountpoint, FSType: fields[sep+1]}
+		wholeFS[device] = whole
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for device, m := range mounts {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(filepath.Join(root, m.Mountpoint), &st); err != nil {
+			continue
+		}
+		m.Size = st.Blocks * uint64(st.Bsize)
+		m.Used = (st.Blocks - st.Bfree) * uint64(st.Bsize)
+		mounts[device] = m
+	}
+	return mounts, nil
+}
+
+// unescapeMountPath undoes the octal escaping of spaces, tabs, newlines and
+// backslashes in mountinfo paths.
+func unescapeMountPath(s string) string {
+	for _, r := range []struct{ escaped, raw string }{{`\040`, " "}, {`\011`, "\t"}, {`\012`, "\n"}, {`\134`, `\`}} {
+		s = strings.Replace(s, r.escaped, r.raw, -1)
+	}
+	return s
+}
@@ -0,0 +1,209 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	hostMountStatsPath = "/proc/1/mountstats"
+	selfMountStatsPath = "/proc/self/mountstats"
+)
+
+func init() {
+	collectorFactories["nfs"] = func(opts collectorOptions) (Collector, error) {
+		return newNFSStats(hostMountStatsPath, selfMountStatsPath), nil
+	}
+}
+
+// nfsOp is the per-op statistics of one NFS operation of a mount.
+type nfsOp struct {
+	ops, rttMs float64
+}
+
+// nfsMount is the cumulative statistics of an NFS mount.
+type nfsMount struct {
+	Mountpoint, Export string
+	ops                float64 // of all operations
+	read, write        nfsOp
+}
+
+// kubeletVolumeRegexp matches the mountpoints of pod volumes, e.g.
+// /var/lib/kubelet/pods/<uid>/volumes/kubernetes.io~nfs/<pv>, or
+// .../kubernetes.io~csi/<pv>/mount for CSI drivers.
+var kubeletVolumeRegexp = regexp.MustCompile(`/pods/([0-9a-f-]+)/volumes/[^/]+~[^/]+/([^/]+)(?:/mount)?$`)
+
+// readMountStats reads the statistics of the NFS mounts in a mountstats
+// file:
+//
+//	device srv:/export mounted on /mnt with fstype nfs4 statvers=1.1
+//		...
+//		per-op statistics
+//		        READ: 3 3 0 468 1752 0 2 2 0
+//
+// where the per-op fields are the operations, transmissions, timeouts,
+// bytes sent and received, and the cumulative queue, RTT and execution
+// milliseconds.
+func readMountStats(path string) (map[string]nfsMount, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	mounts := map[string]nfsMount{}
+	var cur *nfsMount
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if fields[0] == "device" {
+			if cur != nil {
+				mounts[cur.Mountpoint] = *cur
+				cur = nil
+			}
+			if len(fields) >= 8 && fields[2] == "mounted" && strings.HasPrefix(fields[7], "nfs") {
+				cur = &nfsMount{Export: fields[1], Mountpoint: unescapeMountPath(fields[4])}
+			}
+			continue
+		}
+		if cur == nil || !strings.HasSuffix(fields[0], ":") || len(fields) < 8 {
+			continue
+		}
+		ops, err1 := strconv.ParseFloat(fields[1], 64)
+		rtt, err2 := strconv.ParseFloat(fields[7], 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		cur.ops += ops
+		switch fields[0] {
+		case "READ:":
+			cur.read = nfsOp{ops, rtt}
+		case "WRITE:":
+			cur.write = nfsOp{ops, rtt}
+		}
+	}
+	if cur != nil {
+		mounts[cur.Mountpoint] = *cur
+	}
+	return mounts, scanner.Err()
+}
+
+// nfsStats reports the operation rates and the READ and WRITE round trip
+// times of the host's NFS mounts. Those of pod volumes, such as NFS PVs,
+// are attached to the pod node and named after the volume; others to the
+// host node, named after the mountpoint. Rates are only known from the
+// second reading of a mount onwards.
+type nfsStats struct {
+	path, fallback string
+
+	lock     sync.Mutex
+	prev     map[string]nfsMount
+	prevTime time.Time
+}
+
+func newNFSStats(path, fallback string) *nfsStats {
+	return &nfsStats{path: path, fallback: fallback}
+}
+
+func (n *nfsStats) Name() string { return "nfs" }
+
+func (n *nfsStats) resetCounters() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.prev = nil
+}
+
+// rtt returns the mean round trip time of the operations since prev.
+func (op nfsOp) rtt(prev nfsOp) float64 {
+	if op.ops <= prev.ops {
+		return 0
+	}
+	return (op.rttMs - prev.rttMs) / (op.ops - prev.ops)
+}
+
+// mountNode returns the name of a mount's metrics and where they go, the
+// host node if topologyID is empty.
+func mountNode(mountpoint string) (name, topologyID, nodeID string) {
+	if m := kubeletVolumeRegexp.FindStringSubmatch(mountpoint); m != nil {
+		return m[2], podTopologyID, fmt.Sprintf("%s;<pod>", m[1])
+	}
+	name = strings.Trim(mountpoint, "/")
+	if name == "" {
+		name = "root"
+	}
+	return strings.NewReplacer("/", "_", " ", "_").Replace(name), "", ""
+}
+
+func (n *nfsStats) Collect(ctx context.Context) ([]Metric, error) {
+	cur, err := readMountStats(n.path)
+	if err != nil {
+		if cur, err = readMountStats(n.fallback); err != nil {
+			return nil, fmt.Errorf("nfs: %v", err)
+		}
+	}
+	now := time.Now()
+	n.lock.Lock()
+	prev, elapsed := n.prev, now.Sub(n.prevTime).Seconds()
+	n.prev, n.prevTime = cur, now
+	n.lock.Unlock()
+
+	mountpoints := []string{}
+	for mountpoint := range cur {
+		mountpoints = append(mountpoints, mountpoint)
+	}
+	sort.Strings(mountpoints)
+	metrics := []Metric{}
+	for i, mountpoint := range mountpoints {
+		c, p := cur[mountpoint], prev[mountpoint]
+		if _, ok := prev[mountpoint]; !ok {
+			continue
+		}
+		ops, ok1 := counterRate(c.ops, p.ops, elapsed)
+		reads, ok2 := counterRate(c.read.ops, p.read.ops, elapsed)
+		writes, ok3 := counterRate(c.write.ops, p.write.ops, elapsed)
+		if !ok1 || !ok2 || !ok3 {
+			continue
+		}
+		name, topologyID, nodeID := mountNode(mountpoint)
+		priority := 20.0
+		if topologyID == "" {
+			priority += float64(i) / 10
+		}
+		for j, m := range []struct {
+			id, label, format string
+			value             float64
+		}{
+			{"nfs_ops", "NFS ops/s", "", ops},
+			{"nfs_read_ops", "NFS reads/s", "", reads},
+			{"nfs_write_ops", "NFS writes/s", "", writes},
+			{"nfs_read_rtt", "NFS read RTT (ms)", "", c.read.rtt(p.read)},
+			{"nfs_write_rtt", "NFS write RTT (ms)", "", c.write.rtt(p.write)},
+		} {
+			metrics = append(metrics, Metric{
+				ID:       m.id + "_" + name,
+				Label:    name + " " + m.label,
+				Format:   m.format,
+				Priority: priority + float64(j)/100,
+				Value:    m.value,
+				Max:      m.value,
+				Time:     now,
+				Topology: topologyID,
+				NodeID:   nodeID,
+			})
+		}
+	}
+	return metrics, nil
+}
@@ -0,0 +1,72 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReadMountStats(t *testing.T) {
+	const nfsMountStats = `device rootfs mounted on / with fstype rootfs
+device proc mounted on /proc with fstype proc
+device 10.0.0.5:/exports/data mounted on /var/lib/kubelet/pods/0a1b2c3d-aaaa-bbbb-cccc-0123456789ab/volumes/kubernetes.io~nfs/pvc-0a1b2c3d with fstype nfs4 statvers=1.1
+	opts:	rw,vers=4.1,rsize=1048576,wsize=1048576
+	age:	3600
+	per-op statistics
+	        NULL: 1 1 0 44 24 0 0 0 0
+	        READ: 3 3 0 468 1752 0 2 2 0
+	       WRITE: 10 10 0 41600 1680 0 40 45 0
+	      GETATTR: 7 7 0 1036 1680 0 5 6 0
+
+device srv:/home mounted on /mnt/my\040home with fstype nfs statvers=1.1
+	per-op statistics
+	        READ: 100 100 0 14800 409600 5 250 260 0
+	       WRITE: 0 0 0 0 0 0 0 0 0
+`
+	for _, tc := range []struct {
+		name  string
+		stats string
+		want  map[string]nfsMount
+	}{
+		{
+			name:  "no NFS mounts",
+			stats: "device rootfs mounted on / with fstype rootfs\ndevice proc mounted on /proc with fstype proc\n",
+			want:  map[string]nfsMount{},
+		},
+		{
+			name:  "NFS mounts",
+			stats: nfsMountStats,
+			want: map[string]nfsMount{
+				"/var/lib/kubelet/pods/0a1b2c3d-aaaa-bbbb-cccc-0123456789ab/volumes/kubernetes.io~nfs/pvc-0a1b2c3d": {
+					Mountpoint: "/var/lib/kubelet/pods/0a1b2c3d-aaaa-bbbb-cccc-0123456789ab/volumes/kubernetes.io~nfs/pvc-0a1b2c3d",
+					Export:     "10.0.0.5:/exports/data",
+					ops:        21,
+					read:       nfsOp{ops: 3, rttMs: 2},
+					write:      nfsOp{ops: 10, rttMs: 40},
+				},
+				"/mnt/my home": {
+					Mountpoint: "/mnt/my home",
+					Export:     "srv:/home",
+					ops:        100,
+					read:       nfsOp{ops: 100, rttMs: 250},
+				},
+			},
+		},
+		{
+			name:  "short per-op lines skipped",
+			stats: "device srv:/home mounted on /home with fstype nfs statvers=1.1\n\tper-op statistics\n\t        READ: 3 3 0\n",
+			want:  map[string]nfsMount{"/home": {Mountpoint: "/home", Export: "srv:/home"}},
+		},
+	} {
+		got, err := readMountStats(writeTestFile(t, "mountstats", tc.stats))
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
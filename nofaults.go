@@ -0,0 +1,14 @@
+//go:build !faults
+// +build !faults
+
+package main
+
+import "net/http"
+
+// Without the faults build tag the fault injection wrappers are no-ops.
+
+func faultyCortexClient(client *http.Client) *http.Client { return client }
+
+func faultyCPUSource(src cpuSource) cpuSource { return src }
+
+func faultyHandler(h http.Handler) http.Handler { return h }
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	notifyMinBackoff = time.Second
+	notifyMaxBackoff = 5 * time.Minute
+
+	// The journal is compacted once it holds this many delivered
+	// notifications.
+	notifyCompactAfter = 100
+)
+
+var notifyLog = componentLog("notify")
+
+// A notification is a JSON body queued for POSTing to a webhook.
+type notification struct {
+	ID       uint64          `json:"id"`
+	Source   string          `json:"source"`
+	URL      string          `json:"url"`
+	Body     json.RawMessage `json:"body"`
+	Queued   time.Time       `json:"queued"`
+	Attempts int             `json:"attempts,omitempty"`
+}
+
+// journalRecord is a line of the notification journal: a queued
+// notification, or the ID of one that was delivered or dropped.
+type journalRecord struct {
+	Queued *notification `json:"queued,omitempty"`
+	Done   uint64        `json:"done,omitempty"`
+}
+
+// notifier delivers notifications in the order they were queued, retrying
+// with exponential backoff, so that alerts raised while a webhook is
+// unreachable, e.g. during a network partition, are delivered once it is
+// back. Notifications are written ahead to a journal file before being
+// sent, so they also survive restarts; without a journal they are only
+// kept in memory. Notifications older than maxAge are dropped.
+type notifier struct {
+	path   string
+	client *http.Client
+	maxAge time.Duration
+
+	lock    sync.Mutex
+	journal *os.File
+	pending []notification
+	nextID  uint64
+	done    int
+	wake    chan struct{}
+}
+
+func newNotifier(path string, client *http.Client, maxAge time.Duration) (*notifier, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	n := &notifier{path: path, client: client, maxAge: maxAge, nextID: 1, wake: make(chan struct{}, 1)}
+	if path == "" {
+		return n, nil
+	}
+	if err := n.replay(); err != nil {
+		return nil, err
+	}
+	if err := n.compact(); err != nil {
+		return nil, err
+	}
+	if len(n.pending) > 0 {
+		notifyLog.Infof("%d notifications left to deliver from %s", len(n.pending), path)
+	}
+	return n, nil
+}
+
+func (n *notifier) String() string {
+	if n.path != "" {
+		return "notify=" + n.path
+	}
+	return "notify"
+}
+
+// replay reads the journal back. A torn last line, left by a crash while
+// appending, is ignored.
+func (n *notifier) replay() error {
+	f, err := os.Open(n.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("notify: %w", err)
+	}
+	defer f.Close()
+	pending := map[uint64]notification{}
+	order := []uint64{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		rec := journalRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			notifyLog.Warnf("%s: skipping a corrupt record: %v", n.path, err)
+			continue
+		}
+		switch {
+		case rec.Queued != nil:
+			pending[rec.Queued.ID] = *rec.Queued
+			order = append(order, rec.Queued.ID)
+			if rec.Queued.ID >= n.nextID {
+				n.nextID = rec.Queued.ID + 1
+			}
+		case rec.Done != 0:
+			delete(pending, rec.Done)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("notify: %s: %v", n.path, err)
+	}
+	for _, id := range order {
+		if p, ok := pending[id]; ok {
+			n.pending = append(n.pending, p)
+		}
+	}
+	return nil
+}
+
+// compact rewrites the journal with only the pending notifications,
+// replacing it atomically. The caller holds n.lock, if needed.
+func (n *notifier) compact() error {
+	buf := &bytes.Buffer{}
+	for i := range n.pending {
+		raw, err := json.Marshal(journalRecord{Queued: &n.pending[i]})
+		if err != nil {
+			return fmt.Errorf("notify: %v", err)
+		}
+		buf.Write(raw)
+		buf.WriteByte('\n')
+	}
+	if err := os.MkdirAll(filepath.Dir(n.path), 0700); err != nil {
+		return fmt.Errorf("notify: %w", err)
+	}
+	tmp := n.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("notify: %w", err)
+	}
+	if n.journal != nil {
+		n.journal.Close()
+	}
+	// If the rename fails, keep appending to the old journal.
+	renameErr := os.Rename(tmp, n.path)
+	f, err := os.OpenFile(n.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		n.journal = nil
+		return fmt.Errorf("notify: %w", err)
+	}
+	n.journal = f
+	if renameErr != nil {
+		return fmt.Errorf("notify: %w", renameErr)
+	}
+	n.done = 0
+	return nil
+}
+
+// append writes a record to the journal and syncs it. The caller holds
+// n.lock.
+func (n *notifier) append(rec journalRecord) error {
+	if n.journal == nil {
+		return nil
+	}
+	raw, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("notify: %v", err)
+	}
+	if _, err := n.journal.Write(append(raw, '\n')); err != nil {
+		return fmt.Errorf("notify: %s: %v", n.path, err)
+	}
+	if err := n.journal.Sync(); err != nil {
+		return fmt.Errorf("notify: %s: %v", n.path, err)
+	}
+	return nil
+}
+
+// send queues v, marshalled to JSON, for POSTing to url. It only fails if
+// the notification could not be journalled; it is still delivered from
+// memory then.
+func (n *notifier) send(source, url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("notify: %v", err)
+	}
+	n.lock.Lock()
+	msg := notification{ID: n.nextID, Source: source, URL: url, Body: body, Queued: time.Now()}
+	n.nextID++
+	n.pending = append(n.pending, msg)
+	err = n.append(journalRecord{Queued: &msg})
+	n.lock.Unlock()
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+	return err
+}
+
+// run delivers the pending notifications until the process exits.
+func (n *notifier) run() {
+	backoff := notifyMinBackoff
+	for {
+		if n.deliver() {
+			backoff = notifyMinBackoff
+			<-n.wake
+			continue
+		}
+		select {
+		case <-n.wake:
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > notifyMaxBackoff {
+			backoff = notifyMaxBackoff
+		}
+	}
+}
+
+// deliver tries to send every pending notification once, oldest first,
+// and tells whether none is left. Once a webhook fails, its later
+// notifications wait for the next round, so they arrive in order.
+func (n *notifier) deliver() bool {
+	n.lock.Lock()
+	pending := append([]notification{}, n.pending...)
+	n.lock.Unlock()
+
+	failed := map[string]bool{}
+	for _, msg := range pending {
+		if failed[msg.URL] {
+			continue
+		}
+		if n.maxAge > 0 && time.Since(msg.Queued) > n.maxAge {
+			notifyLog.WithField("source", msg.Source).Errorf("Dropping a notification to %s queued at %s after %d attempts", msg.URL, msg.Queued.Format(time.RFC3339), msg.Attempts)
+			n.finish(msg.ID)
+			continue
+		}
+		permanent, err := n.post(msg)
+		if err == nil || permanent {
+			if err != nil {
+				notifyLog.WithField("source", msg.Source).Errorf("Dropping a notification: %v", err)
+			}
+			n.finish(msg.ID)
+			continue
+		}
+		notifyLog.WithField("source", msg.Source).Warnf("%v, retrying", err)
+		failed[msg.URL] = true
+		n.lock.Lock()
+		for i := range n.pending {
+			if n.pending[i].ID == msg.ID {
+				n.pending[i].Attempts++
+			}
+		}
+		n.lock.Unlock()
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return len(n.pending) == 0
+}
+
+// post sends a notification, and tells whether a failure is permanent:
+// the webhook rejected the notification itself, so retrying won't help.
+func (n *notifier) post(msg notification) (bool, error) {
+	res, err := n.client.Post(msg.URL, "application/json", bytes.NewReader(msg.Body))
+	if err != nil {
+		return false, fmt.Errorf("notify: %w", err)
+	}
+	res.Body.Close()
+	if res.StatusCode/100 == 2 {
+		return false, nil
+	}
+	permanent := res.StatusCode/100 == 4 && res.StatusCode != http.StatusTooManyRequests && res.StatusCode != http.StatusRequestTimeout
+	return permanent, fmt.Errorf("notify: %s: %s", msg.URL, res.Status)
+}
+
+// finish removes a delivered or dropped notification from the queue.
+func (n *notifier) finish(id uint64) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for i := range n.pending {
+		if n.pending[i].ID == id {
+			n.pending = append(n.pending[:i], n.pending[i+1:]...)
+			break
+		}
+	}
+	if n.journal == nil {
+		return
+	}
+	n.done++
+	var err error
+	if len(n.pending) == 0 || n.done >= notifyCompactAfter {
+		err = n.compact()
+	} else {
+		err = n.append(journalRecord{Done: id})
+	}
+	if err != nil {
+		notifyLog.Error(err)
+	}
+}
+
+func (n *notifier) debugState() interface{} {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return map[string]interface{}{"journal": n.path, "pending": append([]notification{}, n.pending...)}
+}
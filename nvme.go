@@ -0,0 +1,179 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	sysClassNVMePath = "/sys/class/nvme"
+	devPath          = "/dev"
+
+	// nvmeIoctlAdminCmd is NVME_IOCTL_ADMIN_CMD, _IOWR('N', 0x41, struct
+	// nvme_admin_cmd), from linux/nvme_ioctl.h.
+	nvmeIoctlAdminCmd = 0xc0484e41
+	nvmeGetLogPage    = 0x02
+	nvmeSmartLog      = 0x02
+	nvmeSmartLogSize  = 512
+)
+
+func init() {
+	collectorFactories["nvme"] = func(opts collectorOptions) (Collector, error) {
+		return newNVMeHealth(sysClassNVMePath, devPath)
+	}
+}
+
+// nvmeAdminCmd is struct nvme_admin_cmd of linux/nvme_ioctl.h.
+type nvmeAdminCmd struct {
+	Opcode      uint8
+	Flags       uint8
+	Rsvd1       uint16
+	NSID        uint32
+	Cdw2, Cdw3  uint32
+	Metadata    uint64
+	Addr        uint64
+	MetadataLen uint32
+	DataLen     uint32
+	Cdw10       uint32
+	Cdw11       uint32
+	Cdw12       uint32
+	Cdw13       uint32
+	Cdw14       uint32
+	Cdw15       uint32
+	TimeoutMs   uint32
+	Result      uint32
+}
+
+// nvmeSmart is the part of the SMART / Health Information log page, as
+// defined by the NVMe base specification, that is reported.
+type nvmeSmart struct {
+	Temperature     float64 // Celsius
+	PercentageUsed  float64
+	MediaErrors     float64
+	UnsafeShutdowns float64
+}
+
+// readNVMeSmartLog reads the controller-wide SMART log of an NVMe controller
+// character device, e.g. /dev/nvme0, which takes CAP_SYS_ADMIN.
+func readNVMeSmartLog(path string) (nvmeSmart, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nvmeSmart{}, err
+	}
+	defer f.Close()
+	buf := make([]byte, nvmeSmartLogSize)
+	cmd := nvmeAdminCmd{
+		Opcode:  nvmeGetLogPage,
+		NSID:    0xffffffff,
+		Addr:    uint64(uintptr(unsafe.Pointer(&buf[0]))),
+		DataLen: nvmeSmartLogSize,
+		// The number of dwords to read, minus one, and the log page.
+		Cdw10: (nvmeSmartLogSize/4-1)<<16 | nvmeSmartLog,
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), nvmeIoctlAdminCmd, uintptr(unsafe.Pointer(&cmd))); errno != 0 {
+		return nvmeSmart{}, fmt.Errorf("%s: get SMART log: %v", path, errno)
+	}
+	// The 128 bit counters are little endian; their low 64 bits suffice.
+	counter := func(offset int) float64 { return float64(binary.LittleEndian.Uint64(buf[offset:])) }
+	return nvmeSmart{
+		Temperature:     float64(binary.LittleEndian.Uint16(buf[1:])) - 273.15,
+		PercentageUsed:  float64(buf[5]),
+		UnsafeShutdowns: counter(144),
+		MediaErrors:     counter(160),
+	}, nil
+}
+
+// nvmeMetrics are the statistics reported for every controller.
+var nvmeMetrics = []struct {
+	id, label, format string
+	max               float64
+	value             func(nvmeSmart) float64
+}{
+	{"nvme_temperature", "temperature (°C)", "", 0, func(s nvmeSmart) float64 { return s.Temperature }},
+	{"nvme_percentage_used", "endurance used", "percent", 100, func(s nvmeSmart) float64 { return s.PercentageUsed }},
+	{"nvme_media_errors", "media errors", "integer", 0, func(s nvmeSmart) float64 { return s.MediaErrors }},
+	{"nvme_unsafe_shutdowns", "unsafe shutdowns", "integer", 0, func(s nvmeSmart) float64 { return s.UnsafeShutdowns }},
+}
+
+// nvmeHealth reports the wear and health of the host's NVMe controllers from
+// their SMART logs, next to the IO statistics of their namespaces.
+type nvmeHealth struct {
+	sysClass, dev string
+}
+
+// newNVMeHealth fails on hosts without NVMe controllers.
+func newNVMeHealth(sysClass, dev string) (*nvmeHealth, error) {
+	n := &nvmeHealth{sysClass: sysClass, dev: dev}
+	controllers, err := n.controllers()
+	if err != nil {
+		return nil, fmt.Errorf("nvme: %v", err)
+	}
+	if len(controllers) == 0 {
+		return nil, fmt.Errorf("nvme: no controllers in %s", sysClass)
+	}
+	return n, nil
+}
+
+func (n *nvmeHealth) Name() string { return "nvme" }
+
+// controllers lists the NVMe controllers, e.g. nvme0, in order.
+func (n *nvmeHealth) controllers() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(n.sysClass, "nvme*"))
+	if err != nil {
+		return nil, err
+	}
+	controllers := []string{}
+	for _, path := range paths {
+		controllers = append(controllers, filepath.Base(path))
+	}
+	sort.Strings(controllers)
+	return controllers, nil
+}
+
+func (n *nvmeHealth) Collect(ctx context.Context) ([]Metric, error) {
+	controllers, err := n.controllers()
+	if err != nil {
+		return nil, fmt.Errorf("nvme: %v", err)
+	}
+	now := time.Now()
+	metrics := []Metric{}
+	var lastErr error
+	for i, controller := range controllers {
+		smart, err := readNVMeSmartLog(filepath.Join(n.dev, controller))
+		if err != nil {
+			collectorLog(n.Name()).Debugf("Controller %s: %v", controller, err)
+			lastErr = err
+			continue
+		}
+		for j, m := range nvmeMetrics {
+			value := m.value(smart)
+			max := m.max
+			if max == 0 {
+				max = value
+			}
+			metrics = append(metrics, Metric{
+				ID:       m.id + "_" + controller,
+				Label:    controller + " " + m.label,
+				Format:   m.format,
+				Priority: 18 + float64(i)/10 + float64(j)/100,
+				Value:    value,
+				Max:      max,
+				Time:     now,
+			})
+		}
+	}
+	if len(metrics) == 0 && lastErr != nil {
+		return nil, fmt.Errorf("nvme: %v", lastErr)
+	}
+	return metrics, nil
+}
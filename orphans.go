@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	orphanTableID     = "orphaned-pv-table"
+	orphanTablePrefix = "orphaned-pv-table-"
+
+	// orphanQuery counts the series of every volume.
+	orphanQuery = `count by (openebs_pv) ({openebs_pv!=""})`
+)
+
+func init() {
+	collectorFactories["orphaned-pvs"] = func(opts collectorOptions) (Collector, error) {
+		prom, err := newPrometheusCollector(opts.PrometheusURL, nil, opts.HTTPClient, nil)
+		if err != nil {
+			return nil, err
+		}
+		kube, err := newInClusterKubeClient()
+		if err != nil {
+			return nil, err
+		}
+		d := newOrphanDetector(prom, kube, opts.PVShard, opts.Notifier, opts.OrphanWebhook)
+		go d.watch(opts.OrphanInterval)
+		return d, nil
+	}
+}
+
+// orphanedPV is a volume that still has series in Prometheus but no
+// PersistentVolume in Kubernetes any more, e.g. after its PVC was deleted
+// while its exporter kept running.
+type orphanedPV struct {
+	PV     string    `json:"pv"`
+	Series int       `json:"series"`
+	Since  time.Time `json:"since"`
+}
+
+// orphanDetector periodically compares the volumes found in Prometheus
+// with the PersistentVolumes of the cluster and shows the orphaned ones in
+// a table. New orphans are optionally posted to a webhook.
+type orphanDetector struct {
+	prom     *prometheusCollector
+	kube     *kubeClient
+	owns     func(key string) bool
+	notifier *notifier
+	webhook  string
+
+	lock     sync.Mutex
+	orphaned map[string]orphanedPV
+	err      error
+}
+
+func newOrphanDetector(prom *prometheusCollector, kube *kubeClient, owns func(key string) bool, notifier *notifier, webhook string) *orphanDetector {
+	return &orphanDetector{prom: prom, kube: kube, owns: owns, notifier: notifier, webhook: webhook, orphaned: map[string]orphanedPV{}}
+}
+
+func (d *orphanDetector) Name() string { return "orphaned-pvs" }
+
+func (d *orphanDetector) String() string {
+	if d.webhook != "" {
+		return "orphaned-pvs=webhook"
+	}
+	return "orphaned-pvs"
+}
+
+func (d *orphanDetector) watch(interval time.Duration) {
+	d.check(context.Background())
+	for range time.Tick(interval) {
+		d.check(context.Background())
+	}
+}
+
+func (d *orphanDetector) check(ctx context.Context) {
+	found, err := d.find(ctx)
+	d.lock.Lock()
+	if d.err = err; err != nil {
+		d.lock.Unlock()
+		collectorLog(d.Name()).Error(err)
+		return
+	}
+	now := time.Now()
+	orphaned, added := map[string]orphanedPV{}, []orphanedPV{}
+	for pv, series := range found {
+		o, ok := d.orphaned[pv]
+		if !ok {
+			o = orphanedPV{PV: pv, Since: now}
+			added = append(added, o)
+		}
+		o.Series = series
+		orphaned[pv] = o
+	}
+	d.orphaned = orphaned
+	d.lock.Unlock()
+
+	if len(added) == 0 {
+		return
+	}
+	sort.Slice(added, func(i, j int) bool { return added[i].PV < added[j].PV })
+	for _, o := range added {
+		collectorLog(d.Name()).Warnf("Volume %s has %d series in Prometheus but no PersistentVolume", o.PV, o.Series)
+	}
+	if d.webhook != "" {
+		if err := d.notifier.send(d.Name(), d.webhook, map[string][]orphanedPV{"orphaned": added}); err != nil {
+			collectorLog(d.Name()).Error(err)
+		}
+	}
+}
+
+// find returns the series count of every orphaned volume this replica owns.
+func (d *orphanDetector) find(ctx context.Context) (map[string]int, error) {
+	result, err := d.prom.query(ctx, orphanQuery)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := d.kube.persistentVolumes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("orphaned pvs: %w", err)
+	}
+	orphaned := map[string]int{}
+	for _, r := range result.Data.Result {
+		pv := r.Metric.OpenebsPv
+		if _, ok := existing[pv]; pv == "" || ok || (d.owns != nil && !d.owns(pv)) {
+			continue
+		}
+		_, count, err := parseSampleValue(r.Value)
+		if err != nil {
+			return nil, fmt.Errorf("orphaned pvs: %v", err)
+		}
+		orphaned[pv] = int(count)
+	}
+	return orphaned, nil
+}
+
+// Collect only reports errors of the latest check; orphans are shown as a
+// table.
+func (d *orphanDetector) Collect(ctx context.Context) ([]Metric, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return nil, d.err
+}
+
+func orphanTableTemplate() tableTemplate {
+	return tableTemplate{
+		ID:     orphanTableID,
+		Label:  "Orphaned volume series",
+		Prefix: orphanTablePrefix,
+		Type:   "multicolumn-table",
+		Columns: []column{
+			{ID: "pv", Label: "Volume"},
+			{ID: "series", Label: "Series", DataType: "number"},
+			{ID: "since", Label: "Orphaned since"},
+		},
+	}
+}
+
+func (d *orphanDetector) Tables() []table {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	rows := map[string]map[string]string{}
+	for pv, o := range d.orphaned {
+		rows[pv] = map[string]string{
+			"pv":     pv,
+			"series": strconv.Itoa(o.Series),
+			"since":  o.Since.UTC().Format(time.RFC3339),
+		}
+	}
+	return []table{{Template: orphanTableTemplate(), Rows: rows}}
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !windows && !darwin
+// +build !linux,!windows,!darwin
+
+package main
+
+// Elsewhere, CPU and block device statistics come from gopsutil.
+const (
+	defaultCPUSource  = "gopsutil"
+	defaultDiskSource = "gopsutil"
+)
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// otlpScopeName is the instrumentation scope of the exported metrics and
+// spans.
+const otlpScopeName = "scope-iowait-plugin"
+
+var otlpLog = componentLog("otlp")
+
+// otlpExporter pushes every collected metric to an OpenTelemetry collector,
+// as OTLP/HTTP JSON gauges, alongside the Scope report. Metrics are grouped
+// into a resource per host, with the host.name and k8s.node.name
+// attributes; volume metrics are named after their query and carry the pv
+// and, if the volumes can be listed, k8s.namespace.name attributes, and pod
+// and container metrics the k8s.pod.uid and container.id ones. Exports run
+// in the background, one at a time: collections made while one is in
+// flight replace the one waiting.
+type otlpExporter struct {
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+	prefix   string
+	hostID   string
+	// kube, if set, lists the volumes their namespaces are looked up in.
+	kube *kubeClient
+
+	pending chan []Metric
+
+	lock       sync.Mutex
+	namespaces map[string]string
+	fetched    time.Time
+}
+
+// parseOTLPHeaders parses a comma separated list of name=value headers sent
+// with every export, e.g. for authentication.
+func parseOTLPHeaders(s string) (map[string]string, error) {
+	headers := map[string]string{}
+	for _, pair := range splitList(s) {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid OTLP header %q, expected name=value", pair)
+		}
+		headers[parts[0]] = parts[1]
+	}
+	return headers, nil
+}
+
+// otlpSignalURL returns the URL a signal, metrics or traces, is posted to
+// at the OTLP/HTTP endpoint of a collector, e.g. http://otel-collector:4318.
+func otlpSignalURL(endpoint, signal string) string {
+	return strings.TrimSuffix(endpoint, "/") + "/v1/" + signal
+}
+
+// otlpHostAttributes are the attributes of the resource of a host.
+func otlpHostAttributes(hostID string) []otlpAttribute {
+	return []otlpAttribute{
+		otlpAttr("service.name", otlpScopeName),
+		otlpAttr("host.name", hostID),
+		otlpAttr("k8s.node.name", hostID),
+	}
+}
+
+// otlpPost posts an OTLP/HTTP JSON export request.
+func otlpPost(ctx context.Context, client *http.Client, url string, headers map[string]string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// newOTLPExporter exports to the OTLP/HTTP endpoint of a collector, e.g.
+// http://otel-collector:4318.
+func newOTLPExporter(endpoint string, headers map[string]string, client *http.Client, prefix, hostID string, kube *kubeClient) *otlpExporter {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &otlpExporter{
+		endpoint: otlpSignalURL(endpoint, "metrics"),
+		headers:  headers,
+		client:   client,
+		prefix:   prefix,
+		hostID:   hostID,
+		kube:     kube,
+		pending:  make(chan []Metric, 1),
+	}
+}
+
+// export queues the metrics of a collection, replacing any still waiting.
+func (e *otlpExporter) export(metrics []Metric) {
+	select {
+	case <-e.pending:
+	default:
+	}
+	select {
+	case e.pending <- metrics:
+	default:
+	}
+}
+
+func (e *otlpExporter) run() {
+	for metrics := range e.pending {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := e.push(ctx, metrics); err != nil {
+			otlpLog.Warnf("Exporting %d metrics: %v", len(metrics), err)
+			self.inc("iowait_otlp_errors_total")
+		}
+		cancel()
+	}
+}
+
+// volumeNamespaces returns the namespaces of the claims of volumes, cached
+// for volumeNamespacesMaxAge.
+func (e *otlpExporter) volumeNamespaces(ctx context.Context) map[string]string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.kube == nil || time.Since(e.fetched) < volumeNamespacesMaxAge {
+		return e.namespaces
+	}
+	volumes, err := e.kube.persistentVolumes(ctx)
+	e.fetched = time.Now()
+	if err != nil {
+		otlpLog.Debugf("%v", err)
+		return e.namespaces
+	}
+	e.namespaces = map[string]string{}
+	for name, pv := range volumes {
+		if pv.Namespace != "" {
+			e.namespaces[name] = pv.Namespace
+		}
+	}
+	return e.namespaces
+}
+
+// The OTLP/HTTP JSON encoding of the metrics protocol.
+type (
+	otlpRequest struct {
+		ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+	}
+	otlpResourceMetrics struct {
+		Resource     otlpResource       `json:"resource"`
+		ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeMetrics struct {
+		Scope   otlpScope    `json:"scope"`
+		Metrics []otlpMetric `json:"metrics"`
+	}
+	otlpScope struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	otlpMetric struct {
+		Name  string    `json:"name"`
+		Unit  string    `json:"unit,omitempty"`
+		Gauge otlpGauge `json:"gauge"`
+	}
+	otlpGauge struct {
+		DataPoints []otlpDataPoint `json:"dataPoints"`
+	}
+	otlpDataPoint struct {
+		Attributes   []otlpAttribute `json:"attributes,omitempty"`
+		TimeUnixNano string          `json:"timeUnixNano"`
+		AsDouble     float64         `json:"asDouble"`
+	}
+	otlpAttribute struct {
+		Key   string         `json:"key"`
+		Value otlpAttrString `json:"value"`
+	}
+	otlpAttrString struct {
+		StringValue string `json:"stringValue"`
+	}
+)
+
+func otlpAttr(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpAttrString{StringValue: value}}
+}
+
+// otlpUnit returns the UCUM unit of a metric format.
+func otlpUnit(format string) string {
+	switch format {
+	case "filesize":
+		return "By"
+	case "percent":
+		return "%"
+	}
+	return ""
+}
+
+// request encodes metrics as an export request.
+func (e *otlpExporter) request(metrics []Metric, namespaces map[string]string) otlpRequest {
+	// hosts holds the metrics of every host by name, in order.
+	hosts := map[string]map[string]*otlpMetric{}
+	names := map[string][]string{}
+	for _, m := range metrics {
+		host := e.hostID
+		attrs := []otlpAttribute{}
+		switch nodeID := strings.SplitN(m.NodeID, ";", 2)[0]; m.Topology {
+		case "", hostTopologyID:
+			if nodeID != "" {
+				host = nodeID
+			}
+		case podTopologyID:
+			attrs = append(attrs, otlpAttr("k8s.pod.uid", nodeID))
+		case containerTopologyID:
+			attrs = append(attrs, otlpAttr("container.id", nodeID))
+		}
+		name := m.ID
+		if query, pv, ok := splitVolumeMetric(m.ID); ok {
+			name = query
+			attrs = append(attrs, otlpAttr("pv", pv))
+			if ns := namespaces[pv]; ns != "" {
+				attrs = append(attrs, otlpAttr("k8s.namespace.name", ns))
+			}
+		}
+		if hosts[host] == nil {
+			hosts[host] = map[string]*otlpMetric{}
+		}
+		om := hosts[host][name]
+		if om == nil {
+			om = &otlpMetric{Name: e.prefix + name, Unit: otlpUnit(m.Format)}
+			hosts[host][name] = om
+			names[host] = append(names[host], name)
+		}
+		ts := m.Time
+		if ts.IsZero() {
+			ts = time.Now()
+		}
+		om.Gauge.DataPoints = append(om.Gauge.DataPoints, otlpDataPoint{
+			Attributes:   attrs,
+			TimeUnixNano: strconv.FormatInt(ts.UnixNano(), 10),
+			AsDouble:     m.Value,
+		})
+	}
+
+	hostIDs := []string{}
+	for host := range hosts {
+		hostIDs = append(hostIDs, host)
+	}
+	sort.Strings(hostIDs)
+	req := otlpRequest{ResourceMetrics: []otlpResourceMetrics{}}
+	for _, host := range hostIDs {
+		scope := otlpScopeMetrics{Scope: otlpScope{Name: otlpScopeName, Version: version}}
+		for _, name := range names[host] {
+			scope.Metrics = append(scope.Metrics, *hosts[host][name])
+		}
+		req.ResourceMetrics = append(req.ResourceMetrics, otlpResourceMetrics{
+			Resource:     otlpResource{Attributes: otlpHostAttributes(host)},
+			ScopeMetrics: []otlpScopeMetrics{scope},
+		})
+	}
+	return req
+}
+
+// push exports metrics to the collector.
+func (e *otlpExporter) push(ctx context.Context, metrics []Metric) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+	return otlpPost(ctx, e.client, e.endpoint, e.headers, e.request(metrics, e.volumeNamespaces(ctx)))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	pauseControlID  = "pauseReporting"
+	resumeControlID = "resumeReporting"
+
+	pausedKey = "iowait_paused"
+)
+
+// pauseControls pause and resume collection, e.g. during a maintenance
+// window in which Prometheus is down and collection errors are expected.
+// The plugin stays registered with Scope while paused: its reports carry
+// no metrics, only the controls and when it was paused.
+func (p *Plugin) pauseControls() []controlDetails {
+	return []controlDetails{
+		{
+			id:    pauseControlID,
+			human: "Pause reporting",
+			icon:  "fa-pause",
+			dead:  !p.pausedSince.IsZero(),
+		},
+		{
+			id:    resumeControlID,
+			human: "Resume reporting",
+			icon:  "fa-play",
+			dead:  p.pausedSince.IsZero(),
+		},
+	}
+}
+
+// setPaused pauses or resumes collection. The caller holds p.lock.
+func (p *Plugin) setPaused(paused bool) {
+	switch {
+	case paused && p.pausedSince.IsZero():
+		p.pausedSince = time.Now()
+		log.Infof("Reporting paused")
+	case !paused && !p.pausedSince.IsZero():
+		p.pausedSince = time.Time{}
+		log.Infof("Reporting resumed")
+	}
+}
+
+// paused tells whether collection is paused.
+func (p *Plugin) paused() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return !p.pausedSince.IsZero()
+}
+
+// addPausedStatus shows on the host node since when reporting is paused.
+func (p *Plugin) addPausedStatus(rpt *report) {
+	if p.pausedSince.IsZero() {
+		return
+	}
+	hostNodeID := p.getTopologyHost()
+	n := rpt.Host.Nodes[hostNodeID]
+	if n.Latest == nil {
+		n.Latest = map[string]stringEntry{}
+	}
+	n.Latest[pausedKey] = stringEntry{
+		Timestamp: p.pausedSince,
+		Value:     fmt.Sprintf("since %s", p.pausedSince.UTC().Format(time.RFC3339)),
+	}
+	rpt.Host.Nodes[hostNodeID] = n
+	if rpt.Host.MetadataTemplates == nil {
+		rpt.Host.MetadataTemplates = map[string]metadataTemplate{}
+	}
+	rpt.Host.MetadataTemplates[pausedKey] = metadataTemplate{
+		ID:       pausedKey,
+		Label:    "Reporting paused",
+		Priority: 1,
+		From:     "latest",
+	}
+}
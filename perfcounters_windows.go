@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// The perfcounters backend reads CPU and physical disk statistics from the
+// Windows Performance Counters, through the PDH API. Counters are sampled
+// when they are read, so every reading covers the time since the previous
+// one. Windows has no notion of IO wait: it is always reported as 0.
+
+const (
+	defaultCPUSource  = "perfcounters"
+	defaultDiskSource = "perfcounters"
+
+	pdhFmtDouble   = 0x00000200
+	pdhMoreData    = 0x800007D2
+	pdhCstatusNew  = 0x00000001
+	pdhTotalObject = "_Total"
+)
+
+var (
+	pdh                             = windows.NewLazySystemDLL("pdh.dll")
+	procPdhOpenQuery                = pdh.NewProc("PdhOpenQueryW")
+	procPdhAddEnglishCounter        = pdh.NewProc("PdhAddEnglishCounterW")
+	procPdhCollectQueryData         = pdh.NewProc("PdhCollectQueryData")
+	procPdhGetFormattedCounterValue = pdh.NewProc("PdhGetFormattedCounterValue")
+	procPdhGetFormattedCounterArray = pdh.NewProc("PdhGetFormattedCounterArrayW")
+)
+
+func init() {
+	cpuSources = append(cpuSources, "perfcounters")
+	collectorFactories["perfcounters"] = func(opts collectorOptions) (Collector, error) {
+		cpu, err := newPerfCPU()
+		if err != nil {
+			return nil, err
+		}
+		return newCPUCollector("perfcounters", cpu.cpuStats), nil
+	}
+	diskSources["perfcounters"] = func(exclude *regexp.Regexp) diskRater {
+		return newPerfDisk(exclude)
+	}
+}
+
+// pdhCounterValue is a PDH_FMT_COUNTERVALUE holding a double.
+type pdhCounterValue struct {
+	CStatus uint32
+	_       uint32
+	Value   float64
+}
+
+// pdhCounterValueItem is a PDH_FMT_COUNTERVALUE_ITEM_W.
+type pdhCounterValueItem struct {
+	Name  *uint16
+	Value pdhCounterValue
+}
+
+// pdhQuery is a PDH query over a fixed set of counter paths, which may use
+// a "*" instance wildcard.
+type pdhQuery struct {
+	handle   uintptr
+	counters map[string]uintptr
+}
+
+func newPDHQuery(paths []string) (*pdhQuery, error) {
+	q := &pdhQuery{counters: map[string]uintptr{}}
+	if ret, _, _ := procPdhOpenQuery.Call(0, 0, uintptr(unsafe.Pointer(&q.handle))); ret != 0 {
+		return nil, fmt.Errorf("perfcounters: PdhOpenQuery: 0x%x", ret)
+	}
+	for _, path := range paths {
+		p, err := windows.UTF16PtrFromString(path)
+		if err != nil {
+			return nil, fmt.Errorf("perfcounters: %v", err)
+		}
+		var counter uintptr
+		if ret, _, _ := procPdhAddEnglishCounter.Call(q.handle, uintptr(unsafe.Pointer(p)), 0, uintptr(unsafe.Pointer(&counter))); ret != 0 {
+			return nil, fmt.Errorf("perfcounters: adding %s: 0x%x", path, ret)
+		}
+		q.counters[path] = counter
+	}
+	// Rate counters need a first sample to compute the next one from.
+	return q, q.collect()
+}
+
+func (q *pdhQuery) collect() error {
+	if ret, _, _ := procPdhCollectQueryData.Call(q.handle); ret != 0 {
+		return fmt.Errorf("perfcounters: PdhCollectQueryData: 0x%x", ret)
+	}
+	return nil
+}
+
+func (q *pdhQuery) value(path string) (float64, error) {
+	var v pdhCounterValue
+	if ret, _, _ := procPdhGetFormattedCounterValue.Call(q.counters[path], pdhFmtDouble, 0, uintptr(unsafe.Pointer(&v))); ret != 0 {
+		return 0, fmt.Errorf("perfcounters: reading %s: 0x%x", path, ret)
+	}
+	if v.CStatus > pdhCstatusNew {
+		return 0, fmt.Errorf("perfcounters: reading %s: status 0x%x", path, v.CStatus)
+	}
+	return v.Value, nil
+}
+
+// values reads every instance of a wildcard counter.
+func (q *pdhQuery) values(path string) (map[string]float64, error) {
+	var size, count uint32
+	counter := q.counters[path]
+	ret, _, _ := procPdhGetFormattedCounterArray.Call(counter, pdhFmtDouble, uintptr(unsafe.Pointer(&size)), uintptr(unsafe.Pointer(&count)), 0)
+	if ret != pdhMoreData {
+		return nil, fmt.Errorf("perfcounters: reading %s: 0x%x", path, ret)
+	}
+	itemSize := unsafe.Sizeof(pdhCounterValueItem{})
+	items := make([]pdhCounterValueItem, (uintptr(size)+itemSize-1)/itemSize)
+	ret, _, _ = procPdhGetFormattedCounterArray.Call(counter, pdhFmtDouble, uintptr(unsafe.Pointer(&size)), uintptr(unsafe.Pointer(&count)), uintptr(unsafe.Pointer(&items[0])))
+	if ret != 0 {
+		return nil, fmt.Errorf("perfcounters: reading %s: 0x%x", path, ret)
+	}
+	values := map[string]float64{}
+	for _, item := range items[:count] {
+		if item.Value.CStatus > pdhCstatusNew {
+			continue
+		}
+		values[windows.UTF16PtrToString(item.Name)] = item.Value.Value
+	}
+	return values, nil
+}
+
+const (
+	cpuUserCounter       = `\Processor(_Total)\% User Time`
+	cpuPrivilegedCounter = `\Processor(_Total)\% Privileged Time`
+	cpuIdleCounter       = `\Processor(_Total)\% Idle Time`
+)
+
+// perfCPU reads the CPU utilisation of all processors.
+type perfCPU struct {
+	lock  sync.Mutex
+	query *pdhQuery
+}
+
+func newPerfCPU() (*perfCPU, error) {
+	q, err := newPDHQuery([]string{cpuUserCounter, cpuPrivilegedCounter, cpuIdleCounter})
+	if err != nil {
+		return nil, err
+	}
+	return &perfCPU{query: q}, nil
+}
+
+func (c *perfCPU) cpuStats(ctx context.Context) (cpuStats, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.query.collect(); err != nil {
+		return cpuStats{}, err
+	}
+	stats := cpuStats{}
+	for path, field := range map[string]*float64{
+		cpuUserCounter:       &stats.User,
+		cpuPrivilegedCounter: &stats.System,
+		cpuIdleCounter:       &stats.Idle,
+	} {
+		value, err := c.query.value(path)
+		if err != nil {
+			return cpuStats{}, err
+		}
+		*field = value
+	}
+	return stats, nil
+}
+
+// perfDiskCounters maps the PhysicalDisk counters to the rates they fill
+// in. Windows reports seconds where iostat reports milliseconds, and bytes
+// where /proc/diskstats reports 512 byte sectors.
+var perfDiskCounters = []struct {
+	path string
+	set  func(r *diskRates, v float64)
+}{
+	{`\PhysicalDisk(*)\Disk Reads/sec`, func(r *diskRates, v float64) { r.ReadIOPS = v }},
+	{`\PhysicalDisk(*)\Disk Writes/sec`, func(r *diskRates, v float64) { r.WriteIOPS = v }},
+	{`\PhysicalDisk(*)\Disk Read Bytes/sec`, func(r *diskRates, v float64) { r.SectorsReadPerSec = v / 512 }},
+	{`\PhysicalDisk(*)\Disk Write Bytes/sec`, func(r *diskRates, v float64) { r.SectorsWrittenPerSec = v / 512 }},
+	{`\PhysicalDisk(*)\Current Disk Queue Length`, func(r *diskRates, v float64) { r.InFlight = v }},
+	{`\PhysicalDisk(*)\Avg. Disk sec/Read`, func(r *diskRates, v float64) { r.ReadAwait = v * 1000 }},
+	{`\PhysicalDisk(*)\Avg. Disk sec/Write`, func(r *diskRates, v float64) { r.WriteAwait = v * 1000 }},
+	{`\PhysicalDisk(*)\Avg. Disk sec/Transfer`, func(r *diskRates, v float64) { r.Await = v * 1000 }},
+	{`\PhysicalDisk(*)\% Idle Time`, func(r *diskRates, v float64) { r.Util = 100 - v }},
+	{`\PhysicalDisk(*)\Avg. Disk Queue Length`, func(r *diskRates, v float64) { r.AvgQueueSize = v }},
+}
+
+// perfDisk reports the IO rates of every physical disk. Disks are named
+// after their Windows device, e.g. PhysicalDrive0.
+type perfDisk struct {
+	exclude *regexp.Regexp
+
+	lock  sync.Mutex
+	query *pdhQuery
+	err   error
+}
+
+func newPerfDisk(exclude *regexp.Regexp) *perfDisk {
+	d := &perfDisk{exclude: exclude}
+	paths := []string{}
+	for _, counter := range perfDiskCounters {
+		paths = append(paths, counter.path)
+	}
+	d.query, d.err = newPDHQuery(paths)
+	return d
+}
+
+func (d *perfDisk) sourceName() string { return "perfcounters" }
+
+func (d *perfDisk) rates() ([]diskRates, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.err != nil {
+		return nil, d.err
+	}
+	if err := d.query.collect(); err != nil {
+		return nil, err
+	}
+	devices := map[string]*diskRates{}
+	for _, counter := range perfDiskCounters {
+		values, err := d.query.values(counter.path)
+		if err != nil {
+			return nil, err
+		}
+		for instance, value := range values {
+			// Instances are named "<disk number> <drive letters>".
+			fields := strings.Fields(instance)
+			if instance == pdhTotalObject || len(fields) == 0 {
+				continue
+			}
+			device := "PhysicalDrive" + fields[0]
+			if d.exclude != nil && d.exclude.MatchString(device) {
+				continue
+			}
+			r, ok := devices[device]
+			if !ok {
+				r = &diskRates{Device: device}
+				devices[device] = r
+			}
+			counter.set(r, value)
+		}
+	}
+	rates := []diskRates{}
+	for _, r := range devices {
+		rates = append(rates, *r)
+	}
+	sort.Slice(rates, func(i, j int) bool { return rates[i].Device < rates[j].Device })
+	return rates, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// registerPprof serves the Go runtime profiles under /debug/pprof/, e.g.
+// for go tool pprof.
+func registerPprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// servePprof also serves the profiles over TCP, only on a loopback
+// address: they expose the command line and memory contents.
+func servePprof(addr string) error {
+	loopback, err := isLoopbackAddr(addr)
+	if err != nil {
+		return fmt.Errorf("invalid -pprof-addr %q: %v", addr, err)
+	}
+	if !loopback {
+		return fmt.Errorf("invalid -pprof-addr %q: profiles are only served on localhost", addr)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %q: %v", addr, err)
+	}
+	mux := http.NewServeMux()
+	registerPprof(mux)
+	log.Infof("Profiles listening on: tcp://%s/debug/pprof/", ln.Addr())
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			log.Error(err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// preflight validates the environment, as the check subcommand, e.g. from
+// an initContainer or an install smoke test: the configuration, which
+// reached it if it parsed, every collector, Prometheus and the plugin
+// socket directory.
+type preflight struct {
+	plugin     *Plugin
+	socketPath string
+	promURL    string
+	client     *http.Client
+	// unavailable are the collectors that couldn't be created, which only
+	// warrant warnings: the plugin runs without them.
+	unavailable map[string]error
+}
+
+// run writes a [+], [!] or [-] line per check, like the health probes, and
+// tells whether all passed.
+func (c *preflight) run(ctx context.Context, w io.Writer) bool {
+	ok := true
+	pass := func(name string) { fmt.Fprintf(w, "[+]%s ok\n", name) }
+	fail := func(name string, err error) {
+		fmt.Fprintf(w, "[-]%s failed: %v\n", name, err)
+		ok = false
+	}
+
+	pass("config")
+	for _, col := range c.plugin.collectors {
+		if _, err := col.Collect(ctx); err != nil {
+			fail("collector "+col.Name(), err)
+			continue
+		}
+		pass("collector " + col.Name())
+	}
+	names := []string{}
+	for name := range c.unavailable {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "[!]collector %s unavailable, reports go without it: %v\n", name, c.unavailable[name])
+	}
+	if c.promURL != "" {
+		if err := c.checkPrometheus(ctx); err != nil {
+			fail("prometheus", err)
+		} else {
+			pass("prometheus")
+		}
+	}
+	if err := c.checkSocketDir(); err != nil {
+		fail("socket", err)
+	} else {
+		pass("socket")
+	}
+	return ok
+}
+
+// checkPrometheus resolves the Prometheus host first, the usual failure
+// in clusters, so that it gets its own message.
+func (c *preflight) checkPrometheus(ctx context.Context) error {
+	u, err := url.Parse(c.promURL)
+	if err != nil {
+		return fmt.Errorf("invalid -prometheus-url %q: %v", c.promURL, err)
+	}
+	if host := u.Hostname(); net.ParseIP(host) == nil {
+		if _, err := net.DefaultResolver.LookupHost(ctx, host); err != nil {
+			return fmt.Errorf("cannot resolve %s: %v; check -prometheus-url and the cluster DNS", host, err)
+		}
+	}
+	prom, err := newPrometheusCollector(c.promURL, nil, c.client, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := prom.query(ctx, "vector(1)"); err != nil {
+		return fmt.Errorf("%v; check Prometheus is up and the URL is its API root", err)
+	}
+	return nil
+}
+
+// checkSocketDir checks the plugin can create its socket, and that no
+// running instance serves it unless this one is to be its warm standby.
+func (c *preflight) checkSocketDir() error {
+	dir := filepath.Dir(c.socketPath)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("cannot create %s: %v; mount /var/run/scope/plugins from the host, writable", dir, err)
+	}
+	f, err := ioutil.TempFile(dir, ".check-")
+	if err != nil {
+		return fmt.Errorf("cannot write to %s: %v; mount /var/run/scope/plugins from the host, writable", dir, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	if c.plugin.warmStandby {
+		return nil
+	}
+	if conn, err := net.DialTimeout("unix", c.socketPath, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is served by a running instance; stop it first or start this one with -warm-standby", c.socketPath)
+	}
+	return nil
+}
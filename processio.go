@@ -0,0 +1,209 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	procRoot = "/proc"
+
+	processTableID     = "process-io-table"
+	processTablePrefix = "process-io-table-"
+)
+
+func init() {
+	collectorFactories["process-io"] = func(opts collectorOptions) (Collector, error) {
+		return newProcessIO(procRoot, opts.ProcessTop), nil
+	}
+}
+
+type processCounters struct {
+	name                  string
+	readBytes, writeBytes float64
+}
+
+// processRates are the storage IO rates of one process.
+type processRates struct {
+	PID              int
+	Name             string
+	ReadBytesPerSec  float64
+	WriteBytesPerSec float64
+}
+
+// processIO finds the processes doing the most storage IO from the
+// read_bytes and write_bytes counters of /proc/<pid>/io. Rates are only
+// known from the second reading of a process onwards.
+type processIO struct {
+	root string
+	n    int
+
+	lock     sync.Mutex
+	prev     map[int]processCounters
+	prevTime time.Time
+	last     []processRates
+}
+
+func newProcessIO(root string, n int) *processIO {
+	return &processIO{root: root, n: n}
+}
+
+// shedMemory drops the counters of the previous reading; rates are known
+// again from the next reading onwards.
+func (p *processIO) shedMemory() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.prev = nil
+}
+
+func (p *processIO) resetCounters() { p.shedMemory() }
+
+// top returns the n processes with the highest read+write rate.
+func (p *processIO) top() ([]processRates, error) {
+	dirs, err := ioutil.ReadDir(p.root)
+	if err != nil {
+		return nil, fmt.Errorf("process io: %v", err)
+	}
+	now := time.Now()
+	cur := map[int]processCounters{}
+	for _, dir := range dirs {
+		pid, err := strconv.Atoi(dir.Name())
+		if err != nil || !dir.IsDir() {
+			continue
+		}
+		// Processes exit while we read them, and some are unreadable
+		// without CAP_SYS_PTRACE; skip those.
+		counters, err := readProcessIO(filepath.Join(p.root, dir.Name()))
+		if err != nil {
+			continue
+		}
+		cur[pid] = counters
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	prev, elapsed := p.prev, now.Sub(p.prevTime).Seconds()
+	p.prev, p.prevTime = cur, now
+
+	rates := []processRates{}
+	for pid, c := range cur {
+		old, ok := prev[pid]
+		// A different name means the PID was reused.
+		if !ok || old.name != c.name || elapsed <= 0 || c.readBytes < old.readBytes || c.writeBytes < old.writeBytes {
+			continue
+		}
+		rates = append(rates, processRates{
+			PID:              pid,
+			Name:             c.name,
+			ReadBytesPerSec:  (c.readBytes - old.readBytes) / elapsed,
+			WriteBytesPerSec: (c.writeBytes - old.writeBytes) / elapsed,
+		})
+	}
+	sort.Slice(rates, func(i, j int) bool {
+		ti := rates[i].ReadBytesPerSec + rates[i].WriteBytesPerSec
+		tj := rates[j].ReadBytesPerSec + rates[j].WriteBytesPerSec
+		if ti != tj {
+			return ti > tj
+		}
+		return rates[i].PID < rates[j].PID
+	})
+	if len(rates) > p.n {
+		rates = rates[:p.n]
+	}
+	return rates, nil
+}
+
+func readProcessIO(dir string) (processCounters, error) {
+	comm, err := ioutil.ReadFile(filepath.Join(dir, "comm"))
+	if err != nil {
+		return processCounters{}, err
+	}
+	f, err := os.Open(filepath.Join(dir, "io"))
+	if err != nil {
+		return processCounters{}, err
+	}
+	defer f.Close()
+
+	// rchar: 323934931
+	// wchar: 323929600
+	// syscr: 632687
+	// syscw: 632675
+	// read_bytes: 0
+	// write_bytes: 323932160
+	// cancelled_write_bytes: 0
+	counters := processCounters{name: strings.TrimSpace(string(comm))}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		var dst *float64
+		switch parts[0] {
+		case "read_bytes":
+			dst = &counters.readBytes
+		case "write_bytes":
+			dst = &counters.writeBytes
+		default:
+			continue
+		}
+		if *dst, err = strconv.ParseFloat(strings.TrimSpace(parts[1]), 64); err != nil {
+			return processCounters{}, err
+		}
+	}
+	return counters, scanner.Err()
+}
+
+func processTableTemplate() tableTemplate {
+	return tableTemplate{
+		ID:     processTableID,
+		Label:  "Top IO processes",
+		Prefix: processTablePrefix,
+		Type:   "multicolumn-table",
+		Columns: []column{
+			{ID: "pid", Label: "PID", DataType: "number"},
+			{ID: "name", Label: "Process"},
+			{ID: "read_bytes", Label: "Read bytes/s", DataType: "number"},
+			{ID: "write_bytes", Label: "Write bytes/s", DataType: "number"},
+		},
+	}
+}
+
+func (p *processIO) Name() string { return "process-io" }
+
+// Collect only samples the processes; they are shown as a table.
+func (p *processIO) Collect(ctx context.Context) ([]Metric, error) {
+	procs, err := p.top()
+	p.lock.Lock()
+	p.last = procs
+	p.lock.Unlock()
+	return nil, err
+}
+
+func (p *processIO) Tables() []table {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	rows := map[string]map[string]string{}
+	for _, proc := range p.last {
+		pid := strconv.Itoa(proc.PID)
+		rows[pid] = map[string]string{
+			"pid":         pid,
+			"name":        proc.Name,
+			"read_bytes":  formatNumber(proc.ReadBytesPerSec),
+			"write_bytes": formatNumber(proc.WriteBytesPerSec),
+		}
+	}
+	return []table{{Template: processTableTemplate(), Rows: rows}}
+}
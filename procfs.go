@@ -0,0 +1,160 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The procfs backend reads CPU and block device statistics straight from
+// the Linux /proc files, without any external binaries.
+
+const (
+	procStatPath  = "/proc/stat"
+	diskStatsPath = "/proc/diskstats"
+	uptimePath    = "/proc/uptime"
+
+	defaultCPUSource  = "proc"
+	defaultDiskSource = "procfs"
+)
+
+func init() {
+	cpuSources = append(cpuSources, "proc")
+	collectorFactories["proc"] = func(opts collectorOptions) (Collector, error) {
+		return newProcStatCollector("proc", newProcStat(procStatPath)), nil
+	}
+	diskSources["procfs"] = func(exclude *regexp.Regexp) diskRater {
+		return newDiskStats(diskStatsPath, exclude)
+	}
+}
+
+func newProcStat(path string) *procStat {
+	return &procStat{
+		source: path,
+		read:   func() (cpuTimes, error) { return readCPUTimes(path) },
+	}
+}
+
+func readCPUTimes(path string) (cpuTimes, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return cpuTimes{}, fmt.Errorf("iowait: %w", err)
+	}
+	defer f.Close()
+
+	// cpu  4705 356 584 3699176 23 23 0 0 0 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] != "cpu" {
+			continue
+		}
+		if len(fields) < 5 {
+			return cpuTimes{}, fmt.Errorf("iowait: unexpected %s line: %q", path, scanner.Text())
+		}
+		values := make([]float64, 10)
+		for i, field := range fields[1:] {
+			if i >= len(values) {
+				break
+			}
+			if values[i], err = strconv.ParseFloat(field, 64); err != nil {
+				return cpuTimes{}, fmt.Errorf("iowait: unexpected %s line: %q", path, scanner.Text())
+			}
+		}
+		return cpuTimes{
+			user:      values[0],
+			nice:      values[1],
+			system:    values[2],
+			idle:      values[3],
+			iowait:    values[4],
+			irq:       values[5],
+			softirq:   values[6],
+			steal:     values[7],
+			guest:     values[8],
+			guestNice: values[9],
+		}, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return cpuTimes{}, fmt.Errorf("iowait: %w", err)
+	}
+	return cpuTimes{}, fmt.Errorf("iowait: no cpu line in %s", path)
+}
+
+func newDiskStats(path string, exclude *regexp.Regexp) *diskStats {
+	return &diskStats{
+		source: "procfs",
+		read:   func() (*diskSample, error) { return readDiskStats(path, exclude) },
+		boot:   bootTime,
+	}
+}
+
+func readDiskStats(path string, exclude *regexp.Regexp) (*diskSample, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("diskstats: %v", err)
+	}
+	defer f.Close()
+
+	sample := &diskSample{time: time.Now(), devices: map[string]diskCounters{}}
+
+	//    8       0 sda 4463 1158 250266 2071 2228 2040 74216 1555 0 2599 3626 0 0 0 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 14 {
+			continue
+		}
+		device := fields[2]
+		if exclude != nil && exclude.MatchString(device) {
+			continue
+		}
+		values := make([]float64, 11)
+		for i := range values {
+			if values[i], err = strconv.ParseFloat(fields[i+3], 64); err != nil {
+				return nil, fmt.Errorf("diskstats: unexpected %s line: %q", path, scanner.Text())
+			}
+		}
+		sample.devices[device] = diskCounters{
+			reads:          values[0],
+			readsMerged:    values[1],
+			sectorsRead:    values[2],
+			readTicks:      values[3],
+			writes:         values[4],
+			writesMerged:   values[5],
+			sectorsWritten: values[6],
+			writeTicks:     values[7],
+			inFlight:       values[8],
+			ioTicks:        values[9],
+			weightedTicks:  values[10],
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("diskstats: %v", err)
+	}
+	return sample, nil
+}
+
+// bootTime derives the system boot time from /proc/uptime.
+func bootTime() (time.Time, error) {
+	raw, err := ioutil.ReadFile(uptimePath)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("diskstats: %v", err)
+	}
+	fields := strings.Fields(string(raw))
+	if len(fields) == 0 {
+		return time.Time{}, fmt.Errorf("diskstats: unexpected %s content: %q", uptimePath, raw)
+	}
+	uptime, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("diskstats: unexpected %s content: %q", uptimePath, raw)
+	}
+	return time.Now().Add(-time.Duration(uptime * float64(time.Second))), nil
+}
@@ -0,0 +1,72 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestReadDiskStats(t *testing.T) {
+	const diskstats = `   7       0 loop0 54 0 2160 12 0 0 0 0 0 28 12 0 0 0 0
+   8       0 sda 4463 1158 250266 2071 2228 2040 74216 1555 0 2599 3626 0 0 0 0
+   8       1 sda1 4200 1150 240000 2000 2200 2040 74000 1500 1 2500 3500
+ 259       0 nvme0n1 120 0 9600 30 80 10 6400 25 2 40 55 0 0 0 0 0 0
+   8      16 sdb 1 2 3
+`
+	sda := diskCounters{
+		reads: 4463, readsMerged: 1158, sectorsRead: 250266, readTicks: 2071,
+		writes: 2228, writesMerged: 2040, sectorsWritten: 74216, writeTicks: 1555,
+		inFlight: 0, ioTicks: 2599, weightedTicks: 3626,
+	}
+	sda1 := diskCounters{
+		reads: 4200, readsMerged: 1150, sectorsRead: 240000, readTicks: 2000,
+		writes: 2200, writesMerged: 2040, sectorsWritten: 74000, writeTicks: 1500,
+		inFlight: 1, ioTicks: 2500, weightedTicks: 3500,
+	}
+	nvme := diskCounters{
+		reads: 120, sectorsRead: 9600, readTicks: 30,
+		writes: 80, writesMerged: 10, sectorsWritten: 6400, writeTicks: 25,
+		inFlight: 2, ioTicks: 40, weightedTicks: 55,
+	}
+	loop := diskCounters{reads: 54, sectorsRead: 2160, readTicks: 12, ioTicks: 28, weightedTicks: 12}
+	for _, tc := range []struct {
+		name    string
+		content string
+		exclude *regexp.Regexp
+		want    map[string]diskCounters
+		wantErr bool
+	}{
+		{name: "empty", content: "", want: map[string]diskCounters{}},
+		{
+			name:    "every device",
+			content: diskstats,
+			want:    map[string]diskCounters{"loop0": loop, "sda": sda, "sda1": sda1, "nvme0n1": nvme},
+		},
+		{
+			name:    "excluded devices",
+			content: diskstats,
+			exclude: regexp.MustCompile(`^(loop|ram|zram)\d+$`),
+			want:    map[string]diskCounters{"sda": sda, "sda1": sda1, "nvme0n1": nvme},
+		},
+		{
+			name:    "invalid counter",
+			content: "   8       0 sda 4463 x 250266 2071 2228 2040 74216 1555 0 2599 3626\n",
+			wantErr: true,
+		},
+	} {
+		got, err := readDiskStats(writeTestFile(t, "diskstats", tc.content), tc.exclude)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tc.name, err, tc.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !reflect.DeepEqual(got.devices, tc.want) {
+			t.Errorf("%s: got %+v, want %+v", tc.name, got.devices, tc.want)
+		}
+	}
+}
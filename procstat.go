@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// cpuTimes are cumulative CPU times, e.g. the jiffies of the aggregate
+// "cpu" line of /proc/stat.
+type cpuTimes struct {
+	user, nice, system, idle, iowait, irq, softirq, steal, guest, guestNice float64
+}
+
+func (t cpuTimes) total() float64 {
+	// user and nice already include guest and guestNice.
+	return t.user + t.nice + t.system + t.idle + t.iowait + t.irq + t.softirq + t.steal
+}
+
+// procStat derives CPU utilisation from cumulative CPU times, such as
+// those of /proc/stat. Like iostat, the
+// first reading covers the time since boot and every following reading
+// covers the time since the previous one.
+type procStat struct {
+	source string
+	read   func() (cpuTimes, error)
+
+	lock sync.Mutex
+	prev cpuTimes
+	last cpuStats
+}
+
+func (p *procStat) resetCounters() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.prev = cpuTimes{}
+}
+
+func (p *procStat) cpuStats(ctx context.Context) (cpuStats, error) {
+	cur, err := p.read()
+	if err != nil {
+		return cpuStats{}, err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	prev := p.prev
+
+	// No time elapsed since the last reading: nothing new to report.
+	if cur.total() == prev.total() && prev.total() > 0 {
+		return p.last, nil
+	}
+	// Counters only go backwards if the kernel reset them; start afresh.
+	if cur.total() < prev.total() {
+		prev = cpuTimes{}
+	}
+	p.prev = cur
+	delta := cpuTimes{
+		user:      cur.user - prev.user,
+		nice:      cur.nice - prev.nice,
+		system:    cur.system - prev.system,
+		idle:      cur.idle - prev.idle,
+		iowait:    cur.iowait - prev.iowait,
+		irq:       cur.irq - prev.irq,
+		softirq:   cur.softirq - prev.softirq,
+		steal:     cur.steal - prev.steal,
+		guest:     cur.guest - prev.guest,
+		guestNice: cur.guestNice - prev.guestNice,
+	}
+	total := delta.total()
+	if total <= 0 {
+		return cpuStats{}, fmt.Errorf("iowait: no CPU time elapsed in %s", p.source)
+	}
+	percent := func(v float64) float64 {
+		if v < 0 {
+			return 0
+		}
+		return 100 * v / total
+	}
+	p.last = cpuStats{
+		User:   percent(delta.user - delta.guest),
+		Nice:   percent(delta.nice - delta.guestNice),
+		System: percent(delta.system + delta.irq + delta.softirq),
+		IOWait: percent(delta.iowait),
+		Steal:  percent(delta.steal),
+		Idle:   percent(delta.idle),
+	}
+	return p.last, nil
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultPrometheusURL = "http://cortex-agent-service.maya-system.svc.cluster.local:80"
+
+const (
+	// breakerFailures is how many collections in a row may fail before
+	// the circuit breaker opens, sparing Cortex the queries of the next
+	// breakerCooldown.
+	breakerFailures = 3
+	breakerCooldown = 30 * time.Second
+)
+
+var errBreakerOpen = errors.New("prometheus: circuit breaker open")
+
+// Iops is the structure for IOPS Json
+type Iops struct {
+	Status string `json:"status"`
+	Data   struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Metric struct {
+				Name              string `json:"__name__"`
+				Instance          string `json:"instance"`
+				Job               string `json:"job"`
+				KubernetesPodName string `json:"kubernetes_pod_name"`
+				OpenebsPv         string `json:"openebs_pv"`
+				Le                string `json:"le"`
+			} `json:"metric"`
+			Value []interface{} `json:"value"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+// promQuery is an instant PromQL query reported as the metric ID.
+type promQuery struct {
+	ID    string
+	Query string
+}
+
+// promQueries is a repeatable -prometheus-query flag of id=promql pairs.
+type promQueries []promQuery
+
+// defaultPromQueries are run without -prometheus-query flags.
+var defaultPromQueries = promQueries{{ID: "write_iops", Query: "OpenEBS_write_iops"}}
+
+func (q *promQueries) String() string {
+	queries := []string{}
+	for _, query := range *q {
+		queries = append(queries, query.ID+"="+query.Query)
+	}
+	return strings.Join(queries, " ")
+}
+
+func (q *promQueries) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("invalid query %q, expected id=promql", value)
+	}
+	*q = append(*q, promQuery{ID: parts[0], Query: parts[1]})
+	return nil
+}
+
+// prometheusCollector runs instant queries against a Prometheus compatible
+// API, such as Cortex. Series with an openebs_pv label are reported as one
+// metric per volume. With owns set, only the volumes (and, for series
+// without a volume, the queries) it owns are reported. With hosts set,
+// series are reported on the host node of their instance. Should Cortex
+// fail, the metrics of the latest successful collection are reported
+// until it recovers, and a circuit breaker stops querying it for a while
+// once several collections failed in a row.
+type prometheusCollector struct {
+	url    string
+	client *http.Client
+	owns   func(key string) bool
+	hosts  *instanceHosts
+
+	lock    sync.Mutex
+	queries []promQuery
+	// last are the latest responses, or errors, by query ID.
+	last map[string]interface{}
+	// stale are the metrics of the latest successful collection and
+	// failures the number of collections failed since; the breaker is open
+	// until openUntil.
+	stale     []Metric
+	failures  int
+	openUntil time.Time
+}
+
+func newPrometheusCollector(url string, queries []promQuery, client *http.Client, owns func(key string) bool) (*prometheusCollector, error) {
+	if url == "" {
+		return nil, fmt.Errorf("prometheus: no URL configured")
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	client = faultyCortexClient(client)
+	return &prometheusCollector{url: strings.TrimSuffix(url, "/"), queries: queries, client: client, owns: owns}, nil
+}
+
+func (c *prometheusCollector) Name() string { return "prometheus" }
+
+func (c *prometheusCollector) String() string {
+	options := []string{}
+	if c.owns != nil {
+		options = append(options, "sharded")
+	}
+	if c.hosts != nil {
+		options = append(options, "aggregator")
+	}
+	if len(options) == 0 {
+		return "prometheus"
+	}
+	return "prometheus=" + strings.Join(options, "+")
+}
+
+// setQueries replaces the queries, e.g. on a config reload.
+func (c *prometheusCollector) setQueries(queries []promQuery) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.queries, c.stale = queries, nil
+}
+
+// Collect runs the queries, unless the breaker is open. On failure the
+// stale metrics are returned with the error, if there are any.
+func (c *prometheusCollector) Collect(ctx context.Context) ([]Metric, error) {
+	c.lock.Lock()
+	queries, stale := c.queries, c.stale
+	open := time.Now().Before(c.openUntil)
+	c.lock.Unlock()
+	if open {
+		return stale, errBreakerOpen
+	}
+	metrics, err := c.collect(ctx, queries)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err == nil {
+		c.stale, c.failures = metrics, 0
+		return metrics, nil
+	}
+	c.failures++
+	if c.failures >= breakerFailures {
+		collectorLog(c.Name()).Warnf("%d collections failed in a row, not querying %s for %s", c.failures, c.url, breakerCooldown)
+		self.inc("iowait_prometheus_breaker_opened_total")
+		c.openUntil, c.failures = time.Now().Add(breakerCooldown), 0
+	}
+	if c.stale != nil {
+		return c.stale, err
+	}
+	return metrics, err
+}
+
+func (c *prometheusCollector) collect(ctx context.Context, queries []promQuery) ([]Metric, error) {
+	metrics := []Metric{}
+	for i, q := range queries {
+		result, err := c.query(ctx, q.Query)
+		c.recordResponse(q.ID, result, err)
+		if err != nil {
+			return metrics, err
+		}
+		for _, r := range result.Data.Result {
+			ts, value, err := parseSampleValue(r.Value)
+			if err != nil {
+				return metrics, fmt.Errorf("prometheus: query %q: %v", q.Query, err)
+			}
+			s := querySample{PV: r.Metric.OpenebsPv, Instance: r.Metric.Instance, Time: ts, Value: value}
+			if m, ok := s.metric(ctx, q.ID, i, c.owns, c.hosts); ok {
+				metrics = append(metrics, m)
+			}
+		}
+	}
+	return metrics, nil
+}
+
+// querySample is one series of the result of a query, from Prometheus or
+// another time series database, with the volume and instance it is of, if
+// any.
+type querySample struct {
+	PV, Instance string
+	Time         time.Time
+	Value        float64
+}
+
+// metric returns the metric of a sample of the i-th query: one per volume
+// for samples of a volume. It is false for samples that can't be shown and
+// for those of volumes or queries owns doesn't own. With hosts set,
+// samples are reported on the host node of their instance.
+func (s querySample) metric(ctx context.Context, queryID string, i int, owns func(key string) bool, hosts *instanceHosts) (Metric, bool) {
+	// Scope cannot represent NaN or infinite samples.
+	if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+		return Metric{}, false
+	}
+	id, label, key := queryID, queryID, queryID
+	if s.PV != "" {
+		id, label, key = queryID+"_"+s.PV, s.PV+" "+queryID, s.PV
+	}
+	if owns != nil && !owns(key) {
+		return Metric{}, false
+	}
+	nodeID := ""
+	if hosts != nil && s.Instance != "" {
+		if host, ok := hosts.host(ctx, s.Instance); ok {
+			nodeID = hostNodeID(host)
+		}
+	}
+	return Metric{
+		ID:       id,
+		Label:    label,
+		Priority: 20 + float64(i),
+		Value:    s.Value,
+		Min:      0,
+		Max:      s.Value,
+		Time:     s.Time,
+		NodeID:   nodeID,
+	}, true
+}
+
+func (c *prometheusCollector) recordResponse(id string, result *Iops, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.last == nil {
+		c.last = map[string]interface{}{}
+	}
+	if err != nil {
+		c.last[id] = map[string]string{"error": err.Error()}
+		return
+	}
+	c.last[id] = result
+}
+
+func (c *prometheusCollector) debugState() interface{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	last := map[string]interface{}{}
+	for id, response := range c.last {
+		last[id] = response
+	}
+	return map[string]interface{}{"url": c.url, "responses": last}
+}
+
+// query runs an instant query, recording its latency and failures in the
+// plugin's own metrics.
+func (c *prometheusCollector) query(ctx context.Context, query string) (*Iops, error) {
+	ctx, sp := startSpan(ctx, "prometheus.query", otlpAttr("query", query))
+	defer sp.end()
+	start := time.Now()
+	result, err := c.rawQuery(ctx, query)
+	self.observe("iowait_prometheus_query_duration_seconds", time.Since(start))
+	if err != nil {
+		self.inc("iowait_prometheus_query_errors_total")
+		sp.setError(err)
+	}
+	return result, err
+}
+
+func (c *prometheusCollector) rawQuery(ctx context.Context, query string) (*Iops, error) {
+	req, err := http.NewRequest("GET", c.url+"/api/v1/query?query="+url.QueryEscape(query), nil)
+	if err != nil {
+		return nil, fmt.Errorf("prometheus: %v", err)
+	}
+	res, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("prometheus: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("prometheus: query %q: %s", query, res.Status)
+	}
+	raw, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("prometheus: query %q: %v", query, err)
+	}
+	collectorLog(c.Name()).WithField("query", query).Debugf("Response: %s", raw)
+	result := &Iops{}
+	if err := json.Unmarshal(raw, result); err != nil {
+		return nil, fmt.Errorf("prometheus: query %q: %v", query, err)
+	}
+	if result.Status != "success" {
+		return nil, fmt.Errorf("prometheus: query %q: status %q", query, result.Status)
+	}
+	return result, nil
+}
+
+// perVolume runs a query and returns its value for every volume, summing
+// the series of a volume.
+func (c *prometheusCollector) perVolume(ctx context.Context, query string) (map[string]float64, error) {
+	result, err := c.query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]float64{}
+	for _, r := range result.Data.Result {
+		if r.Metric.OpenebsPv == "" {
+			continue
+		}
+		_, value, err := parseSampleValue(r.Value)
+		if err != nil {
+			return nil, fmt.Errorf("prometheus: query %q: %v", query, err)
+		}
+		values[r.Metric.OpenebsPv] += value
+	}
+	return values, nil
+}
+
+// parseSampleValue parses a [<unix time>, "<value>"] instant vector sample.
+func parseSampleValue(v []interface{}) (time.Time, float64, error) {
+	if len(v) != 2 {
+		return time.Time{}, 0, fmt.Errorf("unexpected sample %v", v)
+	}
+	ts, ok := v[0].(float64)
+	if !ok {
+		return time.Time{}, 0, fmt.Errorf("unexpected sample time %v", v[0])
+	}
+	raw, ok := v[1].(string)
+	if !ok {
+		return time.Time{}, 0, fmt.Errorf("unexpected sample value %v", v[1])
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	return time.Unix(0, int64(ts*float64(time.Second))), value, nil
+}
@@ -0,0 +1,127 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const psiIOPath = "/proc/pressure/io"
+
+func init() {
+	collectorFactories["psi"] = func(opts collectorOptions) (Collector, error) {
+		return newPSICollector(psiIOPath)
+	}
+}
+
+// psiStats are the IO Pressure Stall Information averages, the percentage
+// of time some (or all) tasks were stalled on IO. They need a kernel built
+// with CONFIG_PSI. See https://docs.kernel.org/accounting/psi.html
+type psiStats struct {
+	SomeAvg10, SomeAvg60 float64
+	FullAvg10, FullAvg60 float64
+}
+
+func readPSI(path string) (psiStats, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return psiStats{}, fmt.Errorf("psi: %v", err)
+	}
+	defer f.Close()
+
+	// some avg10=0.00 avg60=0.00 avg300=0.00 total=0
+	// full avg10=0.00 avg60=0.00 avg300=0.00 total=0
+	stats := psiStats{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		var avg10, avg60 *float64
+		switch fields[0] {
+		case "some":
+			avg10, avg60 = &stats.SomeAvg10, &stats.SomeAvg60
+		case "full":
+			avg10, avg60 = &stats.FullAvg10, &stats.FullAvg60
+		default:
+			continue
+		}
+		for _, field := range fields[1:] {
+			parts := strings.SplitN(field, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			var dst *float64
+			switch parts[0] {
+			case "avg10":
+				dst = avg10
+			case "avg60":
+				dst = avg60
+			default:
+				continue
+			}
+			if *dst, err = strconv.ParseFloat(parts[1], 64); err != nil {
+				return psiStats{}, fmt.Errorf("psi: unexpected %s line: %q", path, scanner.Text())
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return psiStats{}, fmt.Errorf("psi: %v", err)
+	}
+	return stats, nil
+}
+
+var psiMetricDefs = []struct {
+	id, label string
+	value     func(psiStats) float64
+}{
+	{"psi_io_some_avg10", "IO pressure (some, 10s)", func(s psiStats) float64 { return s.SomeAvg10 }},
+	{"psi_io_some_avg60", "IO pressure (some, 60s)", func(s psiStats) float64 { return s.SomeAvg60 }},
+	{"psi_io_full_avg10", "IO pressure (full, 10s)", func(s psiStats) float64 { return s.FullAvg10 }},
+	{"psi_io_full_avg60", "IO pressure (full, 60s)", func(s psiStats) float64 { return s.FullAvg60 }},
+}
+
+// psiCollector reports the IO pressure of the host.
+type psiCollector struct {
+	path string
+}
+
+// newPSICollector fails on kernels without PSI support.
+func newPSICollector(path string) (*psiCollector, error) {
+	if _, err := readPSI(path); err != nil {
+		return nil, err
+	}
+	return &psiCollector{path: path}, nil
+}
+
+func (c *psiCollector) Name() string { return "psi" }
+
+func (c *psiCollector) Collect(ctx context.Context) ([]Metric, error) {
+	stats, err := readPSI(c.path)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	metrics := []Metric{}
+	for i, def := range psiMetricDefs {
+		metrics = append(metrics, Metric{
+			ID:       def.id,
+			Label:    def.label,
+			Format:   "percent",
+			Priority: 1 + float64(i)/10,
+			Value:    def.value(stats),
+			Min:      0,
+			Max:      100,
+			Time:     now,
+		})
+	}
+	return metrics, nil
+}
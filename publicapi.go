@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var publicLog = componentLog("public-api")
+
+// publicReportMaxAge is how old the latest report may be before the
+// public API builds a fresh one, e.g. when Scope isn't polling.
+const publicReportMaxAge = 10 * time.Second
+
+// publicAPI serves read-only views of the plugin (a status page, the
+// latest report, the history of the host's metrics and a Grafana JSON
+// datasource) over TCP, e.g. to wallboards behind an ingress. Controls
+// stay on the plugin socket only. With tenants set, requests need a token
+// and namespace scoped tokens only see their namespaces' volumes. The
+// history is served thinned by thinner.
+type publicAPI struct {
+	plugin  *Plugin
+	window  time.Duration
+	tenants *tenantFilter
+	thinner sampleThinner
+
+	lock     sync.Mutex
+	last     *report
+	lastTime time.Time
+	history  map[string][]sample
+}
+
+func newPublicAPI(plugin *Plugin, window time.Duration, tenants *tenantFilter, thinner sampleThinner) *publicAPI {
+	return &publicAPI{plugin: plugin, window: window, tenants: tenants, thinner: thinner, history: map[string][]sample{}}
+}
+
+// observe records a report built for Scope. The caller holds p.lock.
+func (a *publicAPI) observe(rpt *report) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	now := time.Now()
+	a.last, a.lastTime = rpt, now
+	n := rpt.Host.Nodes[a.plugin.getTopologyHost()]
+	start := now.Add(-a.window)
+	for id, m := range n.Metrics {
+		kept := a.history[id]
+		for _, smp := range m.Samples {
+			if len(kept) == 0 || smp.Date.After(kept[len(kept)-1].Date) {
+				kept = append(kept, smp)
+			}
+		}
+		i := 0
+		for i < len(kept) && kept[i].Date.Before(start) {
+			i++
+		}
+		a.history[id] = append([]sample(nil), kept[i:]...)
+	}
+}
+
+// shedMemory drops the history; the latest report is kept.
+func (a *publicAPI) shedMemory() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.history = map[string][]sample{}
+}
+
+// latest returns the latest report, getting one if it is too old. That is
+// the one served on the socket, sharing its cache and collections.
+func (a *publicAPI) latest(ctx context.Context) *report {
+	a.lock.Lock()
+	rpt, age := a.last, time.Since(a.lastTime)
+	a.lock.Unlock()
+	if rpt != nil && age < publicReportMaxAge {
+		return rpt
+	}
+	p := a.plugin
+	raw, err := p.reportJSON(ctx)
+	if err == nil {
+		rpt = &report{}
+		err = json.Unmarshal(raw, rpt)
+	}
+	if err != nil {
+		publicLog.Error(err)
+		return p.diagnosticReport(err)
+	}
+	return rpt
+}
+
+// report returns the latest report as the request's token may see it.
+func (a *publicAPI) report(r *http.Request) *report {
+	rpt := a.latest(r.Context())
+	if a.tenants == nil {
+		return rpt
+	}
+	if v, ok := a.tenants.view(r); ok {
+		return filterReport(rpt, v)
+	}
+	return rpt
+}
+
+// metricFilter tells which metrics' history the request's token may see.
+func (a *publicAPI) metricFilter(r *http.Request) func(id string) bool {
+	if a.tenants != nil {
+		if v, ok := a.tenants.view(r); ok {
+			return v.metric
+		}
+	}
+	return func(string) bool { return true }
+}
+
+func (a *publicAPI) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", a.serveStatus)
+	mux.HandleFunc("/report", a.serveReport)
+	mux.HandleFunc("/api/v1/history", a.serveHistory)
+	mux.HandleFunc("/stream", a.serveStream)
+	mux.HandleFunc("/grafana/", a.serveGrafanaTest)
+	mux.HandleFunc("/grafana/search", a.serveGrafanaSearch)
+	mux.HandleFunc("/grafana/query", a.serveGrafanaQuery)
+	if a.tenants != nil {
+		return readOnly(a.tenants.authorize(mux))
+	}
+	return readOnly(mux)
+}
+
+// readOnly rejects every method but GET, HEAD and the POSTs of the Grafana
+// datasource protocol, which only query.
+func readOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" || r.Method == "HEAD":
+		case r.Method == "POST" && (r.URL.Path == "/grafana/search" || r.URL.Path == "/grafana/query"):
+		default:
+			http.Error(w, "read-only API", http.StatusMethodNotAllowed)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		publicLog.Error(err)
+	}
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html><head><title>{{.Label}} on {{.Host}}</title><meta http-equiv="refresh" content="5"></head>
+<body>
+<h1>{{.Label}} on {{.Host}}</h1>
+<p>{{.Description}}</p>
+<table>
+{{range .Rows}}<tr><td>{{.Label}}</td><td>{{.Value}}</td></tr>
+{{end}}</table>
+</body></html>
+`))
+
+func (a *publicAPI) serveStatus(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	rpt := a.report(r)
+	type row struct{ Label, Value string }
+	rows := []row{}
+	n := rpt.Host.Nodes[a.plugin.getTopologyHost()]
+	for id, m := range n.Metrics {
+		if len(m.Samples) == 0 {
+			continue
+		}
+		label := rpt.Host.MetricTemplates[id].Label
+		if label == "" {
+			label = id
+		}
+		rows = append(rows, row{label, formatNumber(m.Samples[len(m.Samples)-1].Value)})
+	}
+	for id, tmpl := range rpt.Host.MetadataTemplates {
+		if entry, ok := n.Latest[id]; ok {
+			rows = append(rows, row{tmpl.Label, entry.Value})
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Label < rows[j].Label })
+	spec := rpt.Plugins[0]
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := statusTemplate.Execute(w, map[string]interface{}{
+		"Label":       spec.Label,
+		"Host":        a.plugin.HostID,
+		"Description": spec.Description,
+		"Rows":        rows,
+	})
+	if err != nil {
+		publicLog.Error(err)
+	}
+}
+
+func (a *publicAPI) serveReport(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.report(r))
+}
+
+// serveHistory returns the samples of the host's metrics over the window,
+// thinned to their limits, or only those of the metric query parameter.
+func (a *publicAPI) serveHistory(w http.ResponseWriter, r *http.Request) {
+	a.latest(r.Context())
+	visible := a.metricFilter(r)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	history := map[string][]sample{}
+	for id, samples := range a.history {
+		if metric := r.URL.Query().Get("metric"); visible(id) && (metric == "" || metric == id) {
+			history[id] = a.thinner.apply(id, samples, 0)
+		}
+	}
+	writeJSON(w, history)
+}
+
+// serveStream streams the samples the request's token may see.
+func (a *publicAPI) serveStream(w http.ResponseWriter, r *http.Request) {
+	a.plugin.stream.serve(w, r, a.metricFilter(r))
+}
+
+// serveGrafanaTest answers the datasource test of Grafana's JSON
+// datasource plugins.
+func (a *publicAPI) serveGrafanaTest(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/grafana/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (a *publicAPI) serveGrafanaSearch(w http.ResponseWriter, r *http.Request) {
+	visible := a.metricFilter(r)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	ids := []string{}
+	for id := range a.history {
+		if visible(id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	writeJSON(w, ids)
+}
+
+// serveGrafanaQuery returns the samples of the requested metrics within
+// the requested range, as Grafana time series of at most the requested
+// number of points.
+func (a *publicAPI) serveGrafanaQuery(w http.ResponseWriter, r *http.Request) {
+	query := struct {
+		Range struct {
+			From time.Time `json:"from"`
+			To   time.Time `json:"to"`
+		} `json:"range"`
+		Targets []struct {
+			Target string `json:"target"`
+		} `json:"targets"`
+		MaxDataPoints int `json:"maxDataPoints"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	type series struct {
+		Target     string       `json:"target"`
+		Datapoints [][2]float64 `json:"datapoints"`
+	}
+	a.latest(r.Context())
+	visible := a.metricFilter(r)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	result := []series{}
+	for _, t := range query.Targets {
+		s := series{Target: t.Target, Datapoints: [][2]float64{}}
+		if !visible(t.Target) {
+			result = append(result, s)
+			continue
+		}
+		inRange := []sample{}
+		for _, smp := range a.history[t.Target] {
+			if smp.Date.Before(query.Range.From) || (!query.Range.To.IsZero() && smp.Date.After(query.Range.To)) {
+				continue
+			}
+			inRange = append(inRange, smp)
+		}
+		for _, smp := range a.thinner.apply(t.Target, inRange, query.MaxDataPoints) {
+			s.Datapoints = append(s.Datapoints, [2]float64{smp.Value, float64(smp.Date.UnixNano() / int64(time.Millisecond))})
+		}
+		result = append(result, s)
+	}
+	writeJSON(w, result)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// pushTimeout bounds every push. Building the report isn't bounded by it,
+// as the report is shared with the requests on the socket.
+const pushTimeout = 10 * time.Second
+
+var pushLog = componentLog("push")
+
+// reportPusher publishes the plugin's reports to the report API of the
+// Scope app, as probes do, for when the plugin runs off-host or the probe
+// can't mount the plugins directory. Reports are the ones served on the
+// plugin socket, sharing its report cache and collections.
+type reportPusher struct {
+	url     string
+	token   string
+	probeID string
+	client  *http.Client
+	plugin  *Plugin
+}
+
+// newReportPusher publishes to the Scope app at appURL, e.g.
+// http://scope-app:4040, authenticating with token if set, as the probe
+// probeID.
+func newReportPusher(appURL, token, probeID string, plugin *Plugin) *reportPusher {
+	return &reportPusher{
+		url:     strings.TrimSuffix(appURL, "/") + "/api/report",
+		token:   token,
+		probeID: probeID,
+		client:  &http.Client{},
+		plugin:  plugin,
+	}
+}
+
+func (p *reportPusher) watch(interval time.Duration) {
+	p.run()
+	for range time.Tick(interval) {
+		p.run()
+	}
+}
+
+func (p *reportPusher) run() {
+	ctx, cancel := context.WithTimeout(context.Background(), pushTimeout)
+	defer cancel()
+	ctx, sp := startSpan(ctx, "push")
+	defer sp.end()
+	if err := p.push(ctx); err != nil {
+		pushLog.Warnf("%v", err)
+		sp.setError(err)
+		self.inc("iowait_push_errors_total")
+	}
+}
+
+// push posts the latest report.
+func (p *reportPusher) push(ctx context.Context) error {
+	raw, err := p.plugin.reportJSON(ctx)
+	if err != nil {
+		return fmt.Errorf("push: %v", err)
+	}
+	return p.post(ctx, raw)
+}
+
+// post posts a gzipped JSON report.
+func (p *reportPusher) post(ctx context.Context, raw []byte) error {
+	var body bytes.Buffer
+	gz := gzip.NewWriter(&body)
+	gz.Write(raw)
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("push: %v", err)
+	}
+	req, err := http.NewRequest("POST", p.url, &body)
+	if err != nil {
+		return fmt.Errorf("push: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("User-Agent", "Scope_Probe/"+version)
+	req.Header.Set("X-Scope-Probe-ID", p.probeID)
+	if p.token != "" {
+		req.Header.Set("Authorization", "Scope-Probe token="+p.token)
+	}
+	res, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("push: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("push: %s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
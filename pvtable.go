@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+const (
+	pvTableID     = "pv-iops-table"
+	pvTablePrefix = "pv-iops-table-"
+
+	defaultPVReadIOPSQuery  = "sum by (openebs_pv) (OpenEBS_read_iops)"
+	defaultPVWriteIOPSQuery = "sum by (openebs_pv) (OpenEBS_write_iops)"
+	defaultPVLatencyQuery   = "avg by (openebs_pv) (OpenEBS_read_latency + OpenEBS_write_latency) / 2"
+)
+
+func init() {
+	collectorFactories["pv-table"] = func(opts collectorOptions) (Collector, error) {
+		prom, err := newPrometheusCollector(opts.PrometheusURL, nil, opts.HTTPClient, nil)
+		if err != nil {
+			return nil, err
+		}
+		return newPVTable(prom, opts.PVShard, opts.PVTableQueries), nil
+	}
+}
+
+// pvTableQueries return the read and write IOPS and the latency of every
+// volume, by openebs_pv. An empty latency query leaves latencies out.
+type pvTableQueries struct {
+	ReadIOPS  string
+	WriteIOPS string
+	Latency   string
+}
+
+// pvTable shows a table with the IOPS and latency of every volume on the
+// host node, a sortable summary next to the per-volume graphs.
+type pvTable struct {
+	prom    *prometheusCollector
+	owns    func(key string) bool
+	queries pvTableQueries
+
+	lock sync.Mutex
+	rows map[string]map[string]string
+}
+
+func newPVTable(prom *prometheusCollector, owns func(key string) bool, queries pvTableQueries) *pvTable {
+	return &pvTable{prom: prom, owns: owns, queries: queries}
+}
+
+func (t *pvTable) Name() string { return "pv-table" }
+
+// Collect queries the volume statistics; they are only shown as a table.
+func (t *pvTable) Collect(ctx context.Context) ([]Metric, error) {
+	reads, err := t.prom.perVolume(ctx, t.queries.ReadIOPS)
+	if err != nil {
+		return nil, fmt.Errorf("pv-table: %w", err)
+	}
+	writes, err := t.prom.perVolume(ctx, t.queries.WriteIOPS)
+	if err != nil {
+		return nil, fmt.Errorf("pv-table: %w", err)
+	}
+	latencies := map[string]float64{}
+	if t.queries.Latency != "" {
+		if latencies, err = t.prom.perVolume(ctx, t.queries.Latency); err != nil {
+			return nil, fmt.Errorf("pv-table: %w", err)
+		}
+	}
+	rows := map[string]map[string]string{}
+	for _, values := range []map[string]float64{reads, writes, latencies} {
+		for pv := range values {
+			if _, ok := rows[pv]; ok || (t.owns != nil && !t.owns(pv)) {
+				continue
+			}
+			row := map[string]string{
+				"pv":         pv,
+				"read_iops":  formatNumber(reads[pv]),
+				"write_iops": formatNumber(writes[pv]),
+			}
+			if latency, ok := latencies[pv]; ok {
+				row["latency"] = formatNumber(latency)
+			}
+			rows[pv] = row
+		}
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.rows = rows
+	return nil, nil
+}
+
+func (t *pvTable) Tables() []table {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	columns := []column{
+		{ID: "pv", Label: "Volume"},
+		{ID: "read_iops", Label: "Read IOPS", DataType: "number"},
+		{ID: "write_iops", Label: "Write IOPS", DataType: "number"},
+	}
+	if t.queries.Latency != "" {
+		columns = append(columns, column{ID: "latency", Label: "Latency", DataType: "number"})
+	}
+	return []table{{
+		Template: tableTemplate{
+			ID:      pvTableID,
+			Label:   "Volume IOPS",
+			Prefix:  pvTablePrefix,
+			Type:    "multicolumn-table",
+			Columns: columns,
+		},
+		Rows: t.rows,
+	}}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	bootIDPath    = "/proc/sys/kernel/random/boot_id"
+	osReleasePath = "/proc/sys/kernel/osrelease"
+
+	rebootKey = "iowait_reboot"
+)
+
+// bootIdentity identifies the running kernel instance: the boot ID changes
+// on every boot, the release on kernel upgrades. Both are empty where they
+// can't be read.
+type bootIdentity struct {
+	BootID string
+	Kernel string
+}
+
+func readBootIdentity() bootIdentity {
+	return bootIdentity{BootID: readSysfs(bootIDPath), Kernel: readSysfs(osReleasePath)}
+}
+
+// A counterResetter derives rates from cumulative kernel counters, which
+// restart from zero on reboot. resetCounters forgets the previous reading,
+// so the next one starts afresh instead of producing a bogus delta.
+type counterResetter interface {
+	resetCounters()
+}
+
+// noteBoot compares the boot identity with a previous one, e.g. from the
+// saved state, and records a reboot event if the host rebooted in between.
+// The caller holds p.lock.
+func (p *Plugin) noteBoot(prev bootIdentity) bool {
+	if prev.BootID == "" || p.boot.BootID == "" || prev.BootID == p.boot.BootID {
+		return false
+	}
+	p.rebootEvent = "rebooted"
+	if prev.Kernel != "" && prev.Kernel != p.boot.Kernel {
+		p.rebootEvent = fmt.Sprintf("rebooted, kernel changed from %s to %s", prev.Kernel, p.boot.Kernel)
+	}
+	p.rebootTime = time.Now()
+	log.WithField("nodeID", p.HostID).Warnf("Node %s", p.rebootEvent)
+	return true
+}
+
+// checkReboot notices reboots while the plugin is running, e.g. after a
+// checkpoint/restore or on a VM resumed from a snapshot, and resets the
+// counter-based collectors. The caller holds p.lock.
+func (p *Plugin) checkReboot() {
+	prev := p.boot
+	p.boot = readBootIdentity()
+	if !p.noteBoot(prev) {
+		return
+	}
+	for _, c := range p.collectors {
+		if r, ok := c.(counterResetter); ok {
+			r.resetCounters()
+		}
+	}
+}
+
+// addRebootEvent annotates the host node with the latest reboot, so the
+// discontinuity it causes in graphs has an explanation.
+func (p *Plugin) addRebootEvent(rpt *report) {
+	if p.rebootEvent == "" {
+		return
+	}
+	hostNodeID := p.getTopologyHost()
+	n := rpt.Host.Nodes[hostNodeID]
+	if n.Latest == nil {
+		n.Latest = map[string]stringEntry{}
+	}
+	n.Latest[rebootKey] = stringEntry{
+		Timestamp: p.rebootTime,
+		Value:     fmt.Sprintf("%s (detected %s)", p.rebootEvent, p.rebootTime.UTC().Format(time.RFC3339)),
+	}
+	rpt.Host.Nodes[hostNodeID] = n
+	if rpt.Host.MetadataTemplates == nil {
+		rpt.Host.MetadataTemplates = map[string]metadataTemplate{}
+	}
+	rpt.Host.MetadataTemplates[rebootKey] = metadataTemplate{
+		ID:       rebootKey,
+		Label:    "Node rebooted",
+		Priority: 2,
+		From:     "latest",
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+var replicationLog = componentLog("replication")
+
+// State replication keeps a warm standby instance up to date with the
+// state of the active one, over a gRPC stream: the active instance serves
+// snapshots of its state every interval and the standby follows them until
+// it takes over, so a failover doesn't reset the settings users chose
+// through Scope controls. Messages are serialized with a pluggable
+// stateCodec rather than protobuf.
+
+const watchStateMethod = "/iowait.StateReplication/Watch"
+
+// watchRequest starts a state stream.
+type watchRequest struct {
+	Follower string
+}
+
+type stateReplicationServer interface {
+	watchState(req *watchRequest, stream grpc.ServerStream) error
+}
+
+var stateReplicationDesc = grpc.ServiceDesc{
+	ServiceName: "iowait.StateReplication",
+	HandlerType: (*stateReplicationServer)(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Watch",
+		Handler:       watchStateHandler,
+		ServerStreams: true,
+	}},
+	Metadata: "replication.go",
+}
+
+func watchStateHandler(srv interface{}, stream grpc.ServerStream) error {
+	req := &watchRequest{}
+	if err := stream.RecvMsg(req); err != nil {
+		return err
+	}
+	return srv.(stateReplicationServer).watchState(req, stream)
+}
+
+// stateReplicator serves the plugin state while the instance is active and
+// follows the active instance's state while it is a standby.
+type stateReplicator struct {
+	plugin   *Plugin
+	addr     string
+	codec    stateCodec
+	interval time.Duration
+
+	lock     sync.Mutex
+	followed *pluginState
+	server   *grpc.Server
+}
+
+func newStateReplicator(plugin *Plugin, addr string, codec stateCodec, interval time.Duration) *stateReplicator {
+	return &stateReplicator{plugin: plugin, addr: addr, codec: codec, interval: interval}
+}
+
+func (r *stateReplicator) watchState(req *watchRequest, stream grpc.ServerStream) error {
+	replicationLog.Infof("Replicating state to %s", req.Follower)
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		r.plugin.lock.Lock()
+		state := r.plugin.snapshotState()
+		r.plugin.lock.Unlock()
+		if err := stream.SendMsg(&state); err != nil {
+			return err
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// serve serves the state once the address is free, i.e. once the previous
+// active instance stopped serving it.
+func (r *stateReplicator) serve() {
+	for {
+		ln, err := net.Listen("tcp", r.addr)
+		if err == nil {
+			server := grpc.NewServer(grpc.ForceServerCodec(r.codec))
+			server.RegisterService(&stateReplicationDesc, r)
+			r.lock.Lock()
+			r.server = server
+			r.lock.Unlock()
+			replicationLog.Infof("Serving state replication on: tcp://%s", r.addr)
+			if err := server.Serve(ln); err != nil {
+				replicationLog.Error(err)
+			}
+			return
+		}
+		time.Sleep(r.interval)
+	}
+}
+
+// stop stops serving the state, e.g. when another instance took over.
+func (r *stateReplicator) stop() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.server != nil {
+		r.server.Stop()
+	}
+}
+
+// follow keeps the latest state of the active instance until ctx is done.
+func (r *stateReplicator) follow(ctx context.Context) {
+	for ctx.Err() == nil {
+		if err := r.followStream(ctx, false); err != nil && ctx.Err() == nil {
+			replicationLog.Errorf("following state: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(r.interval):
+		}
+	}
+}
+
+// followStream keeps the states streamed by the active instance, or only
+// the first one if once is set.
+func (r *stateReplicator) followStream(ctx context.Context, once bool) error {
+	conn, err := grpc.DialContext(ctx, r.addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return fmt.Errorf("state replication: %w", err)
+	}
+	defer conn.Close()
+	stream, err := conn.NewStream(ctx, &stateReplicationDesc.Streams[0], watchStateMethod, grpc.ForceCodec(r.codec))
+	if err != nil {
+		return fmt.Errorf("state replication: %w", err)
+	}
+	hostname, _ := os.Hostname()
+	if err := stream.SendMsg(&watchRequest{Follower: fmt.Sprintf("%s[%d]", hostname, os.Getpid())}); err != nil {
+		return fmt.Errorf("state replication: %w", err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		return fmt.Errorf("state replication: %w", err)
+	}
+	for {
+		state := pluginState{}
+		if err := stream.RecvMsg(&state); err != nil {
+			return fmt.Errorf("state replication: %w", err)
+		}
+		r.lock.Lock()
+		r.followed = &state
+		r.lock.Unlock()
+		if once {
+			return nil
+		}
+	}
+}
+
+// adopt applies the latest state of the previous active instance to the
+// plugin. It asks for a fresh state first, which the previous instance can
+// still serve while it drains, falling back to the latest one followed.
+func (r *stateReplicator) adopt() {
+	ctx, cancel := context.WithTimeout(context.Background(), r.interval)
+	defer cancel()
+	if err := r.followStream(ctx, true); err != nil {
+		replicationLog.Errorf("fetching the latest state: %v", err)
+	}
+	r.lock.Lock()
+	state := r.followed
+	r.lock.Unlock()
+	if state == nil {
+		replicationLog.Warnf("No state replicated from the active instance")
+		return
+	}
+	r.plugin.lock.Lock()
+	r.plugin.restoreState(*state)
+	r.plugin.lock.Unlock()
+	replicationLog.Infof("Adopted the state of the previous active instance")
+}
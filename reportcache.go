@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// reportCache coalesces concurrent /report requests into a single
+// collection, and serves the marshalled report it built to the requests
+// within ttl of it, for Scope polling faster than metrics change. Only one
+// collection runs at a time, and requests wait for it, instead of each
+// collecting in turn behind p.lock.
+type reportCache struct {
+	ttl time.Duration
+
+	lock     sync.Mutex
+	raw      []byte
+	built    time.Time
+	inflight *reportFlight
+}
+
+var errAbortedReport = errors.New("report: collection aborted")
+
+// A reportFlight is a report being built, done closed once it is.
+type reportFlight struct {
+	done chan struct{}
+	raw  []byte
+	err  error
+}
+
+func newReportCache(ttl time.Duration) *reportCache {
+	return &reportCache{ttl: ttl}
+}
+
+// get returns the cached report if it is fresh, else the one being built,
+// else builds one. build reports whether its report may be cached, which
+// diagnostic reports must not be.
+func (c *reportCache) get(build func() ([]byte, bool, error)) ([]byte, error) {
+	c.lock.Lock()
+	if c.raw != nil && time.Since(c.built) < c.ttl {
+		raw := c.raw
+		c.lock.Unlock()
+		self.inc("iowait_report_cache_hits_total")
+		return raw, nil
+	}
+	if f := c.inflight; f != nil {
+		c.lock.Unlock()
+		<-f.done
+		self.inc("iowait_report_cache_hits_total")
+		return f.raw, f.err
+	}
+	f := &reportFlight{done: make(chan struct{})}
+	c.inflight = f
+	c.lock.Unlock()
+
+	// Waiters get an error, rather than hang, should build panic.
+	f.err = errAbortedReport
+	var cacheable bool
+	defer func() {
+		c.lock.Lock()
+		c.inflight = nil
+		if f.err == nil && cacheable {
+			c.raw, c.built = f.raw, time.Now()
+		}
+		c.lock.Unlock()
+		close(f.done)
+	}()
+	f.raw, cacheable, f.err = build()
+	return f.raw, f.err
+}
+
+// invalidate drops the cached report, e.g. once a control changed what
+// reports show.
+func (c *reportCache) invalidate() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.raw = nil
+}
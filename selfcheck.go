@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// selfCheck periodically fetches a report from the plugin's own socket, as
+// Scope does, and checks it parses, comes from this plugin and has fresh
+// samples. It catches the plugin socket existing while its handler is
+// wedged, which the other probes can't see from inside the process.
+type selfCheck struct {
+	path     string
+	pluginID string
+	nodeID   string
+	maxAge   time.Duration
+	client   *http.Client
+
+	lock        sync.Mutex
+	checked     time.Time
+	err         error
+	lastSuccess time.Time
+}
+
+func newSelfCheck(socketPath, pluginID, nodeID string, timeout, maxAge time.Duration) *selfCheck {
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+	}
+	return &selfCheck{
+		path:     socketPath,
+		pluginID: pluginID,
+		nodeID:   nodeID,
+		maxAge:   maxAge,
+		client:   &http.Client{Timeout: timeout, Transport: &http.Transport{DialContext: dial}},
+	}
+}
+
+func (c *selfCheck) watch(interval time.Duration) {
+	c.run()
+	for range time.Tick(interval) {
+		c.run()
+	}
+}
+
+func (c *selfCheck) run() {
+	start := time.Now()
+	err := c.check()
+	self.observe("iowait_self_check_duration_seconds", time.Since(start))
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.checked, c.err = start, err
+	if err != nil {
+		healthLog.Warnf("Self check: %v", err)
+		self.set("iowait_self_check_success", 0)
+		return
+	}
+	c.lastSuccess = start
+	self.set("iowait_self_check_success", 1)
+	self.set("iowait_self_check_last_success_timestamp_seconds", float64(start.UnixNano())/1e9)
+}
+
+func (c *selfCheck) check() error {
+	res, err := c.client.Get("http://plugin/report")
+	if err != nil {
+		return fmt.Errorf("self check: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("self check: %s", res.Status)
+	}
+	rpt := report{}
+	if err := json.NewDecoder(res.Body).Decode(&rpt); err != nil {
+		return fmt.Errorf("self check: unparsable report: %v", err)
+	}
+	if len(rpt.Plugins) == 0 || rpt.Plugins[0].ID != c.pluginID {
+		return fmt.Errorf("self check: report is not from plugin %s", c.pluginID)
+	}
+	n, ok := rpt.Host.Nodes[c.nodeID]
+	if !ok {
+		return fmt.Errorf("self check: report has no node %s", c.nodeID)
+	}
+	// Paused reports have no samples.
+	if _, paused := n.Latest[pausedKey]; paused {
+		return nil
+	}
+	var newest time.Time
+	for _, m := range n.Metrics {
+		for _, s := range m.Samples {
+			if s.Date.After(newest) {
+				newest = s.Date
+			}
+		}
+	}
+	if newest.IsZero() {
+		return fmt.Errorf("self check: report has no samples")
+	}
+	if age := time.Since(newest); age > c.maxAge {
+		return fmt.Errorf("self check: newest sample is %s old", age.Round(time.Second))
+	}
+	return nil
+}
+
+// status returns the latest error, or nil if a check succeeded within
+// window.
+func (c *selfCheck) status(window time.Duration) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	switch {
+	case c.checked.IsZero():
+		return fmt.Errorf("not checked yet")
+	case c.err != nil:
+		return c.err
+	case time.Since(c.lastSuccess) > window:
+		return fmt.Errorf("no successful check for %s", time.Since(c.lastSuccess).Round(time.Second))
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// selfMetricDefs are the plugin's own operational metrics, served in the
+// Prometheus text exposition format so the plugin can be monitored by the
+// stack it queries.
+var selfMetricDefs = map[string]struct{ kind, help string }{
+	"iowait_report_duration_seconds":                   {"histogram", "Time taken to build a report."},
+	"iowait_report_cache_hits_total":                   {"counter", "Reports served from cache or from a collection already in progress."},
+	"iowait_collection_errors_total":                   {"counter", "Collections that failed, by collector."},
+	"iowait_command_timeouts_total":                    {"counter", "External tool runs killed for exceeding the command timeout, by command."},
+	"iowait_prometheus_query_duration_seconds":         {"histogram", "Latency of Prometheus queries."},
+	"iowait_prometheus_query_errors_total":             {"counter", "Prometheus queries that failed."},
+	"iowait_prometheus_breaker_opened_total":           {"counter", "Times the Prometheus circuit breaker opened after failed collections."},
+	"iowait_controls_total":                            {"counter", "Control invocations, by control and result."},
+	"iowait_build_info":                                {"gauge", "Always 1, labelled with the plugin version and commit."},
+	"iowait_self_check_success":                        {"gauge", "Whether the latest report fetched from the plugin socket was valid and fresh."},
+	"iowait_self_check_duration_seconds":               {"histogram", "Time taken to fetch a report from the plugin socket."},
+	"iowait_self_check_last_success_timestamp_seconds": {"gauge", "When a report fetched from the plugin socket was last valid and fresh."},
+	"iowait_otlp_errors_total":                         {"counter", "OTLP metric and span exports that failed."},
+	"iowait_otlp_spans_dropped_total":                  {"counter", "Spans dropped while the OpenTelemetry collector was unreachable."},
+	"iowait_push_errors_total":                         {"counter", "Reports that could not be pushed to the Scope app."},
+	"iowait_shortcut_reports_total":                    {"counter", "Shortcut reports pushed to the Scope app after threshold crossings."},
+	"iowait_stream_dropped_total":                      {"counter", "Collections not sent to /stream clients too slow to keep up."},
+	"iowait_statsd_errors_total":                       {"counter", "StatsD packets that could not be sent."},
+}
+
+// selfMetricBuckets are the upper bounds of histogram buckets, in seconds.
+var selfMetricBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// self records the plugin's own metrics. It is global like the collector
+// registry, so that code deep in collectors can record without plumbing.
+var self = newSelfMetrics()
+
+type selfMetricKey struct {
+	name   string
+	labels string // rendered, e.g. collector="cpu"
+}
+
+type selfHistogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+type selfMetrics struct {
+	lock       sync.Mutex
+	values     map[selfMetricKey]float64
+	histograms map[selfMetricKey]*selfHistogram
+}
+
+func newSelfMetrics() *selfMetrics {
+	m := &selfMetrics{values: map[selfMetricKey]float64{}, histograms: map[selfMetricKey]*selfHistogram{}}
+	m.set("iowait_build_info", 1, "version", version, "commit", commit)
+	m.set("iowait_prometheus_query_errors_total", 0)
+	m.set("iowait_report_cache_hits_total", 0)
+	return m
+}
+
+// renderLabels renders name, value pairs as Prometheus labels.
+func renderLabels(pairs []string) string {
+	labels := []string{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		labels = append(labels, fmt.Sprintf("%s=%q", pairs[i], pairs[i+1]))
+	}
+	return strings.Join(labels, ",")
+}
+
+func (m *selfMetrics) set(name string, v float64, labels ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.values[selfMetricKey{name, renderLabels(labels)}] = v
+}
+
+func (m *selfMetrics) inc(name string, labels ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.values[selfMetricKey{name, renderLabels(labels)}]++
+}
+
+func (m *selfMetrics) observe(name string, d time.Duration, labels ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	key := selfMetricKey{name, renderLabels(labels)}
+	h := m.histograms[key]
+	if h == nil {
+		h = &selfHistogram{counts: make([]uint64, len(selfMetricBuckets))}
+		m.histograms[key] = h
+	}
+	v := d.Seconds()
+	for i, le := range selfMetricBuckets {
+		if v <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// withLabel adds a label to rendered labels.
+func withLabel(labels, label string) string {
+	if labels == "" {
+		return label
+	}
+	return labels + "," + label
+}
+
+func seriesName(name, labels string) string {
+	if labels == "" {
+		return name
+	}
+	return name + "{" + labels + "}"
+}
+
+func (m *selfMetrics) write(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	names := []string{}
+	for name := range selfMetricDefs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		def := selfMetricDefs[name]
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, def.help, name, def.kind)
+		for _, labels := range m.series(name) {
+			key := selfMetricKey{name, labels}
+			h, ok := m.histograms[key]
+			if !ok {
+				fmt.Fprintf(w, "%s %g\n", seriesName(name, labels), m.values[key])
+				continue
+			}
+			var cumulative uint64
+			for i, le := range selfMetricBuckets {
+				cumulative += h.counts[i]
+				fmt.Fprintf(w, "%s %d\n", seriesName(name+"_bucket", withLabel(labels, fmt.Sprintf("le=%q", fmt.Sprint(le)))), cumulative)
+			}
+			fmt.Fprintf(w, "%s %d\n", seriesName(name+"_bucket", withLabel(labels, `le="+Inf"`)), h.count)
+			fmt.Fprintf(w, "%s %g\n", seriesName(name+"_sum", labels), h.sum)
+			fmt.Fprintf(w, "%s %d\n", seriesName(name+"_count", labels), h.count)
+		}
+	}
+}
+
+// series returns the sorted labels of a metric's series. The caller holds
+// m.lock.
+func (m *selfMetrics) series(name string) []string {
+	labels := []string{}
+	for key := range m.values {
+		if key.name == name {
+			labels = append(labels, key.labels)
+		}
+	}
+	for key := range m.histograms {
+		if key.name == name {
+			labels = append(labels, key.labels)
+		}
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+func (m *selfMetrics) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.write(w)
+}
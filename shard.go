@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var shardLog = componentLog("shard")
+
+// hashRingReplicas is the number of virtual nodes per member, which keeps
+// the shards balanced and limits how many keys move on membership change.
+const hashRingReplicas = 128
+
+// hashRing assigns keys to members by consistent hashing.
+type hashRing struct {
+	hashes  []uint32
+	members map[uint32]string
+}
+
+func newHashRing(members []string) *hashRing {
+	r := &hashRing{members: map[uint32]string{}}
+	for _, member := range members {
+		for i := 0; i < hashRingReplicas; i++ {
+			h := hashKey(member + "#" + strconv.Itoa(i))
+			r.hashes = append(r.hashes, h)
+			r.members[h] = member
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// owner returns the member a key belongs to, or "" if the ring is empty.
+func (r *hashRing) owner(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.members[r.hashes[i]]
+}
+
+// pvSharder splits the volumes reported by several aggregator replicas, so
+// that each replica only reports its own shard. Its members are the ready
+// endpoints of a Kubernetes service, refreshed periodically, so volumes are
+// rebalanced when replicas come and go.
+type pvSharder struct {
+	self      string
+	namespace string
+	service   string
+	kube      *kubeClient
+
+	lock    sync.Mutex
+	members []string
+	ring    *hashRing
+}
+
+// newPVSharder shards across the endpoints of a "namespace/service".
+func newPVSharder(endpoints, self string) (*pvSharder, error) {
+	parts := strings.SplitN(endpoints, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("shard: invalid endpoints %q, expected namespace/service", endpoints)
+	}
+	if self == "" {
+		return nil, fmt.Errorf("shard: unknown own address, set POD_IP or -shard-self")
+	}
+	kube, err := newInClusterKubeClient()
+	if err != nil {
+		return nil, fmt.Errorf("shard: %w", err)
+	}
+	return &pvSharder{self: self, namespace: parts[0], service: parts[1], kube: kube, ring: newHashRing(nil)}, nil
+}
+
+// owns tells whether this replica reports a volume. Until the membership is
+// known every replica reports every volume: duplicates beat gaps.
+func (s *pvSharder) owns(pv string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.members) == 0 {
+		return true
+	}
+	return s.ring.owner(pv) == s.self
+}
+
+func (s *pvSharder) refresh(ctx context.Context) error {
+	members, err := s.kube.readyAddresses(ctx, s.namespace, s.service)
+	if err != nil {
+		return fmt.Errorf("shard: %w", err)
+	}
+	sort.Strings(members)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if strings.Join(members, ",") == strings.Join(s.members, ",") {
+		return nil
+	}
+	shardLog.Infof("Shard members changed to %s", strings.Join(members, ", "))
+	s.members = members
+	s.ring = newHashRing(members)
+	return nil
+}
+
+// watch refreshes the membership every interval.
+func (s *pvSharder) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		if err := s.refresh(ctx); err != nil {
+			shardLog.Error(err)
+		}
+		cancel()
+	}
+}
+
+func (s *pvSharder) String() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return fmt.Sprintf("shard %s of %d", s.self, len(s.members))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// trackStatuses records the IO status levels of a report's nodes and tells
+// whether a node crossed a threshold, either way, since the previous
+// report. Node IDs are unique across topologies. The caller holds p.lock.
+func (p *Plugin) trackStatuses(statuses map[statusNode]thresholdLevel) bool {
+	previous := p.statusLevels
+	levels := map[string]thresholdLevel{}
+	crossed := false
+	for key, level := range statuses {
+		levels[key.nodeID] = level
+		if level != previous[key.nodeID] {
+			crossed = true
+		}
+	}
+	for nodeID, level := range previous {
+		if _, ok := levels[nodeID]; !ok && level != levelOK {
+			crossed = true
+		}
+	}
+	p.statusLevels = levels
+	return crossed
+}
+
+// queueShortcut hands a report in which a node crossed a threshold to the
+// pusher, unless a shortcut report is already waiting. The report is
+// shared with its other readers, so it is pushed as a shallow copy. The
+// caller holds p.lock.
+func (p *Plugin) queueShortcut(rpt *report) {
+	if p.shortcuts == nil {
+		return
+	}
+	shortcut := *rpt
+	shortcut.Shortcut = true
+	select {
+	case p.shortcuts <- &shortcut:
+	default:
+	}
+}
+
+// pushShortcuts pushes the reports of collections in which a node crossed
+// a threshold as soon as they are built, so that the Scope UI shows spikes
+// without waiting for the next push, as it does after controls.
+func (p *reportPusher) pushShortcuts(shortcuts <-chan *report) {
+	for rpt := range shortcuts {
+		ctx, cancel := context.WithTimeout(context.Background(), pushTimeout)
+		ctx, sp := startSpan(ctx, "shortcut")
+		err := p.pushShortcut(ctx, rpt)
+		if err != nil {
+			pushLog.Warnf("Shortcut report: %v", err)
+			sp.setError(err)
+			self.inc("iowait_push_errors_total")
+		}
+		sp.end()
+		cancel()
+	}
+}
+
+func (p *reportPusher) pushShortcut(ctx context.Context, rpt *report) error {
+	raw, err := json.Marshal(*rpt)
+	if err != nil {
+		return err
+	}
+	pushLog.Debugf("Pushing a shortcut report")
+	self.inc("iowait_shortcut_reports_total")
+	return p.post(ctx, raw)
+}
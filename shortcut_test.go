@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestTrackStatuses(t *testing.T) {
+	p := &Plugin{}
+	node := func(id string) statusNode { return statusNode{&topology{}, id} }
+	for _, tc := range []struct {
+		name     string
+		statuses map[statusNode]thresholdLevel
+		want     bool
+	}{
+		{name: "first report, all OK", statuses: map[statusNode]thresholdLevel{node("a"): levelOK}, want: false},
+		{name: "warning", statuses: map[statusNode]thresholdLevel{node("a"): levelWarning}, want: true},
+		{name: "still warning", statuses: map[statusNode]thresholdLevel{node("a"): levelWarning}, want: false},
+		{name: "critical", statuses: map[statusNode]thresholdLevel{node("a"): levelCritical}, want: true},
+		{name: "node gone", statuses: map[statusNode]thresholdLevel{}, want: true},
+		{name: "still gone", statuses: map[statusNode]thresholdLevel{}, want: false},
+	} {
+		if got := p.trackStatuses(tc.statuses); got != tc.want {
+			t.Errorf("%s: got crossed %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestQueueShortcut(t *testing.T) {
+	p := &Plugin{}
+	p.queueShortcut(&report{}) // without -push-shortcuts
+
+	p.shortcuts = make(chan *report, 1)
+	rpt := &report{}
+	p.queueShortcut(rpt)
+	p.queueShortcut(&report{}) // dropped while one is waiting
+	shortcut := <-p.shortcuts
+	if !shortcut.Shortcut || rpt.Shortcut {
+		t.Errorf("got Shortcut %v on the pushed report and %v on the built one, want true and false", shortcut.Shortcut, rpt.Shortcut)
+	}
+	if len(p.shortcuts) != 0 {
+		t.Errorf("got %d further shortcut reports, want none", len(p.shortcuts))
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	smartTableID     = "smart-table"
+	smartTablePrefix = "smart-table-"
+)
+
+func init() {
+	collectorFactories["smart"] = func(opts collectorOptions) (Collector, error) {
+		if _, err := exec.LookPath("smartctl"); err != nil {
+			return nil, fmt.Errorf("smart: %w", err)
+		}
+		s := newSMARTHealth(opts.SMARTInterval, opts.CommandTimeout)
+		go s.watch()
+		return s, nil
+	}
+}
+
+// smartDevice is the health of a drive as smartctl --json reports it.
+type smartDevice struct {
+	Device struct {
+		Name string `json:"name"`
+		Type string `json:"type"`
+	} `json:"device"`
+	ModelName   string `json:"model_name"`
+	SmartStatus *struct {
+		Passed bool `json:"passed"`
+	} `json:"smart_status"`
+	Temperature struct {
+		Current float64 `json:"current"`
+	} `json:"temperature"`
+	PowerOnTime struct {
+		Hours float64 `json:"hours"`
+	} `json:"power_on_time"`
+	ATASmartAttributes struct {
+		Table []struct {
+			ID  int `json:"id"`
+			Raw struct {
+				Value float64 `json:"value"`
+			} `json:"raw"`
+		} `json:"table"`
+	} `json:"ata_smart_attributes"`
+	NVMeLog *struct {
+		MediaErrors float64 `json:"media_errors"`
+	} `json:"nvme_smart_health_information_log"`
+}
+
+// name is the device's name without /dev/, e.g. sda.
+func (d smartDevice) name() string { return filepath.Base(d.Device.Name) }
+
+// attribute returns the raw value of an ATA SMART attribute.
+func (d smartDevice) attribute(id int) (float64, bool) {
+	for _, a := range d.ATASmartAttributes.Table {
+		if a.ID == id {
+			return a.Raw.Value, true
+		}
+	}
+	return 0, false
+}
+
+// badSectors are the reallocated, pending and uncorrectable sectors of ATA
+// drives or the media errors of NVMe ones.
+func (d smartDevice) badSectors() float64 {
+	if d.NVMeLog != nil {
+		return d.NVMeLog.MediaErrors
+	}
+	sum := 0.0
+	for _, id := range []int{5, 197, 198} {
+		if v, ok := d.attribute(id); ok {
+			sum += v
+		}
+	}
+	return sum
+}
+
+func (d smartDevice) failed() bool { return d.SmartStatus != nil && !d.SmartStatus.Passed }
+
+// smartHealth reports the SMART health of the host's drives through
+// smartctl. Reading SMART data is slow and wakes sleeping drives, so the
+// drives are only read every interval, in the background, and reports use
+// the latest results. Drives failing their self-assessment are flagged by
+// the smart_failed metric, which has a critical threshold by default.
+type smartHealth struct {
+	interval, timeout time.Duration
+
+	lock    sync.Mutex
+	devices []smartDevice
+	time    time.Time
+	err     error
+}
+
+func newSMARTHealth(interval, timeout time.Duration) *smartHealth {
+	return &smartHealth{interval: interval, timeout: timeout}
+}
+
+func (s *smartHealth) Name() string { return "smart" }
+
+func (s *smartHealth) watch() {
+	for {
+		devices, err := s.read(context.Background())
+		if err != nil {
+			collectorLog(s.Name()).Error(err)
+		}
+		s.lock.Lock()
+		s.err = err
+		if err == nil {
+			s.devices, s.time = devices, time.Now()
+		}
+		s.lock.Unlock()
+		time.Sleep(s.interval)
+	}
+}
+
+// smartctl runs smartctl and decodes its JSON output. Its exit status is a
+// bit mask that is also set for failing drives, so output is decoded
+// whatever the status.
+func (s *smartHealth) smartctl(ctx context.Context, v interface{}, args ...string) error {
+	out, err := commandOutput(ctx, s.timeout, "smartctl", append([]string{"--json"}, args...)...)
+	var exitErr *exec.ExitError
+	if err != nil && !(errors.As(err, &exitErr) && len(out) > 0) {
+		return fmt.Errorf("smart: %w", err)
+	}
+	if err := json.Unmarshal(out, v); err != nil {
+		return fmt.Errorf("smart: smartctl %s: %v", args[0], err)
+	}
+	return nil
+}
+
+// read scans for drives and reads the SMART data of every one.
+func (s *smartHealth) read(ctx context.Context) ([]smartDevice, error) {
+	scan := struct {
+		Devices []struct {
+			Name string `json:"name"`
+			Type string `json:"type"`
+		} `json:"devices"`
+	}{}
+	if err := s.smartctl(ctx, &scan, "--scan"); err != nil {
+		return nil, err
+	}
+	devices := []smartDevice{}
+	for _, dev := range scan.Devices {
+		d := smartDevice{}
+		if err := s.smartctl(ctx, &d, "--all", "--device", dev.Type, dev.Name); err != nil {
+			collectorLog(s.Name()).Debugf("Device %s: %v", dev.Name, err)
+			continue
+		}
+		devices = append(devices, d)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].name() < devices[j].name() })
+	return devices, nil
+}
+
+// smartMetrics are the statistics reported for every drive.
+var smartMetrics = []struct {
+	id, label, format string
+	value             func(smartDevice) float64
+}{
+	{"smart_failed", "SMART failed", "integer", func(d smartDevice) float64 {
+		if d.failed() {
+			return 1
+		}
+		return 0
+	}},
+	{"smart_temperature", "temperature (°C)", "", func(d smartDevice) float64 { return d.Temperature.Current }},
+	{"smart_bad_sectors", "bad sectors", "integer", func(d smartDevice) float64 { return d.badSectors() }},
+	{"smart_power_on_hours", "power-on hours", "integer", func(d smartDevice) float64 { return d.PowerOnTime.Hours }},
+}
+
+func (s *smartHealth) Collect(ctx context.Context) ([]Metric, error) {
+	s.lock.Lock()
+	devices, t, err := s.devices, s.time, s.err
+	s.lock.Unlock()
+	if t.IsZero() {
+		return nil, err
+	}
+	metrics := []Metric{}
+	for i, d := range devices {
+		for j, m := range smartMetrics {
+			if m.id == "smart_failed" && d.SmartStatus == nil {
+				continue
+			}
+			value := m.value(d)
+			metrics = append(metrics, Metric{
+				ID:       m.id + "_" + d.name(),
+				Label:    d.name() + " " + m.label,
+				Format:   m.format,
+				Priority: 19 + float64(i)/10 + float64(j)/100,
+				Value:    value,
+				Max:      value,
+				Time:     t,
+			})
+		}
+	}
+	return metrics, nil
+}
+
+func (s *smartHealth) Tables() []table {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	rows := map[string]map[string]string{}
+	for _, d := range s.devices {
+		health := "unknown"
+		if d.SmartStatus != nil {
+			health = "passed"
+			if d.failed() {
+				health = "FAILED"
+			}
+		}
+		rows[d.name()] = map[string]string{
+			"device":      d.name(),
+			"model":       d.ModelName,
+			"health":      health,
+			"temperature": strconv.FormatFloat(d.Temperature.Current, 'f', -1, 64),
+			"bad_sectors": strconv.FormatFloat(d.badSectors(), 'f', -1, 64),
+			"power_on":    strconv.FormatFloat(d.PowerOnTime.Hours, 'f', -1, 64),
+		}
+	}
+	return []table{{
+		Template: tableTemplate{
+			ID:     smartTableID,
+			Label:  "SMART health",
+			Prefix: smartTablePrefix,
+			Type:   "multicolumn-table",
+			Columns: []column{
+				{ID: "device", Label: "Device"},
+				{ID: "model", Label: "Model"},
+				{ID: "health", Label: "Health"},
+				{ID: "temperature", Label: "Temperature (°C)", DataType: "number"},
+				{ID: "bad_sectors", Label: "Bad sectors", DataType: "number"},
+				{ID: "power_on", Label: "Power-on hours", DataType: "number"},
+			},
+		},
+		Rows: rows,
+	}}
+}
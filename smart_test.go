@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSMARTDevice(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		out         string
+		device      string
+		failed      bool
+		temperature float64
+		badSectors  float64
+		hours       float64
+	}{
+		{
+			name: "healthy ATA drive",
+			out: `{"device": {"name": "/dev/sda", "type": "sat"}, "model_name": "Samsung SSD 860 EVO 500GB",
+				"smart_status": {"passed": true}, "temperature": {"current": 31}, "power_on_time": {"hours": 12345},
+				"ata_smart_attributes": {"table": [
+					{"id": 5, "name": "Reallocated_Sector_Ct", "raw": {"value": 0, "string": "0"}},
+					{"id": 9, "name": "Power_On_Hours", "raw": {"value": 12345, "string": "12345"}},
+					{"id": 194, "name": "Temperature_Celsius", "raw": {"value": 31, "string": "31"}}]}}`,
+			device:      "sda",
+			temperature: 31,
+			hours:       12345,
+		},
+		{
+			name: "failing ATA drive",
+			out: `{"device": {"name": "/dev/sdb", "type": "sat"}, "smart_status": {"passed": false},
+				"temperature": {"current": 45}, "power_on_time": {"hours": 40000},
+				"ata_smart_attributes": {"table": [
+					{"id": 5, "raw": {"value": 8}},
+					{"id": 197, "raw": {"value": 3}},
+					{"id": 198, "raw": {"value": 1}}]}}`,
+			device:      "sdb",
+			failed:      true,
+			temperature: 45,
+			badSectors:  12,
+			hours:       40000,
+		},
+		{
+			name: "NVMe drive",
+			out: `{"device": {"name": "/dev/nvme0", "type": "nvme"}, "smart_status": {"passed": true},
+				"temperature": {"current": 38}, "power_on_time": {"hours": 900},
+				"nvme_smart_health_information_log": {"critical_warning": 0, "media_errors": 2}}`,
+			device:      "nvme0",
+			temperature: 38,
+			badSectors:  2,
+			hours:       900,
+		},
+		{
+			// USB bridges often hide the self-assessment.
+			name:   "unknown health",
+			out:    `{"device": {"name": "/dev/sdc", "type": "scsi"}}`,
+			device: "sdc",
+		},
+	} {
+		d := smartDevice{}
+		if err := json.Unmarshal([]byte(tc.out), &d); err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if got := d.name(); got != tc.device {
+			t.Errorf("%s: got device %q, want %q", tc.name, got, tc.device)
+		}
+		if got := d.failed(); got != tc.failed {
+			t.Errorf("%s: got failed %v, want %v", tc.name, got, tc.failed)
+		}
+		if got := d.Temperature.Current; got != tc.temperature {
+			t.Errorf("%s: got temperature %v, want %v", tc.name, got, tc.temperature)
+		}
+		if got := d.badSectors(); got != tc.badSectors {
+			t.Errorf("%s: got %v bad sectors, want %v", tc.name, got, tc.badSectors)
+		}
+		if got := d.PowerOnTime.Hours; got != tc.hours {
+			t.Errorf("%s: got %v power-on hours, want %v", tc.name, got, tc.hours)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	snapshotControlPrefix = "snapshot_"
+	snapshotTablePrefix   = "snapshot-"
+
+	// snapshotTimeout bounds the API calls requesting a snapshot.
+	snapshotTimeout = 30 * time.Second
+)
+
+func init() {
+	collectorFactories["snapshot"] = func(opts collectorOptions) (Collector, error) {
+		kube, err := newInClusterKubeClient()
+		if err != nil {
+			return nil, err
+		}
+		return newSnapshotter(kube, opts.SnapshotPVs, opts.SnapshotClass), nil
+	}
+}
+
+// snapshotter takes snapshots of OpenEBS volumes on demand, through the CSI
+// snapshot API: it creates a VolumeSnapshot of the volume's claim, which
+// the OpenEBS CSI driver then takes. It keeps the latest snapshot of every
+// volume, whose status it follows on every collection.
+type snapshotter struct {
+	kube  *kubeClient
+	pvs   []string
+	class string
+
+	lock      sync.Mutex
+	running   map[string]bool
+	snapshots map[string]volumeSnapshot
+}
+
+// volumeSnapshot is the latest snapshot requested of a volume.
+type volumeSnapshot struct {
+	Name      string
+	Namespace string
+	Requested time.Time
+	Ready     bool
+	Err       error
+}
+
+// status renders the state of the snapshot.
+func (s volumeSnapshot) status() string {
+	switch {
+	case s.Err != nil:
+		return "failed: " + s.Err.Error()
+	case s.Ready:
+		return "ready"
+	}
+	return "pending"
+}
+
+// volumeSnapshotObject is the part of a snapshot.storage.k8s.io/v1
+// VolumeSnapshot the plugin uses.
+type volumeSnapshotObject struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name      string `json:"name"`
+		Namespace string `json:"namespace"`
+	} `json:"metadata"`
+	Spec struct {
+		VolumeSnapshotClassName string `json:"volumeSnapshotClassName,omitempty"`
+		Source                  struct {
+			PersistentVolumeClaimName string `json:"persistentVolumeClaimName"`
+		} `json:"source"`
+	} `json:"spec"`
+	Status *struct {
+		ReadyToUse *bool `json:"readyToUse"`
+		Error      *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	} `json:"status,omitempty"`
+}
+
+func volumeSnapshotsPath(namespace string) string {
+	return "/apis/snapshot.storage.k8s.io/v1/namespaces/" + namespace + "/volumesnapshots"
+}
+
+func newSnapshotter(kube *kubeClient, pvs []string, class string) *snapshotter {
+	return &snapshotter{
+		kube:      kube,
+		pvs:       pvs,
+		class:     class,
+		running:   map[string]bool{},
+		snapshots: map[string]volumeSnapshot{},
+	}
+}
+
+func (s *snapshotter) pvForControl(controlID string) (string, bool) {
+	for _, pv := range s.pvs {
+		if snapshotControlPrefix+pv == controlID {
+			return pv, true
+		}
+	}
+	return "", false
+}
+
+func (s *snapshotter) controlDetails() []controlDetails {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	details := []controlDetails{}
+	for _, pv := range s.pvs {
+		details = append(details, controlDetails{
+			id:    snapshotControlPrefix + pv,
+			human: "Snapshot " + pv,
+			icon:  "fa-camera",
+			dead:  s.running[pv],
+		})
+	}
+	return details
+}
+
+// start requests a snapshot of a volume in the background.
+func (s *snapshotter) start(pv string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.running[pv] {
+		return fmt.Errorf("snapshot: a snapshot of %s is already being requested", pv)
+	}
+	s.running[pv] = true
+	go func() {
+		snap := s.request(pv)
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.running[pv] = false
+		s.snapshots[pv] = snap
+	}()
+	return nil
+}
+
+// request creates a VolumeSnapshot of the claim of a volume.
+func (s *snapshotter) request(pv string) volumeSnapshot {
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotTimeout)
+	defer cancel()
+	snap := volumeSnapshot{Requested: time.Now()}
+	vol, err := s.kube.persistentVolume(ctx, pv)
+	if err != nil {
+		snap.Err = err
+		return snap
+	}
+	if vol.Claim == "" {
+		snap.Err = fmt.Errorf("snapshot: %s is not bound to a claim", pv)
+		return snap
+	}
+	obj := volumeSnapshotObject{APIVersion: "snapshot.storage.k8s.io/v1", Kind: "VolumeSnapshot"}
+	obj.Metadata.Name = fmt.Sprintf("%s-%s", vol.Claim, snap.Requested.UTC().Format("20060102-150405"))
+	obj.Spec.VolumeSnapshotClassName = s.class
+	obj.Spec.Source.PersistentVolumeClaimName = vol.Claim
+	created := volumeSnapshotObject{}
+	if err := s.kube.create(ctx, volumeSnapshotsPath(vol.Namespace), obj, &created); err != nil {
+		snap.Err = err
+		return snap
+	}
+	snap.Name, snap.Namespace = created.Metadata.Name, vol.Namespace
+	log.WithField("pv", pv).Infof("Requested snapshot %s/%s", snap.Namespace, snap.Name)
+	return snap
+}
+
+func (s *snapshotter) Name() string { return "snapshot" }
+
+// Collect follows the status of the snapshots not ready yet. Snapshots are
+// requested by controls and shown as tables.
+func (s *snapshotter) Collect(ctx context.Context) ([]Metric, error) {
+	s.lock.Lock()
+	pending := map[string]volumeSnapshot{}
+	for pv, snap := range s.snapshots {
+		if !snap.Ready && snap.Err == nil {
+			pending[pv] = snap
+		}
+	}
+	s.lock.Unlock()
+	for pv, snap := range pending {
+		obj := volumeSnapshotObject{}
+		if err := s.kube.get(ctx, volumeSnapshotsPath(snap.Namespace)+"/"+snap.Name, &obj); err != nil {
+			return nil, fmt.Errorf("snapshot: %v", err)
+		}
+		if obj.Status != nil {
+			snap.Ready = obj.Status.ReadyToUse != nil && *obj.Status.ReadyToUse
+			if obj.Status.Error != nil && obj.Status.Error.Message != "" {
+				snap.Err = fmt.Errorf("%s", obj.Status.Error.Message)
+			}
+		}
+		s.lock.Lock()
+		// A newer snapshot may have been requested meanwhile.
+		if s.snapshots[pv].Name == snap.Name {
+			s.snapshots[pv] = snap
+		}
+		s.lock.Unlock()
+	}
+	return nil, nil
+}
+
+// Tables returns a property list per snapshotted volume.
+func (s *snapshotter) Tables() []table {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	pvs := make([]string, 0, len(s.snapshots))
+	for pv := range s.snapshots {
+		pvs = append(pvs, pv)
+	}
+	sort.Strings(pvs)
+	tables := []table{}
+	for _, pv := range pvs {
+		snap := s.snapshots[pv]
+		id := snapshotTablePrefix + pv
+		rows := map[string]string{
+			"Requested": snap.Requested.Format(time.RFC3339),
+			"Status":    snap.status(),
+		}
+		if snap.Name != "" {
+			rows["Snapshot"] = snap.Namespace + "/" + snap.Name
+		}
+		tables = append(tables, table{
+			Template: tableTemplate{
+				ID:     id,
+				Label:  "Snapshot of " + pv,
+				Prefix: id + "-",
+				Type:   "property-list",
+			},
+			Properties: rows,
+		})
+	}
+	return tables
+}
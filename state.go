@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// pluginState is the runtime state users change through Scope controls,
+// together with the history the graphs are drawn from. It is what a
+// standby instance needs so that taking over doesn't reset what users see.
+type pluginState struct {
+	IOWaitMode bool
+	Paused     bool
+	CPUField   string
+	CPUHistory map[string][]sample
+
+	// PollInterval is the collection interval set by controls, nil in
+	// states saved before it was kept.
+	PollInterval *time.Duration
+
+	// Boot identifies the kernel instance the state was saved on.
+	Boot bootIdentity
+
+	// Baselines are the hourly baselines of metrics with thresholds.
+	Baselines baselines
+	// ThresholdScales are the adjustments of thresholds by controls.
+	ThresholdScales map[string]float64
+}
+
+// snapshotState copies the plugin state. The caller holds p.lock.
+func (p *Plugin) snapshotState() pluginState {
+	history := map[string][]sample{}
+	for id, samples := range p.cpuHistory {
+		history[id] = append([]sample{}, samples...)
+	}
+	scales := map[string]float64{}
+	for key, scale := range p.thresholdScales {
+		scales[key] = scale
+	}
+	interval := p.pollInterval
+	return pluginState{
+		IOWaitMode:   p.iowaitMode,
+		Paused:       !p.pausedSince.IsZero(),
+		CPUField:     cpuFields[p.cpuField].id,
+		CPUHistory:   history,
+		PollInterval: &interval,
+		Boot:         p.boot,
+		Baselines:    p.baselines.copy(),
+
+		ThresholdScales: scales,
+	}
+}
+
+// restoreState applies a state snapshot. The caller holds p.lock.
+func (p *Plugin) restoreState(s pluginState) {
+	p.iowaitMode = s.IOWaitMode
+	p.setPaused(s.Paused)
+	if isCPUMetric(s.CPUField) {
+		p.cpuField = cpuFieldIndex(s.CPUField)
+	}
+	if s.CPUHistory != nil {
+		p.cpuHistory = s.CPUHistory
+	}
+	if s.PollInterval != nil {
+		p.setPollInterval(*s.PollInterval)
+	}
+	if s.Baselines != nil {
+		p.baselines = s.Baselines
+	}
+	if s.ThresholdScales != nil {
+		p.thresholdScales = s.ThresholdScales
+	}
+	p.noteBoot(s.Boot)
+}
+
+// A stateCodec serializes the plugin state. Codecs double as gRPC codecs.
+type stateCodec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var stateCodecs = map[string]stateCodec{
+	"json": jsonCodec{},
+	"gob":  gobCodec{},
+}
+
+func newStateCodec(name string) (stateCodec, error) {
+	codec, ok := stateCodecs[name]
+	if !ok {
+		names := []string{}
+		for name := range stateCodecs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown state codec %q (known: %s)", name, strings.Join(names, ", "))
+	}
+	return codec, nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string                               { return "json" }
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string { return "gob" }
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	buf := bytes.Buffer{}
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// stateExportVersion is the version of the stateExport format.
+const stateExportVersion = 1
+
+// stateExport is the whole runtime state of the plugin: the runtime
+// config, i.e. the reloadable flags in effect, and the plugin state
+// (control states, CPU history and baselines). It lets the state move to
+// another node, e.g. when nodes are replaced or the DaemonSet is recreated
+// under another name.
+type stateExport struct {
+	Version  int           `json:"version"`
+	Host     string        `json:"host"`
+	Exported time.Time     `json:"exported"`
+	Config   runtimeConfig `json:"config"`
+	State    pluginState   `json:"state"`
+}
+
+// exportState snapshots the runtime state. The caller holds p.lock.
+func (p *Plugin) exportState() stateExport {
+	config := runtimeConfig{}
+	for name, vs := range p.config {
+		config[name] = append([]string{}, vs...)
+	}
+	return stateExport{
+		Version:  stateExportVersion,
+		Host:     p.HostID,
+		Exported: time.Now(),
+		Config:   config,
+		State:    p.snapshotState(),
+	}
+}
+
+// importState applies an exported state. The boot identity of the
+// exporting node is ignored, so that an import is not taken for a reboot.
+func (p *Plugin) importState(e stateExport) error {
+	if e.Version != stateExportVersion {
+		return fmt.Errorf("state import: unsupported version %d, expected %d", e.Version, stateExportVersion)
+	}
+	if err := p.applyConfig(e.Config); err != nil {
+		return fmt.Errorf("state import: %v", err)
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	e.State.Boot = p.boot
+	p.restoreState(e.State)
+	p.saveState()
+	stateLog.Infof("Imported the state exported by %s at %s", e.Host, e.Exported.Format(time.RFC3339))
+	return nil
+}
+
+func (p *Plugin) serveStateExport(w http.ResponseWriter, r *http.Request) {
+	p.lock.Lock()
+	e := p.exportState()
+	p.lock.Unlock()
+	writeJSON(w, e)
+}
+
+func (p *Plugin) serveStateImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST an exported state to import it", http.StatusMethodNotAllowed)
+		return
+	}
+	e := stateExport{}
+	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := p.importState(e); err != nil {
+		stateLog.Error(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var stateLog = componentLog("state")
+
+// A stateStore persists the plugin state across restarts, so a restart
+// doesn't silently revert the choices users made through Scope controls.
+type stateStore interface {
+	// load returns the saved state, and false if there is none.
+	load() (pluginState, bool, error)
+	save(s pluginState) error
+}
+
+// fileStateStore keeps the state in a local file.
+type fileStateStore struct {
+	path  string
+	codec stateCodec
+}
+
+func (f *fileStateStore) load() (pluginState, bool, error) {
+	s := pluginState{}
+	raw, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return s, false, nil
+	}
+	if err != nil {
+		return s, false, fmt.Errorf("state: %w", err)
+	}
+	if err := f.codec.Unmarshal(raw, &s); err != nil {
+		return s, false, fmt.Errorf("state: %s: %v", f.path, err)
+	}
+	return s, true, nil
+}
+
+// save replaces the file atomically, so a crash never leaves half a state.
+func (f *fileStateStore) save(s pluginState) error {
+	raw, err := f.codec.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("state: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(f.path), 0700); err != nil {
+		return fmt.Errorf("state: %w", err)
+	}
+	tmp := f.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, raw, 0600); err != nil {
+		return fmt.Errorf("state: %w", err)
+	}
+	if err := os.Rename(tmp, f.path); err != nil {
+		return fmt.Errorf("state: %w", err)
+	}
+	return nil
+}
+
+// configMapStateStore keeps the state of every host under its own key of
+// a Kubernetes ConfigMap, which must exist.
+type configMapStateStore struct {
+	kube      *kubeClient
+	namespace string
+	name      string
+	key       string
+}
+
+func newConfigMapStateStore(configMap, host string) (*configMapStateStore, error) {
+	parts := strings.SplitN(configMap, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("state: invalid ConfigMap %q, expected namespace/name", configMap)
+	}
+	kube, err := newInClusterKubeClient()
+	if err != nil {
+		return nil, fmt.Errorf("state: %w", err)
+	}
+	return &configMapStateStore{kube: kube, namespace: parts[0], name: parts[1], key: host}, nil
+}
+
+func (c *configMapStateStore) path() string {
+	return "/api/v1/namespaces/" + c.namespace + "/configmaps/" + c.name
+}
+
+func (c *configMapStateStore) load() (pluginState, bool, error) {
+	s := pluginState{}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cm := struct {
+		Data map[string]string `json:"data"`
+	}{}
+	if err := c.kube.get(ctx, c.path(), &cm); err != nil {
+		return s, false, fmt.Errorf("state: %w", err)
+	}
+	raw, ok := cm.Data[c.key]
+	if !ok {
+		return s, false, nil
+	}
+	// ConfigMap data must be text: always JSON.
+	if err := (jsonCodec{}).Unmarshal([]byte(raw), &s); err != nil {
+		return s, false, fmt.Errorf("state: ConfigMap %s/%s key %s: %v", c.namespace, c.name, c.key, err)
+	}
+	return s, true, nil
+}
+
+func (c *configMapStateStore) save(s pluginState) error {
+	raw, err := (jsonCodec{}).Marshal(s)
+	if err != nil {
+		return fmt.Errorf("state: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	patch := map[string]map[string]string{"data": {c.key: string(raw)}}
+	if err := c.kube.mergePatch(ctx, c.path(), patch); err != nil {
+		return fmt.Errorf("state: %w", err)
+	}
+	return nil
+}
+
+// saveState persists the plugin state, if a store is configured. The
+// caller holds p.lock.
+func (p *Plugin) saveState() {
+	if p.store == nil {
+		return
+	}
+	if err := p.store.save(p.snapshotState()); err != nil {
+		stateLog.Error(err)
+	}
+}
+
+// saveStateEvery also saves the state periodically, so what is learnt
+// over time, such as baselines, survives crashes.
+func (p *Plugin) saveStateEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		p.lock.Lock()
+		p.saveState()
+		p.lock.Unlock()
+	}
+}
+
+// loadState restores the persisted plugin state, if any.
+func (p *Plugin) loadState() {
+	if p.store == nil {
+		return
+	}
+	s, ok, err := p.store.load()
+	if err != nil {
+		stateLog.Error(err)
+		return
+	}
+	if !ok {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.restoreState(s)
+	stateLog.Infof("Restored the saved plugin state")
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// statsdMaxPacket keeps StatsD packets within the payload of a single
+// Ethernet frame.
+const statsdMaxPacket = 1432
+
+var statsdLog = componentLog("statsd")
+
+// statsdExporter sends every collected metric to a StatsD server as a
+// gauge, alongside the Scope report, so the per-host and per-volume
+// collection can feed Datadog or Telegraf pipelines. Metrics are named
+// <prefix><metric ID>. With DogStatsD tags, volume metrics are named after
+// their query and tagged with the volume, and every metric is tagged with
+// the node it belongs to, e.g. write_iops|g|#pv:pvc-1,host:node-1.
+type statsdExporter struct {
+	conn      net.Conn
+	prefix    string
+	dogstatsd bool
+	hostID    string
+}
+
+func newStatsdExporter(addr, prefix string, dogstatsd bool, hostID string) (*statsdExporter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("statsd: %v", err)
+	}
+	return &statsdExporter{conn: conn, prefix: prefix, dogstatsd: dogstatsd, hostID: hostID}, nil
+}
+
+// line returns the StatsD line of a metric.
+func (s *statsdExporter) line(m Metric) string {
+	name := m.ID
+	tags := []string{}
+	if s.dogstatsd {
+		if query, pv, ok := splitVolumeMetric(m.ID); ok {
+			name = query
+			tags = append(tags, "pv:"+pv)
+		}
+		topology, id := m.Topology, s.hostID
+		if topology == "" {
+			topology = hostTopologyID
+		}
+		if m.NodeID != "" {
+			id = strings.SplitN(m.NodeID, ";", 2)[0]
+		}
+		tags = append(tags, topology+":"+statsdSanitize(id))
+	}
+	line := statsdSanitize(s.prefix+name) + ":" + strconv.FormatFloat(m.Value, 'f', -1, 64) + "|g"
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line
+}
+
+// send sends the metrics, as many lines to a packet as fit. StatsD is
+// fire and forget, so undelivered packets are only logged.
+func (s *statsdExporter) send(metrics []Metric) {
+	var packet bytes.Buffer
+	flush := func() {
+		if packet.Len() == 0 {
+			return
+		}
+		if _, err := s.conn.Write(packet.Bytes()); err != nil {
+			statsdLog.Debugf("%v", err)
+			self.inc("iowait_statsd_errors_total")
+		}
+		packet.Reset()
+	}
+	for _, m := range metrics {
+		line := s.line(m)
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdMaxPacket {
+			flush()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	flush()
+}
+
+// statsdSanitize replaces the characters StatsD separates fields and tags
+// with.
+func statsdSanitize(s string) string {
+	return strings.NewReplacer(":", "_", "|", "_", "@", "_", ",", "_", "#", "_", "\n", "_").Replace(s)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sysBlockPath = "/sys/block"
+	mountsPath   = "/proc/self/mounts"
+
+	// storageInventoryMaxAge is how long the storage inventory is reused
+	// before block devices and mounts are read again.
+	storageInventoryMaxAge = 5 * time.Minute
+
+	kernelKey       = "iowait_kernel"
+	blockDevicesKey = "iowait_block_devices"
+	filesystemsKey  = "iowait_filesystems"
+	collectorsKey   = "iowait_collectors"
+)
+
+// storageInventory describes the host's storage, static context for the
+// metrics in the Scope details panel. Its fields are empty where they can't
+// be read, e.g. outside Linux.
+type storageInventory struct {
+	// BlockDevices are the block devices and their sizes, e.g.
+	// "nvme0n1 477GiB".
+	BlockDevices []string
+	// Filesystems are the types of the filesystems mounted from block
+	// devices.
+	Filesystems []string
+
+	read time.Time
+}
+
+// readStorageInventory lists the block devices of sysfs, but those
+// excluded, and the filesystems of the mounts.
+func readStorageInventory(sysBlock, mounts string, exclude *regexp.Regexp) storageInventory {
+	return storageInventory{
+		BlockDevices: blockDevices(sysBlock, exclude),
+		Filesystems:  mountedFilesystems(mounts),
+		read:         time.Now(),
+	}
+}
+
+func blockDevices(dir string, exclude *regexp.Regexp) []string {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	devices := []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if exclude != nil && exclude.MatchString(name) {
+			continue
+		}
+		// The size is in 512 byte sectors, whatever the device's.
+		sectors, err := strconv.ParseUint(readSysfs(filepath.Join(dir, name, "size")), 10, 64)
+		if err != nil || sectors == 0 {
+			continue
+		}
+		devices = append(devices, name+" "+formatSize(sectors*512))
+	}
+	sort.Strings(devices)
+	return devices
+}
+
+// mountedFilesystems returns the sorted, distinct types of the filesystems
+// mounted from block devices, leaving out pseudo filesystems.
+func mountedFilesystems(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	seen := map[string]bool{}
+	types := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || !strings.HasPrefix(fields[0], "/dev/") || seen[fields[2]] {
+			continue
+		}
+		seen[fields[2]] = true
+		types = append(types, fields[2])
+	}
+	sort.Strings(types)
+	return types
+}
+
+// formatSize renders a byte count in the largest binary unit it has at
+// least one of, e.g. 477GiB.
+func formatSize(bytes uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+	size, i := float64(bytes), 0
+	for size >= 1024 && i < len(units)-1 {
+		size /= 1024
+		i++
+	}
+	if i == 0 || size >= 10 {
+		return fmt.Sprintf("%.0f%s", size, units[i])
+	}
+	return fmt.Sprintf("%.1f%s", size, units[i])
+}
+
+// addStorageInventory shows the kernel, block devices, filesystems and
+// collectors of the host on its node. The caller holds p.lock.
+func (p *Plugin) addStorageInventory(rpt *report) {
+	if time.Since(p.storage.read) > storageInventoryMaxAge {
+		p.storage = readStorageInventory(sysBlockPath, mountsPath, p.diskExclude)
+	}
+	collectors := []string{}
+	for _, c := range p.collectors {
+		collectors = append(collectors, collectorSummary(c))
+	}
+	entries := []struct {
+		key, label string
+		value      string
+	}{
+		{kernelKey, "Kernel", p.boot.Kernel},
+		{blockDevicesKey, "Block devices", strings.Join(p.storage.BlockDevices, ", ")},
+		{filesystemsKey, "Filesystems", strings.Join(p.storage.Filesystems, ", ")},
+		{collectorsKey, "Collectors", strings.Join(collectors, ", ")},
+	}
+	hostNodeID := p.getTopologyHost()
+	n := rpt.Host.Nodes[hostNodeID]
+	if n.Latest == nil {
+		n.Latest = map[string]stringEntry{}
+	}
+	if rpt.Host.MetadataTemplates == nil {
+		rpt.Host.MetadataTemplates = map[string]metadataTemplate{}
+	}
+	for i, entry := range entries {
+		if entry.value == "" {
+			continue
+		}
+		n.Latest[entry.key] = stringEntry{Timestamp: p.storage.read, Value: entry.value}
+		rpt.Host.MetadataTemplates[entry.key] = metadataTemplate{
+			ID:       entry.key,
+			Label:    entry.label,
+			Priority: 32 + float64(i),
+			From:     "latest",
+		}
+	}
+	rpt.Host.Nodes[hostNodeID] = n
+}
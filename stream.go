@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// streamBuffer is how many collections a slow /stream client may fall
+// behind before further ones are dropped for it.
+const streamBuffer = 16
+
+// A streamSample is a sample of a metric sent over /stream.
+type streamSample struct {
+	ID       string    `json:"id"`
+	Label    string    `json:"label,omitempty"`
+	Format   string    `json:"format,omitempty"`
+	Topology string    `json:"topology"`
+	NodeID   string    `json:"nodeID"`
+	Date     time.Time `json:"date"`
+	Value    float64   `json:"value"`
+}
+
+// A streamMessage holds the samples of a collection.
+type streamMessage struct {
+	Collected time.Time      `json:"collected"`
+	Samples   []streamSample `json:"samples"`
+}
+
+// sampleStream fans the samples of every collection out to the clients of
+// the /stream WebSocket endpoint, so custom dashboards can render near
+// real-time graphs without polling /report.
+type sampleStream struct {
+	hostNodeID string
+
+	lock        sync.Mutex
+	subscribers map[chan streamMessage]bool
+}
+
+func newSampleStream(hostNodeID string) *sampleStream {
+	return &sampleStream{hostNodeID: hostNodeID, subscribers: map[chan streamMessage]bool{}}
+}
+
+// publish sends the metrics of a collection to every client.
+func (s *sampleStream) publish(metrics []Metric) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.subscribers) == 0 {
+		return
+	}
+	msg := streamMessage{Collected: time.Now(), Samples: make([]streamSample, 0, len(metrics))}
+	for _, m := range metrics {
+		topology, nodeID := m.Topology, m.NodeID
+		if topology == "" {
+			topology = hostTopologyID
+		}
+		if nodeID == "" {
+			nodeID = s.hostNodeID
+		}
+		msg.Samples = append(msg.Samples, streamSample{
+			ID:       m.ID,
+			Label:    m.Label,
+			Format:   m.Format,
+			Topology: topology,
+			NodeID:   nodeID,
+			Date:     m.Time,
+			Value:    m.Value,
+		})
+	}
+	for ch := range s.subscribers {
+		select {
+		case ch <- msg:
+		default:
+			self.inc("iowait_stream_dropped_total")
+		}
+	}
+}
+
+func (s *sampleStream) subscribe() chan streamMessage {
+	ch := make(chan streamMessage, streamBuffer)
+	s.lock.Lock()
+	s.subscribers[ch] = true
+	s.lock.Unlock()
+	return ch
+}
+
+func (s *sampleStream) unsubscribe(ch chan streamMessage) {
+	s.lock.Lock()
+	delete(s.subscribers, ch)
+	s.lock.Unlock()
+}
+
+// serve streams the samples of every collection to a WebSocket client, as
+// a JSON streamMessage per collection, keeping those visible passes and,
+// with the metric query parameter, those of that metric or metric prefix,
+// e.g. write_iops for the write_iops_<pv> of every volume.
+func (s *sampleStream) serve(w http.ResponseWriter, r *http.Request, visible func(id string) bool) {
+	conn, err := upgradeWebSocket(w, r)
+	if err != nil {
+		publicLog.Debugf("/stream: %v", err)
+		return
+	}
+	defer conn.close()
+	metric := r.URL.Query().Get("metric")
+	ch := s.subscribe()
+	defer s.unsubscribe(ch)
+	for {
+		select {
+		case <-conn.done:
+			return
+		case msg := <-ch:
+			kept := msg.Samples[:0:0]
+			for _, smp := range msg.Samples {
+				if visible(smp.ID) && (metric == "" || hasMetricKey(smp.ID, metric)) {
+					kept = append(kept, smp)
+				}
+			}
+			msg.Samples = kept
+			raw, err := json.Marshal(msg)
+			if err != nil {
+				publicLog.Error(err)
+				return
+			}
+			if err := conn.writeText(raw); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// serveStream streams every sample on the plugin socket.
+func (p *Plugin) serveStream(w http.ResponseWriter, r *http.Request) {
+	p.stream.serve(w, r, func(string) bool { return true })
+}
+
+// hasMetricKey tells whether key is one of the keys of a metric, see
+// metricKeys.
+func hasMetricKey(id, key string) bool {
+	for _, k := range metricKeys(id) {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	summaryIDPrefix = "summary_"
+
+	// sparklineWidth is how many buckets of the window a sparkline shows.
+	sparklineWidth = 10
+)
+
+var sparklineBars = []rune("▁▂▃▄▅▆▇█")
+
+// metricSummaries keeps the samples of every metric, per node, over a
+// trailing window.
+type metricSummaries struct {
+	window time.Duration
+
+	lock    sync.Mutex
+	samples map[string][]sample // node ID + metric ID → samples
+}
+
+// summaryHook also reports every metric as a metadata row holding a
+// textual sparkline and its current, average and maximum values over
+// cfg.SummaryWindow. Some older probes drop plugin metrics entirely but
+// still show metadata.
+func summaryHook(cfg hookConfig) reportHook {
+	s := &metricSummaries{window: cfg.SummaryWindow, samples: map[string][]sample{}}
+	return s.apply
+}
+
+func (s *metricSummaries) apply(rpt *report) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	seen := map[string]bool{}
+	for _, t := range rpt.topologies() {
+		for nodeID, n := range t.Nodes {
+			for id, m := range n.Metrics {
+				key := nodeID + "\x00" + id
+				seen[key] = true
+				samples := s.record(key, m.Samples, now)
+				if len(samples) == 0 {
+					continue
+				}
+				tmpl := t.MetricTemplates[id]
+				if n.Latest == nil {
+					n.Latest = map[string]stringEntry{}
+				}
+				n.Latest[summaryIDPrefix+id] = stringEntry{Timestamp: now, Value: summarize(samples, tmpl.Format, s.window, now)}
+				if t.MetadataTemplates == nil {
+					t.MetadataTemplates = map[string]metadataTemplate{}
+				}
+				label := tmpl.Label
+				if label == "" {
+					label = id
+				}
+				t.MetadataTemplates[summaryIDPrefix+id] = metadataTemplate{
+					ID:       summaryIDPrefix + id,
+					Label:    label,
+					Priority: 20 + tmpl.Priority,
+					From:     "latest",
+				}
+			}
+			t.Nodes[nodeID] = n
+		}
+	}
+	// Forget the metrics of nodes that went away.
+	for key := range s.samples {
+		if !seen[key] {
+			delete(s.samples, key)
+		}
+	}
+}
+
+// record adds the new samples of a metric and drops those older than the
+// window, except the latest one: collectors throttled in edge mode may
+// collect less often than the window.
+func (s *metricSummaries) record(key string, samples []sample, now time.Time) []sample {
+	kept := s.samples[key]
+	for _, smp := range samples {
+		if len(kept) == 0 || smp.Date.After(kept[len(kept)-1].Date) {
+			kept = append(kept, smp)
+		}
+	}
+	start := now.Add(-s.window)
+	i := 0
+	for i < len(kept)-1 && kept[i].Date.Before(start) {
+		i++
+	}
+	kept = append([]sample(nil), kept[i:]...)
+	s.samples[key] = kept
+	return kept
+}
+
+// summarize renders samples as e.g. "▁▃█▅ 12.50 (avg 8.20, max 20.00, 5m0s)".
+func summarize(samples []sample, format string, window time.Duration, now time.Time) string {
+	sum, max := 0.0, math.Inf(-1)
+	for _, smp := range samples {
+		sum += smp.Value
+		max = math.Max(max, smp.Value)
+	}
+	unit := ""
+	if format == "percent" {
+		unit = "%"
+	}
+	value := func(v float64) string { return formatNumber(v) + unit }
+	return sparkline(samples, window, now) + " " + value(samples[len(samples)-1].Value) +
+		" (avg " + value(sum/float64(len(samples))) + ", max " + value(max) + ", " + window.String() + ")"
+}
+
+// sparkline averages the samples into sparklineWidth buckets of the window
+// and draws every non-empty bucket as a bar.
+func sparkline(samples []sample, window time.Duration, now time.Time) string {
+	width := window / sparklineWidth
+	if width <= 0 {
+		width = 1
+	}
+	start := now.Add(-window)
+	sums, counts := make([]float64, sparklineWidth), make([]int, sparklineWidth)
+	for _, smp := range samples {
+		i := int(smp.Date.Sub(start) / width)
+		if i < 0 {
+			i = 0
+		}
+		if i >= sparklineWidth {
+			i = sparklineWidth - 1
+		}
+		sums[i] += smp.Value
+		counts[i]++
+	}
+	values := []float64{}
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for i := range sums {
+		if counts[i] == 0 {
+			continue
+		}
+		v := sums[i] / float64(counts[i])
+		values = append(values, v)
+		lo, hi = math.Min(lo, v), math.Max(hi, v)
+	}
+	var b strings.Builder
+	for _, v := range values {
+		level := 0
+		if hi > lo {
+			level = int((v - lo) / (hi - lo) * float64(len(sparklineBars)-1))
+		}
+		b.WriteRune(sparklineBars[level])
+	}
+	return b.String()
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// volumeNamespacesMaxAge is how long the namespaces of volumes are cached
+// for tenant filtering.
+const volumeNamespacesMaxAge = time.Minute
+
+// A tenantScope says which namespaces' volumes a read-only API token
+// shows; all shows everything, host metrics included.
+type tenantScope struct {
+	all        bool
+	namespaces map[string]bool
+}
+
+// readTenantTokens reads a file of token=namespace,namespace lines, "*"
+// granting every namespace. Tokens therefore can't contain "=".
+func readTenantTokens(path string) (map[string]tenantScope, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("tenants: %w", err)
+	}
+	defer f.Close()
+	tokens := map[string]tenantScope{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		token := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || token == "" {
+			return nil, fmt.Errorf("tenants: %s:%d: expected token=namespace,namespace", path, n)
+		}
+		scope := tenantScope{namespaces: map[string]bool{}}
+		for _, ns := range splitList(parts[1]) {
+			if ns == "*" {
+				scope.all = true
+			}
+			scope.namespaces[ns] = true
+		}
+		if len(scope.namespaces) == 0 {
+			return nil, fmt.Errorf("tenants: %s:%d: no namespaces for token", path, n)
+		}
+		tokens[token] = scope
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("tenants: %w", err)
+	}
+	return tokens, nil
+}
+
+// tenantFilter restricts the read-only API to the volumes of the
+// namespaces of the request's token, so that application teams can be
+// handed a URL only showing their own volumes.
+type tenantFilter struct {
+	tokens map[string]tenantScope
+	kube   *kubeClient
+
+	lock    sync.Mutex
+	fetched time.Time
+	volumes map[string]persistentVolume
+}
+
+func newTenantFilter(path string) (*tenantFilter, error) {
+	tokens, err := readTenantTokens(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &tenantFilter{tokens: tokens}
+	for _, scope := range tokens {
+		if scope.all {
+			continue
+		}
+		// Only namespace scoped tokens need to know where volumes belong.
+		if f.kube, err = newInClusterKubeClient(); err != nil {
+			return nil, fmt.Errorf("tenants: %w", err)
+		}
+		break
+	}
+	return f, nil
+}
+
+// scope returns the scope of the request's token, given as a bearer token
+// or a token query parameter, and false if it has none or an unknown one.
+func (f *tenantFilter) scope(r *http.Request) (tenantScope, bool) {
+	token := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return f.tokenScope(token)
+}
+
+// tokenScope returns the scope of a token, and false if it is empty or
+// unknown.
+func (f *tenantFilter) tokenScope(token string) (tenantScope, bool) {
+	if token == "" {
+		return tenantScope{}, false
+	}
+	// Tokens are compared in constant time, not to leak how much of one a
+	// guess got right.
+	for known, scope := range f.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(known)) == 1 {
+			return scope, true
+		}
+	}
+	return tenantScope{}, false
+}
+
+// authorize rejects requests without a known token, and passes the others
+// on with their scope.
+func (f *tenantFilter) authorize(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scope, ok := f.scope(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="iowait"`)
+			http.Error(w, "missing or unknown token", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantScopeKey{}, scope)))
+	})
+}
+
+type tenantScopeKey struct{}
+
+// requestScope returns the scope authorize attached to a request; requests
+// not going through it, i.e. without tokens configured, see everything.
+func requestScope(r *http.Request) tenantScope {
+	if scope, ok := r.Context().Value(tenantScopeKey{}).(tenantScope); ok {
+		return scope
+	}
+	return tenantScope{all: true}
+}
+
+// namespaceVolumes returns the volumes of the scope's namespaces. Should
+// the PersistentVolumes be unknown, it returns none rather than leaking
+// other tenants' volumes.
+func (f *tenantFilter) namespaceVolumes(ctx context.Context, scope tenantScope) map[string]bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if time.Since(f.fetched) > volumeNamespacesMaxAge {
+		volumes, err := f.kube.persistentVolumes(ctx)
+		if err != nil {
+			publicLog.Errorf("tenants: %v", err)
+			return map[string]bool{}
+		}
+		f.volumes, f.fetched = volumes, time.Now()
+	}
+	allowed := map[string]bool{}
+	for name, pv := range f.volumes {
+		if scope.namespaces[pv.Namespace] {
+			allowed[name] = true
+		}
+	}
+	return allowed
+}
+
+// tenantView is what a scoped token is allowed to see.
+type tenantView struct {
+	volumes    map[string]bool
+	namespaces map[string]bool
+}
+
+// metric tells whether a metric ID is that of an allowed volume: volume
+// metrics are named <query>_<volume>.
+func (v tenantView) metric(id string) bool {
+	_, pv, ok := splitVolumeMetric(id)
+	return ok && v.volumes[pv]
+}
+
+// row tells whether a table row is about an allowed volume or namespace,
+// including the namespace/<ns> groups of latency rollups.
+func (v tenantView) row(rowID string) bool {
+	return v.volumes[rowID] || v.namespaces[rowID] || v.namespaces[strings.TrimPrefix(rowID, "namespace/")]
+}
+
+// view returns the view of a request, and false if it sees everything.
+func (f *tenantFilter) view(r *http.Request) (tenantView, bool) {
+	return f.scopeView(r.Context(), requestScope(r))
+}
+
+// scopeView returns the view of a scope, and false if it sees everything.
+func (f *tenantFilter) scopeView(ctx context.Context, scope tenantScope) (tenantView, bool) {
+	if scope.all {
+		return tenantView{}, false
+	}
+	return tenantView{volumes: f.namespaceVolumes(ctx, scope), namespaces: scope.namespaces}, true
+}
+
+// filterReport returns a copy of the host topology of a report restricted
+// to a view: the metrics and table rows of its volumes and namespaces.
+// Host metrics, metadata, controls and containers are left out.
+func filterReport(rpt *report, v tenantView) *report {
+	filtered := &report{Plugins: rpt.Plugins, Host: topology{
+		Nodes:             map[string]node{},
+		MetricTemplates:   map[string]metricTemplate{},
+		MetadataTemplates: map[string]metadataTemplate{},
+		TableTemplates:    map[string]tableTemplate{},
+		Controls:          map[string]control{},
+	}}
+	for id, n := range rpt.Host.Nodes {
+		kept := node{Metrics: map[string]metric{}, Latest: map[string]stringEntry{}}
+		for metricID, m := range n.Metrics {
+			if v.metric(metricID) {
+				kept.Metrics[metricID] = m
+				if tmpl, ok := rpt.Host.MetricTemplates[metricID]; ok {
+					filtered.Host.MetricTemplates[metricID] = tmpl
+				}
+			}
+		}
+		for key, entry := range n.Latest {
+			for tableID, tmpl := range rpt.Host.TableTemplates {
+				sep := strings.Index(key, "___")
+				if !strings.HasPrefix(key, tmpl.Prefix) || sep < len(tmpl.Prefix) || !v.row(key[len(tmpl.Prefix):sep]) {
+					continue
+				}
+				kept.Latest[key] = entry
+				filtered.Host.TableTemplates[tableID] = tmpl
+			}
+		}
+		filtered.Host.Nodes[id] = kept
+	}
+	return filtered
+}
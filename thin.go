@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// thinFuncs are the available sample thinning algorithms. Each returns at
+// most max samples, keeping the first and last ones.
+var thinFuncs = map[string]func(samples []sample, max int) []sample{
+	"stride": strideThin,
+	"lttb":   lttbThin,
+}
+
+func validThinMethod(method string) error {
+	if _, ok := thinFuncs[method]; !ok {
+		return fmt.Errorf("unknown thinning method %q, expected stride or lttb", method)
+	}
+	return nil
+}
+
+// strideThin keeps evenly spaced samples.
+func strideThin(samples []sample, max int) []sample {
+	if len(samples) <= max {
+		return samples
+	}
+	if max == 1 {
+		return samples[len(samples)-1:]
+	}
+	stride := float64(len(samples)-1) / float64(max-1)
+	thinned := make([]sample, 0, max)
+	for i := 0; i < max; i++ {
+		thinned = append(thinned, samples[int(float64(i)*stride+0.5)])
+	}
+	return thinned
+}
+
+// lttbThin implements Largest-Triangle-Three-Buckets downsampling, which
+// keeps the samples that contribute most to the visual shape of the graph
+// (peaks and troughs) rather than whichever happen to fall on a stride.
+func lttbThin(samples []sample, max int) []sample {
+	if len(samples) <= max || max < 3 {
+		return strideThin(samples, max)
+	}
+
+	x := func(i int) float64 { return float64(samples[i].Date.UnixNano()) }
+	y := func(i int) float64 { return samples[i].Value }
+
+	thinned := make([]sample, 0, max)
+	thinned = append(thinned, samples[0])
+
+	// The first and last samples are kept as-is; the rest are split into
+	// max-2 buckets and the best sample of each bucket is picked.
+	bucketSize := float64(len(samples)-2) / float64(max-2)
+	selected := 0
+	for b := 0; b < max-2; b++ {
+		start := int(float64(b)*bucketSize) + 1
+		end := int(float64(b+1)*bucketSize) + 1
+
+		// Average of the next bucket, used as the third triangle vertex.
+		nextStart, nextEnd := end, int(float64(b+2)*bucketSize)+1
+		if nextEnd > len(samples) {
+			nextEnd = len(samples)
+		}
+		var avgX, avgY float64
+		for i := nextStart; i < nextEnd; i++ {
+			avgX += x(i)
+			avgY += y(i)
+		}
+		count := float64(nextEnd - nextStart)
+		avgX /= count
+		avgY /= count
+
+		best, bestArea := start, -1.0
+		for i := start; i < end; i++ {
+			area := math.Abs((x(selected)-avgX)*(y(i)-y(selected)) - (x(selected)-x(i))*(avgY-y(selected)))
+			if area > bestArea {
+				best, bestArea = i, area
+			}
+		}
+		thinned = append(thinned, samples[best])
+		selected = best
+	}
+
+	return append(thinned, samples[len(samples)-1])
+}
+
+// sampleThinner caps the samples of the series served by the read-only
+// API, the only long ones: reports hold a sample per metric, but for the
+// CPU history already capped by -cpu-history.
+type sampleThinner struct {
+	thin func(samples []sample, max int) []sample
+	// max is the limit of every metric but those of perMetric; 0 means
+	// unlimited.
+	max       int
+	perMetric map[string]int
+}
+
+func newSampleThinner(method string, max int, perMetric map[string]int) sampleThinner {
+	thin := thinFuncs[method]
+	if thin == nil {
+		thin = strideThin
+	}
+	return sampleThinner{thin: thin, max: max, perMetric: perMetric}
+}
+
+// apply thins the samples of a metric to its limit, or to limit if it is
+// lower and positive, e.g. the points a Grafana panel can show.
+func (t sampleThinner) apply(id string, samples []sample, limit int) []sample {
+	max, ok := t.perMetric[id]
+	if !ok {
+		max = t.max
+	}
+	if limit > 0 && (max <= 0 || limit < max) {
+		max = limit
+	}
+	if max <= 0 || t.thin == nil {
+		return samples
+	}
+	return t.thin(samples, max)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sineSamples returns n samples a second apart.
+func sineSamples(n int) []sample {
+	start := time.Unix(1600000000, 0)
+	samples := make([]sample, n)
+	for i := range samples {
+		samples[i] = sample{Date: start.Add(time.Duration(i) * time.Second), Value: math.Sin(float64(i) / 10)}
+	}
+	return samples
+}
+
+func TestThinFuncs(t *testing.T) {
+	for method, thin := range thinFuncs {
+		for _, tc := range []struct {
+			n, max, want int
+		}{
+			{n: 10, max: 20, want: 10},
+			{n: 10, max: 10, want: 10},
+			{n: 1000, max: 100, want: 100},
+			{n: 1000, max: 2, want: 2},
+			{n: 1000, max: 1, want: 1},
+		} {
+			samples := sineSamples(tc.n)
+			thinned := thin(samples, tc.max)
+			if len(thinned) != tc.want {
+				t.Errorf("%s: %d samples thinned to %d: got %d, want %d", method, tc.n, tc.max, len(thinned), tc.want)
+				continue
+			}
+			if last := samples[len(samples)-1]; thinned[len(thinned)-1] != last {
+				t.Errorf("%s: %d samples thinned to %d: dropped the last sample", method, tc.n, tc.max)
+			}
+			if tc.max > 1 && thinned[0] != samples[0] {
+				t.Errorf("%s: %d samples thinned to %d: dropped the first sample", method, tc.n, tc.max)
+			}
+			for i := 1; i < len(thinned); i++ {
+				if !thinned[i].Date.After(thinned[i-1].Date) {
+					t.Errorf("%s: %d samples thinned to %d: out of order at %d", method, tc.n, tc.max, i)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestSampleThinner(t *testing.T) {
+	thinner := newSampleThinner("lttb", 100, map[string]int{"idle": 10, "iowait": 0})
+	for _, tc := range []struct {
+		id    string
+		limit int
+		want  int
+	}{
+		{id: "write_iops", want: 100},
+		{id: "write_iops", limit: 50, want: 50},
+		{id: "write_iops", limit: 500, want: 100},
+		{id: "idle", want: 10},
+		{id: "idle", limit: 5, want: 5},
+		{id: "iowait", want: 1000},
+		{id: "iowait", limit: 20, want: 20},
+	} {
+		if got := len(thinner.apply(tc.id, sineSamples(1000), tc.limit)); got != tc.want {
+			t.Errorf("%s limited to %d: got %d samples, want %d", tc.id, tc.limit, got, tc.want)
+		}
+	}
+}
+
+// TestPublicHistoryThinned checks the long series of the read-only API
+// are thinned, those of /api/v1/history to -max-samples and those of
+// Grafana queries to their maxDataPoints.
+func TestPublicHistoryThinned(t *testing.T) {
+	samples := sineSamples(3600)
+	a := &publicAPI{
+		thinner:  newSampleThinner("lttb", 300, nil),
+		last:     &report{},
+		lastTime: time.Now(),
+		history:  map[string][]sample{"iowait": samples},
+	}
+
+	res := httptest.NewRecorder()
+	a.serveHistory(res, httptest.NewRequest("GET", "/api/v1/history", nil))
+	history := map[string][]sample{}
+	if err := json.NewDecoder(res.Body).Decode(&history); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(history["iowait"]); got != 300 {
+		t.Errorf("/api/v1/history: got %d samples, want 300", got)
+	}
+
+	body := `{"range":{"from":"2020-09-13T12:26:40Z"},"targets":[{"target":"iowait"}],"maxDataPoints":120}`
+	res = httptest.NewRecorder()
+	a.serveGrafanaQuery(res, httptest.NewRequest("POST", "/grafana/query", strings.NewReader(body)))
+	if res.Code != http.StatusOK {
+		t.Fatalf("/grafana/query: %d %s", res.Code, res.Body)
+	}
+	series := []struct {
+		Datapoints [][2]float64 `json:"datapoints"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&series); err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 1 {
+		t.Fatalf("/grafana/query: got %d series, want 1", len(series))
+	}
+	if got := len(series[0].Datapoints); got != 120 {
+		t.Errorf("/grafana/query: got %d points, want 120", got)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	raiseThresholdControlPrefix = "thresholdUp_"
+	lowerThresholdControlPrefix = "thresholdDown_"
+)
+
+// Threshold controls let operators calibrate the thresholds of this node
+// without editing the config: every press raises or lowers both the
+// warning and critical thresholds of a metric by the threshold step. The
+// adjustments are scales of the configured thresholds, kept in the plugin
+// state, so they survive restarts and config reloads.
+
+// thresholdKeys returns the sorted keys of the warning and critical
+// thresholds. The caller holds p.lock.
+func (p *Plugin) thresholdKeys() []string {
+	seen := map[string]bool{}
+	keys := []string{}
+	for _, thresholds := range []map[string]threshold{p.thresholds, p.criticalThresholds} {
+		for key := range thresholds {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// describeThresholds renders the thresholds in effect of a key, e.g.
+// "30 / 60" for the warning and critical ones. The caller holds p.lock.
+func (p *Plugin) describeThresholds(key string) string {
+	limits := []string{}
+	for _, thresholds := range []map[string]threshold{p.thresholds, p.criticalThresholds} {
+		if th, ok := p.thresholdFor(thresholds, key); ok {
+			limits = append(limits, th.String())
+		} else {
+			limits = append(limits, "-")
+		}
+	}
+	return strings.Join(limits, " / ")
+}
+
+// thresholdControls raise and lower the thresholds of every metric with
+// one. The caller holds p.lock.
+func (p *Plugin) thresholdControls() []controlDetails {
+	if p.thresholdStep <= 0 {
+		return nil
+	}
+	details := []controlDetails{}
+	for _, key := range p.thresholdKeys() {
+		current := p.describeThresholds(key)
+		details = append(details,
+			controlDetails{
+				id:    raiseThresholdControlPrefix + key,
+				human: fmt.Sprintf("Raise %s thresholds (%s)", key, current),
+				icon:  "fa-arrow-up",
+			},
+			controlDetails{
+				id:    lowerThresholdControlPrefix + key,
+				human: fmt.Sprintf("Lower %s thresholds (%s)", key, current),
+				icon:  "fa-arrow-down",
+			},
+		)
+	}
+	return details
+}
+
+// thresholdForControl returns the threshold key a threshold control
+// adjusts, and whether it raises it. The caller holds p.lock.
+func (p *Plugin) thresholdForControl(controlID string) (string, bool, bool) {
+	if p.thresholdStep <= 0 {
+		return "", false, false
+	}
+	for _, key := range p.thresholdKeys() {
+		switch controlID {
+		case raiseThresholdControlPrefix + key:
+			return key, true, true
+		case lowerThresholdControlPrefix + key:
+			return key, false, true
+		}
+	}
+	return "", false, false
+}
+
+// adjustThreshold scales the thresholds of a key one step up or down. The
+// caller holds p.lock.
+func (p *Plugin) adjustThreshold(key string, raise bool) {
+	scale, ok := p.thresholdScales[key]
+	if !ok {
+		scale = 1
+	}
+	if raise {
+		scale *= 1 + p.thresholdStep
+	} else {
+		scale /= 1 + p.thresholdStep
+	}
+	if p.thresholdScales == nil {
+		p.thresholdScales = map[string]float64{}
+	}
+	p.thresholdScales[key] = scale
+	log.Infof("Thresholds of %s now %s", key, p.describeThresholds(key))
+}
@@ -0,0 +1,2 @@
+// The build tools are built on their own, outside of the plugin module.
+module github.com/weaveworks/build-tools
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// traceBatchSize is how many finished spans trigger an export before
+	// the next traceFlushInterval, and traceMaxPending how many are kept
+	// while the collector is unreachable.
+	traceBatchSize     = 256
+	traceMaxPending    = 4096
+	traceFlushInterval = 5 * time.Second
+
+	// OTLP span kinds and status codes.
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanStatusError  = 2
+)
+
+// traces records the spans of report and control handling, and of the
+// collections and queries they run, and exports them over OTLP/HTTP. It is
+// global like the plugin's own metrics, so that collectors can record
+// spans without plumbing; while it is nil, spans are not recorded.
+var traces *spanTracer
+
+type spanContextKey struct{}
+
+// A span is a timed operation of a trace. Its methods do nothing on a nil
+// span, as returned while tracing is off.
+type span struct {
+	tracer   *spanTracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	attrs    []otlpAttribute
+	err      string
+}
+
+// startSpan starts a span, a child of the span of ctx if any, and returns
+// a context carrying it.
+func startSpan(ctx context.Context, name string, attrs ...otlpAttribute) (context.Context, *span) {
+	return traces.start(ctx, name, spanKindInternal, attrs)
+}
+
+// startServerSpan starts the span of handling a request.
+func startServerSpan(ctx context.Context, name string, attrs ...otlpAttribute) (context.Context, *span) {
+	return traces.start(ctx, name, spanKindServer, attrs)
+}
+
+// detachSpan returns a context carrying the span of ctx, if any, but not
+// its cancellation, for work shared beyond the request that started it.
+func detachSpan(ctx context.Context) context.Context {
+	if s := spanOf(ctx); s != nil {
+		return context.WithValue(context.Background(), spanContextKey{}, s)
+	}
+	return context.Background()
+}
+
+// spanOf returns the span of ctx, nil if none.
+func spanOf(ctx context.Context) *span {
+	s, _ := ctx.Value(spanContextKey{}).(*span)
+	return s
+}
+
+func (s *span) setAttr(key, value string) {
+	if s != nil {
+		s.attrs = append(s.attrs, otlpAttr(key, value))
+	}
+}
+
+func (s *span) setError(err error) {
+	if s != nil && err != nil {
+		s.err = err.Error()
+	}
+}
+
+// end ends the span and queues it for export.
+func (s *span) end() {
+	if s != nil {
+		s.tracer.finish(s, time.Now())
+	}
+}
+
+// spanTracer batches finished spans and exports them in the background.
+type spanTracer struct {
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+	hostID   string
+
+	lock     sync.Mutex
+	finished []otlpSpan
+	wake     chan struct{}
+}
+
+// newSpanTracer exports to the OTLP/HTTP endpoint of a collector, e.g.
+// http://otel-collector:4318.
+func newSpanTracer(endpoint string, headers map[string]string, client *http.Client, hostID string) *spanTracer {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &spanTracer{
+		endpoint: otlpSignalURL(endpoint, "traces"),
+		headers:  headers,
+		client:   client,
+		hostID:   hostID,
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+func (t *spanTracer) start(ctx context.Context, name string, kind int, attrs []otlpAttribute) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := &span{tracer: t, name: name, kind: kind, start: time.Now(), attrs: attrs}
+	if parent := spanOf(ctx); parent != nil {
+		s.traceID, s.parentID = parent.traceID, parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+func (t *spanTracer) finish(s *span, end time.Time) {
+	out := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+		Attributes:        s.attrs,
+	}
+	if s.parentID != ([8]byte{}) {
+		out.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if s.err != "" {
+		out.Status = &otlpSpanStatus{Code: spanStatusError, Message: s.err}
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.finished) >= traceMaxPending {
+		self.inc("iowait_otlp_spans_dropped_total")
+		return
+	}
+	t.finished = append(t.finished, out)
+	if len(t.finished) >= traceBatchSize {
+		select {
+		case t.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run exports the finished spans every traceFlushInterval, or as soon as
+// a batch is full. Spans that could not be exported are kept for the next
+// attempt, up to traceMaxPending.
+func (t *spanTracer) run() {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.wake:
+		}
+		t.lock.Lock()
+		spans := t.finished
+		t.finished = nil
+		t.lock.Unlock()
+		if len(spans) == 0 {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := t.push(ctx, spans)
+		cancel()
+		if err != nil {
+			otlpLog.Warnf("Exporting %d spans: %v", len(spans), err)
+			self.inc("iowait_otlp_errors_total")
+			t.lock.Lock()
+			t.finished = append(spans, t.finished...)
+			if n := len(t.finished) - traceMaxPending; n > 0 {
+				t.finished = t.finished[n:]
+			}
+			t.lock.Unlock()
+		}
+	}
+}
+
+// The OTLP/HTTP JSON encoding of the trace protocol.
+type (
+	otlpTraceRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            *otlpSpanStatus `json:"status,omitempty"`
+	}
+	otlpSpanStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+func (t *spanTracer) push(ctx context.Context, spans []otlpSpan) error {
+	return otlpPost(ctx, t.client, t.endpoint, t.headers, otlpTraceRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: otlpHostAttributes(t.hostID)},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: otlpScopeName, Version: version},
+			Spans: spans,
+		}},
+	}}})
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	trainingTableID     = "training-table"
+	trainingTablePrefix = "training-table-"
+)
+
+// A trainingStep is a line of a training script: after the plugin has run
+// for After, the scenario is simulated on the target, a volume or a pool,
+// for For (forever if 0).
+type trainingStep struct {
+	After    time.Duration
+	Scenario string
+	Target   string
+	For      time.Duration
+	Params   map[string]float64
+}
+
+func (s trainingStep) param(name string, def float64) float64 {
+	if v, ok := s.Params[name]; ok {
+		return v
+	}
+	return def
+}
+
+func (s trainingStep) activeAt(elapsed time.Duration) bool {
+	return elapsed >= s.After && (s.For == 0 || elapsed < s.After+s.For)
+}
+
+// trainingScenarios add a scenario's simulated metrics to the host node and
+// return what the training table shows about it.
+var trainingScenarios = map[string]func(t *topology, n node, s trainingStep, now time.Time) string{
+	"replica-failure": replicaFailureScenario,
+	"latency-spike":   latencySpikeScenario,
+	"pool-full":       poolFullScenario,
+}
+
+func trainingScenarioNames() []string {
+	names := []string{}
+	for name := range trainingScenarios {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// readTrainingScript reads a file of "<after> <scenario> <target>
+// [for=<duration>] [name=value...]" lines, e.g.
+//
+//	2m  latency-spike   pvc-a       for=5m factor=20
+//	10m replica-failure pvc-b       replicas=3 healthy=1
+//	15m pool-full       cstor-pool1 used=97
+func readTrainingScript(path string) ([]trainingStep, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("training: %w", err)
+	}
+	defer f.Close()
+	steps := []trainingStep{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		step, err := parseTrainingStep(fields)
+		if err != nil {
+			return nil, fmt.Errorf("training: %s:%d: %v", path, n, err)
+		}
+		steps = append(steps, step)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("training: %w", err)
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("training: %s has no scenarios", path)
+	}
+	return steps, nil
+}
+
+func parseTrainingStep(fields []string) (trainingStep, error) {
+	if len(fields) < 3 {
+		return trainingStep{}, fmt.Errorf("expected <after> <scenario> <target> [name=value...]")
+	}
+	after, err := time.ParseDuration(fields[0])
+	if err != nil {
+		return trainingStep{}, err
+	}
+	if _, ok := trainingScenarios[fields[1]]; !ok {
+		return trainingStep{}, fmt.Errorf("unknown scenario %q (known: %s)", fields[1], strings.Join(trainingScenarioNames(), ", "))
+	}
+	step := trainingStep{After: after, Scenario: fields[1], Target: fields[2], Params: map[string]float64{}}
+	for _, field := range fields[3:] {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return trainingStep{}, fmt.Errorf("invalid parameter %q, expected name=value", field)
+		}
+		if parts[0] == "for" {
+			if step.For, err = time.ParseDuration(parts[1]); err != nil {
+				return trainingStep{}, err
+			}
+			continue
+		}
+		if step.Params[parts[0]], err = strconv.ParseFloat(parts[1], 64); err != nil {
+			return trainingStep{}, fmt.Errorf("invalid parameter %q: %v", field, err)
+		}
+	}
+	return step, nil
+}
+
+// trainingHook injects the scenarios of a training script active since
+// start into reports, so that storage incidents can be rehearsed in Scope
+// without breaking real volumes. Simulated metrics are labelled as such,
+// and a table lists the active scenarios.
+func trainingHook(steps []trainingStep, nodeID string, start time.Time) reportHook {
+	return func(rpt *report) {
+		n, ok := rpt.Host.Nodes[nodeID]
+		if !ok {
+			return
+		}
+		if n.Latest == nil {
+			n.Latest = map[string]stringEntry{}
+		}
+		now := time.Now()
+		elapsed := now.Sub(start)
+		tbl := table{
+			Template: tableTemplate{
+				ID:     trainingTableID,
+				Label:  "Training scenarios (simulated)",
+				Prefix: trainingTablePrefix,
+				Type:   "multicolumn-table",
+				Columns: []column{
+					{ID: "scenario", Label: "Scenario"},
+					{ID: "target", Label: "Target"},
+					{ID: "detail", Label: "Detail"},
+					{ID: "since", Label: "Since"},
+				},
+			},
+			Rows: map[string]map[string]string{},
+		}
+		for i, s := range steps {
+			if !s.activeAt(elapsed) {
+				continue
+			}
+			detail := trainingScenarios[s.Scenario](&rpt.Host, n, s, now)
+			tbl.Rows[fmt.Sprintf("%d", i)] = map[string]string{
+				"scenario": s.Scenario,
+				"target":   s.Target,
+				"detail":   detail,
+				"since":    start.Add(s.After).Format(time.RFC3339),
+			}
+		}
+		rpt.Host.TableTemplates[trainingTableID] = tbl.Template
+		for key, entry := range tbl.entries(now) {
+			n.Latest[key] = entry
+		}
+		rpt.Host.Nodes[nodeID] = n
+	}
+}
+
+// addTrainingMetric adds a simulated metric, labelled as such.
+func addTrainingMetric(t *topology, n node, id, label, format string, value, max float64, now time.Time) {
+	n.Metrics[id] = metric{Samples: []sample{{Date: now, Value: value}}, Min: 0, Max: max}
+	t.MetricTemplates[id] = metricTemplate{ID: id, Label: label + " (training)", Format: format, Priority: 0.5}
+}
+
+// replicaFailureScenario simulates a volume running on healthy of its
+// replicas.
+func replicaFailureScenario(t *topology, n node, s trainingStep, now time.Time) string {
+	replicas, healthy := s.param("replicas", 3), s.param("healthy", 1)
+	addTrainingMetric(t, n, "training_healthy_replicas_"+s.Target, "Healthy replicas "+s.Target, "", healthy, replicas, now)
+	state := "Degraded"
+	if healthy < replicas/2 {
+		state = "Offline"
+	}
+	return fmt.Sprintf("%s: %g/%g replicas healthy", state, healthy, replicas)
+}
+
+// latencySpikeScenario simulates a volume's latency rising factor times
+// above a baseline in milliseconds, jittered by up to 10% so that its
+// graph looks alive.
+func latencySpikeScenario(t *topology, n node, s trainingStep, now time.Time) string {
+	baseline, factor := s.param("baseline", 2), s.param("factor", 10)
+	latency := baseline * factor * (0.9 + rand.Float64()/5)
+	addTrainingMetric(t, n, "training_latency_ms_"+s.Target, "Latency "+s.Target+" (ms)", "", latency, baseline*factor*2, now)
+	return fmt.Sprintf("latency %gx its %gms baseline", factor, baseline)
+}
+
+// poolFullScenario simulates a storage pool filling up to used percent.
+func poolFullScenario(t *topology, n node, s trainingStep, now time.Time) string {
+	used := s.param("used", 95)
+	addTrainingMetric(t, n, "training_pool_used_"+s.Target, "Pool used "+s.Target, "percent", used, 100, now)
+	return fmt.Sprintf("%g%% used", used)
+}
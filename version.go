@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+)
+
+// Build metadata, set at build time by the Makefile with
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=...".
+var (
+	// version is the plugin version reported to Scope.
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// buildInfo is what /version and -version show, for support and bug
+// reports.
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"buildDate,omitempty"`
+	GoVersion string `json:"goVersion"`
+	Platform  string `json:"platform"`
+}
+
+func currentBuild() buildInfo {
+	return buildInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+}
+
+// String is e.g. "v1.2.0 (commit 1a2b3c4, built 2024-05-01T12:00:00Z)".
+func (b buildInfo) String() string {
+	details := []string{}
+	if b.Commit != "" {
+		details = append(details, "commit "+b.Commit)
+	}
+	if b.BuildDate != "" {
+		details = append(details, "built "+b.BuildDate)
+	}
+	if len(details) == 0 {
+		return b.Version
+	}
+	return fmt.Sprintf("%s (%s)", b.Version, strings.Join(details, ", "))
+}
+
+func serveVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, currentBuild())
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// websocketGUID is appended to the key of a handshake to accept it.
+	websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xa
+
+	// wsMaxControlPayload is the largest payload of control frames; the
+	// data frames of clients are discarded.
+	wsMaxControlPayload = 125
+	wsWriteTimeout      = 10 * time.Second
+)
+
+// wsConn is the server side of a WebSocket connection (RFC 6455) that only
+// sends text messages: the messages of clients are discarded, their pings
+// answered and their close frames echoed. Done is closed once the client
+// is gone.
+type wsConn struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+
+	lock sync.Mutex
+	done chan struct{}
+}
+
+// upgradeWebSocket completes the opening handshake of a WebSocket request,
+// or answers 400 Bad Request.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != "GET" || !headerHasToken(r.Header, "Connection", "upgrade") ||
+		!headerHasToken(r.Header, "Upgrade", "websocket") || key == "" {
+		http.Error(w, "expected a WebSocket handshake", http.StatusBadRequest)
+		return nil, fmt.Errorf("websocket: not a handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusBadRequest)
+		return nil, fmt.Errorf("websocket: unsupported version %q", r.Header.Get("Sec-WebSocket-Version"))
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection can't be upgraded", http.StatusInternalServerError)
+		return nil, fmt.Errorf("websocket: connection can't be hijacked")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("websocket: %v", err)
+	}
+	// Lift the deadlines of the server, the connection lives on.
+	conn.SetDeadline(time.Time{})
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("websocket: %v", err)
+	}
+	c := &wsConn{conn: conn, rw: rw, done: make(chan struct{})}
+	go c.readLoop()
+	return c, nil
+}
+
+// headerHasToken tells whether a comma separated header has a token, in
+// any case.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h[name] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeText sends a text message.
+func (c *wsConn) writeText(data []byte) error {
+	return c.writeFrame(wsOpText, data)
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	header := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n <= 125:
+		header = append(header, byte(n))
+	case n <= 0xffff:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if _, err := c.rw.Write(header); err != nil {
+		return err
+	}
+	if _, err := c.rw.Write(payload); err != nil {
+		return err
+	}
+	return c.rw.Flush()
+}
+
+// readLoop reads the frames of the client until it closes the connection.
+func (c *wsConn) readLoop() {
+	defer close(c.done)
+	defer c.conn.Close()
+	for {
+		opcode, payload, err := c.readFrame()
+		if err != nil {
+			return
+		}
+		switch opcode {
+		case wsOpClose:
+			c.writeFrame(wsOpClose, payload)
+			return
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readFrame reads a frame, discarding the payload of data frames.
+func (c *wsConn) readFrame() (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.rw, head[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode, masked := head[0]&0x0f, head[1]&0x80 != 0
+	n := uint64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.rw, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if !masked {
+		return 0, nil, errors.New("websocket: unmasked client frame")
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(c.rw, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	if opcode < wsOpClose {
+		_, err := io.CopyN(ioutil.Discard, c.rw, int64(n))
+		return opcode, nil, err
+	}
+	if n > wsMaxControlPayload {
+		return 0, nil, errors.New("websocket: control frame too large")
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(c.rw, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
+
+// close sends a close frame and closes the connection.
+func (c *wsConn) close() {
+	c.writeFrame(wsOpClose, nil)
+	c.conn.Close()
+}
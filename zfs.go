@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	zfsKstatDir = "/proc/spl/kstat/zfs"
+
+	zfsTableID     = "zfs-table"
+	zfsTablePrefix = "zfs-table-"
+)
+
+func init() {
+	collectorFactories["zfs"] = func(opts collectorOptions) (Collector, error) {
+		if _, err := exec.LookPath("zpool"); err != nil {
+			return nil, fmt.Errorf("zfs: %w", err)
+		}
+		return newZFSPools(zfsKstatDir, opts.CommandTimeout), nil
+	}
+}
+
+// zfsPool is the capacity, health and IO rates of a ZFS pool.
+type zfsPool struct {
+	Name                  string
+	Size, Allocated, Free float64
+	Health                string
+
+	ReadOps, WriteOps float64 // per second
+	ReadBW, WriteBW   float64 // bytes per second
+}
+
+// zfsCounters are the cumulative counters of a pool's io kstat.
+type zfsCounters struct {
+	reads, writes, nread, nwritten float64
+}
+
+// zfsPools reports the read/write operations, bandwidth and capacity of
+// every ZFS pool, e.g. those of OpenEBS localpv-zfs, as metrics and in a
+// table. Rates come from the pools' io kstats where the ZFS module still
+// provides them, and otherwise from a one second zpool iostat.
+type zfsPools struct {
+	kstatDir string
+	timeout  time.Duration
+
+	lock     sync.Mutex
+	prev     map[string]zfsCounters
+	prevTime time.Time
+	pools    []zfsPool
+}
+
+func newZFSPools(kstatDir string, timeout time.Duration) *zfsPools {
+	return &zfsPools{kstatDir: kstatDir, timeout: timeout}
+}
+
+func (z *zfsPools) Name() string { return "zfs" }
+
+func (z *zfsPools) resetCounters() {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	z.prev = nil
+}
+
+// list returns the capacity and health of every pool.
+func (z *zfsPools) list(ctx context.Context) ([]zfsPool, error) {
+	out, err := commandOutput(ctx, z.timeout, "zpool", "list", "-Hp", "-o", "name,size,allocated,free,health")
+	if err != nil {
+		return nil, fmt.Errorf("zfs: zpool list: %w", err)
+	}
+	return parseZpoolList(out)
+}
+
+// parseZpoolList parses the tab separated output of zpool list -Hp -o
+// name,size,allocated,free,health:
+//
+//	tank	10737418240	1073741824	9663676416	ONLINE
+func parseZpoolList(out []byte) ([]zfsPool, error) {
+	pools := []zfsPool{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 5 {
+			continue
+		}
+		pool := zfsPool{Name: fields[0], Health: fields[4]}
+		pool.Size, _ = strconv.ParseFloat(fields[1], 64)
+		pool.Allocated, _ = strconv.ParseFloat(fields[2], 64)
+		pool.Free, _ = strconv.ParseFloat(fields[3], 64)
+		pools = append(pools, pool)
+	}
+	return pools, scanner.Err()
+}
+
+// readZFSKstat reads the io kstat of a pool:
+//
+//	12 3 0x00 1 80 2225326830828 32953795101529
+//	nread    nwritten   reads    writes   wtime ...
+//	1884160  3206144    33       201      ...
+func readZFSKstat(path string) (zfsCounters, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return zfsCounters{}, err
+	}
+	lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+	if len(lines) < 3 {
+		return zfsCounters{}, fmt.Errorf("zfs: unexpected kstat %s", path)
+	}
+	names, values := strings.Fields(lines[1]), strings.Fields(lines[2])
+	c := zfsCounters{}
+	for i, name := range names {
+		if i >= len(values) {
+			break
+		}
+		v, err := strconv.ParseFloat(values[i], 64)
+		if err != nil {
+			continue
+		}
+		switch name {
+		case "reads":
+			c.reads = v
+		case "writes":
+			c.writes = v
+		case "nread":
+			c.nread = v
+		case "nwritten":
+			c.nwritten = v
+		}
+	}
+	return c, nil
+}
+
+// kstatRates sets the rates of the pools from their io kstats, and
+// returns false if the ZFS module provides none.
+func (z *zfsPools) kstatRates(pools []zfsPool, now time.Time) bool {
+	cur := map[string]zfsCounters{}
+	for _, pool := range pools {
+		c, err := readZFSKstat(filepath.Join(z.kstatDir, pool.Name, "io"))
+		if os.IsNotExist(err) {
+			return false
+		}
+		if err == nil {
+			cur[pool.Name] = c
+		}
+	}
+	z.lock.Lock()
+	prev, elapsed := z.prev, now.Sub(z.prevTime).Seconds()
+	z.prev, z.prevTime = cur, now
+	z.lock.Unlock()
+	for i, pool := range pools {
+		c, p := cur[pool.Name], prev[pool.Name]
+		if _, ok := prev[pool.Name]; !ok || elapsed <= 0 || c.reads < p.reads || c.writes < p.writes {
+			continue
+		}
+		pools[i].ReadOps = (c.reads - p.reads) / elapsed
+		pools[i].WriteOps = (c.writes - p.writes) / elapsed
+		pools[i].ReadBW = (c.nread - p.nread) / elapsed
+		pools[i].WriteBW = (c.nwritten - p.nwritten) / elapsed
+	}
+	return true
+}
+
+// iostatRates sets the rates of the pools from one second of zpool iostat.
+func (z *zfsPools) iostatRates(ctx context.Context, pools []zfsPool) error {
+	out, err := commandOutput(ctx, z.timeout, "zpool", "iostat", "-Hpy", "1", "1")
+	if err != nil {
+		return fmt.Errorf("zfs: zpool iostat: %w", err)
+	}
+	rates, err := parseZpoolIostat(out)
+	for i, pool := range pools {
+		if r, ok := rates[pool.Name]; ok {
+			pools[i].ReadOps, pools[i].WriteOps, pools[i].ReadBW, pools[i].WriteBW = r.ReadOps, r.WriteOps, r.ReadBW, r.WriteBW
+		}
+	}
+	return err
+}
+
+// parseZpoolIostat parses the rates of zpool iostat -Hp by pool name:
+//
+//	pool	alloc	free	read_ops	write_ops	read_bw	write_bw
+func parseZpoolIostat(out []byte) (map[string]zfsPool, error) {
+	rates := map[string]zfsPool{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 7 {
+			continue
+		}
+		values := []float64{}
+		for _, field := range fields[3:] {
+			v, _ := strconv.ParseFloat(field, 64)
+			values = append(values, v)
+		}
+		rates[fields[0]] = zfsPool{Name: fields[0], ReadOps: values[0], WriteOps: values[1], ReadBW: values[2], WriteBW: values[3]}
+	}
+	return rates, scanner.Err()
+}
+
+// zfsMetrics are the statistics reported for every pool.
+var zfsMetrics = []struct {
+	id, label, format string
+	value             func(zfsPool) float64
+}{
+	{"read_ops", "read ops/s", "", func(p zfsPool) float64 { return p.ReadOps }},
+	{"write_ops", "write ops/s", "", func(p zfsPool) float64 { return p.WriteOps }},
+	{"read_bw", "read bytes/s", "filesize", func(p zfsPool) float64 { return p.ReadBW }},
+	{"write_bw", "write bytes/s", "filesize", func(p zfsPool) float64 { return p.WriteBW }},
+	{"used", "used", "percent", func(p zfsPool) float64 { return 100 * p.Allocated / p.Size }},
+}
+
+func (z *zfsPools) Collect(ctx context.Context) ([]Metric, error) {
+	pools, err := z.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if !z.kstatRates(pools, now) {
+		if err := z.iostatRates(ctx, pools); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(pools, func(i, j int) bool { return pools[i].Name < pools[j].Name })
+	z.lock.Lock()
+	z.pools = pools
+	z.lock.Unlock()
+
+	metrics := []Metric{}
+	for i, pool := range pools {
+		for j, m := range zfsMetrics {
+			if m.id == "used" && pool.Size == 0 {
+				continue
+			}
+			value := m.value(pool)
+			max := value
+			if m.format == "percent" {
+				max = 100
+			}
+			metrics = append(metrics, Metric{
+				ID:       "zfs_" + pool.Name + "_" + m.id,
+				Label:    pool.Name + " " + m.label,
+				Format:   m.format,
+				Priority: 16 + float64(i)/10 + float64(j)/100,
+				Value:    value,
+				Max:      max,
+				Time:     now,
+			})
+		}
+	}
+	return metrics, nil
+}
+
+func (z *zfsPools) Tables() []table {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	rows := map[string]map[string]string{}
+	for _, pool := range z.pools {
+		rows[pool.Name] = map[string]string{
+			"pool":      pool.Name,
+			"health":    pool.Health,
+			"size":      formatSize(uint64(pool.Size)),
+			"allocated": formatSize(uint64(pool.Allocated)),
+			"free":      formatSize(uint64(pool.Free)),
+			"read_ops":  formatNumber(pool.ReadOps),
+			"write_ops": formatNumber(pool.WriteOps),
+		}
+	}
+	return []table{{
+		Template: tableTemplate{
+			ID:     zfsTableID,
+			Label:  "ZFS pools",
+			Prefix: zfsTablePrefix,
+			Type:   "multicolumn-table",
+			Columns: []column{
+				{ID: "pool", Label: "Pool"},
+				{ID: "health", Label: "Health"},
+				{ID: "size", Label: "Size"},
+				{ID: "allocated", Label: "Allocated"},
+				{ID: "free", Label: "Free"},
+				{ID: "read_ops", Label: "Read ops/s", DataType: "number"},
+				{ID: "write_ops", Label: "Write ops/s", DataType: "number"},
+			},
+		},
+		Rows: rows,
+	}}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseZpoolList(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		out  string
+		want []zfsPool
+	}{
+		{name: "empty", out: "", want: []zfsPool{}},
+		{
+			name: "pools",
+			out:  "tank\t10737418240\t1073741824\t9663676416\tONLINE\nzfspv-pool\t2147483648\t2097152\t2145386496\tDEGRADED\n",
+			want: []zfsPool{
+				{Name: "tank", Size: 10737418240, Allocated: 1073741824, Free: 9663676416, Health: "ONLINE"},
+				{Name: "zfspv-pool", Size: 2147483648, Allocated: 2097152, Free: 2145386496, Health: "DEGRADED"},
+			},
+		},
+		{
+			name: "unexpected lines skipped",
+			out:  "no pools available\ntank\t100\t25\t75\tONLINE\n",
+			want: []zfsPool{{Name: "tank", Size: 100, Allocated: 25, Free: 75, Health: "ONLINE"}},
+		},
+	} {
+		got, err := parseZpoolList([]byte(tc.out))
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestParseZpoolIostat(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		out  string
+		want map[string]zfsPool
+	}{
+		{name: "empty", out: "", want: map[string]zfsPool{}},
+		{
+			name: "pools",
+			out:  "tank\t1073741824\t9663676416\t12\t34\t49152\t139264\nzfspv-pool\t2097152\t2145386496\t0\t5\t0\t20480\n",
+			want: map[string]zfsPool{
+				"tank":       {Name: "tank", ReadOps: 12, WriteOps: 34, ReadBW: 49152, WriteBW: 139264},
+				"zfspv-pool": {Name: "zfspv-pool", WriteOps: 5, WriteBW: 20480},
+			},
+		},
+		{
+			name: "unexpected lines skipped",
+			out:  "tank\t1073741824\t9663676416\n  mirror\t-\t-\t1\t2\t3\t4\t5\ntank\t1\t2\t3\t4\t5\t6\n",
+			want: map[string]zfsPool{"tank": {Name: "tank", ReadOps: 3, WriteOps: 4, ReadBW: 5, WriteBW: 6}},
+		},
+	} {
+		got, err := parseZpoolIostat([]byte(tc.out))
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestReadZFSKstat(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		kstat   string
+		want    zfsCounters
+		wantErr bool
+	}{
+		{
+			name: "io kstat",
+			kstat: "12 3 0x00 1 80 2225326830828 32953795101529\n" +
+				"nread    nwritten   reads    writes   wtime    wlentime   wupdate  rtime    rlentime   rupdate  wcnt     rcnt\n" +
+				"1884160  3206144    33       201      2275516  49082428   1243     4327417  54116416   1263     0        0\n",
+			want: zfsCounters{reads: 33, writes: 201, nread: 1884160, nwritten: 3206144},
+		},
+		{name: "truncated", kstat: "12 3 0x00 1 80 2225326830828 32953795101529\n", wantErr: true},
+	} {
+		got, err := readZFSKstat(writeTestFile(t, "io", tc.kstat))
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tc.name, err, tc.wantErr)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}